@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// parseUserIDs reads a comma-separated list of user IDs, such as the admins
+// in ADMIN_USER_IDS.
+func parseUserIDs(list string) (map[uuid.UUID]bool, error) {
+	ids := map[uuid.UUID]bool{}
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID %q: %w", s, err)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
@@ -199,7 +199,7 @@ async function getVideos() {
       throw new Error(`Failed to get videos. Error: ${data.error}`);
     }
 
-    const videos = await res.json();
+    const { videos } = await res.json();
     const videoList = document.getElementById('video-list');
     videoList.innerHTML = '';
     for (const video of videos) {
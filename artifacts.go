@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	artifactThumbnail = "thumbnail"
+	artifactRendition = "rendition"
+	artifactHLS       = "hls"
+	artifactSprite    = "sprite"
+	artifactPreview   = "preview"
+)
+
+// artifactPriority orders derivations from most to least important. When a
+// video hits the artifact cap, lower-priority derivations are skipped first.
+var artifactPriority = map[string]int{
+	artifactThumbnail: 0,
+	artifactRendition: 1,
+	artifactHLS:       2,
+	artifactSprite:    3,
+	artifactPreview:   4,
+}
+
+// derivation is an artifact kind an upload is about to create, and how
+// many files it takes.
+type derivation struct {
+	kind  string
+	files int
+}
+
+// planDerivations returns the requested derivations that still fit under the
+// video's cap, in priority order, and the ones that had to be skipped. Once
+// one doesn't fit, everything of lower priority is skipped too.
+func (cfg *apiConfig) planDerivations(video database.Video, requested []derivation) (allowed, skipped []derivation) {
+	ordered := append([]derivation(nil), requested...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return artifactPriority[ordered[i].kind] < artifactPriority[ordered[j].kind]
+	})
+
+	if cfg.maxDerivedArtifacts == 0 {
+		return ordered, nil
+	}
+
+	remaining := cfg.maxDerivedArtifacts - len(video.Artifacts)
+	for i, d := range ordered {
+		if d.files > remaining {
+			return allowed, ordered[i:]
+		}
+		allowed = append(allowed, d)
+		remaining -= d.files
+	}
+	return allowed, nil
+}
+
+// countDerivations counts the derivations of the given kind.
+func countDerivations(derivations []derivation, kind string) int {
+	n := 0
+	for _, d := range derivations {
+		if d.kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// addArtifact records a derived file on the video, replacing any previous
+// artifact stored under the same key.
+func addArtifact(video *database.Video, kind, key string) {
+	for i, a := range video.Artifacts {
+		if a.Key == key {
+			video.Artifacts[i].Kind = kind
+			return
+		}
+	}
+	video.Artifacts = append(video.Artifacts, database.Artifact{Kind: kind, Key: key})
+}
+
+// staleArtifacts are derivatives of media that has been replaced.
+type staleArtifacts struct {
+	bucket    string
+	artifacts []database.Artifact
+}
+
+// detachMediaArtifacts drops the artifacts derived from the video's current
+// media from the record, ahead of that media being replaced. Thumbnails are
+// kept since the record still points at them. Nothing is detached unless
+// CLEANUP_REPLACED_ARTIFACTS is set.
+func (cfg *apiConfig) detachMediaArtifacts(video *database.Video) staleArtifacts {
+	// The preview sheet indexes the old media's timeline
+	video.SpritesURL = nil
+	video.SpritesVTTURL = nil
+
+	stale := staleArtifacts{bucket: cfg.s3Bucket}
+	if !cfg.cleanupReplacedArtifacts {
+		return stale
+	}
+	if video.VideoURL != nil {
+		if bucket, _, err := cfg.parseS3Key(*video.VideoURL); err == nil {
+			stale.bucket = bucket
+		}
+	}
+
+	kept := []database.Artifact{}
+	for _, a := range video.Artifacts {
+		if a.Kind == artifactThumbnail {
+			kept = append(kept, a)
+			continue
+		}
+		if ownsArtifact(video.ID, a) {
+			stale.artifacts = append(stale.artifacts, a)
+		}
+	}
+	video.Artifacts = kept
+	return stale
+}
+
+// ownsArtifact reports whether the artifact was stored for this video alone.
+// Older derivatives were named after the media, which identical uploads to
+// other videos share, so those are never deleted.
+func ownsArtifact(videoID uuid.UUID, a database.Artifact) bool {
+	return strings.Contains(a.Key, "/"+videoID.String()+"/")
+}
+
+// spare drops the artifacts stored under any of keys, which the replacement
+// media has reused.
+func (s *staleArtifacts) spare(keys []string) {
+	kept := s.artifacts[:0]
+	for _, a := range s.artifacts {
+		if !slices.Contains(keys, a.Key) {
+			kept = append(kept, a)
+		}
+	}
+	s.artifacts = kept
+}
+
+// deleteStaleArtifacts removes the objects in the background. Call it only
+// once the record pointing at the new media has been saved, so a failed
+// replace never leaves a video without its derivatives.
+func (cfg *apiConfig) deleteStaleArtifacts(stale staleArtifacts) {
+	if len(stale.artifacts) == 0 {
+		return
+	}
+	go func() {
+		ctx := context.Background()
+		for _, a := range stale.artifacts {
+			if err := cfg.deleteArtifact(ctx, stale.bucket, a); err != nil {
+				slog.Error("couldn't delete artifact", "kind", a.Kind, "key", a.Key, "error", err)
+			}
+		}
+	}()
+}
+
+// deleteArtifact removes a single derived object. HLS artifacts are keyed by
+// the prefix holding the playlist and its segments.
+func (cfg *apiConfig) deleteArtifact(ctx context.Context, bucket string, a database.Artifact) error {
+	cfg.presignCache.invalidate(bucket, a.Key)
+	if a.Kind != artifactHLS {
+		_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &bucket,
+			Key:    &a.Key,
+		})
+		return err
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &a.Key,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: &bucket,
+				Key:    obj.Key,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestReplacedMediaArtifactsCleanup(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.cleanupReplacedArtifacts = true
+
+	videoID := uuid.New()
+	oldRendition := "renditions/720/" + videoID.String() + "/old.mp4"
+	reused := "renditions/480/" + videoID.String() + "/same.mp4"
+	legacy := "renditions/720/sharedhash.mp4"
+	thumbnail := "thumbnails/" + videoID.String() + ".jpg"
+	newRendition := "renditions/720/" + videoID.String() + "/new.mp4"
+
+	videoURL := cfg.getObjectURL(testBucket, "landscape/old.mp4")
+	video := database.Video{
+		ID:            videoID,
+		VideoURL:      &videoURL,
+		SpritesURL:    &videoURL,
+		SpritesVTTURL: &videoURL,
+		Artifacts: []database.Artifact{
+			{Kind: artifactRendition, Key: oldRendition},
+			{Kind: artifactRendition, Key: reused},
+			{Kind: artifactRendition, Key: legacy},
+			{Kind: artifactThumbnail, Key: thumbnail},
+		},
+	}
+	for _, a := range video.Artifacts {
+		fake.put(testBucket, a.Key, []byte("artifact"))
+	}
+
+	stale := cfg.detachMediaArtifacts(&video)
+	if video.SpritesURL != nil || video.SpritesVTTURL != nil {
+		t.Error("the old media's preview sheet is still attached")
+	}
+	if len(video.Artifacts) != 1 || video.Artifacts[0].Key != thumbnail {
+		t.Errorf("artifacts left on the record = %v, want only the thumbnail", video.Artifacts)
+	}
+
+	// The new media reused one rendition and added another
+	stale.spare([]string{reused})
+	addArtifact(&video, artifactRendition, reused)
+	fake.put(testBucket, newRendition, []byte("artifact"))
+	addArtifact(&video, artifactRendition, newRendition)
+
+	cfg.deleteStaleArtifacts(stale)
+	waitFor(t, func() bool {
+		_, ok := fake.object(testBucket, oldRendition)
+		return !ok
+	})
+
+	for _, key := range []string{reused, legacy, thumbnail, newRendition} {
+		if _, ok := fake.object(testBucket, key); !ok {
+			t.Errorf("%s was deleted", key)
+		}
+	}
+}
+
+func TestDetachMediaArtifactsDisabled(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	video := database.Video{
+		ID:        uuid.New(),
+		Artifacts: []database.Artifact{{Kind: artifactRendition, Key: "renditions/720/x.mp4"}},
+	}
+	stale := cfg.detachMediaArtifacts(&video)
+	if len(stale.artifacts) != 0 || len(video.Artifacts) != 1 {
+		t.Errorf("detached %v with cleanup disabled", stale.artifacts)
+	}
+}
+
+func TestPlanDerivationsStopsAtCap(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	rendition := derivation{kind: artifactRendition, files: 1}
+	sprite := derivation{kind: artifactSprite, files: 2}
+	preview := derivation{kind: artifactPreview, files: 1}
+	// Requested out of priority order
+	requested := []derivation{preview, sprite, rendition, rendition}
+	existing := database.Video{Artifacts: []database.Artifact{{Kind: artifactThumbnail, Key: "thumbnails/a.jpg"}}}
+
+	for _, tc := range []struct {
+		name        string
+		max         int
+		video       database.Video
+		renditions  int
+		sprites     int
+		previews    int
+		skippedKind []string
+	}{
+		{"no cap", 0, existing, 2, 1, 1, nil},
+		{"room for everything", 5, database.Video{}, 2, 1, 1, nil},
+		{"sprites don't fit", 3, database.Video{}, 2, 0, 0, []string{artifactSprite, artifactPreview}},
+		{"existing artifacts count", 4, existing, 2, 0, 0, []string{artifactSprite, artifactPreview}},
+		{"one rendition", 1, database.Video{}, 1, 0, 0, []string{artifactRendition, artifactSprite, artifactPreview}},
+		{"already full", 1, existing, 0, 0, 0, []string{artifactRendition, artifactRendition, artifactSprite, artifactPreview}},
+	} {
+		cfg.maxDerivedArtifacts = tc.max
+		allowed, skipped := cfg.planDerivations(tc.video, requested)
+		if got := countDerivations(allowed, artifactRendition); got != tc.renditions {
+			t.Errorf("%s: %d renditions allowed, want %d", tc.name, got, tc.renditions)
+		}
+		if got := countDerivations(allowed, artifactSprite); got != tc.sprites {
+			t.Errorf("%s: %d sprites allowed, want %d", tc.name, got, tc.sprites)
+		}
+		if got := countDerivations(allowed, artifactPreview); got != tc.previews {
+			t.Errorf("%s: %d previews allowed, want %d", tc.name, got, tc.previews)
+		}
+		var skippedKinds []string
+		for _, d := range skipped {
+			skippedKinds = append(skippedKinds, d.kind)
+		}
+		if !slices.Equal(skippedKinds, tc.skippedKind) {
+			t.Errorf("%s: skipped %v, want %v", tc.name, skippedKinds, tc.skippedKind)
+		}
+	}
+}
+
+func TestProfileDerives(t *testing.T) {
+	all := processingProfile{}
+	if !all.derives(artifactRendition) || !all.derives(artifactSprite) {
+		t.Error("profile without derivations doesn't allow every kind")
+	}
+	renditionsOnly := processingProfile{Derivations: []string{artifactRendition}}
+	if !renditionsOnly.derives(artifactRendition) || renditionsOnly.derives(artifactSprite) {
+		t.Error("profile derivations weren't applied")
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -14,31 +17,179 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	return nil
 }
 
-func getAssetPath(videoID, mediaType string) string {
-	ext := mediaTypeToExt(mediaType)
-	return fmt.Sprintf("%s%s", videoID, ext)
+// getAssetPath names a stored file after the given random name, with the
+// extension configured for its media type. CDNs infer Content-Type from
+// the extension, so a type without a mapping is an error rather than a guess.
+func (cfg apiConfig) getAssetPath(name, mediaType string) (string, error) {
+	ext, ok := cfg.mediaExtensions[mediaType]
+	if !ok {
+		return "", fmt.Errorf("no file extension configured for media type %q", mediaType)
+	}
+	if !assetNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid asset name %q", name)
+	}
+	return name + ext, nil
 }
 
-func (cfg apiConfig) getAssetDiskPath(assetPath string) string {
-	return filepath.Join(cfg.assetsRoot, assetPath)
+// getAssetDiskPath returns where the asset is kept on disk. It's an error for
+// the path to resolve anywhere but directly inside the assets root.
+func (cfg apiConfig) getAssetDiskPath(assetPath string) (string, error) {
+	root := filepath.Clean(cfg.assetsRoot)
+	diskPath := filepath.Join(root, assetPath)
+	// Backslashes are separators on some platforms, so they're never part of
+	// a name
+	if strings.ContainsAny(assetPath, `/\`) || filepath.Dir(diskPath) != root {
+		return "", fmt.Errorf("asset path %q escapes the assets directory", assetPath)
+	}
+	return diskPath, nil
 }
 
 func (cfg apiConfig) getAssetURL(assetPath string) string {
 	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, assetPath)
 }
 
-func (cfg apiConfig) getObjectURL(fileKey string) string {
-	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.s3Bucket, cfg.s3Region, fileKey)
+// Length of the content hash prefix versionURL appends.
+const urlVersionLength = 12
+
+// versionURL appends a ?v= suffix taken from the content hash, so caches
+// refetch an asset when its content changes and only then.
+func (cfg apiConfig) versionURL(url, contentHash string) string {
+	if !cfg.versionAssetURLs || contentHash == "" {
+		return url
+	}
+	return url + "?v=" + contentHash[:min(len(contentHash), urlVersionLength)]
+}
+
+// stripURLVersion removes a suffix added by versionURL.
+func stripURLVersion(url string) string {
+	base, _, _ := strings.Cut(url, "?")
+	return base
+}
+
+// assetPathFromURL reverses getAssetURL.
+func (cfg apiConfig) assetPathFromURL(url string) (string, bool) {
+	assetPath, ok := strings.CutPrefix(stripURLVersion(url), cfg.getAssetURL(""))
+	if !ok || assetPath == "" || strings.ContainsAny(assetPath, `/\`) {
+		return "", false
+	}
+	return assetPath, true
+}
+
+// getObjectURL returns the URL media is served from: the CloudFront
+// distribution when one is configured and fronts the bucket, otherwise S3
+// directly. Staged media never goes through the distribution, so until it's
+// promoted it can only be reached with a presigned URL.
+func (cfg apiConfig) getObjectURL(bucket, fileKey string) string {
+	if cfg.servesViaCloudFront(bucket) && !strings.HasPrefix(fileKey, stagingPrefix) {
+		return cfg.getCloudFrontURL(fileKey)
+	}
+	return cfg.getDirectObjectURL(bucket, fileKey)
+}
+
+func (cfg apiConfig) getDirectObjectURL(bucket, fileKey string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, cfg.s3Region, fileKey)
 }
 
 func (cfg apiConfig) getCloudFrontURL(fileKey string) string {
 	return fmt.Sprintf("%s/%s", cfg.s3CfDistribution, fileKey)
 }
 
-func mediaTypeToExt(mediaType string) string {
-	parts := strings.Split(mediaType, "/")
-	if len(parts) != 2 {
-		return ".bin"
+// servesViaCloudFront reports whether objects in the bucket are served
+// through the distribution, which only fronts the configured bucket.
+func (cfg apiConfig) servesViaCloudFront(bucket string) bool {
+	return cfg.s3CfDistribution != "" && bucket == cfg.s3Bucket
+}
+
+// isCloudFrontURL reports whether the URL points at the distribution.
+func (cfg apiConfig) isCloudFrontURL(url string) bool {
+	return cfg.s3CfDistribution != "" && strings.HasPrefix(url, cfg.s3CfDistribution+"/")
+}
+
+// parseS3Key recovers the bucket and key from a stored video URL. It
+// reverses getCloudFrontURL and getDirectObjectURL, and also accepts the
+// "bucket,key" form some older records were saved in.
+func (cfg apiConfig) parseS3Key(videoURL string) (bucket, key string, err error) {
+	url := stripURLVersion(videoURL)
+	if cfg.isCloudFrontURL(url) {
+		key = strings.TrimPrefix(url, cfg.s3CfDistribution+"/")
+		if key == "" {
+			return "", "", fmt.Errorf("no object key in video URL %q", videoURL)
+		}
+		return cfg.s3Bucket, key, nil
+	}
+
+	rest, ok := strings.CutPrefix(url, "https://")
+	if !ok {
+		// Bucket names can't contain commas, so the first one separates
+		// the two parts
+		bucket, key, ok = strings.Cut(videoURL, ",")
+		if !ok || bucket == "" || key == "" || strings.Contains(bucket, "/") {
+			return "", "", fmt.Errorf("unrecognized video URL %q", videoURL)
+		}
+		return bucket, key, nil
+	}
+	host, key, ok := strings.Cut(rest, "/")
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("no object key in video URL %q", videoURL)
+	}
+	bucket, ok = strings.CutSuffix(host, fmt.Sprintf(".s3.%s.amazonaws.com", cfg.s3Region))
+	if !ok || bucket == "" {
+		return "", "", fmt.Errorf("video URL %q isn't in this region's S3", videoURL)
+	}
+	return bucket, key, nil
+}
+
+// applyThumbnailPlaceholder points the video at the configured placeholder
+// thumbnail, if there is one.
+func (cfg apiConfig) applyThumbnailPlaceholder(video *database.Video) {
+	if cfg.thumbnailPlaceholderURL == "" {
+		return
+	}
+	url := cfg.thumbnailPlaceholderURL
+	video.ThumbnailURL = &url
+	video.ThumbnailSource = database.ThumbnailSourcePlaceholder
+}
+
+// Media types the upload endpoints accept; each needs a file extension.
+var acceptedMediaTypes = []string{"video/mp4", "image/jpeg", "image/png"}
+
+var defaultMediaExtensions = map[string]string{
+	"video/mp4":  ".mp4",
+	"image/jpeg": ".jpeg",
+	"image/png":  ".png",
+}
+
+var (
+	assetNameRegexp     = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	fileExtensionRegexp = regexp.MustCompile(`^\.[a-z0-9]{1,8}$`)
+)
+
+// parseMediaExtensions reads a comma-separated list of type=.ext pairs, e.g.
+// "video/mp4=.mp4,image/jpeg=.jpg". An empty list keeps the defaults. The
+// result must map every accepted media type.
+func parseMediaExtensions(list string) (map[string]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return defaultMediaExtensions, nil
+	}
+
+	extensions := map[string]string{}
+	for _, pair := range strings.Split(list, ",") {
+		mediaType, ext, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mapping %q, want type=.ext", pair)
+		}
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if !fileExtensionRegexp.MatchString(ext) {
+			return nil, fmt.Errorf("invalid extension %q for %s", ext, mediaType)
+		}
+		extensions[mediaType] = ext
+	}
+
+	for _, mediaType := range acceptedMediaTypes {
+		if _, ok := extensions[mediaType]; !ok {
+			return nil, fmt.Errorf("no extension for accepted media type %s", mediaType)
+		}
 	}
-	return "." + parts[1]
+	return extensions, nil
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestApplyThumbnailPlaceholder(t *testing.T) {
+	const placeholder = "https://cdn.example.com/placeholder.png"
+	tests := []struct {
+		name       string
+		configured string
+		wantURL    string
+		wantSource string
+	}{
+		{"configured", placeholder, placeholder, database.ThumbnailSourcePlaceholder},
+		{"not configured", "", "", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := apiConfig{thumbnailPlaceholderURL: tc.configured}
+			var video database.Video
+			cfg.applyThumbnailPlaceholder(&video)
+
+			gotURL := ""
+			if video.ThumbnailURL != nil {
+				gotURL = *video.ThumbnailURL
+			}
+			if gotURL != tc.wantURL || video.ThumbnailSource != tc.wantSource {
+				t.Errorf("got %q from %q, want %q from %q", gotURL, video.ThumbnailSource, tc.wantURL, tc.wantSource)
+			}
+		})
+	}
+}
+
+func TestGetAssetDiskPath(t *testing.T) {
+	cfg := apiConfig{assetsRoot: "/srv/assets"}
+	tests := []struct {
+		assetPath string
+		want      string
+	}{
+		{"abc.jpg", "/srv/assets/abc.jpg"},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"../abc.jpg", ""},
+		{"../../etc/passwd", ""},
+		{"sub/abc.jpg", ""},
+		{"/abc.jpg", ""},
+		{`..\abc.jpg`, ""},
+		{`sub\abc.jpg`, ""},
+	}
+	for _, tc := range tests {
+		got, err := cfg.getAssetDiskPath(tc.assetPath)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("getAssetDiskPath(%q) = %q, want an error", tc.assetPath, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(tc.want) {
+			t.Errorf("getAssetDiskPath(%q) = %q, %v, want %q", tc.assetPath, got, err, tc.want)
+		}
+	}
+}
+
+func TestGetAssetPath(t *testing.T) {
+	cfg := apiConfig{mediaExtensions: defaultMediaExtensions}
+	tests := []struct {
+		name      string
+		mediaType string
+		want      string
+	}{
+		{"abc", "image/png", "abc.png"},
+		{"abc", "video/mp4", "abc.mp4"},
+		{"abc", "image/../../x", ""},
+		{"abc", "video/mp4/../../x", ""},
+		{"abc", "", ""},
+		{"../abc", "image/png", ""},
+		{"a/b", "image/png", ""},
+		{`a\b`, "image/png", ""},
+		{"", "image/png", ""},
+	}
+	for _, tc := range tests {
+		got, err := cfg.getAssetPath(tc.name, tc.mediaType)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("getAssetPath(%q, %q) = %q, want an error", tc.name, tc.mediaType, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("getAssetPath(%q, %q) = %q, %v, want %q", tc.name, tc.mediaType, got, err, tc.want)
+		}
+	}
+}
+
+func TestDefaultMediaExtensions(t *testing.T) {
+	want := map[string]string{
+		"video/mp4":  ".mp4",
+		"image/jpeg": ".jpeg",
+		"image/png":  ".png",
+	}
+	cfg := apiConfig{mediaExtensions: defaultMediaExtensions}
+	for _, mediaType := range acceptedMediaTypes {
+		got, err := cfg.getAssetPath("abc", mediaType)
+		if err != nil || got != "abc"+want[mediaType] {
+			t.Errorf("getAssetPath(abc, %s) = %q, %v, want %q", mediaType, got, err, "abc"+want[mediaType])
+		}
+	}
+}
+
+func TestParseMediaExtensions(t *testing.T) {
+	got, err := parseMediaExtensions(" Video/MP4 = .M4V, image/jpeg=.jpg ,image/png=.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"video/mp4": ".m4v", "image/jpeg": ".jpg", "image/png": ".png"}
+	for mediaType, ext := range want {
+		if got[mediaType] != ext {
+			t.Errorf("extension for %s = %q, want %q", mediaType, got[mediaType], ext)
+		}
+	}
+
+	if got, err := parseMediaExtensions(""); err != nil || len(got) != len(defaultMediaExtensions) {
+		t.Errorf("empty list = %v, %v, want the defaults", got, err)
+	}
+
+	for _, list := range []string{
+		"video/mp4=.mp4,image/jpeg=.jpg",                  // misses image/png
+		"video/mp4=mp4,image/jpeg=.jpg,image/png=.png",    // no dot
+		"video/mp4=.mp4/x,image/jpeg=.jpg,image/png=.png", // separator
+		"video/mp4=.toolongext,image/jpeg=.jpg,image/png=.png",
+		"video/mp4,image/jpeg=.jpg,image/png=.png",
+	} {
+		if _, err := parseMediaExtensions(list); err == nil {
+			t.Errorf("parseMediaExtensions(%q) succeeded, want an error", list)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// countingResponseWriter tracks how many body bytes made it to the client.
+// A write cut short by a disconnect still counts the bytes it managed to send.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// recordBytesServed bills delivered media bytes to the video's owner.
+func (cfg *apiConfig) recordBytesServed(ownerID uuid.UUID, endpoint string, w *countingResponseWriter) {
+	if w.written == 0 {
+		return
+	}
+	cfg.metrics.bytesServed.add(float64(w.written), endpoint, strconv.Itoa(w.status))
+	if err := cfg.db.AddBytesServed(ownerID, w.written); err != nil {
+		slog.Error("couldn't record bytes served", "user_id", ownerID, "bytes", w.written, "error", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// bucketOverrideHeader lets integration tests running on trusted networks
+// direct an upload at an isolated bucket.
+const bucketOverrideHeader = "X-Tubely-Bucket"
+
+var bucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+var (
+	errBucketOverrideUntrusted = errors.New("bucket override from an untrusted address")
+	errBucketOverrideInvalid   = errors.New("invalid bucket name")
+)
+
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isFromNetworks checks the connection's peer address only; forwarding
+// headers are client-controlled and can't establish trust.
+func isFromNetworks(r *http.Request, networks []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ipInNetworks(ip, networks)
+}
+
+func ipInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketForRequest returns the bucket an upload should be written to. An
+// override the request can't make is an error rather than being ignored, so
+// a misconfigured test run can't end up writing to the default bucket.
+func (cfg *apiConfig) bucketForRequest(r *http.Request) (string, error) {
+	bucket := r.Header.Get(bucketOverrideHeader)
+	if bucket == "" {
+		return cfg.s3Bucket, nil
+	}
+	if !isFromNetworks(r, cfg.bucketOverrideNetworks) {
+		requestLogger(r).Warn("rejecting bucket override from untrusted address", "header", bucketOverrideHeader, "remote_addr", r.RemoteAddr)
+		return "", errBucketOverrideUntrusted
+	}
+	if !bucketNameRegexp.MatchString(bucket) {
+		requestLogger(r).Warn("rejecting invalid bucket override", "bucket", bucket)
+		return "", errBucketOverrideInvalid
+	}
+	return bucket, nil
+}
+
+// respondWithBucketOverrideError writes the response for an override
+// bucketForRequest rejected.
+func respondWithBucketOverrideError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errBucketOverrideUntrusted) {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeBucketOverrideDenied, bucketOverrideHeader+" isn't allowed from this address", err)
+		return
+	}
+	respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidBucketOverride, "Invalid "+bucketOverrideHeader+" bucket name", err)
+}
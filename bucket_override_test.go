@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := parseCIDRs(" 10.0.0.0/8, ,fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 2 {
+		t.Errorf("parsed %d networks, want 2", len(networks))
+	}
+	if _, err := parseCIDRs("10.0.0.1"); err == nil {
+		t.Error("accepted an address without a prefix length")
+	}
+}
+
+func TestBucketForRequest(t *testing.T) {
+	networks, err := parseCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &apiConfig{s3Bucket: testBucket, bucketOverrideNetworks: networks}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		forwarded  string
+		want       string
+		wantErr    error
+	}{
+		{"no header", "10.1.2.3:4000", "", "", testBucket, nil},
+		{"trusted override", "10.1.2.3:4000", "run-42-bucket", "", "run-42-bucket", nil},
+		{"untrusted override is rejected", "203.0.113.7:4000", "run-42-bucket", "", "", errBucketOverrideUntrusted},
+		{"forwarded address isn't trusted", "203.0.113.7:4000", "run-42-bucket", "10.1.2.3", "", errBucketOverrideUntrusted},
+		{"invalid bucket name is rejected", "10.1.2.3:4000", "Not_A_Bucket", "", "", errBucketOverrideInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/video_upload/id", nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.header != "" {
+				r.Header.Set(bucketOverrideHeader, tc.header)
+			}
+			if tc.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			got, err := cfg.bucketForRequest(r)
+			if got != tc.want || !errors.Is(err, tc.wantErr) {
+				t.Errorf("bucket = %q, %v; want %q, %v", got, err, tc.want, tc.wantErr)
+			}
+		})
+	}
+
+	// Overrides are off when no networks are configured
+	cfg.bucketOverrideNetworks = nil
+	r := httptest.NewRequest(http.MethodPost, "/api/video_upload/id", nil)
+	r.RemoteAddr = "10.1.2.3:4000"
+	r.Header.Set(bucketOverrideHeader, "run-42-bucket")
+	if _, err := cfg.bucketForRequest(r); !errors.Is(err, errBucketOverrideUntrusted) {
+		t.Errorf("with no trusted networks, err = %v, want %v", err, errBucketOverrideUntrusted)
+	}
+}
+
+func TestUploadRejectsUntrustedBucketOverride(t *testing.T) {
+	cfg, _ := newVideoTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	r := videoUploadRequest(t, video.ID.String(), token, "video/mp4", []byte("not really a video"))
+	r.RemoteAddr = "203.0.113.7:4000"
+	r.Header.Set(bucketOverrideHeader, "run-42-bucket")
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, r)
+	if w.Code != http.StatusForbidden || errorCode(t, w) != errCodeBucketOverrideDenied {
+		t.Errorf("got %d %q, want %d %q", w.Code, errorCode(t, w), http.StatusForbidden, errCodeBucketOverrideDenied)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Longest User-Agent kept on a video; anything beyond is noise or abuse.
+const maxUserAgentLength = 512
+
+// clientIP returns the address of the client that sent the request. The
+// X-Forwarded-For chain is only followed through proxies in trustedProxies,
+// stopping at the first hop we don't operate.
+func (cfg *apiConfig) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isFromNetworks(r, cfg.trustedProxies) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !ipInNetworks(ip, cfg.trustedProxies) {
+			break
+		}
+	}
+	return host
+}
+
+// sanitizeClientValue drops control characters and truncates to maxLen bytes
+// without splitting a UTF-8 sequence.
+func sanitizeClientValue(s string, maxLen int) string {
+	s = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if len(s) > maxLen {
+		s = strings.ToValidUTF8(s[:maxLen], "")
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseCIDRs("10.0.0.0/8, 192.168.1.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &apiConfig{trustedProxies: proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer can't spoof", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:443", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without header", "10.1.2.3:443", nil, "10.1.2.3"},
+		{"chain of trusted proxies", "10.1.2.3:443", []string{"198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"spoofed entry before an untrusted hop", "10.1.2.3:443", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"split across headers", "10.1.2.3:443", []string{"1.1.1.1", "198.51.100.1, 10.0.0.9"}, "198.51.100.1"},
+		{"garbage hop", "10.1.2.3:443", []string{"not-an-ip"}, "10.1.2.3"},
+		{"ipv6", "[2001:db8::1]:443", []string{"198.51.100.1"}, "2001:db8::1"},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/video_upload/x", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for _, v := range tc.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := cfg.clientIP(r); got != tc.want {
+			t.Errorf("%s: clientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSanitizeClientValue(t *testing.T) {
+	tests := []struct {
+		in     string
+		maxLen int
+		want   string
+	}{
+		{"curl/8.5.0", 512, "curl/8.5.0"},
+		{"  evil\r\nX-Injected: 1\x00 ", 512, "evilX-Injected: 1"},
+		{"bad \xff utf8", 512, "bad  utf8"},
+		{strings.Repeat("a", 600), 512, strings.Repeat("a", 512)},
+		// Truncating mid-rune drops the partial sequence
+		{"aé", 2, "a"},
+	}
+	for _, tc := range tests {
+		if got := sanitizeClientValue(tc.in, tc.maxLen); got != tc.want {
+			t.Errorf("sanitizeClientValue(%q, %d) = %q, want %q", tc.in, tc.maxLen, got, tc.want)
+		}
+	}
+}
+
+func TestVideoGetClientDetailsVisibility(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+	admin, adminToken := createTestUser(t, cfg, "admin@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	cfg.adminUserIDs = map[uuid.UUID]bool{admin.ID: true}
+
+	video := createTestVideo(t, cfg, owner.ID)
+	video.UploadUserAgent = "curl/8.5.0"
+	video.UploadIP = "198.51.100.1"
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		visible bool
+	}{
+		{"anonymous", "", false},
+		{"other user", otherToken, false},
+		{"owner", ownerToken, true},
+		{"admin", adminToken, true},
+		{"bad token", "garbage", false},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String(), nil)
+		r.SetPathValue("videoID", video.ID.String())
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		cfg.handlerVideoGet(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tc.name, w.Code, w.Body)
+		}
+		var got database.Video
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if visible := got.UploadIP != "" || got.UploadUserAgent != ""; visible != tc.visible {
+			t.Errorf("%s: client details shown = %v, want %v", tc.name, visible, tc.visible)
+		}
+	}
+}
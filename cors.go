@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", apiKeyHeader, idempotencyKeyHeader, "Range", "Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset"}
+)
+
+// Response headers scripts on another origin can only read once exposed.
+var corsExposedHeaders = strings.Join([]string{
+	"Content-Disposition", "Content-Range", "ETag", idempotentReplayedHeader, "Location", "Retry-After",
+	"Tus-Resumable", "Upload-Length", "Upload-Offset", requestIDHeader,
+}, ", ")
+
+// How long browsers may cache a preflight response.
+const corsMaxAge = 10 * time.Minute
+
+// corsMiddleware lets pages on the allowed origins call the API from the
+// browser. It answers preflight requests itself. Requests from any other
+// origin are passed through untouched, so the browser blocks them.
+func (cfg *apiConfig) corsMiddleware(next http.Handler) http.Handler {
+	if len(cfg.corsAllowedOrigins) == 0 {
+		return next
+	}
+	allowMethods := strings.Join(cfg.corsAllowedMethods, ", ")
+	allowHeaders := strings.Join(cfg.corsAllowedHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on the origin, so shared caches mustn't hand
+		// one origin's answer to another
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" || !slices.Contains(cfg.corsAllowedOrigins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkCORSOrigin makes sure an allowed origin is written the way browsers
+// send it: a scheme and host, with no path or trailing slash.
+func checkCORSOrigin(origin string) error {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("%q isn't an origin like https://example.com", origin)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// Room in a JSON body for everything around a data URL's encoded payload:
+// the field name, the "data:" prefix and the media type.
+const dataURLOverhead = 1 << 10
+
+// dataURLBodyLimit is how large a JSON body carrying a data URL of up to
+// maxBytes decoded bytes can be.
+func dataURLBodyLimit(maxBytes int64) int64 {
+	return int64(base64.StdEncoding.EncodedLen(int(maxBytes))) + dataURLOverhead
+}
+
+// parseDataURL decodes a base64 data URL of the form
+// "data:image/png;base64,...", returning its declared media type and the
+// decoded bytes. Only base64 payloads are accepted.
+func parseDataURL(dataURL string) (string, []byte, error) {
+	rest, ok := strings.CutPrefix(dataURL, "data:")
+	if !ok {
+		return "", nil, errors.New("not a data URL")
+	}
+	meta, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", nil, errors.New("data URL has no payload")
+	}
+	meta, ok = strings.CutSuffix(meta, ";base64")
+	if !ok {
+		return "", nil, errors.New("data URL isn't base64 encoded")
+	}
+	mediaType, _, err := mime.ParseMediaType(meta)
+	if err != nil {
+		return "", nil, fmt.Errorf("data URL media type: %w", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("data URL payload: %w", err)
+	}
+	return mediaType, data, nil
+}
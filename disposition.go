@@ -0,0 +1,24 @@
+package main
+
+import "mime"
+
+const (
+	dispositionInline     = "inline"
+	dispositionAttachment = "attachment"
+)
+
+// mediaOverrides returns the headers that make browsers either play a video
+// in place or save it as a file named after its title.
+func mediaOverrides(disposition, title string) presignOverrides {
+	filename := map[string]string{"filename": title + ".mp4"}
+	if disposition == dispositionAttachment {
+		return presignOverrides{
+			contentType:        "application/octet-stream",
+			contentDisposition: mime.FormatMediaType(dispositionAttachment, filename),
+		}
+	}
+	return presignOverrides{
+		contentType:        "video/mp4",
+		contentDisposition: mime.FormatMediaType(dispositionInline, filename),
+	}
+}
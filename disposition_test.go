@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestMediaOverrides(t *testing.T) {
+	inline := mediaOverrides(dispositionInline, "My clip")
+	if inline.contentType != "video/mp4" || inline.contentDisposition != `inline; filename="My clip.mp4"` {
+		t.Errorf("inline: got %+v", inline)
+	}
+	attachment := mediaOverrides(dispositionAttachment, "My clip")
+	if attachment.contentType != "application/octet-stream" || attachment.contentDisposition != `attachment; filename="My clip.mp4"` {
+		t.Errorf("attachment: got %+v", attachment)
+	}
+}
+
+func TestDispositionPerEndpoint(t *testing.T) {
+	tests := []struct {
+		name               string
+		playback, download string
+		wantStream         string
+		wantStreamType     string
+		wantDownload       string
+		wantDownloadType   string
+	}{
+		{
+			"defaults", dispositionInline, dispositionAttachment,
+			`inline; filename="test video.mp4"`, "video/mp4",
+			`attachment; filename="test video.mp4"`, "application/octet-stream",
+		},
+		{
+			"download plays inline", dispositionInline, dispositionInline,
+			`inline; filename="test video.mp4"`, "video/mp4",
+			`inline; filename="test video.mp4"`, "video/mp4",
+		},
+		{
+			"playback saves the file", dispositionAttachment, dispositionAttachment,
+			`attachment; filename="test video.mp4"`, "application/octet-stream",
+			`attachment; filename="test video.mp4"`, "application/octet-stream",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, fake := newTestConfig(t)
+			cfg.s3CfDistribution = "https://cdn.example.com"
+			cfg.s3Client = rangeS3(t, fake)
+			cfg.playbackDisposition = tc.playback
+			cfg.downloadDisposition = tc.download
+			owner, _ := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner.ID)
+			fake.put(testBucket, "landscape/abc.mp4", []byte("media"))
+			videoURL := cfg.getCloudFrontURL("landscape/abc.mp4")
+			video.VideoURL = &videoURL
+			if err := cfg.db.UpdateVideo(video); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/stream", nil)
+			r.SetPathValue("videoID", video.ID.String())
+			rec := httptest.NewRecorder()
+			cfg.handlerStreamVideo(rec, r)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("stream: status %d: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Disposition"); got != tc.wantStream {
+				t.Errorf("stream Content-Disposition = %q, want %q", got, tc.wantStream)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tc.wantStreamType {
+				t.Errorf("stream Content-Type = %q, want %q", got, tc.wantStreamType)
+			}
+			if got := rec.Header().Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("stream Accept-Ranges = %q, want bytes", got)
+			}
+
+			rec = downloadVideo(cfg, video.ID.String(), "")
+			if rec.Code != http.StatusFound {
+				t.Fatalf("download: status %d: %s", rec.Code, rec.Body)
+			}
+			signed, err := url.Parse(rec.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := signed.Query().Get("response-content-disposition"); got != tc.wantDownload {
+				t.Errorf("download disposition = %q, want %q", got, tc.wantDownload)
+			}
+			if got := signed.Query().Get("response-content-type"); got != tc.wantDownloadType {
+				t.Errorf("download type = %q, want %q", got, tc.wantDownloadType)
+			}
+		})
+	}
+}
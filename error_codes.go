@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Codes sent with error responses so clients can act on the cause without
+// parsing the message. Once released, a code's meaning must not change.
+const (
+	errCodeInvalidID              = "invalid_id"
+	errCodeMissingToken           = "missing_token"
+	errCodeInvalidToken           = "invalid_token"
+	errCodeTokenExpired           = "token_expired"
+	errCodeVideoNotFound          = "video_not_found"
+	errCodeNotOwner               = "not_owner"
+	errCodeVideoModified          = "video_modified"
+	errCodeAlreadyProcessing      = "already_processing"
+	errCodeInvalidProfile         = "invalid_processing_profile"
+	errCodeInvalidForm            = "invalid_form"
+	errCodeInvalidParameter       = "invalid_parameter"
+	errCodeFileRequired           = "file_required"
+	errCodeFileTooLarge           = "file_too_large"
+	errCodeQuotaExceeded          = "quota_exceeded"
+	errCodeInvalidContentType     = "invalid_content_type"
+	errCodeInvalidFileType        = "invalid_file_type"
+	errCodeContentTypeMismatch    = "content_type_mismatch"
+	errCodeInvalidDataURL         = "invalid_data_url"
+	errCodeInvalidImage           = "invalid_image"
+	errCodeThumbnailTooSimilar    = "thumbnail_too_similar"
+	errCodeInvalidVideo           = "invalid_video"
+	errCodeDurationMismatch       = "duration_mismatch"
+	errCodeStillImage             = "still_image"
+	errCodeMalwareDetected        = "malware_detected"
+	errCodeScanFailed             = "scan_failed"
+	errCodeDuplicateUploadTimeout = "duplicate_upload_timeout"
+	errCodeStorageFailed          = "storage_failed"
+	errCodeUploadCorrupted        = "upload_corrupted"
+	errCodeUploadNotFound         = "upload_not_found"
+	errCodeUploadBusy             = "upload_busy"
+	errCodeOffsetMismatch         = "offset_mismatch"
+	errCodeIdempotencyKeyTooLong  = "idempotency_key_too_long"
+	errCodeIdempotencyKeyReused   = "idempotency_key_reused"
+	errCodeIdempotencyKeyInFlight = "idempotency_key_in_progress"
+	errCodeBucketOverrideDenied   = "bucket_override_denied"
+	errCodeInvalidBucketOverride  = "invalid_bucket_override"
+)
+
+// defaultErrorCode names the status, for errors without a code of their own.
+func defaultErrorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		case r == ' ' || r == '-':
+			return '_'
+		}
+		return -1
+	}, text)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+const bandwidthDayLayout = "2006-01-02"
+
+// How far back the bandwidth report goes when no start day is given
+const defaultBandwidthWindow = 30 * 24 * time.Hour
+
+// handlerBandwidth reports the media bytes served for the user's videos
+// between ?from and ?to, inclusive, as YYYY-MM-DD days in UTC. Only
+// streamed bytes are counted: downloads redirect to S3, which serves them
+// directly.
+func (cfg *apiConfig) handlerBandwidth(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	to := time.Now().UTC()
+	if v := r.URL.Query().Get("to"); v != "" {
+		to, err = time.Parse(bandwidthDayLayout, v)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParameter, "to must be a YYYY-MM-DD day", err)
+			return
+		}
+	}
+	from := to.Add(-defaultBandwidthWindow)
+	if v := r.URL.Query().Get("from"); v != "" {
+		from, err = time.Parse(bandwidthDayLayout, v)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParameter, "from must be a YYYY-MM-DD day", err)
+			return
+		}
+	}
+	if from.After(to) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParameter, "from must not be after to", nil)
+		return
+	}
+
+	fromDay, toDay := from.Format(bandwidthDayLayout), to.Format(bandwidthDayLayout)
+	served, err := cfg.db.GetBytesServed(userID, fromDay, toDay)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get bandwidth usage", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct {
+		From        string `json:"from"`
+		To          string `json:"to"`
+		BytesServed int64  `json:"bytes_served"`
+	}{fromDay, toDay, served})
+}
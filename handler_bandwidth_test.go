@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBandwidthReport(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	if err := cfg.db.AddBytesServed(user.ID, 1234); err != nil {
+		t.Fatal(err)
+	}
+	today := time.Now().UTC().Format(bandwidthDayLayout)
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		status int
+		want   int64
+	}{
+		{"default window", "", http.StatusOK, 1234},
+		{"explicit range", "?from=" + today + "&to=" + today, http.StatusOK, 1234},
+		{"before any traffic", "?from=2000-01-01&to=2000-01-31", http.StatusOK, 0},
+		{"bad day", "?from=yesterday", http.StatusBadRequest, 0},
+		{"reversed range", "?from=2000-02-01&to=2000-01-01", http.StatusBadRequest, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/bandwidth"+tc.query, nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			cfg.handlerBandwidth(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp struct {
+				BytesServed int64 `json:"bytes_served"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.BytesServed != tc.want {
+				t.Errorf("bytes_served = %d, want %d", resp.BytesServed, tc.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"net/http"
-	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 )
@@ -20,17 +19,21 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 
 	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user for refresh token", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token is invalid, revoked or expired", nil)
 		return
 	}
 
 	accessToken, err := auth.MakeJWT(
 		user.ID,
 		cfg.jwtSecret,
-		time.Hour,
+		accessTokenTTL,
 	)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access token", err)
 		return
 	}
 
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func refreshRequest(path, token string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestRefresh(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+
+	newToken := func(expiresIn time.Duration) string {
+		t.Helper()
+		token, err := auth.MakeRefreshToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
+			Token:     token,
+			UserID:    user.ID,
+			ExpiresAt: time.Now().Add(expiresIn),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	valid := newToken(time.Hour)
+	expired := newToken(-time.Minute)
+	revoked := newToken(time.Hour)
+	w := httptest.NewRecorder()
+	cfg.handlerRevoke(w, refreshRequest("/api/revoke", revoked))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"expired", expired, http.StatusUnauthorized},
+		{"revoked", revoked, http.StatusUnauthorized},
+		{"unknown", "deadbeef", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		cfg.handlerRefresh(w, refreshRequest("/api/refresh", tc.token))
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, w.Code, tc.wantStatus, w.Body)
+			continue
+		}
+		if tc.wantStatus != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := cfg.validateJWT(resp.Token); err != nil || got != user.ID {
+			t.Errorf("%s: minted token validates to %v, %v, want %v", tc.name, got, err, user.ID)
+		}
+	}
+}
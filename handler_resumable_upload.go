@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads follow the tus protocol: POST creates a session, HEAD
+// reports how much of it has arrived and each PATCH appends a chunk. The
+// video is processed as soon as the last byte is received.
+const tusVersion = "1.0.0"
+
+func (cfg *apiConfig) handlerResumableUploadCreate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateRequestJWT(r, token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid Upload-Length", err)
+		return
+	}
+	if length > cfg.maxVideoUploadBytes {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("File exceeds %d byte limit", cfg.maxVideoUploadBytes), nil)
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid Upload-Metadata", err)
+		return
+	}
+
+	videoID, err := uuid.Parse(metadata["video_id"])
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+	vid, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if vid.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotOwner, "The authenticated user is not the video owner", nil)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(metadata["filetype"])
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidContentType, "Invalid filetype", err)
+		return
+	}
+	if !cfg.acceptsVideoType(mediaType) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFileType, "Invalid file type", nil)
+		return
+	}
+	staging := false
+	if v := metadata["staging"]; v != "" {
+		staging, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid staging flag", err)
+			return
+		}
+	}
+	encodeDeadline := cfg.encodeDeadline
+	if v := metadata["encode_deadline"]; v != "" {
+		encodeDeadline, err = time.ParseDuration(v)
+		if err != nil || encodeDeadline <= 0 {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid encode deadline", err)
+			return
+		}
+	}
+
+	ok, err := cfg.withinStorageQuota(userID, vid.FileSize, length)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return
+	}
+	if !ok {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeQuotaExceeded, "Storage quota exceeded", nil)
+		return
+	}
+
+	upload := resumableUpload{
+		ID:             uuid.New(),
+		VideoID:        videoID,
+		UserID:         userID,
+		Length:         length,
+		MediaType:      mediaType,
+		Filename:       metadata["filename"],
+		Staging:        staging,
+		EncodeDeadline: encodeDeadline,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if err := cfg.resumableUploads.create(upload); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/uploads/"+upload.ID.String())
+	respondWithJSON(w, http.StatusCreated, upload)
+}
+
+func (cfg *apiConfig) handlerResumableUploadHead(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.authorizeResumableUpload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerResumableUploadPatch(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.authorizeResumableUpload(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.resumableUploads.lock(upload.ID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadBusy, "Upload is already receiving a chunk", nil)
+		return
+	}
+	defer cfg.resumableUploads.unlock(upload.ID)
+
+	// Reload now the session is ours, in case a chunk landed in between
+	upload, err := cfg.resumableUploads.load(upload.ID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeUploadNotFound, "Upload not found", err)
+		return
+	}
+
+	bucket, err := cfg.bucketForRequest(r)
+	if err != nil {
+		respondWithBucketOverrideError(w, err)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithErrorCode(w, http.StatusUnsupportedMediaType, errCodeInvalidContentType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+	offset, err := chunkOffset(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid chunk offset", err)
+		return
+	}
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		respondWithErrorCode(w, http.StatusConflict, errCodeOffsetMismatch, fmt.Sprintf("Upload is at offset %d", upload.Offset), nil)
+		return
+	}
+	if r.ContentLength > upload.Length-upload.Offset {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, "Chunk runs past the end of the upload", nil)
+		return
+	}
+
+	err = cfg.resumableUploads.append(&upload, r.Body)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if err != nil {
+		// Whatever arrived is kept; the client resumes from Upload-Offset
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save chunk", err)
+		return
+	}
+	if upload.Offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	cfg.finishResumableUpload(w, r, upload, bucket)
+}
+
+func (cfg *apiConfig) handlerResumableUploadDelete(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.authorizeResumableUpload(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.resumableUploads.lock(upload.ID) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeUploadBusy, "Upload is already receiving a chunk", nil)
+		return
+	}
+	defer cfg.resumableUploads.unlock(upload.ID)
+
+	cfg.resumableUploads.remove(upload.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeResumableUpload loads the session named in the path, responding
+// with an error unless it belongs to the authenticated user.
+func (cfg *apiConfig) authorizeResumableUpload(w http.ResponseWriter, r *http.Request) (resumableUpload, bool) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid upload ID", err)
+		return resumableUpload{}, false
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
+		return resumableUpload{}, false
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return resumableUpload{}, false
+	}
+
+	upload, err := cfg.resumableUploads.load(uploadID)
+	if errors.Is(err, errUploadSessionNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeUploadNotFound, "Upload not found", err)
+		return resumableUpload{}, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return resumableUpload{}, false
+	}
+	if upload.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeNotOwner, "The authenticated user didn't start this upload", nil)
+		return resumableUpload{}, false
+	}
+	return upload, true
+}
+
+// finishResumableUpload runs a fully received upload through the same
+// pipeline as a single-request upload. The session is kept after a failure
+// worth retrying, which an empty chunk at the final offset does; otherwise
+// it's gone afterwards.
+func (cfg *apiConfig) finishResumableUpload(w http.ResponseWriter, r *http.Request, upload resumableUpload, bucket string) {
+	logger := requestLogger(r).With("operation", "upload_video", "video_id", upload.VideoID, "user_id", upload.UserID)
+	keepSession := false
+	defer func() {
+		if !keepSession {
+			cfg.resumableUploads.remove(upload.ID)
+		}
+	}()
+
+	vid, err := cfg.db.GetVideo(upload.VideoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		keepSession = true
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if vid.UserID != upload.UserID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotOwner, "The authenticated user is not the video owner", nil)
+		return
+	}
+
+	claimed, err := cfg.db.ClaimVideoUpload(vid.ID)
+	if err != nil {
+		keepSession = true
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if !claimed {
+		keepSession = true
+		respondWithErrorCode(w, http.StatusConflict, errCodeAlreadyProcessing, "An upload for this video is already processing", nil)
+		return
+	}
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			cfg.setProcessingStatus(vid.ID, vid.ProcessingStatus, vid.ErrorMessage)
+		}
+	}()
+
+	profileName, profile, err := cfg.profileFor(r, upload.UserID)
+	if err != nil {
+		respondWithProfileError(w, err)
+		return
+	}
+
+	cfg.metrics.uploadedBytes.add(float64(upload.Length), "video", upload.MediaType)
+
+	dataPath := cfg.resumableUploads.dataPath(upload.ID)
+	checksum, err := hashFile(dataPath)
+	if err != nil {
+		keepSession = true
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash video", err)
+		return
+	}
+	f, err := os.Open(dataPath)
+	if err != nil {
+		keepSession = true
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open video", err)
+		return
+	}
+	defer f.Close()
+
+	w, finishIdempotent, ok := cfg.beginIdempotentUpload(w, r, logger, upload.UserID, vid.ID, checksum)
+	if !ok {
+		return
+	}
+	defer finishIdempotent()
+
+	videoUpload := videoUpload{
+		video:          vid,
+		userID:         upload.UserID,
+		profileName:    profileName,
+		profile:        profile,
+		mediaType:      upload.MediaType,
+		staging:        upload.Staging,
+		encodeDeadline: upload.EncodeDeadline,
+		file:           f,
+		checksum:       checksum,
+		filename:       upload.Filename,
+		bucket:         bucket,
+		userAgent:      sanitizeClientValue(r.UserAgent(), maxUserAgentLength),
+		uploadIP:       cfg.clientIP(r),
+	}
+	handedOff = true
+	if cfg.processingQueue != nil {
+		keepSession = true
+		if cfg.queueVideoUpload(w, r, logger, videoUpload) {
+			// The job owns the received bytes from here on
+			cfg.resumableUploads.release(upload.ID)
+		}
+		return
+	}
+	// A finish retried after a failure may have left a processed copy behind
+	os.Remove(dataPath + processingSuffix)
+	// A client that gives up waiting doesn't abandon a half-stored upload
+	ctx, cancel := workContext(r)
+	defer cancel()
+	resp, err := cfg.runVideoUpload(ctx, logger, videoUpload)
+	if err != nil {
+		keepSession = retryableUploadError(err)
+		respondWithUploadError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// retryableUploadError reports whether an upload failed for reasons of our
+// own, such as S3 being unavailable, so that sending it again may succeed.
+func retryableUploadError(err error) bool {
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		return uploadErr.status >= 500 || uploadErr.status == http.StatusFailedDependency
+	}
+	return true
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma separated
+// pairs of a key and a base64 value.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// chunkOffset reads where a chunk starts from Upload-Offset or, for clients
+// that don't speak tus, the start of its Content-Range.
+func chunkOffset(h http.Header) (int64, error) {
+	if v := h.Get("Upload-Offset"); v != "" {
+		return strconv.ParseInt(v, 10, 64)
+	}
+	contentRange, ok := strings.CutPrefix(h.Get("Content-Range"), "bytes ")
+	if !ok {
+		return 0, errors.New("missing Upload-Offset or Content-Range")
+	}
+	start, _, ok := strings.Cut(contentRange, "-")
+	if !ok {
+		return 0, fmt.Errorf("malformed Content-Range %q", contentRange)
+	}
+	return strconv.ParseInt(start, 10, 64)
+}
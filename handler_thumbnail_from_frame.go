@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerThumbnailFromFrame makes the frame at a chosen time the video's
+// thumbnail.
+func (cfg *apiConfig) handlerThumbnailFromFrame(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		TimestampSeconds *float64 `json:"timestampSeconds"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateRequestJWT(r, token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1024)
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.TimestampSeconds == nil {
+		respondWithError(w, http.StatusBadRequest, "timestampSeconds is required", nil)
+		return
+	}
+	seconds := *params.TimestampSeconds
+	if seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		respondWithError(w, http.StatusBadRequest, "timestampSeconds must be a number of seconds from the start", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video has no media yet", nil)
+		return
+	}
+	// Caught here when the duration is known, to save downloading the media
+	if video.Duration > 0 && seconds >= video.Duration {
+		respondWithError(w, http.StatusBadRequest, errFrameOutOfRange.Error(), nil)
+		return
+	}
+
+	at := time.Duration(seconds * float64(time.Second))
+	video, err = cfg.thumbnailFromFrame(r.Context(), video, at)
+	if errors.Is(err, errFrameOutOfRange) {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if errors.Is(err, database.ErrVideoModified) {
+		respondWithError(w, http.StatusConflict, "video was modified concurrently", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't make thumbnail", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.signVideoForResponse(r.Context(), video))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerThumbnailRegenerate(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateRequestJWT(r, token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+	logger := requestLogger(r).With("operation", "regenerate_thumbnail", "video_id", videoID, "user_id", userID)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video has no media yet", nil)
+		return
+	}
+	bucket, key, err := cfg.parseS3Key(*video.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate video media", err)
+		return
+	}
+
+	head, err := cfg.s3Client.HeadObject(r.Context(), &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusFailedDependency, "Unable to read video media", err)
+		return
+	}
+
+	// Large files take a while to pull down, so don't hold the request open
+	if head.ContentLength != nil && *head.ContentLength > cfg.thumbnailRegenAsyncBytes {
+		started := cfg.backgroundTasks.start(func(ctx context.Context) {
+			// The video may have been edited while the task waited to run
+			video, err := cfg.db.GetVideo(videoID)
+			if err != nil {
+				logger.Error("couldn't get video for thumbnail", "error", err)
+				return
+			}
+			if _, err := cfg.regenerateThumbnail(ctx, video); err != nil {
+				logger.Error("couldn't regenerate thumbnail", "error", err)
+			}
+		})
+		if !started {
+			respondWithError(w, http.StatusServiceUnavailable, "Server is shutting down", nil)
+			return
+		}
+		respondWithJSON(w, http.StatusAccepted, cfg.signVideoForResponse(r.Context(), video))
+		return
+	}
+
+	video, err = cfg.regenerateThumbnail(r.Context(), video)
+	if errors.Is(err, database.ErrVideoModified) {
+		respondWithError(w, http.StatusConflict, "video was modified concurrently", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't regenerate thumbnail", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.signVideoForResponse(r.Context(), video))
+}
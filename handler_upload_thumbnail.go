@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -10,6 +16,7 @@ import (
 	"os"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
@@ -17,54 +24,151 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
 		return
 	}
 
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateRequestJWT(r, token)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithJWTError(w, err)
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
+	logger := requestLogger(r).With("operation", "upload_thumbnail", "video_id", videoID, "user_id", userID)
+	logger.Info("uploading thumbnail")
 
-	const maxMemory = 10 << 20 // 10 MB
-	r.ParseMultipartForm(int64(maxMemory))
+	var (
+		file      io.ReadSeeker
+		size      int64
+		mediaType string
+	)
+	if requestType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); requestType == "application/json" {
+		// Clients drawing on a canvas send the image as a base64 data URL.
+		// The body limit allows for the encoding; the decoded image is held
+		// to the same limit as a multipart upload
+		r.Body = http.MaxBytesReader(w, r.Body, dataURLBodyLimit(cfg.maxThumbnailBytes))
+		var params struct {
+			Thumbnail string `json:"thumbnail"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Thumbnail exceeds %d byte limit", cfg.maxThumbnailBytes), err)
+				return
+			}
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Couldn't decode parameters", err)
+			return
+		}
+		if params.Thumbnail == "" {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeFileRequired, "thumbnail is required", nil)
+			return
+		}
+		declared, decoded, err := parseDataURL(params.Thumbnail)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidDataURL, "thumbnail must be a base64 data URL", err)
+			return
+		}
+		if int64(len(decoded)) > cfg.maxThumbnailBytes {
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Thumbnail exceeds %d byte limit", cfg.maxThumbnailBytes), nil)
+			return
+		}
+		file, size, mediaType = bytes.NewReader(decoded), int64(len(decoded)), declared
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.maxThumbnailBytes)
 
-	file, header, err := r.FormFile("thumbnail")
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
-		return
+		// Parts up to the limit stay in memory instead of spilling to temp files
+		err = r.ParseMultipartForm(cfg.thumbnailMemoryLimit)
+		defer removeMultipartFiles(r)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Thumbnail exceeds %d byte limit", cfg.maxThumbnailBytes), err)
+				return
+			}
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Invalid multipart form", err)
+			return
+		}
+
+		formFile, header, err := r.FormFile("thumbnail")
+		if errors.Is(err, http.ErrMissingFile) {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeFileRequired, "thumbnail file is required", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to parse form file", err)
+			return
+		}
+		defer formFile.Close()
+
+		mediaType, _, err = mime.ParseMediaType(header.Header.Get("Content-Type"))
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidContentType, "Invalid Content-Type", err)
+			return
+		}
+		file, size = formFile, header.Size
 	}
-	defer file.Close()
 
-	contentType := header.Header.Get("Content-Type")
-	mediaType, _, err := mime.ParseMediaType(contentType)
+	if mediaType != "image/jpeg" && mediaType != "image/png" && !convertedThumbnailTypes[mediaType] {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFileType, "Invalid file type", nil)
+		return
+	}
+	// The declared type is client-controlled; the bytes have to agree
+	sniffed, err := sniffMediaType(file)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
+		respondWithError(w, http.StatusInternalServerError, "Unable to read file", err)
+		return
+	}
+	if sniffed != mediaType {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeContentTypeMismatch, "File contents don't match its Content-Type", fmt.Errorf("declared %s, found %s", mediaType, sniffed))
 		return
 	}
-	if mediaType != "image/jpeg" && mediaType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+	if err := checkThumbnailDimensions(file, cfg.maxThumbnailDimension); err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidImage, "Thumbnail dimensions are too large or unreadable", err)
 		return
 	}
+	cfg.metrics.uploadedBytes.add(float64(size), "thumbnail", mediaType)
 
 	vid, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Video not found", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
 	if vid.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "The authenticated user is not the video owner", nil)
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotOwner, "The authenticated user is not the video owner", nil)
+		return
+	}
+
+	ok, err := cfg.withinStorageQuota(userID, vid.ThumbnailSize, size)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return
+	}
+	if !ok {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeQuotaExceeded, "Storage quota exceeded", nil)
+		return
+	}
+
+	// WebP, GIF and oversized thumbnails are stored as a scaled JPEG, so the
+	// asset is named for the converted format
+	data, err := normalizeThumbnail(file, mediaType, cfg.thumbnailMaxEdge, cfg.thumbnailJPEGQuality)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidImage, "Couldn't convert thumbnail", err)
 		return
 	}
+	converted := data != nil
+	if converted {
+		mediaType = "image/jpeg"
+	}
 
 	randBytes := make([]byte, 32)
 	if _, err := rand.Read(randBytes); err != nil {
@@ -73,28 +177,148 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	}
 	randStr := base64.RawURLEncoding.EncodeToString(randBytes)
 
-	assetPath := getAssetPath(randStr, mediaType)
-	assetDiskPath := cfg.getAssetDiskPath(assetPath)
-
-	dst, err := os.Create(assetDiskPath)
+	assetPath, err := cfg.getAssetPath(randStr, mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't name thumbnail file", err)
 		return
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Saving file failed", err)
-		return
+	// Small thumbnails are hashed and watermarked in memory and stored from
+	// there without touching a temp file; larger ones are spooled to their
+	// work path and processed there
+	var (
+		// Empty while the thumbnail is only in memory
+		thumbPath string
+		written   int64
+	)
+	switch {
+	case converted:
+		// Already decoded and re-encoded in memory
+	case size <= cfg.thumbnailMemoryLimit:
+		data, err = io.ReadAll(file)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Reading file failed", err)
+			return
+		}
+	default:
+		thumbPath, err = cfg.thumbnailWorkPath(assetPath)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't name thumbnail file", err)
+			return
+		}
+		if cfg.thumbnailStorage == thumbnailStorageS3 {
+			defer os.Remove(thumbPath)
+		}
+		dst, err := os.Create(thumbPath)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
+			return
+		}
+		written, err = io.Copy(dst, file)
+		dst.Close()
+		if err != nil {
+			os.Remove(thumbPath)
+			respondWithError(w, http.StatusInternalServerError, "Saving file failed", err)
+			return
+		}
+	}
+
+	// Reusing the same stock image across many videos is a spam signal
+	vid.ThumbnailHash = ""
+	if cfg.duplicateThumbnailPolicy != duplicateThumbnailOff {
+		var hash uint64
+		if data != nil {
+			hash, err = thumbnailHashFrom(bytes.NewReader(data))
+		} else {
+			hash, err = thumbnailHash(thumbPath)
+		}
+		if err != nil {
+			os.Remove(thumbPath)
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidImage, "Couldn't read thumbnail image", err)
+			return
+		}
+		stored, err := cfg.db.GetThumbnailHashes(userID, vid.ID)
+		if err != nil {
+			os.Remove(thumbPath)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't compare thumbnail", err)
+			return
+		}
+		if d := closestThumbnailHash(hash, stored); d != -1 && d <= cfg.duplicateThumbnailThreshold {
+			if cfg.duplicateThumbnailPolicy == duplicateThumbnailReject {
+				os.Remove(thumbPath)
+				respondWithErrorCode(w, http.StatusUnprocessableEntity, errCodeThumbnailTooSimilar, "Thumbnail is too similar to one used on another of your videos", nil)
+				return
+			}
+			logger.Info("thumbnail is close to another of the user's thumbnails", "distance_bits", d)
+		}
+		vid.ThumbnailHash = formatThumbnailHash(hash)
 	}
 
-	url := cfg.getAssetURL(assetPath)
+	if data != nil {
+		data, err = cfg.watermarkThumbnailData(data, mediaType, userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't watermark thumbnail", err)
+			return
+		}
+		written = int64(len(data))
+	} else if cfg.thumbnailWatermark != nil {
+		if err := cfg.watermarkThumbnail(thumbPath, mediaType, userID); err != nil {
+			os.Remove(thumbPath)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't watermark thumbnail", err)
+			return
+		}
+		info, err := os.Stat(thumbPath)
+		if err != nil {
+			os.Remove(thumbPath)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't stat thumbnail", err)
+			return
+		}
+		written = info.Size()
+	}
+
+	var url string
+	if data != nil {
+		url, err = cfg.storeThumbnailData(r.Context(), data, assetPath, mediaType)
+	} else {
+		url, err = cfg.storeThumbnail(r.Context(), thumbPath, assetPath, mediaType)
+	}
+	if err != nil {
+		os.Remove(thumbPath)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store thumbnail", err)
+		return
+	}
+	if cfg.versionAssetURLs {
+		contentHash := ""
+		if data != nil {
+			sum := sha256.Sum256(data)
+			contentHash = hex.EncodeToString(sum[:])
+		} else if contentHash, err = hashFile(thumbPath); err != nil {
+			cfg.removeThumbnailAsset(context.Background(), url)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't hash thumbnail", err)
+			return
+		}
+		url = cfg.versionURL(url, contentHash)
+	}
+	oldURL, oldSource := vid.ThumbnailURL, vid.ThumbnailSource
 	vid.ThumbnailURL = &url
+	vid.ThumbnailSource = database.ThumbnailSourceUser
+	if cfg.trackFileSizes {
+		vid.ThumbnailSize = written
+	}
 
 	if err := cfg.db.UpdateVideo(vid); err != nil {
+		cfg.removeThumbnailAsset(context.Background(), url)
+		if errors.Is(err, database.ErrVideoModified) {
+			respondWithErrorCode(w, http.StatusConflict, errCodeVideoModified, "video was modified concurrently", err)
+			return
+		}
 		respondWithError(w, http.StatusInternalServerError, "Unable to update video", err)
 		return
 	}
+	// The placeholder is shared by every video showing it
+	if oldURL != nil && *oldURL != url && oldSource != database.ThumbnailSourcePlaceholder {
+		cfg.removeThumbnailAsset(context.Background(), *oldURL)
+	}
 
-	respondWithJSON(w, http.StatusOK, vid)
+	respondWithJSON(w, http.StatusOK, cfg.signVideoForResponse(r.Context(), vid))
 }
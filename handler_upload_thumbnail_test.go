@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func testPNG(t testing.TB, size int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for x := range size {
+		for y := range size {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x ^ y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testJPEG(t testing.TB, size int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, size, size)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func thumbnailUploadRequest(t testing.TB, videoID, token string, image []byte) *http.Request {
+	t.Helper()
+	return thumbnailUploadRequestAs(t, videoID, token, "image/png", image)
+}
+
+// thumbnailUploadRequestAs uploads the image declared as mediaType.
+func thumbnailUploadRequestAs(t testing.TB, videoID, token, mediaType string, image []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="thumbnail"; filename="thumb"`},
+		"Content-Type":        {mediaType},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(image)
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/thumbnail_upload/"+videoID, &body)
+	r.SetPathValue("videoID", videoID)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func newThumbnailTestConfig(t testing.TB) *apiConfig {
+	t.Helper()
+	cfg, _ := newTestConfig(t)
+	cfg.maxThumbnailBytes = 10 << 20
+	cfg.thumbnailMemoryLimit = 1 << 20
+	cfg.maxThumbnailDimension = 4096
+	cfg.thumbnailMaxEdge = 1920
+	cfg.thumbnailJPEGQuality = 85
+	cfg.duplicateThumbnailPolicy = duplicateThumbnailOff
+	return cfg
+}
+
+func TestUploadThumbnailReplacesPlaceholder(t *testing.T) {
+	cfg := newThumbnailTestConfig(t)
+	cfg.thumbnailPlaceholderURL = "https://cdn.example.com/placeholder.png"
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+	cfg.applyThumbnailPlaceholder(&video)
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video.ID.String(), token, testPNG(t, 16)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	got, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ThumbnailSource != database.ThumbnailSourceUser {
+		t.Errorf("thumbnail source = %q, want %q", got.ThumbnailSource, database.ThumbnailSourceUser)
+	}
+	if got.ThumbnailURL == nil || *got.ThumbnailURL == cfg.thumbnailPlaceholderURL {
+		t.Errorf("thumbnail URL = %v, want the uploaded image", got.ThumbnailURL)
+	}
+}
+
+func TestUploadThumbnailFormErrors(t *testing.T) {
+	cfg := newThumbnailTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	want := map[string]string{
+		"no file part":        errCodeFileRequired,
+		"file in other field": errCodeFileRequired,
+		"malformed multipart": errCodeInvalidForm,
+	}
+	for name, r := range formErrorRequests(t, "/api/thumbnail_upload/", video.ID.String(), token) {
+		w := httptest.NewRecorder()
+		cfg.handlerUploadThumbnail(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d: %s", name, w.Code, http.StatusBadRequest, w.Body)
+			continue
+		}
+		if code := errorCode(t, w); code != want[name] {
+			t.Errorf("%s: code %q, want %q", name, code, want[name])
+		}
+	}
+}
+
+func TestUploadThumbnailRejectsOversizedBody(t *testing.T) {
+	cfg := newThumbnailTestConfig(t)
+	cfg.maxThumbnailBytes = 1 << 10
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video.ID.String(), token, testPNG(t, 256)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusRequestEntityTooLarge, w.Body)
+	}
+	if code := errorCode(t, w); code != errCodeFileTooLarge {
+		t.Errorf("code %q, want %q", code, errCodeFileTooLarge)
+	}
+}
+
+func TestUploadThumbnailRemovesMultipartFiles(t *testing.T) {
+	cfg := newThumbnailTestConfig(t)
+	t.Setenv("TMPDIR", t.TempDir())
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	// Over the memory limit but under the size limit, so the part is
+	// spilled to disk
+	data := bytes.Repeat([]byte{0}, int(cfg.thumbnailMemoryLimit)*2)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, thumbnailUploadRequestAs(t, video.ID.String(), token, "image/gif", data))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	assertEmptyDir(t, os.TempDir())
+}
+
+func TestUploadThumbnailStoresSize(t *testing.T) {
+	for _, track := range []bool{true, false} {
+		t.Run(fmt.Sprintf("tracking %v", track), func(t *testing.T) {
+			cfg := newThumbnailTestConfig(t)
+			cfg.trackFileSizes = track
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID)
+			image := testPNG(t, 16)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video.ID.String(), token, image))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			want := int64(0)
+			if track {
+				want = int64(len(image))
+			}
+			var resp database.Video
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.ThumbnailSize != want {
+				t.Errorf("response thumbnail_size = %d, want %d", resp.ThumbnailSize, want)
+			}
+			got, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ThumbnailSize != want {
+				t.Errorf("stored thumbnail size = %d, want %d", got.ThumbnailSize, want)
+			}
+		})
+	}
+}
+
+func TestUploadSmallThumbnailWithoutTempFiles(t *testing.T) {
+	for _, storage := range []string{thumbnailStorageDisk, thumbnailStorageS3} {
+		t.Run(storage, func(t *testing.T) {
+			cfg := newThumbnailTestConfig(t)
+			cfg.thumbnailStorage = storage
+			// Any temp file, whether a spilled multipart part or a work
+			// file, would fail to be created in a directory that's missing
+			missing := filepath.Join(t.TempDir(), "missing")
+			t.Setenv("TMPDIR", missing)
+			cfg.uploadTempDir = missing
+
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video.ID.String(), token, testPNG(t, 64)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestUploadLargeThumbnailIsSpooled(t *testing.T) {
+	cfg := newThumbnailTestConfig(t)
+	cfg.thumbnailStorage = thumbnailStorageS3
+	cfg.thumbnailMemoryLimit = 1
+	cfg.uploadTempDir = filepath.Join(t.TempDir(), "missing")
+
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video.ID.String(), token, testPNG(t, 64)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want the spool to a missing directory to fail", w.Code)
+	}
+}
+
+func BenchmarkUploadThumbnail(b *testing.B) {
+	for _, tc := range []struct {
+		name        string
+		memoryLimit int64
+	}{
+		{"memory", 1 << 20},
+		{"disk", 1},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			cfg := newThumbnailTestConfig(b)
+			cfg.thumbnailStorage = thumbnailStorageS3
+			cfg.thumbnailMemoryLimit = tc.memoryLimit
+			user, token := createTestUser(b, cfg, "owner@example.com")
+			video := createTestVideo(b, cfg, user.ID)
+			image := testPNG(b, 256)
+
+			b.ResetTimer()
+			for range b.N {
+				b.StopTimer()
+				r := thumbnailUploadRequest(b, video.ID.String(), token, image)
+				w := httptest.NewRecorder()
+				b.StartTimer()
+				cfg.handlerUploadThumbnail(w, r)
+				if w.Code != http.StatusOK {
+					b.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadThumbnailSniffsContentType(t *testing.T) {
+	tests := []struct {
+		name       string
+		declared   string
+		image      func(testing.TB, int) []byte
+		wantStatus int
+	}{
+		{"png", "image/png", testPNG, http.StatusOK},
+		{"jpeg", "image/jpeg", testJPEG, http.StatusOK},
+		{"jpeg disguised as png", "image/png", testJPEG, http.StatusBadRequest},
+		{"png disguised as jpeg", "image/jpeg", testPNG, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newThumbnailTestConfig(t)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(w, thumbnailUploadRequestAs(t, video.ID.String(), token, tc.declared, tc.image(t, 32)))
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if tc.wantStatus == http.StatusOK {
+				return
+			}
+			if code := errorCode(t, w); code != errCodeContentTypeMismatch {
+				t.Errorf("code %q, want %q", code, errCodeContentTypeMismatch)
+			}
+		})
+	}
+}
+
+func TestUploadThumbnailRemovesReplacedAsset(t *testing.T) {
+	cfg := newThumbnailTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	upload := func() string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video.ID.String(), token, testPNG(t, 16)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		got, err := cfg.db.GetVideo(video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assetPath, ok := cfg.assetPathFromURL(*got.ThumbnailURL)
+		if !ok {
+			t.Fatalf("thumbnail %s isn't a local asset", *got.ThumbnailURL)
+		}
+		diskPath, err := cfg.getAssetDiskPath(assetPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return diskPath
+	}
+
+	first := upload()
+	second := upload()
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Errorf("replaced thumbnail is still on disk: %v", err)
+	}
+	if _, err := os.Stat(second); err != nil {
+		t.Errorf("new thumbnail is missing: %v", err)
+	}
+}
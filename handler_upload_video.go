@@ -1,214 +1,831 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math"
+	"log/slog"
 	"mime"
 	"net/http"
 	"os"
-	"os/exec"
+	"path"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+type videoUploadResponse struct {
+	database.Video
+	Processed         bool   `json:"processed"`
+	EncodePreset      string `json:"encode_preset,omitempty"`
+	ProcessingProfile string `json:"processing_profile"`
+}
+
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	const uploadLimit = 1 << 30 // 1 GB
-	http.MaxBytesReader(w, r.Body, uploadLimit)
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoUploadBytes)
 
 	// Get video id
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
 		return
 	}
 
 	// Authenticate the user
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := cfg.validateRequestJWT(r, token)
+	if err != nil {
+		respondWithJWTError(w, err)
 		return
 	}
+	logger := requestLogger(r).With("operation", "upload_video", "video_id", videoID, "user_id", userID)
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	bucket, err := cfg.bucketForRequest(r)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithBucketOverrideError(w, err)
 		return
 	}
 
 	// Get the video metadata from the database, if the user is not the video owner, return 401
 	vid, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Video not found", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
 	if vid.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "The authenticated user is not the video owner", nil)
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotOwner, "The authenticated user is not the video owner", nil)
+		return
+	}
+
+	// Only one upload of a video can be processing at a time; the later one
+	// would fail when it saves the video anyway. Clients can poll the status
+	// from here on. An upload turned away before it's processed leaves the
+	// video as it was.
+	claimed, err := cfg.db.ClaimVideoUpload(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if !claimed {
+		respondWithErrorCode(w, http.StatusConflict, errCodeAlreadyProcessing, "An upload for this video is already processing", nil)
+		return
+	}
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			cfg.setProcessingStatus(videoID, vid.ProcessingStatus, vid.ErrorMessage)
+		}
+	}()
+
+	// Enterprise API keys and paid plans get heavier processing
+	profileName, profile, err := cfg.profileFor(r, userID)
+	if err != nil {
+		respondWithProfileError(w, err)
 		return
 	}
 
+	// Count the body as it arrives so clients can poll upload-progress
+	progress := cfg.uploadProgress.start(videoID, r.ContentLength)
+	defer cfg.uploadProgress.finish(videoID, progress)
+	r.Body = progressReader{ReadCloser: r.Body, progress: progress}
+
 	// Parse the uploaded video file from the form data
+	const maxMemory = 32 << 20
+	err = r.ParseMultipartForm(maxMemory)
+	defer removeMultipartFiles(r)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("File exceeds %d byte limit", cfg.maxVideoUploadBytes), err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Invalid multipart form", err)
+		return
+	}
 	file, header, err := r.FormFile("video")
+	if errors.Is(err, http.ErrMissingFile) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeFileRequired, "video file is required", err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't parse form file", err)
 		return
 	}
 	defer file.Close()
 
-	// Validate the uploaded video file to ensure it's an MP4 video
+	// The new media replaces whatever the video has now
+	ok, err := cfg.withinStorageQuota(userID, vid.FileSize, header.Size)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return
+	}
+	if !ok {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeQuotaExceeded, "Storage quota exceeded", nil)
+		return
+	}
+
+	// Staged uploads stay out of the live prefix until they're promoted
+	staging := false
+	if v := r.FormValue("staging"); v != "" {
+		staging, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid staging flag", err)
+			return
+		}
+	}
+
+	// Time-sensitive uploads trade encode quality for speed past this deadline
+	encodeDeadline := cfg.encodeDeadline
+	if v := r.FormValue("encode_deadline"); v != "" {
+		encodeDeadline, err = time.ParseDuration(v)
+		if err != nil || encodeDeadline <= 0 {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid encode deadline", err)
+			return
+		}
+	}
+
+	// Validate the uploaded video file's type; it's checked against the
+	// actual contents once probed
 	contentType := header.Header.Get("Content-Type")
 	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidContentType, "Invalid Content-Type", err)
 		return
 	}
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+	if !cfg.acceptsVideoType(mediaType) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFileType, "Invalid file type", nil)
 		return
 	}
 
 	// Save the uploaded file to a temporary file on disk
-	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	tempFile, cleanupTemp, err := createUploadTemp(cfg.uploadTempDir)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create temporary file", err)
 		return
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
-
-	io.Copy(tempFile, file)
-
-	// Pre-process the video for fast start (by moving the moov atom to the start)
-	processedFilePath, err := processVideoForFastStart(tempFile.Name())
+	// A queued upload's file belongs to its job from then on
+	queued := false
+	defer func() {
+		if !queued {
+			cleanupTemp()
+		}
+	}()
+
+	// The body was read in full when the form was parsed, so the size limit
+	// has already been enforced. Hash it on the way to disk so the checks
+	// below don't have to read the file again.
+	uploadHasher := sha256.New()
+	received, err := io.Copy(io.MultiWriter(tempFile, uploadHasher), file)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save video", err)
+		return
+	}
+	cfg.metrics.uploadedBytes.add(float64(received), "video", mediaType)
+	uploadChecksum := hex.EncodeToString(uploadHasher.Sum(nil))
+	// ffmpeg and ffprobe open the file by path, so it has to be complete on disk
+	if err := tempFile.Sync(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save video", err)
 		return
 	}
-	defer os.Remove(processedFilePath)
 
-	processedFile, err := os.Open(processedFilePath)
+	w, finishIdempotent, ok := cfg.beginIdempotentUpload(w, r, logger, userID, videoID, uploadChecksum)
+	if !ok {
+		return
+	}
+	defer finishIdempotent()
+
+	upload := videoUpload{
+		video:          vid,
+		userID:         userID,
+		profileName:    profileName,
+		profile:        profile,
+		mediaType:      mediaType,
+		staging:        staging,
+		encodeDeadline: encodeDeadline,
+		file:           tempFile,
+		checksum:       uploadChecksum,
+		filename:       header.Filename,
+		bucket:         bucket,
+		userAgent:      sanitizeClientValue(r.UserAgent(), maxUserAgentLength),
+		uploadIP:       cfg.clientIP(r),
+	}
+	if cfg.processingQueue != nil {
+		handedOff = true
+		queued = cfg.queueVideoUpload(w, r, logger, upload)
+		return
+	}
+	handedOff = true
+	// A client that gives up waiting doesn't abandon a half-stored upload
+	ctx, cancel := workContext(r)
+	defer cancel()
+	resp, err := cfg.runVideoUpload(ctx, logger, upload)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed file", err)
+		respondWithUploadError(w, err)
 		return
 	}
-	defer processedFile.Close()
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// beginIdempotentUpload applies the request's Idempotency-Key to an upload
+// received in full; the key can't be checked against the payload any
+// sooner. A retried request gets the response to the first one, in which
+// case it reports false. Otherwise the caller responds through the returned
+// writer and calls finish once it has.
+func (cfg *apiConfig) beginIdempotentUpload(w http.ResponseWriter, r *http.Request, logger *slog.Logger, userID, videoID uuid.UUID, checksum string) (http.ResponseWriter, func(), bool) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" || cfg.idempotentUploads == nil {
+		return w, func() {}, true
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeIdempotencyKeyTooLong, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength), nil)
+		return w, nil, false
+	}
+	key = idempotentUploadKey(userID, key)
+	fingerprint := videoID.String() + ":" + checksum
+	entry, claimed := cfg.idempotentUploads.claim(key, fingerprint)
+	if !claimed {
+		logger.Info("repeated idempotency key")
+		cfg.replayIdempotentUpload(w, r, entry, fingerprint)
+		return w, nil, false
+	}
+	if entry == nil {
+		logger.Warn("too many idempotency keys in use, not tracking this one")
+		return w, func() {}, true
+	}
+	recorder := &recordingResponseWriter{ResponseWriter: w}
+	return recorder, func() { cfg.idempotentUploads.finish(key, entry, recorder) }, true
+}
+
+// videoUpload is an upload saved to disk in full, ready to be checked,
+// processed and stored.
+type videoUpload struct {
+	video          database.Video
+	userID         uuid.UUID
+	profileName    string
+	profile        processingProfile
+	mediaType      string
+	staging        bool
+	encodeDeadline time.Duration
+	file           *os.File
+	checksum       string
+	filename       string
+	// Taken from the upload request, which may be long gone by the time
+	// the upload is processed
+	bucket    string
+	userAgent string
+	uploadIP  string
+}
+
+// uploadError is an upload that couldn't be processed, along with the
+// response it maps to.
+type uploadError struct {
+	status  int
+	code    string
+	message string
+	err     error
+}
+
+func uploadFailure(status int, message string, err error) error {
+	return uploadFailureCode(status, defaultErrorCode(status), message, err)
+}
+
+func uploadFailureCode(status int, code, message string, err error) error {
+	return &uploadError{status: status, code: code, message: message, err: err}
+}
+
+// s3UploadFailure describes a failed upload of the processed video to S3.
+func s3UploadFailure(err error) error {
+	if isS3ChecksumMismatch(err) {
+		return uploadFailureCode(http.StatusBadGateway, errCodeUploadCorrupted, "Video was corrupted on its way to S3, please try again", err)
+	}
+	return uploadFailureCode(http.StatusFailedDependency, errCodeStorageFailed, "Unable to upload to S3", err)
+}
+
+func (e *uploadError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
 
+func (e *uploadError) Unwrap() error {
+	return e.err
+}
+
+// respondWithUploadError writes the response for an upload processVideoUpload
+// rejected.
+func respondWithUploadError(w http.ResponseWriter, err error) {
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		respondWithErrorCode(w, uploadErr.status, uploadErr.code, uploadErr.message, uploadErr.err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, genericProcessingError, err)
+}
+
+// processVideoUpload runs a saved upload through scanning, validation and
+// processing, stores the result in S3 and returns the updated video.
+func (cfg *apiConfig) processVideoUpload(ctx context.Context, logger *slog.Logger, upload videoUpload) (videoUploadResponse, error) {
+	vid := upload.video
+	videoID := vid.ID
+	userID := upload.userID
+	profileName, profile := upload.profileName, upload.profile
+	mediaType := upload.mediaType
+	staging := upload.staging
+	encodeDeadline := upload.encodeDeadline
+	tempFile := upload.file
+	uploadChecksum := upload.checksum
+	var err error
+
+	// Collapse a double-posted upload into the first one
+	uploadSucceeded := false
+	if cfg.recentUploads != nil {
+		key := recentUploadKey(userID, uploadChecksum, upload.filename)
+		entry, claimed := cfg.recentUploads.claim(key, videoID)
+		if claimed {
+			defer func() { cfg.recentUploads.finish(key, entry, uploadSucceeded) }()
+		} else {
+			succeeded, err := entry.wait(ctx)
+			if err != nil {
+				return videoUploadResponse{}, uploadFailureCode(http.StatusServiceUnavailable, errCodeDuplicateUploadTimeout, "Gave up waiting for identical upload", err)
+			}
+			if succeeded {
+				existing, err := cfg.db.GetVideo(entry.videoID)
+				if err == nil && existing.VideoURL != nil {
+					logger.Info("duplicate of recent upload", "original_video_id", entry.videoID)
+					return videoUploadResponse{Video: cfg.signVideoForResponse(ctx, existing)}, nil
+				}
+			}
+		}
+	}
+
+	check, err := cfg.checkVideoFile(ctx, userID, vid.FileSize, tempFile, mediaType)
+	if err != nil {
+		return videoUploadResponse{}, err
+	}
+	probe := check.probe
+	vid.StillImage = check.stillImage
+	if check.stillImage {
+		logger.Info("flagged as a still image", "duration", probe.duration())
+	}
+
+	// Every ffprobe and quick ffmpeg run below is bounded by the media tool
+	// timeout, so a malformed file can't pin the handler
+	mediaCtx := cfg.mediaContext(ctx)
+
+	vid.UploadUserAgent = upload.userAgent
+	vid.UploadIP = upload.uploadIP
+
+	// Re-uploads of our own output can reuse the stored media. The marker only
+	// triggers the lookup; the checksum must match media we actually stored
+	// for this user.
+	if probe.Format.Tags["comment"] == processedMarker && !staging {
+		existing, err := cfg.db.GetVideoByContentHash(userID, uploadChecksum)
+		if err != nil {
+			return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't look up video", err)
+		}
+		var bucket, srcKey string
+		unlockMedia := func() {}
+		if existing.VideoURL != nil {
+			bucket, srcKey, err = cfg.parseS3Key(*existing.VideoURL)
+			if err != nil {
+				return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't locate stored media", err)
+			}
+			// Held until this video references the media, so purging the
+			// original in the meantime can't delete it. A purge that got
+			// there first leaves nothing to reuse.
+			unlockMedia = sync.OnceFunc(cfg.mediaLocks.lock(bucket, srcKey))
+			defer unlockMedia()
+			exists, err := cfg.objectExists(ctx, bucket, srcKey)
+			if err != nil {
+				return videoUploadResponse{}, uploadFailureCode(http.StatusFailedDependency, errCodeStorageFailed, "Unable to check S3 for existing media", err)
+			}
+			if !exists {
+				unlockMedia()
+				existing.VideoURL = nil
+			}
+		}
+		if existing.VideoURL != nil {
+			logger.Info("re-upload of stored output, reusing its media", "original_video_id", existing.ID)
+			replacedURL := vid.VideoURL
+			videoURL := *existing.VideoURL
+			// A deterministic key belongs to a single video, so the media is
+			// copied rather than shared with one whose next upload would
+			// overwrite it
+			if cfg.deterministicVideoKeys {
+				dstKey, err := cfg.deterministicVideoKey(vid.ID, "video/mp4", staging)
+				if err != nil {
+					return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't name video file", err)
+				}
+				if err := cfg.copyObject(ctx, bucket, srcKey, dstKey); err != nil {
+					return videoUploadResponse{}, uploadFailureCode(http.StatusFailedDependency, errCodeStorageFailed, "Unable to copy stored media", err)
+				}
+				videoURL = cfg.versionURL(cfg.getObjectURL(bucket, dstKey), uploadChecksum)
+			}
+			stale := cfg.detachMediaArtifacts(&vid)
+			vid.VideoURL = &videoURL
+			vid.ContentHash = uploadChecksum
+			vid.DynamicRange = existing.DynamicRange
+			if cfg.trackFileSizes {
+				vid.FileSize = existing.FileSize
+			}
+			vid.Status = database.VideoStatusPublished
+			if vid.ThumbnailURL == nil {
+				cfg.applyThumbnailPlaceholder(&vid)
+			}
+			err := cfg.db.UpdateVideo(vid)
+			unlockMedia()
+			if errors.Is(err, database.ErrVideoModified) {
+				return videoUploadResponse{}, uploadFailureCode(http.StatusConflict, errCodeVideoModified, "video was modified concurrently", err)
+			} else if err != nil {
+				return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Unable to update video", err)
+			}
+			cfg.deleteStaleArtifacts(stale)
+			cfg.discardReplacedMedia(context.Background(), replacedURL, videoURL)
+			uploadSucceeded = true
+			return videoUploadResponse{Video: cfg.signVideoForResponse(ctx, vid)}, nil
+		}
+	}
+
+	fastStart, err := isFastStart(tempFile.Name())
+	if err != nil {
+		return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't inspect video", err)
+	}
+	processing, reason := selectPipeline(probe, fastStart, cfg.maxPassthroughBitRate, cfg.processingPipelines)
+	transcodeOpts := transcodeOptions{
+		preset:     profile.Preset,
+		maxBitRate: cfg.maxPassthroughBitRate,
+	}
+	if profile.MaxBitRate > 0 {
+		transcodeOpts.maxBitRate = profile.MaxBitRate
+	}
+
+	// Long GOPs make seeking choppy and HLS segments huge
+	if cfg.maxKeyframeInterval > 0 {
+		interval, err := maxKeyframeInterval(mediaCtx, tempFile.Name())
+		if err != nil {
+			return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't inspect keyframes", err)
+		}
+		if interval > cfg.maxKeyframeInterval.Seconds() {
+			logger.Info("keyframe interval exceeds limit", "interval", interval, "limit", cfg.maxKeyframeInterval)
+			if cfg.longGOPPolicy == longGOPPolicyReencode {
+				processing = processingTranscode
+				reason = fmt.Sprintf("keyframe interval %.1fs is too long", interval)
+				transcodeOpts.gopSize = probe.gopSizeFor(targetKeyframeInterval)
+			}
+		}
+	}
+	logger.Info("selected processing", "processing", processing, "reason", reason)
+
+	processedFilePath := tempFile.Name()
+	encodePreset := ""
+	// Streamed encodes go straight to S3, so a deadline can't fall back to
+	// another preset once bytes have been sent
+	streamTranscode := processing == processingTranscode && cfg.streamTranscode && encodeDeadline <= 0
+	switch {
+	case streamTranscode:
+		// Encoded further down, directly into the upload
+		encodePreset = transcodeOpts.preset
+	case processing == processingTranscode:
+		done := cfg.metrics.timeMediaStep("transcode")
+		processedFilePath, encodePreset, err = transcodeWithDeadline(ctx, tempFile.Name(), transcodeOpts, encodeDeadline)
+		done()
+		if encodePreset == processingPassthrough {
+			processing = processingPassthrough
+		}
+	case processing == processingFastStart:
+		// Pre-process the video for fast start (by moving the moov atom to the start)
+		done := cfg.metrics.timeMediaStep("faststart")
+		processedFilePath, err = processVideoForFastStart(mediaCtx, tempFile.Name())
+		done()
+	case processing == processingRemux:
+		done := cfg.metrics.timeMediaStep("remux")
+		processedFilePath, err = remuxVideo(mediaCtx, tempFile.Name())
+		done()
+	}
+	if err != nil {
+		return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't process video", err)
+	}
 	// Get the video aspect ratio of the video from the tempFile
-	ratio, err := getVideoAspectRatio(tempFile.Name())
+	ratio, err := probe.aspectRatio()
+	if errors.Is(err, errNoDimensions) && cfg.aspectRatioFallback != "" {
+		logger.Warn("falling back to default aspect ratio", "error", err, "aspect_ratio", cfg.aspectRatioFallback)
+		ratio, err = cfg.aspectRatioFallback, nil
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't parse video aspect ratio", err)
-		return
+		return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't parse video aspect ratio", err)
 	}
 
+	cfg.metrics.videoAspectRatios.inc(aspectRatioClass(ratio))
+
+	// Every pipeline above leaves an mp4, whatever was uploaded
+	mediaType = "video/mp4"
+
 	// Reset the tempFile's file pointer to the beginning
 	tempFile.Seek(0, io.SeekStart)
 
-	// Put the object in S3
-	randBytes := make([]byte, 32)
-	if _, err := rand.Read(randBytes); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Generating rand bytes failed", err)
-		return
+	// Put the object in S3. Processed media is named after its hash, so an
+	// identical re-upload maps onto the object already stored. Streamed
+	// transcodes are only hashed as they upload and get a random name. With
+	// deterministic keys every upload for the video goes to the same key,
+	// whatever its shape, so a replacement overwrites the previous object
+	// instead of orphaning it.
+	if !streamTranscode {
+		if processedFilePath == tempFile.Name() {
+			vid.ContentHash = uploadChecksum
+		} else if vid.ContentHash, err = hashFile(processedFilePath); err != nil {
+			return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't hash processed video", err)
+		}
+	}
+	var fileKey string
+	if cfg.deterministicVideoKeys {
+		fileKey, err = cfg.deterministicVideoKey(vid.ID, mediaType, staging)
+	} else {
+		objectName := vid.ContentHash
+		if streamTranscode {
+			randBytes := make([]byte, 32)
+			if _, err := rand.Read(randBytes); err != nil {
+				return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Generating rand bytes failed", err)
+			}
+			objectName = hex.EncodeToString(randBytes)
+		}
+		fileKey, err = cfg.getAssetPath(objectName, mediaType)
+		fileKey = aspectRatioPrefix(ratio) + fileKey
+		if staging {
+			fileKey = stagingPrefix + fileKey
+		}
+	}
+	if err == nil {
+		err = cfg.checkObjectKey(fileKey)
+	}
+	if err != nil {
+		return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't name video file", err)
 	}
-	fileKey := getAssetPath(hex.EncodeToString(randBytes), mediaType)
 
-	switch ratio {
-	case "16:9":
-		fileKey = "landscape/" + fileKey
-	case "9:16":
-		fileKey = "portrait/" + fileKey
-	default:
-		fileKey = "other/" + fileKey
+	vid.Status = database.VideoStatusPublished
+	if staging {
+		vid.Status = database.VideoStatusStaged
 	}
 
-	_, err = cfg.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
+	bucket := upload.bucket
+	// Identical media shares a key, so the object is held until this video's
+	// reference to it is committed. Otherwise purging another video could
+	// delete it after the existence check below.
+	unlockMedia := sync.OnceFunc(cfg.mediaLocks.lock(bucket, fileKey))
+	defer unlockMedia()
+	putInput := &s3.PutObjectInput{
+		Bucket:      &bucket,
 		Key:         &fileKey,
-		Body:        processedFile,
 		ContentType: &mediaType,
-	})
-	if err != nil {
-		respondWithError(w, http.StatusFailedDependency, "Unable to upload to S3", err)
-		return
+	}
+	// An object under a deterministic key may already back the video, so only
+	// a newly created one is safe to delete if the update below fails
+	ownsObject := !cfg.deterministicVideoKeys
+	var processedSize int64
+	if streamTranscode {
+		processedSize, vid.ContentHash, err = cfg.transcodeToS3(ctx, tempFile.Name(), transcodeOpts, putInput)
+		if errors.Is(err, errTranscodeFailed) {
+			return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't process video", err)
+		}
+		if err != nil {
+			return videoUploadResponse{}, s3UploadFailure(err)
+		}
+	} else {
+		processedFile, err := os.Open(processedFilePath)
+		if err != nil {
+			return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't open processed file", err)
+		}
+		defer processedFile.Close()
+
+		processedInfo, err := processedFile.Stat()
+		if err != nil {
+			return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't stat processed file", err)
+		}
+		processedSize = processedInfo.Size()
+
+		// A deterministic key names the video, not its content, so whatever
+		// is already there has to be overwritten
+		exists := false
+		if !cfg.deterministicVideoKeys {
+			exists, err = cfg.objectExists(ctx, bucket, fileKey)
+			if err != nil {
+				return videoUploadResponse{}, uploadFailureCode(http.StatusFailedDependency, errCodeStorageFailed, "Unable to check S3 for existing media", err)
+			}
+		}
+		if exists {
+			logger.Info("identical media already stored, skipping upload", "key", fileKey)
+			ownsObject = false
+		} else {
+			// A single PutObject can be checked against the hash of the
+			// whole file; multipart uploads are checked part by part
+			if processedSize < cfg.s3Uploader.PartSize {
+				if putInput.ChecksumSHA256, err = objectChecksumSHA256(vid.ContentHash); err != nil {
+					return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Couldn't checksum processed video", err)
+				}
+			}
+			putInput.Body = processedFile
+			if err := cfg.uploadObject(ctx, putInput, processedSize); err != nil {
+				return videoUploadResponse{}, s3UploadFailure(err)
+			}
+		}
+	}
+	if cfg.trackFileSizes {
+		vid.FileSize = processedSize
+	}
+	vid.Duration = probe.duration()
+	// Our encodes are 8-bit BT.709 and drop HDR signalling, so only media we
+	// didn't re-encode keeps the source's dynamic range
+	vid.DynamicRange = database.DynamicRangeSDR
+	if processing != processingTranscode {
+		vid.DynamicRange = probe.dynamicRange()
+	}
+
+	// Derivatives of the media being replaced are deleted once the new
+	// media is saved
+	stale := cfg.detachMediaArtifacts(&vid)
+
+	// Signed links to the media being replaced must not outlive it
+	replacedURL := vid.VideoURL
+	if vid.VideoURL != nil {
+		if oldBucket, oldKey, err := cfg.parseS3Key(*vid.VideoURL); err == nil {
+			cfg.presignCache.invalidate(oldBucket, oldKey)
+		}
 	}
 
 	// Update the VideoURL of the video record in the database with the S3 bucket and key
-	url := cfg.getCloudFrontURL(fileKey)
+	url := cfg.getObjectURL(bucket, fileKey)
+	url = cfg.versionURL(url, vid.ContentHash)
 	vid.VideoURL = &url
 
-	if err := cfg.db.UpdateVideo(vid); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to update video", err)
-		return
+	// Derivatives are stored per video, even when the media is shared with
+	// another one, so replacing or purging a video never touches another's
+	artifactName := path.Join(vid.ID.String(), path.Base(fileKey))
+	// A staged video's derivatives stay under the staging prefix with its
+	// media, out of what the distribution serves
+	artifactPrefix := ""
+	if staging {
+		artifactPrefix = stagingPrefix
 	}
 
-	respondWithJSON(w, http.StatusOK, vid)
-}
-
-func getVideoAspectRatio(filePath string) (string, error) {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-print_format", "json",
-		"-show_streams", filePath,
-	)
-	buf := bytes.NewBuffer([]byte{})
-	cmd.Stdout = buf
+	// Only what fits under the video's artifact cap is derived
+	var requested []derivation
+	var heights []int
+	if profile.derives(artifactRendition) {
+		heights = renditionHeights(profile.Renditions, probe)
+	}
+	for range heights {
+		requested = append(requested, derivation{kind: artifactRendition, files: 1})
+	}
+	if cfg.spriteOptions.interval > 0 && profile.derives(artifactSprite) {
+		// The sheet and its WebVTT index
+		requested = append(requested, derivation{kind: artifactSprite, files: 2})
+	}
+	allowed, skipped := cfg.planDerivations(vid, requested)
+	if len(skipped) > 0 {
+		logger.Info("artifact cap reached, skipping derivations", "profile", profileName, "skipped", skipped)
+	}
+	heights = heights[:countDerivations(allowed, artifactRendition)]
+
+	// Extra renditions are a nice-to-have; the upload succeeds without them
+	var renditionKeys []string
+	if len(heights) > 0 {
+		renditionKeys, err = cfg.createRenditions(ctx, bucket, tempFile.Name(), artifactPrefix, artifactName, heights)
+		if err != nil {
+			logger.Error("couldn't create renditions", "error", err)
+		}
+		for _, key := range renditionKeys {
+			addArtifact(&vid, artifactRendition, key)
+		}
+		// Renditions named after a deterministic key have just overwritten
+		// the old ones and mustn't be cleaned up with them
+		stale.spare(renditionKeys)
+	}
 
-	err := cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("ffprobe error: %v", err)
+	// The scrub-bar preview is optional in the same way
+	var spriteKeys []string
+	if countDerivations(allowed, artifactSprite) > 0 {
+		spriteKey, vttKey, err := cfg.createSprites(ctx, bucket, tempFile.Name(), artifactPrefix, artifactName, probe)
+		if err != nil {
+			logger.Error("couldn't create sprites", "error", err)
+		} else {
+			spriteKeys = []string{spriteKey, vttKey}
+			spritesURL := cfg.getObjectURL(bucket, spriteKey)
+			spritesVTTURL := cfg.getObjectURL(bucket, vttKey)
+			vid.SpritesURL = &spritesURL
+			vid.SpritesVTTURL = &spritesVTTURL
+			for _, key := range spriteKeys {
+				addArtifact(&vid, artifactSprite, key)
+			}
+			stale.spare(spriteKeys)
+		}
+	}
+	derivedKeys := append(renditionKeys, spriteKeys...)
+
+	generatedThumbnail := ""
+	if vid.ThumbnailURL == nil && cfg.thumbnailMode == thumbnailModeUpload {
+		// A missing thumbnail shouldn't fail an upload that otherwise worked
+		thumbURL, thumbSize, err := cfg.thumbnailFromMedia(ctx, processedFilePath, vid.UserID)
+		if err != nil {
+			logger.Error("couldn't generate thumbnail", "error", err)
+		} else {
+			generatedThumbnail = thumbURL
+			vid.ThumbnailURL = &thumbURL
+			vid.ThumbnailSource = database.ThumbnailSourceAuto
+			if cfg.trackFileSizes {
+				vid.ThumbnailSize = thumbSize
+			}
+		}
 	}
 
-	var output struct {
-		Streams []struct {
-			Width  int `json:"width"`
-			Height int `json:"height"`
-		} `json:"streams"`
+	// Fall back to the placeholder so the UI never shows a broken image
+	if vid.ThumbnailURL == nil {
+		cfg.applyThumbnailPlaceholder(&vid)
 	}
-	err = json.Unmarshal(buf.Bytes(), &output)
+
+	err = cfg.db.UpdateVideo(vid)
+	unlockMedia()
 	if err != nil {
-		return "", fmt.Errorf("could not parse ffprobe output: %v", err)
-	}
-	if len(output.Streams) == 0 {
-		return "", fmt.Errorf("Parsed video stream is empty")
+		if errors.Is(err, database.ErrVideoModified) {
+			// Another request replaced the video first, so what this one
+			// stored would be orphaned
+			if ownsObject {
+				cfg.discardUnreferencedObjects(context.Background(), bucket, url, append([]string{fileKey}, derivedKeys...))
+			}
+			if generatedThumbnail != "" {
+				cfg.removeThumbnailAsset(context.Background(), generatedThumbnail)
+			}
+			return videoUploadResponse{}, uploadFailureCode(http.StatusConflict, errCodeVideoModified, "video was modified concurrently", err)
+		}
+		cfg.deleteObjects(context.Background(), bucket, derivedKeys)
+		return videoUploadResponse{}, uploadFailure(http.StatusInternalServerError, "Unable to update video", err)
 	}
+	cfg.deleteStaleArtifacts(stale)
+	cfg.discardReplacedMedia(context.Background(), replacedURL, url)
+
+	cfg.publishUploadCompleted(uploadCompletedEvent{
+		IdempotencyKey: vid.ID.String() + ":" + vid.ContentHash,
+		VideoID:        vid.ID,
+		UserID:         vid.UserID,
+		Bucket:         bucket,
+		Keys:           []string{fileKey},
+		Duration:       probe.duration(),
+		AspectRatio:    ratio,
+	})
 
-	width := output.Streams[0].Width
-	height := output.Streams[0].Height
-	ratio := float64(width) / float64(height)
+	uploadSucceeded = true
+	return videoUploadResponse{
+		Video:             cfg.signVideoForResponse(ctx, vid),
+		Processed:         processing != processingPassthrough,
+		EncodePreset:      encodePreset,
+		ProcessingProfile: profileName,
+	}, nil
+}
 
-	const horizontal = 16.0 / 9.0
-	const vertical = 9.0 / 16.0
+func processVideoForFastStart(ctx context.Context, inputPath string) (string, error) {
+	return copyToMP4(ctx, inputPath)
+}
 
-	if math.Abs(ratio-horizontal) <= 0.01 {
-		return "16:9", nil
-	} else if math.Abs(ratio-vertical) <= 0.01 {
-		return "9:16", nil
-	} else {
-		return "other", nil
-	}
+// remuxVideo moves the streams of a non-mp4 container into an mp4 without
+// re-encoding them. Only the first video stream and the audio are kept;
+// subtitle formats and attachments from containers like mkv can't be copied
+// into mp4.
+func remuxVideo(ctx context.Context, inputPath string) (string, error) {
+	return copyToMP4(ctx, inputPath, "-map", "0:v:0", "-map", "0:a?")
 }
 
-func processVideoForFastStart(inputPath string) (string, error) {
-	outputPath := inputPath + ".processing"
+// copyToMP4 stream-copies the input into a fast start mp4.
+func copyToMP4(ctx context.Context, inputPath string, mapArgs ...string) (string, error) {
+	outputPath := inputPath + processingSuffix
 
-	cmd := exec.Command("ffmpeg",
-		"-i", inputPath,
+	args := append([]string{"-i", inputPath}, mapArgs...)
+	args = append(args,
 		"-c", "copy",
+		"-metadata", "comment="+processedMarker,
 		"-movflags", "faststart",
 		"-f", "mp4", outputPath,
 	)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("error processing video: %s, %v", stderr.String(), err)
+	if err := runMediaTool(ctx, nil, "ffmpeg", args...); err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("error processing video: %w", err)
 	}
 
 	fileInfo, err := os.Stat(outputPath)
@@ -216,6 +833,7 @@ func processVideoForFastStart(inputPath string) (string, error) {
 		return "", fmt.Errorf("could not stat processed file: %v", err)
 	}
 	if fileInfo.Size() == 0 {
+		os.Remove(outputPath)
 		return "", fmt.Errorf("processed file is empty")
 	}
 
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"testing"
+)
+
+func newVideoTestConfig(t testing.TB) (*apiConfig, *fakeS3) {
+	t.Helper()
+	cfg, fake := newTestConfig(t)
+	profiles, err := loadProcessingProfiles("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.processingProfiles = profiles
+	cfg.uploadProgress = newUploadProgressTracker()
+	cfg.maxVideoUploadBytes = 1 << 30
+	return cfg, fake
+}
+
+// videoUploadRequest uploads data as the video, declared as mediaType.
+func videoUploadRequest(t testing.TB, videoID, token, mediaType string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="video"; filename="upload.mp4"`},
+		"Content-Type":        {mediaType},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+videoID, &body)
+	r.SetPathValue("videoID", videoID)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// formErrorRequests returns uploads to path that are broken in the ways a
+// client can get a form wrong: no file part, the file under another field,
+// and a body that isn't the multipart form it claims to be.
+func formErrorRequests(t testing.TB, path, videoID, token string) map[string]*http.Request {
+	t.Helper()
+	newRequest := func(body []byte, contentType string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, path+videoID, bytes.NewReader(body))
+		r.SetPathValue("videoID", videoID)
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+
+	var wrongField bytes.Buffer
+	mw := multipart.NewWriter(&wrongField)
+	part, err := mw.CreateFormFile("file", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("data"))
+	mw.Close()
+
+	return map[string]*http.Request{
+		"no file part":        newRequest([]byte("--b--\r\n"), "multipart/form-data; boundary=b"),
+		"file in other field": newRequest(wrongField.Bytes(), mw.FormDataContentType()),
+		"malformed multipart": newRequest([]byte("--b\r\nnot a part"), "multipart/form-data; boundary=b"),
+	}
+}
+
+// errorCode returns the code of an error response.
+func errorCode(t testing.TB, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("couldn't decode error response %q: %v", w.Body, err)
+	}
+	return body.Code
+}
+
+func TestUploadVideoFormErrors(t *testing.T) {
+	cfg, _ := newVideoTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	want := map[string]string{
+		"no file part":        errCodeFileRequired,
+		"file in other field": errCodeFileRequired,
+		"malformed multipart": errCodeInvalidForm,
+	}
+	for name, r := range formErrorRequests(t, "/api/video_upload/", video.ID.String(), token) {
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d: %s", name, w.Code, http.StatusBadRequest, w.Body)
+			continue
+		}
+		if code := errorCode(t, w); code != want[name] {
+			t.Errorf("%s: code %q, want %q", name, code, want[name])
+		}
+	}
+}
+
+func TestUploadVideoRejectsOversizedBody(t *testing.T) {
+	cfg, _ := newVideoTestConfig(t)
+	cfg.maxVideoUploadBytes = 1 << 10
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, videoUploadRequest(t, video.ID.String(), token, "video/mp4", make([]byte, 4<<10)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusRequestEntityTooLarge, w.Body)
+	}
+	if code := errorCode(t, w); code != errCodeFileTooLarge {
+		t.Errorf("code %q, want %q", code, errCodeFileTooLarge)
+	}
+
+	// A rejected upload leaves the video as it was
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ProcessingStatus != video.ProcessingStatus {
+		t.Errorf("processing status = %q, want %q", stored.ProcessingStatus, video.ProcessingStatus)
+	}
+}
+
+func TestUploadVideoReusesMarkedReupload(t *testing.T) {
+	requireFFmpeg(t)
+	cfg, fake := newVideoTestConfig(t)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	// A file we produced earlier, stored for another video
+	path := makeFixture(t, "processed.mp4",
+		"-f", "lavfi", "-i", "testsrc=duration=1:size=320x180:rate=10",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p",
+		"-metadata", "comment="+processedMarker, "-movflags", "faststart")
+	hash, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := createTestVideo(t, cfg, user.ID)
+	originalURL := cfg.getCloudFrontURL("landscape/original.mp4")
+	original.VideoURL = &originalURL
+	original.ContentHash = hash
+	if err := cfg.db.UpdateVideo(original); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := createTestVideo(t, cfg, user.ID)
+	rr := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rr, videoUploadRequest(t, video.ID.String(), token, "video/mp4", data))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	got, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VideoURL == nil || *got.VideoURL != originalURL {
+		t.Errorf("video URL = %v, want the original's %s", got.VideoURL, originalURL)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("re-upload stored %d new objects, want none", len(fake.objects))
+	}
+}
+
+func TestUploadVideoProcessesForgedMarker(t *testing.T) {
+	requireFFmpeg(t)
+	cfg, fake := newVideoTestConfig(t)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	// Carries the marker, but matches nothing we stored
+	path := makeFixture(t, "forged.mp4",
+		"-f", "lavfi", "-i", "testsrc=duration=1:size=320x180:rate=10",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p",
+		"-metadata", "comment="+processedMarker, "-movflags", "faststart")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := createTestVideo(t, cfg, user.ID)
+	rr := httptest.NewRecorder()
+	cfg.handlerUploadVideo(rr, videoUploadRequest(t, video.ID.String(), token, "video/mp4", data))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	if len(fake.objects) != 1 {
+		t.Errorf("stored %d objects, want the upload stored as usual", len(fake.objects))
+	}
+}
+
+// assertEmptyDir fails the test if anything was left in dir.
+func assertEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s was left in %s", e.Name(), dir)
+	}
+}
+
+func TestUploadVideoCleansUpAfterFailure(t *testing.T) {
+	cfg, _ := newVideoTestConfig(t)
+	cfg.uploadTempDir = t.TempDir()
+	t.Setenv("TMPDIR", t.TempDir())
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	// Big enough for the multipart reader to spill the part to disk, and not
+	// a video, so probing fails once the upload has been spooled
+	data := bytes.Repeat([]byte("not a video "), (33<<20)/12)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, videoUploadRequest(t, video.ID.String(), token, "video/mp4", data))
+	if w.Code < 400 {
+		t.Fatalf("status %d, want the upload to fail: %s", w.Code, w.Body)
+	}
+	assertEmptyDir(t, cfg.uploadTempDir)
+	assertEmptyDir(t, os.TempDir())
+}
+
+func TestUploadVideoStoresSize(t *testing.T) {
+	requireFFmpeg(t)
+	cfg, fake := newVideoTestConfig(t)
+	cfg.trackFileSizes = true
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	// Already browser-ready, so it's stored as uploaded
+	path := makeFixture(t, "ready.mp4",
+		"-f", "lavfi", "-i", "testsrc=duration=1:size=320x180:rate=10",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "faststart")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, videoUploadRequest(t, video.ID.String(), token, "video/mp4", data))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	got, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FileSize != int64(len(data)) {
+		t.Errorf("stored file size = %d, want the %d uploaded bytes", got.FileSize, len(data))
+	}
+	for id, body := range fake.objects {
+		if int64(len(body)) != got.FileSize {
+			t.Errorf("%s is %d bytes, record says %d", id, len(body), got.FileSize)
+		}
+	}
+}
+
+func TestUploadVideoCleansUpAfterStorageFailure(t *testing.T) {
+	requireFFmpeg(t)
+	cfg, fake := newVideoTestConfig(t)
+	cfg.uploadTempDir = t.TempDir()
+	t.Setenv("TMPDIR", t.TempDir())
+	fake.setFailure(testBucket, "*", "AccessDenied")
+
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+	fixture := makeFixture(t, "fixture.mp4", "-f", "lavfi", "-i", "testsrc=s=320x180:r=10:d=2", "-pix_fmt", "yuv420p")
+	data, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, videoUploadRequest(t, video.ID.String(), token, "video/mp4", data))
+	if w.Code < 400 {
+		t.Fatalf("status %d, want the S3 upload to fail: %s", w.Code, w.Body)
+	}
+	assertEmptyDir(t, cfg.uploadTempDir)
+	assertEmptyDir(t, os.TempDir())
+}
+
+func TestUploadVideoRejectsNonVideos(t *testing.T) {
+	requireFFmpeg(t)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty file", nil},
+		{"text document", []byte("Meeting notes\n\n- ship the thing\n- renamed this to .mp4\n")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, fake := newVideoTestConfig(t)
+			user, token := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, user.ID)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, videoUploadRequest(t, video.ID.String(), token, "video/mp4", tc.data))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+			}
+			if code := errorCode(t, w); code != errCodeInvalidVideo {
+				t.Errorf("code %q, want %q", code, errCodeInvalidVideo)
+			}
+			if n := fake.count(); n != 0 {
+				t.Errorf("%d objects were stored in S3", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoDownload redirects to a presigned URL for the video's media.
+// The browser is told to save the file unless DOWNLOAD_DISPOSITION says
+// otherwise; ?disposition=inline or attachment overrides it per request.
+// The media goes straight from S3 to the client, so unlike streamed bytes
+// it isn't billed to the owner's bandwidth.
+func (cfg *apiConfig) handlerVideoDownload(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if !cfg.canViewVideo(r, video) || video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	bucket, key, err := cfg.parseS3Key(*video.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate video media", err)
+		return
+	}
+
+	disposition := r.URL.Query().Get("disposition")
+	if disposition == "" {
+		disposition = cfg.downloadDisposition
+	}
+	if disposition != dispositionInline && disposition != dispositionAttachment {
+		respondWithError(w, http.StatusBadRequest, "disposition must be inline or attachment", nil)
+		return
+	}
+	overrides := mediaOverrides(disposition, video.Title)
+
+	url, err := cfg.presignGetObject(r.Context(), bucket, key, cfg.presignTTL, overrides)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign download URL", err)
+		return
+	}
+
+	http.Redirect(w, r, url, http.StatusFound)
+}
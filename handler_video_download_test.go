@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestParseS3Key(t *testing.T) {
+	cfg := apiConfig{s3Bucket: testBucket, s3Region: testRegion, s3CfDistribution: "https://cdn.example.com"}
+
+	tests := []struct {
+		url        string
+		wantBucket string
+		wantKey    string
+		wantErr    bool
+	}{
+		{"https://cdn.example.com/landscape/abc.mp4", testBucket, "landscape/abc.mp4", false},
+		{"https://other-bucket.s3.us-east-1.amazonaws.com/landscape/abc.mp4", "other-bucket", "landscape/abc.mp4", false},
+		{"other-bucket,landscape/abc.mp4", "other-bucket", "landscape/abc.mp4", false},
+		{"https://other-bucket.s3.eu-west-1.amazonaws.com/landscape/abc.mp4", "", "", true},
+		{"https://other-bucket.s3.us-east-1.amazonaws.com/", "", "", true},
+		{"http://cdn.example.org/abc.mp4", "", "", true},
+		{"other-bucket,", "", "", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.url, func(t *testing.T) {
+			bucket, key, err := cfg.parseS3Key(tc.url)
+			if bucket != tc.wantBucket || key != tc.wantKey || (err != nil) != tc.wantErr {
+				t.Errorf("parseS3Key = (%q, %q, %v), want (%q, %q, error %v)",
+					bucket, key, err, tc.wantBucket, tc.wantKey, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestVideoDownloadOverrides(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	cfg.downloadDisposition = dispositionAttachment
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+	videoURL := cfg.getCloudFrontURL("landscape/abc.mp4")
+	video.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		query           string
+		wantType        string
+		wantDisposition string
+	}{
+		{"default downloads", "", "application/octet-stream", `attachment; filename="test video.mp4"`},
+		{"attachment", "?disposition=attachment", "application/octet-stream", `attachment; filename="test video.mp4"`},
+		{"inline plays", "?disposition=inline", "video/mp4", `inline; filename="test video.mp4"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := downloadVideo(cfg, video.ID.String(), tc.query)
+			if rr.Code != http.StatusFound {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusFound, rr.Body)
+			}
+			signed, err := url.Parse(rr.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signed.Path != "/"+testBucket+"/landscape/abc.mp4" {
+				t.Errorf("signed path = %q", signed.Path)
+			}
+			q := signed.Query()
+			if got := q.Get("response-content-type"); got != tc.wantType {
+				t.Errorf("response-content-type = %q, want %q", got, tc.wantType)
+			}
+			if got := q.Get("response-content-disposition"); got != tc.wantDisposition {
+				t.Errorf("response-content-disposition = %q, want %q", got, tc.wantDisposition)
+			}
+			if q.Get("X-Amz-Signature") == "" {
+				t.Error("URL isn't signed")
+			}
+		})
+	}
+
+	if rr := downloadVideo(cfg, video.ID.String(), "?disposition=bogus"); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown disposition: status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestVideoDownloadNotFound(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+
+	noMedia := createTestVideo(t, cfg, user.ID)
+
+	staged := createTestVideo(t, cfg, user.ID)
+	stagedURL := cfg.getCloudFrontURL(stagingPrefix + "landscape/abc.mp4")
+	staged.VideoURL = &stagedURL
+	staged.Status = database.VideoStatusStaged
+	if err := cfg.db.UpdateVideo(staged); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		videoID string
+		want    int
+	}{
+		"invalid ID":    {"not-a-uuid", http.StatusBadRequest},
+		"no such video": {"00000000-0000-0000-0000-000000000000", http.StatusNotFound},
+		"no media yet":  {noMedia.ID.String(), http.StatusNotFound},
+		"staged":        {staged.ID.String(), http.StatusNotFound},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if rr := downloadVideo(cfg, tc.videoID, ""); rr.Code != tc.want {
+				t.Errorf("status = %d, want %d", rr.Code, tc.want)
+			}
+		})
+	}
+}
+
+func downloadVideo(cfg *apiConfig, videoID, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/api/videos/"+videoID+"/download"+query, nil)
+	r.SetPathValue("videoID", videoID)
+	rr := httptest.NewRecorder()
+	cfg.handlerVideoDownload(rr, r)
+	return rr
+}
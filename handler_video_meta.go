@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -19,9 +22,9 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithJWTError(w, err)
 		return
 	}
 
@@ -56,15 +59,19 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithJWTError(w, err)
 		return
 	}
 
 	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
 	if video.UserID != userID {
@@ -72,7 +79,13 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	// With a grace period the video can still be restored; the sweeper
+	// purges it later
+	if cfg.softDeleteGrace > 0 {
+		err = cfg.db.SoftDeleteVideo(videoID)
+	} else {
+		err = cfg.purgeVideo(r.Context(), video)
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
@@ -90,31 +103,118 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	privileged := cfg.ownerOrAdmin(r, video)
+	// Staged videos are still under review and aren't public yet
+	if video.Status == database.VideoStatusStaged && !privileged {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	// Upload client details are for the owner and admins only
+	if !privileged {
+		video.UploadUserAgent = ""
+		video.UploadIP = ""
+	}
+
+	video, err = cfg.signVideo(r.Context(), video)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, video)
 }
 
+// optionalUserID returns the user a valid bearer token identifies, if the
+// request carries one. Anonymous requests are allowed and report false.
+func (cfg *apiConfig) optionalUserID(r *http.Request) (uuid.UUID, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	userID, err := cfg.validateJWT(token)
+	return userID, err == nil
+}
+
+// ownerOrAdmin reports whether the request is signed in as the video's owner
+// or an admin.
+func (cfg *apiConfig) ownerOrAdmin(r *http.Request, video database.Video) bool {
+	viewerID, signedIn := cfg.optionalUserID(r)
+	return signedIn && (viewerID == video.UserID || cfg.adminUserIDs[viewerID])
+}
+
+// canViewVideo reports whether the request may see the video. Staged videos
+// are still under review, so only their owner and admins can.
+func (cfg *apiConfig) canViewVideo(r *http.Request, video database.Video) bool {
+	return video.Status != database.VideoStatusStaged || cfg.ownerOrAdmin(r, video)
+}
+
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithJWTError(w, err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	limit := defaultVideoPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxVideoPageSize {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxVideoPageSize), err)
+			return
+		}
+	}
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			respondWithError(w, http.StatusBadRequest, "offset must not be negative", err)
+			return
+		}
+	}
+
+	videos, err := cfg.db.GetVideosByUser(userID, limit, offset)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	total, err := cfg.db.CountVideosByUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count videos", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, videoPage{
+		Videos: cfg.batchSignVideos(r.Context(), videos),
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	})
+}
+
+const (
+	defaultVideoPageSize = 50
+	maxVideoPageSize     = 100
+)
 
-	respondWithJSON(w, http.StatusOK, videos)
+// videoPage is one page of a user's videos. Total counts every video, so
+// clients can tell how many pages there are.
+type videoPage struct {
+	Videos []signedVideo `json:"videos"`
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
 }
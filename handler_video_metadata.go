@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"unicode"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxMetadataKeys       = 50
+	maxMetadataKeyLen     = 64
+	maxMetadataValueLen   = 1024
+	maxMetadataTotalBytes = 8 << 10 // 8 KB
+)
+
+// handlerVideoMetadataSet replaces the video's metadata with the request body.
+func (cfg *apiConfig) handlerVideoMetadataSet(w http.ResponseWriter, r *http.Request) {
+	cfg.updateVideoMetadata(w, r, func(_ database.Metadata, params map[string]*string) (database.Metadata, error) {
+		metadata := database.Metadata{}
+		for k, v := range params {
+			if v == nil {
+				return nil, fmt.Errorf("metadata value for %q must be a string", k)
+			}
+			metadata[k] = *v
+		}
+		return metadata, nil
+	})
+}
+
+// handlerVideoMetadataMerge merges the request body into the video's
+// metadata. A null value removes the key.
+func (cfg *apiConfig) handlerVideoMetadataMerge(w http.ResponseWriter, r *http.Request) {
+	cfg.updateVideoMetadata(w, r, func(current database.Metadata, params map[string]*string) (database.Metadata, error) {
+		metadata := database.Metadata{}
+		for k, v := range current {
+			metadata[k] = v
+		}
+		for k, v := range params {
+			if v == nil {
+				delete(metadata, k)
+				continue
+			}
+			metadata[k] = *v
+		}
+		return metadata, nil
+	})
+}
+
+func (cfg *apiConfig) handlerVideoMetadataClear(w http.ResponseWriter, r *http.Request) {
+	cfg.updateVideoMetadata(w, r, nil)
+}
+
+func (cfg *apiConfig) updateVideoMetadata(
+	w http.ResponseWriter,
+	r *http.Request,
+	apply func(current database.Metadata, params map[string]*string) (database.Metadata, error),
+) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	metadata := database.Metadata{}
+	if apply != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxMetadataTotalBytes*2)
+		params := map[string]*string{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Metadata must be a JSON object of strings", err)
+			return
+		}
+		metadata, err = apply(video.Metadata, params)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		if err := validateMetadata(metadata); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+	}
+
+	video.Metadata = metadata
+	if err := cfg.db.UpdateVideo(video); errors.Is(err, database.ErrVideoModified) {
+		respondWithError(w, http.StatusConflict, "video was modified concurrently", err)
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.signVideoForResponse(r.Context(), video))
+}
+
+func validateMetadata(metadata database.Metadata) error {
+	if len(metadata) > maxMetadataKeys {
+		return fmt.Errorf("metadata can't have more than %d keys", maxMetadataKeys)
+	}
+
+	total := 0
+	for k, v := range metadata {
+		if k == "" {
+			return errors.New("metadata keys can't be empty")
+		}
+		if len(k) > maxMetadataKeyLen {
+			return fmt.Errorf("metadata key %q is longer than %d bytes", k, maxMetadataKeyLen)
+		}
+		if len(v) > maxMetadataValueLen {
+			return fmt.Errorf("metadata value for %q is longer than %d bytes", k, maxMetadataValueLen)
+		}
+		if hasControlChars(k) || hasControlChars(v) {
+			return fmt.Errorf("metadata for %q contains control characters", k)
+		}
+		total += len(k) + len(v)
+	}
+	if total > maxMetadataTotalBytes {
+		return fmt.Errorf("metadata can't exceed %d bytes in total", maxMetadataTotalBytes)
+	}
+	return nil
+}
+
+func hasControlChars(s string) bool {
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// metadataRequest sends body to the video's metadata endpoint.
+func metadataRequest(t *testing.T, handler http.HandlerFunc, method, videoID, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, "/api/videos/"+videoID+"/metadata", strings.NewReader(body))
+	r.SetPathValue("videoID", videoID)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// getVideoMetadata fetches the video as a client would and returns its
+// metadata.
+func getVideoMetadata(t *testing.T, cfg *apiConfig, videoID string) database.Metadata {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/videos/"+videoID, nil)
+	r.SetPathValue("videoID", videoID)
+	w := httptest.NewRecorder()
+	cfg.handlerVideoGet(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get video: status = %d: %s", w.Code, w.Body)
+	}
+	var video database.Video
+	if err := json.NewDecoder(w.Body).Decode(&video); err != nil {
+		t.Fatal(err)
+	}
+	return video.Metadata
+}
+
+func TestVideoMetadataSetMergeClear(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	videoID := createTestVideo(t, cfg, user.ID).ID.String()
+
+	steps := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+		want    database.Metadata
+	}{
+		{"set", cfg.handlerVideoMetadataSet, http.MethodPut, `{"genre":"jazz","imdb":"tt01"}`, database.Metadata{"genre": "jazz", "imdb": "tt01"}},
+		{"merge adds and overwrites", cfg.handlerVideoMetadataMerge, http.MethodPatch, `{"genre":"blues","lang":"en"}`, database.Metadata{"genre": "blues", "imdb": "tt01", "lang": "en"}},
+		{"merge null removes", cfg.handlerVideoMetadataMerge, http.MethodPatch, `{"imdb":null}`, database.Metadata{"genre": "blues", "lang": "en"}},
+		{"set replaces", cfg.handlerVideoMetadataSet, http.MethodPut, `{"tags":"live"}`, database.Metadata{"tags": "live"}},
+		{"clear", cfg.handlerVideoMetadataClear, http.MethodDelete, ``, database.Metadata{}},
+	}
+	for _, step := range steps {
+		w := metadataRequest(t, step.handler, step.method, videoID, token, step.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", step.name, w.Code, w.Body)
+		}
+		got := getVideoMetadata(t, cfg, videoID)
+		if len(got) != len(step.want) {
+			t.Fatalf("%s: metadata = %v, want %v", step.name, got, step.want)
+		}
+		for k, v := range step.want {
+			if got[k] != v {
+				t.Errorf("%s: metadata[%q] = %q, want %q", step.name, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestVideoMetadataRejectsInvalid(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	videoID := createTestVideo(t, cfg, user.ID).ID.String()
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+
+	var manyKeys []string
+	for i := range maxMetadataKeys + 1 {
+		manyKeys = append(manyKeys, `"k`+strings.Repeat("x", i)+`":"v"`)
+	}
+	// Each pair stays under the per-key and per-value limits
+	var oversized []string
+	for i := range 10 {
+		oversized = append(oversized, `"key`+string(rune('a'+i))+`":"`+strings.Repeat("v", maxMetadataValueLen)+`"`)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		body  string
+		want  int
+	}{
+		{"not an object", token, `["genre"]`, http.StatusBadRequest},
+		{"non-string value", token, `{"year":1999}`, http.StatusBadRequest},
+		{"empty key", token, `{"":"x"}`, http.StatusBadRequest},
+		{"long key", token, `{"` + strings.Repeat("k", maxMetadataKeyLen+1) + `":"x"}`, http.StatusBadRequest},
+		{"long value", token, `{"k":"` + strings.Repeat("v", maxMetadataValueLen+1) + `"}`, http.StatusBadRequest},
+		{"control characters", token, `{"k":"a\u0007b"}`, http.StatusBadRequest},
+		{"too many keys", token, `{` + strings.Join(manyKeys, ",") + `}`, http.StatusBadRequest},
+		{"too large in total", token, `{` + strings.Join(oversized, ",") + `}`, http.StatusBadRequest},
+		{"not the owner", otherToken, `{"genre":"jazz"}`, http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := metadataRequest(t, cfg.handlerVideoMetadataSet, http.MethodPut, videoID, tc.token, tc.body)
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.want, w.Body)
+			}
+		})
+	}
+
+	if got := getVideoMetadata(t, cfg, videoID); len(got) != 0 {
+		t.Errorf("rejected requests changed the metadata to %v", got)
+	}
+}
+
+func TestVideoMetadataResponseIsSigned(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+	fake.put(testBucket, "landscape/abc.mp4", []byte("media"))
+	videoURL := cfg.getObjectURL(testBucket, "landscape/abc.mp4")
+	video.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	w := metadataRequest(t, cfg.handlerVideoMetadataSet, http.MethodPut, video.ID.String(), token, `{"genre":"jazz"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var got database.Video
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.VideoURL == nil || !strings.Contains(*got.VideoURL, "X-Amz-Signature=") {
+		t.Errorf("response carries an unsigned video URL: %v", got.VideoURL)
+	}
+}
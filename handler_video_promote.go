@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const stagingPrefix = "staging/"
+
+// handlerVideoPromote moves a staged video's media into the live prefix and
+// publishes it.
+func (cfg *apiConfig) handlerVideoPromote(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+	logger := requestLogger(r).With("operation", "promote_video", "video_id", videoID, "user_id", userID)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't promote this video", nil)
+		return
+	}
+	if video.Status != database.VideoStatusStaged || video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video is not staged", nil)
+		return
+	}
+
+	bucket, stagedKey, err := cfg.parseS3Key(*video.VideoURL)
+	if err == nil && !strings.HasPrefix(stagedKey, stagingPrefix) {
+		err = errors.New("staged media isn't under the staging prefix: " + stagedKey)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate staged media", err)
+		return
+	}
+	liveKey := strings.TrimPrefix(stagedKey, stagingPrefix)
+	if err := cfg.checkObjectKey(liveKey); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate staged media", err)
+		return
+	}
+
+	err = cfg.copyObject(r.Context(), bucket, stagedKey, liveKey)
+	if err != nil {
+		respondWithError(w, http.StatusFailedDependency, "Unable to copy staged media", err)
+		return
+	}
+
+	stagedURL := *video.VideoURL
+	videoURL := cfg.getObjectURL(bucket, liveKey)
+	stagedArtifacts, err := cfg.promoteArtifacts(r.Context(), bucket, &video)
+	if err != nil {
+		cfg.discardUnreferencedObjects(context.Background(), bucket, videoURL, []string{liveKey})
+		respondWithError(w, http.StatusFailedDependency, "Unable to copy staged media", err)
+		return
+	}
+
+	video.VideoURL = &videoURL
+	video.Status = database.VideoStatusPublished
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		// The record still points at the staged media, so the live copies
+		// are orphans unless the update that won published the same ones
+		liveKeys := []string{liveKey}
+		for _, key := range stagedArtifacts {
+			liveKeys = append(liveKeys, strings.TrimPrefix(key, stagingPrefix))
+		}
+		cfg.discardUnreferencedObjects(context.Background(), bucket, videoURL, liveKeys)
+		if errors.Is(err, database.ErrVideoModified) {
+			respondWithError(w, http.StatusConflict, "video was modified concurrently", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to update video", err)
+		return
+	}
+
+	// The live copies are committed, so the staged ones can go unless
+	// another video still points at them
+	stagedKeys := append([]string{stagedKey}, stagedArtifacts...)
+	for _, key := range stagedKeys {
+		cfg.presignCache.invalidate(bucket, key)
+	}
+	cfg.discardUnreferencedObjects(context.Background(), bucket, stagedURL, stagedKeys)
+	logger.Info("promoted video", "key", liveKey)
+
+	respondWithJSON(w, http.StatusOK, cfg.signVideoForResponse(r.Context(), video))
+}
+
+// promoteArtifacts copies the video's staged derivatives to their live keys
+// and points the record at them. It returns the staged keys, which can be
+// deleted once the record is committed.
+func (cfg *apiConfig) promoteArtifacts(ctx context.Context, bucket string, video *database.Video) ([]string, error) {
+	var staged []string
+	for i, a := range video.Artifacts {
+		liveKey, ok := strings.CutPrefix(a.Key, stagingPrefix)
+		if !ok {
+			continue
+		}
+		if err := cfg.copyObject(ctx, bucket, a.Key, liveKey); err != nil {
+			return nil, err
+		}
+		video.Artifacts[i].Key = liveKey
+		staged = append(staged, a.Key)
+	}
+
+	for _, u := range []**string{&video.SpritesURL, &video.SpritesVTTURL} {
+		if *u == nil {
+			continue
+		}
+		_, key, err := cfg.parseS3Key(**u)
+		if err != nil {
+			continue
+		}
+		if liveKey, ok := strings.CutPrefix(key, stagingPrefix); ok {
+			url := cfg.getObjectURL(bucket, liveKey)
+			*u = &url
+		}
+	}
+	return staged, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// createStagedVideo stores a staged video with media and a preview sheet
+// under the staging prefix.
+func createStagedVideo(t *testing.T, cfg *apiConfig, fake *fakeS3, video database.Video) database.Video {
+	t.Helper()
+	const mediaKey = stagingPrefix + "landscape/media.mp4"
+	spriteKey := stagingPrefix + "sprites/" + video.ID.String() + "/media.jpg"
+	vttKey := stagingPrefix + "sprites/" + video.ID.String() + "/media.vtt"
+	for _, key := range []string{mediaKey, spriteKey, vttKey} {
+		fake.put(testBucket, key, []byte(key))
+	}
+
+	videoURL := cfg.getObjectURL(testBucket, mediaKey)
+	spritesURL := cfg.getObjectURL(testBucket, spriteKey)
+	spritesVTTURL := cfg.getObjectURL(testBucket, vttKey)
+	video.VideoURL = &videoURL
+	video.SpritesURL = &spritesURL
+	video.SpritesVTTURL = &spritesVTTURL
+	video.Status = database.VideoStatusStaged
+	addArtifact(&video, artifactSprite, spriteKey)
+	addArtifact(&video, artifactSprite, vttKey)
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	video, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+func TestStagedVideoVisibleToOwnerOnly(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := createStagedVideo(t, cfg, fake, createTestVideo(t, cfg, owner.ID))
+
+	if strings.HasPrefix(*video.VideoURL, cfg.s3CfDistribution) {
+		t.Fatalf("staged media is served through the distribution: %s", *video.VideoURL)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"anonymous", "", http.StatusNotFound},
+		{"other user", otherToken, http.StatusNotFound},
+		{"owner", ownerToken, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String(), nil)
+			r.SetPathValue("videoID", video.ID.String())
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			cfg.handlerVideoGet(w, r)
+			if w.Code != tc.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var got database.Video
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.VideoURL == nil || !strings.Contains(*got.VideoURL, "X-Amz-Signature=") {
+				t.Errorf("owner got an unsigned URL for staged media: %v", got.VideoURL)
+			}
+		})
+	}
+}
+
+func TestPromoteMovesStagedArtifacts(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+	video := createStagedVideo(t, cfg, fake, createTestVideo(t, cfg, owner.ID))
+
+	r := httptest.NewRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/promote", nil)
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerVideoPromote(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	promoted, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted.Status != database.VideoStatusPublished {
+		t.Errorf("status = %q, want published", promoted.Status)
+	}
+	for _, a := range promoted.Artifacts {
+		if strings.HasPrefix(a.Key, stagingPrefix) {
+			t.Errorf("artifact still staged: %s", a.Key)
+		}
+		if _, ok := fake.object(testBucket, a.Key); !ok {
+			t.Errorf("artifact %s wasn't copied to its live key", a.Key)
+		}
+		if _, ok := fake.object(testBucket, stagingPrefix+a.Key); ok {
+			t.Errorf("staged copy of %s was left behind", a.Key)
+		}
+	}
+	for _, u := range []*string{promoted.VideoURL, promoted.SpritesURL, promoted.SpritesVTTURL} {
+		if u == nil || strings.Contains(*u, "/"+stagingPrefix) {
+			t.Errorf("URL still points at staged media: %v", u)
+		}
+	}
+}
+
+func TestPromoteKeepsSharedStagedMedia(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+	video := createStagedVideo(t, cfg, fake, createTestVideo(t, cfg, owner.ID))
+
+	// A second staged video deduplicated onto the same media
+	other := createTestVideo(t, cfg, owner.ID)
+	other.VideoURL = video.VideoURL
+	other.Status = database.VideoStatusStaged
+	if err := cfg.db.UpdateVideo(other); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/promote", nil)
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerVideoPromote(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	if _, ok := fake.object(testBucket, stagingPrefix+"landscape/media.mp4"); !ok {
+		t.Error("staged media still used by another video was deleted")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoRestore undoes a soft delete while the grace period lasts.
+func (cfg *apiConfig) handlerVideoRestore(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	video, err := cfg.db.GetDeletedVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "No deleted video with that ID", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't restore this video", nil)
+		return
+	}
+	// The sweeper may not have caught up yet, but the window is closed
+	if time.Since(*video.DeletedAt) >= cfg.softDeleteGrace {
+		respondWithError(w, http.StatusGone, "Video can no longer be restored", nil)
+		return
+	}
+
+	if err := cfg.db.RestoreVideo(videoID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore video", err)
+		return
+	}
+	video.DeletedAt = nil
+
+	respondWithJSON(w, http.StatusOK, cfg.signVideoForResponse(r.Context(), video))
+}
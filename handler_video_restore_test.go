@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// createStoredVideo adds a video whose media and thumbnail exist in the fake
+// bucket and the assets directory.
+func createStoredVideo(t *testing.T, cfg *apiConfig, fake *fakeS3, user *database.User, key string) database.Video {
+	t.Helper()
+	video := createTestVideo(t, cfg, user.ID)
+	fake.put(testBucket, key, []byte("media"))
+	videoURL := cfg.getCloudFrontURL(key)
+	video.VideoURL = &videoURL
+
+	assetPath, err := cfg.getAssetPath(video.ID.String(), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskPath, err := cfg.getAssetDiskPath(assetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(diskPath, []byte("thumbnail"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	thumbnailURL := cfg.getAssetURL(assetPath)
+	video.ThumbnailURL = &thumbnailURL
+
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+func videoRequest(method, videoID, token string) *http.Request {
+	r := httptest.NewRequest(method, "/api/videos/"+videoID, nil)
+	r.SetPathValue("videoID", videoID)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func deleteVideo(t *testing.T, cfg *apiConfig, videoID, token string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	cfg.handlerVideoMetaDelete(w, videoRequest(http.MethodDelete, videoID, token))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	cfg.softDeleteGrace = time.Hour
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := createStoredVideo(t, cfg, fake, user, "landscape/abc.mp4")
+
+	deleteVideo(t, cfg, video.ID.String(), token)
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoGet(w, videoRequest(http.MethodGet, video.ID.String(), token))
+	var served database.Video
+	json.Unmarshal(w.Body.Bytes(), &served)
+	if served.ID == video.ID {
+		t.Errorf("GET served the deleted video: %s", w.Body)
+	}
+	videos, err := cfg.db.GetVideosByUser(user.ID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 0 {
+		t.Errorf("listing has %d videos, want the deleted one hidden", len(videos))
+	}
+	if _, ok := fake.object(testBucket, "landscape/abc.mp4"); !ok {
+		t.Fatal("media was removed during the grace period")
+	}
+
+	w = httptest.NewRecorder()
+	cfg.handlerVideoRestore(w, videoRequest(http.MethodPost, video.ID.String(), otherToken))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("restore by another user: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.handlerVideoRestore(w, videoRequest(http.MethodPost, video.ID.String(), token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("restore: status %d: %s", w.Code, w.Body)
+	}
+	restored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.DeletedAt != nil || restored.VideoURL == nil || *restored.VideoURL != *video.VideoURL {
+		t.Errorf("restored video = %+v", restored)
+	}
+
+	// Nothing is left to restore
+	w = httptest.NewRecorder()
+	cfg.handlerVideoRestore(w, videoRequest(http.MethodPost, video.ID.String(), token))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("second restore: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestSoftDeletePurgeAfterGrace(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	cfg.softDeleteGrace = time.Hour
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createStoredVideo(t, cfg, fake, user, "landscape/abc.mp4")
+	// Deduplicated media shared with a video that stays
+	shared := createStoredVideo(t, cfg, fake, user, "landscape/shared.mp4")
+	sharer := createStoredVideo(t, cfg, fake, user, "landscape/shared.mp4")
+
+	deleteVideo(t, cfg, video.ID.String(), token)
+	deleteVideo(t, cfg, shared.ID.String(), token)
+
+	// Still within the grace period
+	cfg.purgeExpiredVideos(context.Background())
+	if deleted, err := cfg.db.GetDeletedVideo(video.ID); err != nil || deleted.DeletedAt == nil {
+		t.Fatalf("video was purged during the grace period (err %v)", err)
+	}
+
+	// Let the grace period run out
+	cfg.softDeleteGrace = time.Nanosecond
+	w := httptest.NewRecorder()
+	cfg.handlerVideoRestore(w, videoRequest(http.MethodPost, video.ID.String(), token))
+	if w.Code != http.StatusGone {
+		t.Errorf("restore after the grace period: status %d, want %d", w.Code, http.StatusGone)
+	}
+
+	cfg.purgeExpiredVideos(context.Background())
+	for _, id := range []string{video.ID.String(), shared.ID.String()} {
+		w := httptest.NewRecorder()
+		cfg.handlerVideoRestore(w, videoRequest(http.MethodPost, id, token))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("restore %s after purge: status %d, want %d", id, w.Code, http.StatusNotFound)
+		}
+	}
+	if _, ok := fake.object(testBucket, "landscape/abc.mp4"); ok {
+		t.Error("purged video's media is still stored")
+	}
+	assetPath, _ := cfg.assetPathFromURL(*video.ThumbnailURL)
+	diskPath, err := cfg.getAssetDiskPath(assetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(diskPath); !os.IsNotExist(err) {
+		t.Errorf("purged video's thumbnail is still on disk (stat err %v)", err)
+	}
+	if _, ok := fake.object(testBucket, "landscape/shared.mp4"); !ok {
+		t.Error("media still used by another video was deleted")
+	}
+	if _, err := cfg.db.GetVideo(sharer.ID); err != nil {
+		t.Errorf("video sharing the media: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Sprite indexes have a cue per frame, and sheets hold at most a few hundred
+const maxSpritesVTTBytes = 1 << 20
+
+// spritesVTTEndpoint is where the sprite index of a video in a private
+// bucket is served from.
+func (cfg apiConfig) spritesVTTEndpoint(videoID uuid.UUID) string {
+	return fmt.Sprintf("http://localhost:%s/api/videos/%s/sprites.vtt", cfg.port, videoID)
+}
+
+// handlerVideoSpritesVTT serves the video's sprite index with the sheet it
+// refers to signed. The stored index names the sheet relative to itself,
+// which only resolves when the bucket is public.
+func (cfg *apiConfig) handlerVideoSpritesVTT(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if !cfg.canViewVideo(r, video) || video.SpritesURL == nil || video.SpritesVTTURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no sprites", nil)
+		return
+	}
+
+	bucket, vttKey, err := cfg.parseS3Key(*video.SpritesVTTURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate sprites", err)
+		return
+	}
+	_, spriteKey, err := cfg.parseS3Key(*video.SpritesURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate sprites", err)
+		return
+	}
+	spriteURL, err := cfg.signObjectURL(r.Context(), *video.SpritesURL, presignOverrides{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign sprites URL", err)
+		return
+	}
+
+	out, err := cfg.s3Client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &vttKey,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusFailedDependency, "Unable to read sprites", err)
+		return
+	}
+	defer out.Body.Close()
+	vtt, err := io.ReadAll(io.LimitReader(out.Body, maxSpritesVTTBytes))
+	if err != nil {
+		respondWithError(w, http.StatusFailedDependency, "Unable to read sprites", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vtt")
+	// The signed sheet URL expires, so the index mustn't outlive it
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, signSpriteCues(string(vtt), path.Base(spriteKey), spriteURL))
+}
+
+// signSpriteCues points every cue in the index at spriteURL instead of the
+// sheet's name.
+func signSpriteCues(vtt, spriteName, spriteURL string) string {
+	return strings.ReplaceAll(vtt, "\n"+spriteName+"#xywh=", "\n"+spriteURL+"#xywh=")
+}
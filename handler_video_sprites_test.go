@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSignSpriteCues(t *testing.T) {
+	layout := spriteLayout{interval: 5, frames: 3, columns: 2, rows: 2, tileWidth: 160, tileHeight: 90}
+	vtt := string(spriteVTT("abc.jpg", layout, 12))
+	const signed = "https://tubely-test.s3.us-east-1.amazonaws.com/sprites/id/abc.jpg?X-Amz-Signature=sig"
+
+	got := signSpriteCues(vtt, "abc.jpg", signed)
+	if strings.Contains(got, "\nabc.jpg#") {
+		t.Errorf("a cue still refers to the sheet by name:\n%s", got)
+	}
+	if n := strings.Count(got, signed+"#xywh="); n != layout.frames {
+		t.Errorf("%d cues point at the signed sheet, want %d:\n%s", n, layout.frames, got)
+	}
+	if !strings.Contains(got, signed+"#xywh=160,0,160,90") {
+		t.Errorf("second tile's fragment was lost:\n%s", got)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerStreamVideo serves the video's media from disk or proxies it from
+// S3, honouring the Range header so players can seek. Every byte sent is
+// billed to the video's owner.
+func (cfg *apiConfig) handlerStreamVideo(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if !cfg.canViewVideo(r, video) || video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	if assetPath, ok := cfg.assetPathFromURL(*video.VideoURL); ok {
+		cfg.serveLocalVideo(w, r, video, assetPath)
+		return
+	}
+
+	bucket, key, err := cfg.parseS3Key(*video.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate video media", err)
+		return
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		input.Range = &rangeHeader
+	}
+	out, err := cfg.s3Client.GetObject(r.Context(), input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+			respondWithError(w, http.StatusRequestedRangeNotSatisfiable, "Requested range not satisfiable", err)
+			return
+		}
+		respondWithError(w, http.StatusFailedDependency, "Unable to read video media", err)
+		return
+	}
+	defer out.Body.Close()
+
+	// Browsers only play inline with a video type and a matching disposition
+	headers := mediaOverrides(cfg.playbackDisposition, video.Title)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Disposition", headers.contentDisposition)
+	contentType := headers.contentType
+	if cfg.playbackDisposition == dispositionInline && out.ContentType != nil &&
+		strings.HasPrefix(*out.ContentType, "video/") {
+		contentType = *out.ContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	if out.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*out.ContentLength, 10))
+	}
+	if out.ETag != nil {
+		w.Header().Set("ETag", *out.ETag)
+	}
+	status := http.StatusOK
+	if out.ContentRange != nil {
+		w.Header().Set("Content-Range", *out.ContentRange)
+		status = http.StatusPartialContent
+	}
+
+	cw := &countingResponseWriter{ResponseWriter: w}
+	defer cfg.recordBytesServed(video.UserID, "stream", cw)
+
+	cw.WriteHeader(status)
+	if _, err := io.Copy(cw, out.Body); err != nil {
+		// Usually the client went away mid-stream; what was sent still counts
+		requestLogger(r).Info("stream ended early", "operation", "stream_video", "video_id", videoID, "bytes", cw.written, "error", err)
+	}
+}
+
+// serveLocalVideo serves media kept under the assets root. ServeContent
+// handles Range requests, answering unsatisfiable ones with 416.
+func (cfg *apiConfig) serveLocalVideo(w http.ResponseWriter, r *http.Request, video database.Video, assetPath string) {
+	diskPath, err := cfg.getAssetDiskPath(assetPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate video media", err)
+		return
+	}
+	f, err := os.Open(diskPath)
+	if errors.Is(err, os.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read video media", err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read video media", err)
+		return
+	}
+
+	headers := mediaOverrides(cfg.playbackDisposition, video.Title)
+	w.Header().Set("Content-Disposition", headers.contentDisposition)
+	contentType := headers.contentType
+	if cfg.playbackDisposition == dispositionInline {
+		if t := mime.TypeByExtension(filepath.Ext(assetPath)); strings.HasPrefix(t, "video/") {
+			contentType = t
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	cw := &countingResponseWriter{ResponseWriter: w}
+	defer cfg.recordBytesServed(video.UserID, "stream", cw)
+	http.ServeContent(cw, r, "", info.ModTime(), f)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// rangeS3 serves the fake bucket's objects with support for Range requests.
+func rangeS3(t *testing.T, fake *fakeS3) *s3.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		body, ok := fake.object(bucket, key)
+		if r.Method != http.MethodGet || !ok {
+			fake.ServeHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		http.ServeContent(rec, r, key, time.Time{}, bytes.NewReader(body))
+		if rec.Code == http.StatusRequestedRangeNotSatisfiable {
+			writeS3Error(w, rec.Code, "InvalidRange")
+			return
+		}
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return s3.New(s3.Options{
+		Region:       testRegion,
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+}
+
+// brokenResponseWriter accepts limit body bytes, then fails as if the client
+// had disconnected.
+type brokenResponseWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *brokenResponseWriter) Write(b []byte) (int, error) {
+	if len(b) > w.limit {
+		n, _ := w.ResponseRecorder.Write(b[:w.limit])
+		w.limit = 0
+		return n, errors.New("connection reset by peer")
+	}
+	w.limit -= len(b)
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestStreamVideoCountsBytesServed(t *testing.T) {
+	media := bytes.Repeat([]byte("0123456789"), 100<<10) // 1000 KiB
+
+	tests := []struct {
+		name       string
+		rangeHdr   string
+		limit      int // bytes the client receives before disconnecting; 0 is no limit
+		wantStatus int
+		wantBytes  int64
+	}{
+		{"full download", "", 0, http.StatusOK, int64(len(media))},
+		{"range", "bytes=100-1099", 0, http.StatusPartialContent, 1000},
+		{"open-ended range", "bytes=1000000-", 0, http.StatusPartialContent, int64(len(media)) - 1000000},
+		{"interrupted download", "", 64 << 10, http.StatusOK, 64 << 10},
+		{"interrupted range", "bytes=0-499999", 1234, http.StatusPartialContent, 1234},
+		{"unsatisfiable range", "bytes=5000000-", 0, http.StatusRequestedRangeNotSatisfiable, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, fake := newTestConfig(t)
+			cfg.s3CfDistribution = "https://cdn.example.com"
+			cfg.s3Client = rangeS3(t, fake)
+			owner, _ := createTestUser(t, cfg, "owner@example.com")
+			video := createTestVideo(t, cfg, owner.ID)
+			fake.put(testBucket, "landscape/abc.mp4", media)
+			videoURL := cfg.getCloudFrontURL("landscape/abc.mp4")
+			video.VideoURL = &videoURL
+			if err := cfg.db.UpdateVideo(video); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/stream", nil)
+			r.SetPathValue("videoID", video.ID.String())
+			if tc.rangeHdr != "" {
+				r.Header.Set("Range", tc.rangeHdr)
+			}
+			rec := httptest.NewRecorder()
+			var w http.ResponseWriter = rec
+			if tc.limit > 0 {
+				w = &brokenResponseWriter{ResponseRecorder: rec, limit: tc.limit}
+			}
+			cfg.handlerStreamVideo(w, r)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("status %d, want %d: %.200s", rec.Code, tc.wantStatus, rec.Body)
+			}
+			if tc.wantStatus < 300 && int64(rec.Body.Len()) != tc.wantBytes {
+				t.Errorf("client received %d bytes, want %d", rec.Body.Len(), tc.wantBytes)
+			}
+
+			today := time.Now().UTC().Format(time.DateOnly)
+			billed, err := cfg.db.GetBytesServed(owner.ID, today, today)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if billed != tc.wantBytes {
+				t.Errorf("billed %d bytes, want %d", billed, tc.wantBytes)
+			}
+		})
+	}
+}
+
+func TestStreamVideoBillsOwnerAcrossRequests(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	cfg.s3Client = rangeS3(t, fake)
+	owner, _ := createTestUser(t, cfg, "owner@example.com")
+	viewer, _ := createTestUser(t, cfg, "viewer@example.com")
+	video := createTestVideo(t, cfg, owner.ID)
+	fake.put(testBucket, "landscape/abc.mp4", []byte("0123456789"))
+	videoURL := cfg.getCloudFrontURL("landscape/abc.mp4")
+	video.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rangeHdr := range []string{"", "bytes=0-3"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/stream", nil)
+		r.SetPathValue("videoID", video.ID.String())
+		if rangeHdr != "" {
+			r.Header.Set("Range", rangeHdr)
+		}
+		cfg.handlerStreamVideo(httptest.NewRecorder(), r)
+	}
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	for _, tc := range []struct {
+		userID uuid.UUID
+		want   int64
+	}{{owner.ID, 14}, {viewer.ID, 0}} {
+		got, err := cfg.db.GetBytesServed(tc.userID, today, today)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("user %s billed %d bytes, want %d", tc.userID, got, tc.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	cfg.metrics.registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`tubely_media_bytes_served_total{endpoint="stream",code="200"} 10`,
+		`tubely_media_bytes_served_total{endpoint="stream",code="206"} 4`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %s:\n%s", want, rec.Body)
+		}
+	}
+}
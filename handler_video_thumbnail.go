@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoThumbnail redirects to the video's thumbnail. In lazy mode the
+// thumbnail is generated here on first request.
+func (cfg *apiConfig) handlerVideoThumbnail(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if !cfg.canViewVideo(r, video) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	if cfg.thumbnailMode == thumbnailModeLazy && needsThumbnail(video) && video.VideoURL != nil {
+		video, err = cfg.lazyThumbnail(r.Context(), video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't generate thumbnail", err)
+			return
+		}
+	}
+	if video.ThumbnailURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no thumbnail", nil)
+		return
+	}
+
+	// Thumbnails kept in a private bucket are only reachable signed
+	url, err := cfg.signObjectURL(r.Context(), *video.ThumbnailURL, presignOverrides{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign thumbnail URL", err)
+		return
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Screen readers read alt text in full, so it's kept to a sentence or two.
+const maxThumbnailAltLength = 250
+
+// handlerVideoThumbnailMetaUpdate sets the thumbnail's alt text.
+func (cfg *apiConfig) handlerVideoThumbnailMetaUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Alt string `json:"alt"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	// Four bytes per character is the most UTF-8 needs, plus room for the
+	// JSON around it
+	r.Body = http.MaxBytesReader(w, r.Body, maxThumbnailAltLength*4+1024)
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	alt := strings.TrimSpace(params.Alt)
+	if alt == "" {
+		respondWithError(w, http.StatusBadRequest, "alt is required", nil)
+		return
+	}
+	if utf8.RuneCountInString(alt) > maxThumbnailAltLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("alt can't be longer than %d characters", maxThumbnailAltLength), nil)
+		return
+	}
+	if hasControlChars(alt) {
+		respondWithError(w, http.StatusBadRequest, "alt contains control characters", nil)
+		return
+	}
+
+	video.ThumbnailAlt = alt
+	if err := cfg.db.UpdateVideo(video); errors.Is(err, database.ErrVideoModified) {
+		respondWithError(w, http.StatusConflict, "video was modified concurrently", err)
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.signVideoForResponse(r.Context(), video))
+}
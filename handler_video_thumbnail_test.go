@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestThumbnailFlightsShareOneCall(t *testing.T) {
+	flights := newThumbnailFlights()
+	id := uuid.New()
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]database.Video, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = flights.do(id, func() (database.Video, error) {
+				calls.Add(1)
+				<-release
+				return database.Video{ID: id}, nil
+			})
+		}()
+	}
+	// Give every caller time to queue up behind the first
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fn ran %d times, want 1", n)
+	}
+	for i, v := range results {
+		if v.ID != id {
+			t.Errorf("caller %d got video %s, want %s", i, v.ID, id)
+		}
+	}
+
+	// Once finished, the next call runs again
+	flights.do(id, func() (database.Video, error) {
+		calls.Add(1)
+		return database.Video{}, nil
+	})
+	if n := calls.Load(); n != 2 {
+		t.Errorf("fn ran %d times after the flight finished, want 2", n)
+	}
+}
+
+func thumbnailRequest(videoID string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/videos/"+videoID+"/thumbnail", nil)
+	r.SetPathValue("videoID", videoID)
+	return r
+}
+
+func TestVideoThumbnailLazyGeneration(t *testing.T) {
+	// Stands in for frame extraction, counting how often it runs
+	calls := filepath.Join(t.TempDir(), "calls")
+	t.Setenv("FFMPEG_CALLS", calls)
+	fakeFFmpeg(t, `echo >> "$FFMPEG_CALLS"
+sleep 0.2
+echo frame > "$out"`)
+
+	cfg, fake := newTestConfig(t)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	cfg.thumbnailMode = thumbnailModeLazy
+	cfg.thumbnailFlights = newThumbnailFlights()
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+	fake.put(testBucket, "landscape/abc.mp4", []byte("media"))
+	videoURL := cfg.getCloudFrontURL("landscape/abc.mp4")
+	video.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simultaneous first requests generate it once
+	var wg sync.WaitGroup
+	locations := make([]string, 5)
+	for i := range locations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			cfg.handlerVideoThumbnail(w, thumbnailRequest(video.ID.String()))
+			if w.Code != http.StatusFound {
+				t.Errorf("status %d: %s", w.Code, w.Body)
+			}
+			locations[i] = w.Header().Get("Location")
+		}()
+	}
+	wg.Wait()
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ThumbnailURL == nil || stored.ThumbnailSource != database.ThumbnailSourceAuto {
+		t.Fatalf("generated thumbnail wasn't stored: %+v", stored)
+	}
+	for i, loc := range locations {
+		if loc != *stored.ThumbnailURL {
+			t.Errorf("request %d redirected to %q, want %q", i, loc, *stored.ThumbnailURL)
+		}
+	}
+
+	// Later requests are served from the record
+	w := httptest.NewRecorder()
+	cfg.handlerVideoThumbnail(w, thumbnailRequest(video.ID.String()))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != *stored.ThumbnailURL {
+		t.Errorf("cached request: status %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 1 {
+		t.Errorf("frame extraction ran %d times, want 1", n)
+	}
+}
+
+func TestVideoThumbnailWithoutLazyMode(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.thumbnailMode = thumbnailModeOff
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+
+	bare := createTestVideo(t, cfg, user.ID)
+	withThumbnail := createTestVideo(t, cfg, user.ID)
+	url := "https://cdn.example.com/thumb.png"
+	withThumbnail.ThumbnailURL = &url
+	if err := cfg.db.UpdateVideo(withThumbnail); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoThumbnail(w, thumbnailRequest(bare.ID.String()))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("video without a thumbnail: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.handlerVideoThumbnail(w, thumbnailRequest(withThumbnail.ID.String()))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != url {
+		t.Errorf("status %d, Location %q; want a redirect to %s", w.Code, w.Header().Get("Location"), url)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.handlerVideoThumbnail(w, thumbnailRequest(uuid.NewString()))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown video: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestReplacingPlaceholderThumbnailKeepsPlaceholder(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+
+	placeholderPath, err := cfg.getAssetDiskPath("placeholder.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(placeholderPath, []byte("jpeg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.thumbnailPlaceholderURL = cfg.getAssetURL("placeholder.jpg")
+
+	video := createTestVideo(t, cfg, user.ID)
+	fake.put(testBucket, "landscape/abc.mp4", []byte("media"))
+	videoURL := cfg.getObjectURL(testBucket, "landscape/abc.mp4")
+	video.VideoURL = &videoURL
+	cfg.applyThumbnailPlaceholder(&video)
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newURL := cfg.getAssetURL("frame.jpg")
+	updated, err := cfg.replaceThumbnailFromMedia(context.Background(), video, database.ThumbnailSourceUser, func(string) (string, int64, error) {
+		return newURL, 4, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ThumbnailURL == nil || *updated.ThumbnailURL != newURL {
+		t.Errorf("thumbnail = %v, want %s", updated.ThumbnailURL, newURL)
+	}
+	if _, err := os.Stat(placeholderPath); err != nil {
+		t.Errorf("placeholder was removed when the video's thumbnail was replaced: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var transcriptFormats = map[string]string{
+	"text/plain":           database.TranscriptFormatText,
+	"text/vtt":             database.TranscriptFormatVTT,
+	"application/x-subrip": database.TranscriptFormatSRT,
+}
+
+var transcriptContentTypes = map[string]string{
+	database.TranscriptFormatText: "text/plain; charset=utf-8",
+	database.TranscriptFormatVTT:  "text/vtt; charset=utf-8",
+	database.TranscriptFormatSRT:  "application/x-subrip; charset=utf-8",
+}
+
+// handlerVideoTranscriptSet attaches a transcript to the video, replacing any
+// existing one. The body is plain text, WebVTT or SRT, chosen by Content-Type.
+func (cfg *apiConfig) handlerVideoTranscriptSet(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
+		return
+	}
+	format, ok := transcriptFormats[mediaType]
+	if !ok {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Transcript must be text/plain, text/vtt or application/x-subrip", nil)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxTranscriptBytes)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Transcript is too large", err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "Couldn't read transcript", err)
+		return
+	}
+	if !utf8.Valid(body) {
+		respondWithError(w, http.StatusBadRequest, "Transcript must be UTF-8 text", nil)
+		return
+	}
+	if strings.TrimSpace(string(body)) == "" {
+		respondWithError(w, http.StatusBadRequest, "Transcript is empty", nil)
+		return
+	}
+
+	transcript := database.Transcript{
+		VideoID: video.ID,
+		Format:  format,
+		Body:    string(body),
+		Text:    transcriptText(format, string(body)),
+	}
+	if err := cfg.db.UpsertTranscript(transcript); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save transcript", err)
+		return
+	}
+
+	video.TranscriptFormat = format
+	if err := cfg.db.UpdateVideo(video); errors.Is(err, database.ErrVideoModified) {
+		respondWithError(w, http.StatusConflict, "video was modified concurrently", err)
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.signVideoForResponse(r.Context(), video))
+}
+
+// handlerVideoTranscriptGet serves the transcript in the format it was
+// uploaded in.
+func (cfg *apiConfig) handlerVideoTranscriptGet(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if !cfg.canViewVideo(r, video) || video.TranscriptFormat == "" {
+		respondWithError(w, http.StatusNotFound, "Couldn't get transcript", nil)
+		return
+	}
+
+	transcript, err := cfg.db.GetTranscript(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get transcript", err)
+		return
+	}
+	if transcript.Format == "" {
+		respondWithError(w, http.StatusNotFound, "Couldn't get transcript", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", transcriptContentTypes[transcript.Format])
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, transcript.Body)
+}
+
+// handlerVideosSearch lists the user's videos whose transcript contains the
+// q query parameter.
+func (cfg *apiConfig) handlerVideosSearch(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing search query", nil)
+		return
+	}
+
+	videos, err := cfg.db.SearchVideosByTranscript(userID, q)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't search videos", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.batchSignVideos(r.Context(), videos))
+}
+
+var cueTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// transcriptText reduces a transcript to its spoken words so searches don't
+// match cue numbers, timings or styling tags.
+func transcriptText(format, body string) string {
+	if format == database.TranscriptFormatText {
+		return body
+	}
+
+	var words []string
+	inHeader := format == database.TranscriptFormatVTT
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			inHeader = false
+			continue
+		}
+		if inHeader || strings.Contains(line, "-->") || isCueNumber(line) {
+			continue
+		}
+		line = strings.TrimSpace(cueTagPattern.ReplaceAllString(line, ""))
+		if line != "" {
+			words = append(words, line)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func isCueNumber(line string) bool {
+	for _, r := range line {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const testVTT = `WEBVTT
+Kind: captions
+
+1
+00:00:01.000 --> 00:00:04.000
+Welcome to <b>Tubely</b>
+
+2
+00:00:05.000 --> 00:00:08.000
+Today we talk about 100% of buckets
+`
+
+func transcriptRequest(videoID, token, contentType, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPut, "/api/videos/"+videoID+"/transcript", strings.NewReader(body))
+	r.SetPathValue("videoID", videoID)
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func searchVideos(t *testing.T, cfg *apiConfig, token, q string) []signedVideo {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/videos/search?q="+q, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerVideosSearch(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("search %q: status %d: %s", q, w.Code, w.Body)
+	}
+	var videos []signedVideo
+	if err := json.Unmarshal(w.Body.Bytes(), &videos); err != nil {
+		t.Fatal(err)
+	}
+	return videos
+}
+
+func TestVideoTranscriptAttachAndSearch(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.maxTranscriptBytes = 1 << 20
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+	createTestVideo(t, cfg, user.ID) // without a transcript
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoTranscriptSet(w, transcriptRequest(video.ID.String(), token, "text/vtt", testVTT))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var updated database.Video
+	if err := json.Unmarshal(w.Body.Bytes(), &updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.TranscriptFormat != database.TranscriptFormatVTT {
+		t.Errorf("transcript_format = %q, want %q", updated.TranscriptFormat, database.TranscriptFormatVTT)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/transcript", nil)
+	r.SetPathValue("videoID", video.ID.String())
+	w = httptest.NewRecorder()
+	cfg.handlerVideoTranscriptGet(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != testVTT {
+		t.Errorf("GET transcript: status %d, body %q", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/vtt; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	tests := []struct {
+		q    string
+		want int
+	}{
+		{"tubely", 1},
+		{"welcome%20to%20tubely", 1},
+		{"100%25", 1},
+		// Timings, cue numbers and tags aren't searchable
+		{"00:00:01", 0},
+		{"%3Cb%3E", 0},
+		// LIKE wildcards are matched literally
+		{"%25", 1},
+		{"_", 0},
+		{"podcast", 0},
+	}
+	for _, tc := range tests {
+		videos := searchVideos(t, cfg, token, tc.q)
+		if len(videos) != tc.want {
+			t.Errorf("search %q found %d videos, want %d", tc.q, len(videos), tc.want)
+			continue
+		}
+		if tc.want == 1 && videos[0].ID != video.ID {
+			t.Errorf("search %q found video %s, want %s", tc.q, videos[0].ID, video.ID)
+		}
+	}
+
+	// Other users' transcripts aren't searched
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	if videos := searchVideos(t, cfg, otherToken, "tubely"); len(videos) != 0 {
+		t.Errorf("other user found %d videos", len(videos))
+	}
+}
+
+func TestVideoTranscriptRejectsInvalid(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.maxTranscriptBytes = 64
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	tests := []struct {
+		name        string
+		token       string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"not the owner", otherToken, "text/plain", "hello", http.StatusForbidden},
+		{"unsupported format", token, "application/pdf", "hello", http.StatusUnsupportedMediaType},
+		{"too large", token, "text/plain", strings.Repeat("a", 65), http.StatusRequestEntityTooLarge},
+		{"not UTF-8", token, "text/plain", "\xff\xfe", http.StatusBadRequest},
+		{"empty", token, "text/plain", " \n", http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			cfg.handlerVideoTranscriptSet(w, transcriptRequest(video.ID.String(), tc.token, tc.contentType, tc.body))
+			if w.Code != tc.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tc.want, w.Body)
+			}
+		})
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.TranscriptFormat != "" {
+		t.Errorf("rejected transcript was attached as %q", stored.TranscriptFormat)
+	}
+}
+
+func TestTranscriptText(t *testing.T) {
+	srt := "1\r\n00:00:01,000 --> 00:00:02,000\r\nHello <i>there</i>\r\n\r\n2\r\n00:00:03,000 --> 00:00:04,000\r\nGeneral Kenobi\r\n"
+	if got, want := transcriptText(database.TranscriptFormatSRT, srt), "Hello there General Kenobi"; got != want {
+		t.Errorf("SRT text = %q, want %q", got, want)
+	}
+	if got, want := transcriptText(database.TranscriptFormatVTT, testVTT), "Welcome to Tubely Today we talk about 100% of buckets"; got != want {
+		t.Errorf("VTT text = %q, want %q", got, want)
+	}
+	if got := transcriptText(database.TranscriptFormatText, "12\nplain"); got != "12\nplain" {
+		t.Errorf("plain text was altered to %q", got)
+	}
+}
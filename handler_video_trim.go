@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Cuts that move by less than this aren't worth warning about.
+const trimShiftTolerance = 0.05
+
+// handlerVideoTrim cuts the video's stored media down to [start, end)
+// seconds server-side, so small edits don't need a full re-upload.
+func (cfg *apiConfig) handlerVideoTrim(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Start float64  `json:"start"`
+		End   *float64 `json:"end"`
+	}
+	type response struct {
+		database.Video
+		ActualStart float64 `json:"actual_start"`
+		Warning     string  `json:"warning,omitempty"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateRequestJWT(r, token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+	logger := requestLogger(r).With("operation", "trim_video", "video_id", videoID, "user_id", userID)
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Start < 0 || (params.End != nil && *params.End <= params.Start) {
+		respondWithError(w, http.StatusBadRequest, "start must be at least 0 and before end", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video has no media yet", nil)
+		return
+	}
+	bucket, oldKey, err := cfg.parseS3Key(*video.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate video media", err)
+		return
+	}
+
+	mediaPath, err := cfg.downloadObject(r.Context(), bucket, oldKey)
+	if err != nil {
+		respondWithError(w, http.StatusFailedDependency, "Unable to read video media", err)
+		return
+	}
+	defer os.Remove(mediaPath)
+
+	mediaCtx := cfg.mediaContext(r.Context())
+	probe, err := probeVideo(mediaCtx, mediaPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't probe video", err)
+		return
+	}
+	duration := probe.duration()
+	end := duration
+	if params.End != nil {
+		end = *params.End
+	}
+	if params.Start >= duration || end > duration {
+		msg := fmt.Sprintf("Trim range must lie within the video's %.2fs duration", duration)
+		respondWithError(w, http.StatusUnprocessableEntity, msg, nil)
+		return
+	}
+
+	keyframes, err := keyframeTimes(mediaCtx, mediaPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't inspect keyframes", err)
+		return
+	}
+	actualStart := keyframeCut(keyframes, params.Start)
+	warning := ""
+	if shift := params.Start - actualStart; math.Abs(shift) > trimShiftTolerance {
+		warning = fmt.Sprintf("cut moved %.2fs earlier to the nearest keyframe", shift)
+		logger.Info("trim start snapped to keyframe", "requested", params.Start, "actual", actualStart)
+	}
+
+	trimmedPath, err := trimVideo(mediaCtx, mediaPath, params.Start, end)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't trim video", err)
+		return
+	}
+	defer os.Remove(trimmedPath)
+
+	contentHash, err := hashFile(trimmedPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash trimmed video", err)
+		return
+	}
+	trimmedFile, err := os.Open(trimmedPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open trimmed file", err)
+		return
+	}
+	defer trimmedFile.Close()
+	trimmedInfo, err := trimmedFile.Stat()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't stat trimmed file", err)
+		return
+	}
+
+	mediaType := "video/mp4"
+	var newKey string
+	if cfg.deterministicVideoKeys {
+		// The trimmed media replaces the original under the video's one key
+		newKey, err = cfg.deterministicVideoKey(video.ID, mediaType, strings.HasPrefix(oldKey, stagingPrefix))
+	} else {
+		// Keep the aspect and staging prefixes of the original
+		randBytes := make([]byte, 32)
+		if _, err := rand.Read(randBytes); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Generating rand bytes failed", err)
+			return
+		}
+		var assetPath string
+		assetPath, err = cfg.getAssetPath(hex.EncodeToString(randBytes), mediaType)
+		newKey = path.Join(path.Dir(oldKey), assetPath)
+	}
+	if err == nil {
+		err = cfg.checkObjectKey(newKey)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't name video file", err)
+		return
+	}
+	unlockMedia := cfg.mediaLocks.lock(bucket, newKey)
+	defer unlockMedia()
+	err = cfg.uploadObject(r.Context(), &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &newKey,
+		Body:        trimmedFile,
+		ContentType: &mediaType,
+	}, trimmedInfo.Size())
+	if err != nil {
+		respondWithError(w, http.StatusFailedDependency, "Unable to upload to S3", err)
+		return
+	}
+
+	oldURL := *video.VideoURL
+	stale := cfg.detachMediaArtifacts(&video)
+	videoURL := cfg.getObjectURL(bucket, newKey)
+	videoURL = cfg.versionURL(videoURL, contentHash)
+	video.VideoURL = &videoURL
+	video.ContentHash = contentHash
+	video.Duration = end - actualStart
+	if cfg.trackFileSizes {
+		video.FileSize = trimmedInfo.Size()
+	}
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		// A random key is the trimmed copy's alone; a deterministic one is
+		// the video's, whatever it now holds
+		if !cfg.deterministicVideoKeys {
+			cfg.deleteObjects(context.Background(), bucket, []string{newKey})
+		}
+		if errors.Is(err, database.ErrVideoModified) {
+			respondWithError(w, http.StatusConflict, "video was modified concurrently", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to update video", err)
+		return
+	}
+	cfg.deleteStaleArtifacts(stale)
+
+	// The untrimmed media may still back a deduplicated copy of this video
+	cfg.presignCache.invalidate(bucket, oldKey)
+	cfg.discardReplacedMedia(r.Context(), &oldURL, videoURL)
+
+	respondWithJSON(w, http.StatusOK, response{
+		Video:       cfg.signVideoForResponse(r.Context(), video),
+		ActualStart: actualStart,
+		Warning:     warning,
+	})
+}
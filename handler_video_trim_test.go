@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func trimRequest(videoID, token, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/videos/"+videoID+"/trim", strings.NewReader(body))
+	r.SetPathValue("videoID", videoID)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestKeyframeCut(t *testing.T) {
+	keyframes := []float64{0, 2, 4, 6}
+	tests := map[float64]float64{
+		0:   0,
+		1.5: 0,
+		2:   2,
+		3.9: 2,
+		7:   6,
+	}
+	for start, want := range tests {
+		if got := keyframeCut(keyframes, start); got != want {
+			t.Errorf("keyframeCut(%v) = %v, want %v", start, got, want)
+		}
+	}
+	if got := keyframeCut(nil, 3); got != 0 {
+		t.Errorf("no keyframes: got %v, want 0", got)
+	}
+}
+
+func TestVideoTrimRejectsInvalidRequests(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := createTestVideo(t, cfg, owner.ID)
+
+	tests := []struct {
+		name  string
+		token string
+		body  string
+		want  int
+	}{
+		{"malformed body", token, `{"start":`, http.StatusBadRequest},
+		{"negative start", token, `{"start":-1}`, http.StatusBadRequest},
+		{"end before start", token, `{"start":5,"end":2}`, http.StatusBadRequest},
+		{"empty range", token, `{"start":2,"end":2}`, http.StatusBadRequest},
+		{"not the owner", otherToken, `{"start":1}`, http.StatusForbidden},
+		{"no media yet", token, `{"start":1}`, http.StatusConflict},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		cfg.handlerVideoTrim(w, trimRequest(video.ID.String(), tc.token, tc.body))
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+	}
+}
+
+func TestVideoTrim(t *testing.T) {
+	// Ten seconds with a keyframe every two
+	clip := makeFixture(t, "clip.mp4",
+		"-f", "lavfi", "-i", "testsrc=duration=10:size=160x90:rate=10",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-g", "20", "-sc_threshold", "0",
+	)
+	data, err := os.ReadFile(clip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, fake := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createStoredVideo(t, cfg, fake, user, "landscape/clip.mp4")
+	fake.put(testBucket, "landscape/clip.mp4", data)
+
+	for name, body := range map[string]string{
+		"end past the end":   `{"start":1,"end":20}`,
+		"start past the end": `{"start":15}`,
+	} {
+		w := httptest.NewRecorder()
+		cfg.handlerVideoTrim(w, trimRequest(video.ID.String(), token, body))
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status %d, want %d: %s", name, w.Code, http.StatusUnprocessableEntity, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoTrim(w, trimRequest(video.ID.String(), token, `{"start":3,"end":8}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		database.Video
+		ActualStart float64 `json:"actual_start"`
+		Warning     string  `json:"warning"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ActualStart != 2 || resp.Warning == "" {
+		t.Errorf("actual start %v, warning %q; want the cut snapped back to 2s", resp.ActualStart, resp.Warning)
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, newKey, err := cfg.parseS3Key(*stored.VideoURL)
+	if err != nil || newKey == "landscape/clip.mp4" {
+		t.Fatalf("video URL %s wasn't replaced", *stored.VideoURL)
+	}
+	trimmed, ok := fake.object(testBucket, newKey)
+	if !ok {
+		t.Fatalf("trimmed object %s wasn't uploaded", newKey)
+	}
+	if _, ok := fake.object(testBucket, "landscape/clip.mp4"); ok {
+		t.Error("the untrimmed object wasn't deleted")
+	}
+
+	trimmedPath := filepath.Join(t.TempDir(), "trimmed.mp4")
+	if err := os.WriteFile(trimmedPath, trimmed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	probe, err := probeVideo(context.Background(), trimmedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := probe.duration(); d < 5.5 || d > 6.5 {
+		t.Errorf("trimmed duration %.2fs, want about 6s", d)
+	}
+}
+
+func TestVideoTrimKeepsDeterministicKey(t *testing.T) {
+	clip := makeFixture(t, "clip.mp4",
+		"-f", "lavfi", "-i", "testsrc=duration=10:size=160x90:rate=10",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-g", "20", "-sc_threshold", "0",
+	)
+	data, err := os.ReadFile(clip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, fake := newTestConfig(t)
+	cfg.deterministicVideoKeys = true
+	user, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+	key, err := cfg.deterministicVideoKey(video.ID, "video/mp4", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.put(testBucket, key, data)
+	videoURL := cfg.getObjectURL(testBucket, key)
+	video.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoTrim(w, trimRequest(video.ID.String(), token, `{"start":2,"end":6}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, newKey, err := cfg.parseS3Key(*stored.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey != key {
+		t.Errorf("trimmed media stored under %s, want the deterministic key %s", newKey, key)
+	}
+	if trimmed, ok := fake.object(testBucket, key); !ok || len(trimmed) == len(data) {
+		t.Error("trimmed media didn't replace the original under its key")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerVideoUploadProgress(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		BytesReceived int64 `json:"bytes_received"`
+		// BytesTotal is -1 when the client didn't declare the upload's size
+		BytesTotal int64 `json:"bytes_total"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't view this video's upload", nil)
+		return
+	}
+
+	progress, ok := cfg.uploadProgress.get(videoID)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "No upload in progress", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		BytesReceived: progress.received.Load(),
+		BytesTotal:    progress.total,
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// videoValidation is what an upload of the file would be stored as.
+type videoValidation struct {
+	AspectRatio string  `json:"aspect_ratio"`
+	Duration    float64 `json:"duration"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	VideoCodec  string  `json:"video_codec"`
+	AudioCodec  string  `json:"audio_codec,omitempty"`
+	Container   string  `json:"container"`
+	StillImage  bool    `json:"still_image,omitempty"`
+}
+
+// handlerVideoValidate runs a file through the same checks as an upload and
+// reports what was detected, without storing anything. The quota is checked
+// as if the file were uploaded as a new video.
+func (cfg *apiConfig) handlerVideoValidate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoUploadBytes)
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := cfg.validateRequestJWT(r, token)
+	if err != nil {
+		respondWithJWTError(w, err)
+		return
+	}
+	logger := requestLogger(r).With("operation", "validate_video", "user_id", userID)
+
+	const maxMemory = 32 << 20
+	err = r.ParseMultipartForm(maxMemory)
+	defer removeMultipartFiles(r)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("File exceeds %d byte limit", cfg.maxVideoUploadBytes), err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidForm, "Invalid multipart form", err)
+		return
+	}
+	file, header, err := r.FormFile("video")
+	if errors.Is(err, http.ErrMissingFile) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeFileRequired, "video file is required", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't parse form file", err)
+		return
+	}
+	defer file.Close()
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidContentType, "Invalid Content-Type", err)
+		return
+	}
+	if !cfg.acceptsVideoType(mediaType) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFileType, "Invalid file type", nil)
+		return
+	}
+
+	// ffprobe opens the file by path, so it has to be complete on disk
+	tempFile, cleanupTemp, err := createUploadTemp(cfg.uploadTempDir)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temporary file", err)
+		return
+	}
+	defer cleanupTemp()
+	if _, err := io.Copy(tempFile, file); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save video", err)
+		return
+	}
+	if err := tempFile.Sync(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save video", err)
+		return
+	}
+
+	check, err := cfg.checkVideoFile(r.Context(), userID, 0, tempFile, mediaType)
+	if err != nil {
+		respondWithUploadError(w, err)
+		return
+	}
+	probe := check.probe
+	// checkVideoFile has made sure there is one
+	stream, _ := probe.videoStream()
+
+	ratio, err := probe.aspectRatio()
+	if errors.Is(err, errNoDimensions) && cfg.aspectRatioFallback != "" {
+		ratio, err = cfg.aspectRatioFallback, nil
+	}
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidVideo, "Couldn't determine video aspect ratio", err)
+		return
+	}
+
+	result := videoValidation{
+		AspectRatio: ratio,
+		Duration:    probe.duration(),
+		Width:       stream.Width,
+		Height:      stream.Height,
+		VideoCodec:  stream.CodecName,
+		Container:   probe.Format.FormatName,
+		StillImage:  check.stillImage,
+	}
+	for _, s := range probe.Streams {
+		if s.CodecType == "audio" {
+			result.AudioCodec = s.CodecName
+			break
+		}
+	}
+
+	logger.Info("validated video", "aspect_ratio", ratio, "duration", result.Duration, "video_codec", result.VideoCodec)
+	respondWithJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Validation rejects what an upload would, before the file is ever probed.
+func TestValidateVideoRunsUploadChecks(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		setup      func(*testing.T, *apiConfig)
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:    "over quota",
+			content: "0123456789",
+			setup: func(t *testing.T, cfg *apiConfig) {
+				cfg.userStorageQuota = 5
+			},
+			wantStatus: http.StatusForbidden,
+			wantCode:   errCodeQuotaExceeded,
+		},
+		{
+			name:    "infected",
+			content: "INFECTED bytes",
+			setup: func(t *testing.T, cfg *apiConfig) {
+				cfg.scanCommand, _ = fakeScanner(t, `grep -q INFECTED "$1" && exit 1
+exit 0
+`)
+			},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   errCodeMalwareDetected,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newVideoTestConfig(t)
+			_, token := createTestUser(t, cfg, "validate@example.com")
+			tc.setup(t, cfg)
+
+			r := videoUploadRequest(t, "", token, "video/mp4", []byte(tc.content))
+			w := httptest.NewRecorder()
+			cfg.handlerVideoValidate(w, r)
+			if w.Code != tc.wantStatus || errorCode(t, w) != tc.wantCode {
+				t.Fatalf("got %d %q, want %d %q: %s", w.Code, errorCode(t, w), tc.wantStatus, tc.wantCode, w.Body)
+			}
+		})
+	}
+}
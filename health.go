@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Each readiness check gets this long before its dependency counts as down.
+const healthCheckTimeout = 2 * time.Second
+
+// handlerHealthz is the readiness probe. It responds 503 unless both the
+// database and the S3 bucket can be reached. The probe is unauthenticated, so
+// each check only reports "ok" or "fail"; the reason is logged.
+func (cfg *apiConfig) handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Status      string            `json:"status"`
+		Maintenance bool              `json:"maintenance"`
+		Checks      map[string]string `json:"checks"`
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	logger := requestLogger(r)
+
+	checks := map[string]func(context.Context) error{
+		"database": cfg.db.Ping,
+		"s3": func(ctx context.Context) error {
+			_, err := cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &cfg.s3Bucket})
+			return err
+		},
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := map[string]string{}
+	healthy := true
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := "ok"
+			if err := check(ctx); err != nil {
+				logger.Error("health check failed", "check", name, "error", err)
+				result = "fail"
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results[name] = result
+			healthy = healthy && result == "ok"
+		}()
+	}
+	wg.Wait()
+
+	status, code := "ok", http.StatusOK
+	if !healthy {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	respondWithJSON(w, code, response{
+		Status:      status,
+		Maintenance: cfg.maintenance.Load(),
+		Checks:      results,
+	})
+}
+
+// handlerLivez is the liveness probe: answering at all means the process is
+// up.
+func (cfg *apiConfig) handlerLivez(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
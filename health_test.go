@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthzHidesFailureDetails(t *testing.T) {
+	// The fake S3 has no bucket to HEAD, so that check fails
+	cfg, _ := newTestConfig(t)
+	cfg.maintenance = &atomic.Bool{}
+
+	w := httptest.NewRecorder()
+	cfg.handlerHealthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	var body struct {
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"database": "ok", "s3": "fail"}
+	for name, result := range want {
+		if body.Checks[name] != result {
+			t.Errorf("%s check = %q, want %q", name, body.Checks[name], result)
+		}
+	}
+}
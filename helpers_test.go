@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	testBucket    = "tubely-test"
+	testRegion    = "us-east-1"
+	testJWTSecret = "test-secret"
+)
+
+// fakeS3 is just enough of the S3 API, served path-style, for single-part
+// uploads, copies, reads and deletes. Like S3, it rejects a PUT whose body
+// doesn't match its SHA-256 checksum header.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	// headers holds the request headers of the last PUT to each key
+	headers map[string]http.Header
+	// failures makes PUTs to a key, or to any key under "*", fail with the
+	// given error code
+	failures map[string]string
+	// remainingFailures limits a key's failure to that many more PUTs
+	remainingFailures map[string]int
+}
+
+func newFakeS3(t testing.TB) (*fakeS3, *s3.Client) {
+	t.Helper()
+	f := &fakeS3{
+		objects:           map[string][]byte{},
+		headers:           map[string]http.Header{},
+		failures:          map[string]string{},
+		remainingFailures: map[string]int{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	client := s3.New(s3.Options{
+		Region:       testRegion,
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+	return f, client
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		code, ok := f.failures[id]
+		if ok {
+			if n, limited := f.remainingFailures[id]; limited {
+				if n <= 1 {
+					delete(f.failures, id)
+					delete(f.remainingFailures, id)
+				} else {
+					f.remainingFailures[id] = n - 1
+				}
+			}
+		} else {
+			code, ok = f.failures["*"]
+		}
+		if ok {
+			status := http.StatusForbidden
+			if code == "SlowDown" {
+				status = http.StatusServiceUnavailable
+			}
+			writeS3Error(w, status, code)
+			return
+		}
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			body, ok := f.objects[strings.TrimPrefix(src, "/")]
+			if !ok {
+				writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			f.objects[id] = body
+			f.headers[id] = r.Header.Clone()
+			fmt.Fprint(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+			return
+		}
+		body, err := readS3Body(r)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		if want := r.Header.Get("X-Amz-Checksum-Sha256"); want != "" {
+			sum := sha256.Sum256(body)
+			if want != base64.StdEncoding.EncodeToString(sum[:]) {
+				writeS3Error(w, http.StatusBadRequest, "BadDigest")
+				return
+			}
+		}
+		f.objects[id] = body
+		f.headers[id] = r.Header.Clone()
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodGet, http.MethodHead:
+		body, ok := f.objects[id]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case http.MethodDelete:
+		delete(f.objects, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) object(bucket, key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.objects[bucket+"/"+key]
+	return body, ok
+}
+
+func (f *fakeS3) putHeaders(bucket, key string) http.Header {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.headers[bucket+"/"+key]
+}
+
+func (f *fakeS3) put(bucket, key string, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[bucket+"/"+key] = body
+}
+
+// count returns how many objects are stored.
+func (f *fakeS3) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.objects)
+}
+
+// failPuts makes uploads to the key fail with a non-retryable error.
+func (f *fakeS3) failPuts(bucket, key string) {
+	f.setFailure(bucket, key, "AccessDenied")
+}
+
+// throttlePuts makes uploads to the key fail with SlowDown until cleared.
+func (f *fakeS3) throttlePuts(bucket, key string, throttled bool) {
+	if !throttled {
+		f.setFailure(bucket, key, "")
+		return
+	}
+	f.setFailure(bucket, key, "SlowDown")
+}
+
+// failPutsTimes makes the next n uploads to the key fail with the code.
+func (f *fakeS3) failPutsTimes(bucket, key, code string, n int) {
+	f.setFailure(bucket, key, code)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.remainingFailures[bucket+"/"+key] = n
+}
+
+func (f *fakeS3) setFailure(bucket, key, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.remainingFailures, bucket+"/"+key)
+	if code == "" {
+		delete(f.failures, bucket+"/"+key)
+		return
+	}
+	f.failures[bucket+"/"+key] = code
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+// readS3Body reads a PUT body, undoing the aws-chunked encoding the SDK uses
+// to send checksums as trailers.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return io.ReadAll(r.Body)
+	}
+	var body bytes.Buffer
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return body.Bytes(), nil
+		}
+		if _, err := io.CopyN(&body, br, size); err != nil {
+			return nil, err
+		}
+		if _, err := br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// newTestConfig returns a config backed by a fake S3 bucket and an empty
+// database, with assets and temp files in per-test directories.
+func newTestConfig(t testing.TB) (*apiConfig, *fakeS3) {
+	t.Helper()
+	fake, client := newFakeS3(t)
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("couldn't open database: %v", err)
+	}
+	metrics := newAppMetrics()
+	tasks := newBackgroundTasks()
+	t.Cleanup(func() { tasks.drain(time.Minute) })
+	return &apiConfig{
+		db:                db,
+		jwtSecret:         testJWTSecret,
+		assetsRoot:        t.TempDir(),
+		uploadTempDir:     t.TempDir(),
+		port:              "8091",
+		s3Client:          client,
+		s3Uploader:        newS3Uploader(client, 5<<20, 1, 0, time.Millisecond, metrics),
+		s3Presigner:       s3.NewPresignClient(client),
+		s3Bucket:          testBucket,
+		s3Region:          testRegion,
+		metrics:           metrics,
+		mediaExtensions:   defaultMediaExtensions,
+		objectKeyPrefixes: defaultObjectKeyPrefixes,
+		presignTTL:        defaultPresignTTL,
+		thumbnailStorage:  thumbnailStorageDisk,
+		mediaLocks:        newMediaLocks(),
+		backgroundTasks:   tasks,
+	}, fake
+}
+
+// requireFFmpeg skips the test when ffmpeg and ffprobe aren't installed.
+func requireFFmpeg(t *testing.T) {
+	t.Helper()
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+}
+
+// makeFixture renders a video fixture with ffmpeg, e.g. from a lavfi
+// source, and returns its path. args go between the input and output.
+func makeFixture(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	requireFFmpeg(t)
+	out := filepath.Join(t.TempDir(), name)
+	cmd := exec.Command("ffmpeg", append(append([]string{"-v", "error", "-y"}, args...), out)...)
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("couldn't make fixture %s: %v\n%s", name, err, b)
+	}
+	return out
+}
+
+// createTestUser adds a user and returns it with a bearer token for it.
+func createTestUser(t testing.TB, cfg *apiConfig, email string) (*database.User, string) {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: email, Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.MakeJWT(user.ID, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+// createTestVideo adds a video owned by userID.
+func createTestVideo(t testing.TB, cfg *apiConfig, userID uuid.UUID) database.Video {
+	t.Helper()
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "test video", UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+// waitFor polls until cond holds, for work done in the background.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for background work")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
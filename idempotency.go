@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// Set on responses replayed for a repeated key
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	// Upper bound on remembered keys; the oldest finished entry makes way
+	// for a new one
+	maxIdempotentUploads = 10000
+)
+
+// idempotentUploads remembers the response to each upload sent with an
+// Idempotency-Key, so a client retrying after a timeout gets the original
+// response instead of a second upload. Only successful responses are kept;
+// after a failure the key can be used again. The video is looked up and
+// signed again on replay, since the URLs in the original response expire.
+type idempotentUploads struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotentUpload
+}
+
+type idempotentUpload struct {
+	// fingerprint identifies the request the key was first used for
+	fingerprint string
+	// done is set once the response below has been recorded
+	done    bool
+	status  int
+	videoID uuid.UUID
+	// response is the original response without its video, which is read
+	// fresh on replay
+	response videoUploadResponse
+	at       time.Time
+}
+
+func newIdempotentUploads(ttl time.Duration) *idempotentUploads {
+	if ttl <= 0 {
+		return nil
+	}
+	return &idempotentUploads{
+		ttl:     ttl,
+		entries: map[string]*idempotentUpload{},
+	}
+}
+
+func idempotentUploadKey(userID uuid.UUID, key string) string {
+	return userID.String() + "\x00" + key
+}
+
+// claim registers a request under key. If the key has already been used,
+// the existing entry is returned instead and claimed is false. When every
+// slot is taken by an upload still in progress, the request isn't tracked
+// and the returned entry is nil.
+func (iu *idempotentUploads) claim(key, fingerprint string) (entry *idempotentUpload, claimed bool) {
+	iu.mu.Lock()
+	defer iu.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range iu.entries {
+		if e.done && now.Sub(e.at) > iu.ttl {
+			delete(iu.entries, k)
+		}
+	}
+
+	if e, ok := iu.entries[key]; ok {
+		return e, false
+	}
+	if len(iu.entries) >= maxIdempotentUploads && !iu.evictOldest() {
+		return nil, true
+	}
+	e := &idempotentUpload{fingerprint: fingerprint, at: now}
+	iu.entries[key] = e
+	return e, true
+}
+
+// evictOldest forgets the oldest finished entry, reporting whether there
+// was one. The caller holds iu.mu.
+func (iu *idempotentUploads) evictOldest() bool {
+	var oldestKey string
+	var oldest *idempotentUpload
+	for k, e := range iu.entries {
+		if e.done && (oldest == nil || e.at.Before(oldest.at)) {
+			oldestKey, oldest = k, e
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(iu.entries, oldestKey)
+	return true
+}
+
+// finish records the response to a claimed request, or forgets the key if
+// the request failed.
+func (iu *idempotentUploads) finish(key string, entry *idempotentUpload, w *recordingResponseWriter) {
+	var resp videoUploadResponse
+	ok := w.status >= 200 && w.status <= 299 && json.Unmarshal(w.body.Bytes(), &resp) == nil
+
+	iu.mu.Lock()
+	defer iu.mu.Unlock()
+	if !ok {
+		delete(iu.entries, key)
+		return
+	}
+	entry.status = w.status
+	entry.videoID = resp.ID
+	resp.Video = database.Video{}
+	entry.response = resp
+	entry.at = time.Now()
+	entry.done = true
+}
+
+// replayIdempotentUpload answers a request whose key was already used: with
+// the original response if it was for the same upload and has finished, or
+// with a 409.
+func (cfg *apiConfig) replayIdempotentUpload(w http.ResponseWriter, r *http.Request, entry *idempotentUpload, fingerprint string) {
+	iu := cfg.idempotentUploads
+	iu.mu.Lock()
+	done, status, videoID, resp := entry.done, entry.status, entry.videoID, entry.response
+	iu.mu.Unlock()
+
+	if entry.fingerprint != fingerprint {
+		respondWithErrorCode(w, http.StatusConflict, errCodeIdempotencyKeyReused, "Idempotency-Key was already used for a different upload", nil)
+		return
+	}
+	if !done {
+		respondWithErrorCode(w, http.StatusConflict, errCodeIdempotencyKeyInFlight, "An upload with this Idempotency-Key is still in progress", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeVideoNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	resp.Video = cfg.signVideoForResponse(r.Context(), video)
+	w.Header().Set(idempotentReplayedHeader, "true")
+	respondWithJSON(w, status, resp)
+}
+
+// recordingResponseWriter keeps a copy of the response it passes through.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
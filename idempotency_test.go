@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotentReplaySignsVideoAgain(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.idempotentUploads = newIdempotentUploads(time.Hour)
+	user, _ := createTestUser(t, cfg, "replay@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	key := idempotentUploadKey(user.ID, "retry-1")
+	entry, claimed := cfg.idempotentUploads.claim(key, "fingerprint")
+	if !claimed || entry == nil {
+		t.Fatalf("claim() = %v, %v; want a new entry", entry, claimed)
+	}
+	stale := "https://example.com/expired"
+	video.VideoURL = &stale
+	recorder := &recordingResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	respondWithJSON(recorder, http.StatusAccepted, videoUploadResponse{Video: video, ProcessingProfile: "default"})
+	cfg.idempotentUploads.finish(key, entry, recorder)
+
+	// The video has moved on since the first response
+	videoURL := cfg.getObjectURL(testBucket, "landscape/abc.mp4")
+	video.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, claimed = cfg.idempotentUploads.claim(key, "fingerprint")
+	if claimed {
+		t.Fatal("repeated key was claimed again")
+	}
+	w := httptest.NewRecorder()
+	cfg.replayIdempotentUpload(w, httptest.NewRequest(http.MethodPost, "/", nil), entry, "fingerprint")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	if w.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Error("replayed response isn't marked as such")
+	}
+	var resp videoUploadResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProcessingProfile != "default" {
+		t.Errorf("processing_profile = %q, want %q", resp.ProcessingProfile, "default")
+	}
+	if resp.VideoURL == nil {
+		t.Fatal("replayed response has no video URL")
+	}
+	signed, err := url.Parse(*resp.VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(signed.Path, "/landscape/abc.mp4") || signed.Query().Get("X-Amz-Expires") == "" {
+		t.Errorf("video URL %q isn't a fresh presigned link", *resp.VideoURL)
+	}
+
+	// A different upload under the same key is refused
+	w = httptest.NewRecorder()
+	cfg.replayIdempotentUpload(w, httptest.NewRequest(http.MethodPost, "/", nil), entry, "other")
+	if w.Code != http.StatusConflict {
+		t.Errorf("status for a reused key = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestIdempotentUploadsCap(t *testing.T) {
+	iu := newIdempotentUploads(time.Hour)
+	done := func(key string) {
+		entry, _ := iu.claim(key, "fp")
+		w := &recordingResponseWriter{ResponseWriter: httptest.NewRecorder()}
+		respondWithJSON(w, http.StatusOK, videoUploadResponse{})
+		iu.finish(key, entry, w)
+	}
+
+	done("oldest")
+	for i := 1; i < maxIdempotentUploads; i++ {
+		done(strconv.Itoa(i))
+	}
+	if entry, claimed := iu.claim("new", "fp"); !claimed || entry == nil {
+		t.Fatal("full cache didn't make room for a new key")
+	}
+	if len(iu.entries) != maxIdempotentUploads {
+		t.Errorf("%d entries, want %d", len(iu.entries), maxIdempotentUploads)
+	}
+	if _, ok := iu.entries["oldest"]; ok {
+		t.Error("oldest entry wasn't evicted")
+	}
+
+	// Uploads still in progress are never evicted
+	for k, e := range iu.entries {
+		if e.done {
+			delete(iu.entries, k)
+			iu.entries[k+"-busy"] = &idempotentUpload{fingerprint: "fp", at: time.Now()}
+		}
+	}
+	if entry, claimed := iu.claim("untracked", "fp"); !claimed || entry != nil {
+		t.Errorf("claim() with only in-progress entries = %v, %v; want nil, true", entry, claimed)
+	}
+	if len(iu.entries) != maxIdempotentUploads {
+		t.Errorf("%d entries, want %d", len(iu.entries), maxIdempotentUploads)
+	}
+}
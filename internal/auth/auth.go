@@ -22,6 +22,14 @@ const (
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
 
+// Token validation failures wrap one of these so callers can tell a client
+// that should refresh its token from one that has to log in again.
+var (
+	ErrTokenExpired     = errors.New("token is expired")
+	ErrTokenNotYetValid = errors.New("token is not valid yet")
+	ErrTokenInvalid     = errors.New("token is invalid")
+)
+
 func HashPassword(password string) (string, error) {
 	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -55,27 +63,44 @@ func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
 		tokenString,
 		&claimsStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, classifyTokenError(err)
+	}
+	return userIDFromToken(token, string(TokenTypeAccess))
+}
+
+// classifyTokenError wraps a parse failure in ErrTokenExpired,
+// ErrTokenNotYetValid or ErrTokenInvalid.
+func classifyTokenError(err error) error {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return fmt.Errorf("%w: %v", ErrTokenExpired, err)
+	case errors.Is(err, jwt.ErrTokenNotValidYet):
+		return fmt.Errorf("%w: %v", ErrTokenNotYetValid, err)
+	default:
+		return fmt.Errorf("%w: %v", ErrTokenInvalid, err)
 	}
+}
 
+func userIDFromToken(token *jwt.Token, wantIssuer string) (uuid.UUID, error) {
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, classifyTokenError(err)
 	}
 
 	issuer, err := token.Claims.GetIssuer()
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, classifyTokenError(err)
 	}
-	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+	if issuer != wantIssuer {
+		return uuid.Nil, fmt.Errorf("%w: invalid issuer", ErrTokenInvalid)
 	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return uuid.Nil, fmt.Errorf("%w: invalid user ID: %v", ErrTokenInvalid, err)
 	}
 	return id, nil
 }
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func signClaims(t *testing.T, claims jwt.RegisteredClaims, secret string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestValidateJWT(t *testing.T) {
+	const secret = "secret"
+	userID := uuid.New()
+	now := time.Now()
+
+	valid, err := MakeJWT(userID, secret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := MakeJWT(userID, secret, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notYetValid := signClaims(t, jwt.RegisteredClaims{
+		Issuer:    string(TokenTypeAccess),
+		Subject:   userID.String(),
+		NotBefore: jwt.NewNumericDate(now.Add(time.Hour)),
+		ExpiresAt: jwt.NewNumericDate(now.Add(2 * time.Hour)),
+	}, secret)
+	wrongIssuer := signClaims(t, jwt.RegisteredClaims{
+		Issuer:    "someone-else",
+		Subject:   userID.String(),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}, secret)
+	badSubject := signClaims(t, jwt.RegisteredClaims{
+		Issuer:    string(TokenTypeAccess),
+		Subject:   "not-a-uuid",
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}, secret)
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.RegisteredClaims{
+		Issuer:    string(TokenTypeAccess),
+		Subject:   userID.String(),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		secret  string
+		wantErr error
+	}{
+		{"valid", valid, secret, nil},
+		{"expired", expired, secret, ErrTokenExpired},
+		{"wrong secret", valid, "other-secret", ErrTokenInvalid},
+		{"future nbf", notYetValid, secret, ErrTokenNotYetValid},
+		{"wrong issuer", wrongIssuer, secret, ErrTokenInvalid},
+		{"subject isn't a user ID", badSubject, secret, ErrTokenInvalid},
+		{"alg none", unsigned, secret, ErrTokenInvalid},
+		{"garbage", "not.a.jwt", secret, ErrTokenInvalid},
+	}
+	for _, tc := range tests {
+		got, err := ValidateJWT(tc.token, tc.secret)
+		if tc.wantErr == nil {
+			if err != nil || got != userID {
+				t.Errorf("%s: ValidateJWT = %v, %v, want %v", tc.name, got, err, userID)
+			}
+			continue
+		}
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: ValidateJWT error = %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// jwksMinRefetchInterval stops tokens with made-up key IDs from making us
+// hammer the identity provider.
+const jwksMinRefetchInterval = 30 * time.Second
+
+// JWKS is a cached copy of an identity provider's published RSA signing keys.
+// Keys are refetched when the cache is older than the refresh interval or a
+// token names a key ID we haven't seen, which is how rotations show up.
+type JWKS struct {
+	url             string
+	client          *http.Client
+	refreshInterval time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// fetching is the fetch in progress, which concurrent lookups wait on
+	// instead of starting their own
+	fetching *jwksFetch
+}
+
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func NewJWKS(url string, refreshInterval time.Duration) *JWKS {
+	return &JWKS{
+		url:             url,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		refreshInterval: refreshInterval,
+	}
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (j *JWKS) key(kid string) (*rsa.PublicKey, error) {
+	j.mu.Lock()
+	stale := time.Since(j.fetchedAt) > j.refreshInterval
+	key, ok := j.keys[kid]
+	if (ok && !stale) || (!stale && time.Since(j.fetchedAt) <= jwksMinRefetchInterval) {
+		j.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}
+
+	// The lock isn't held while fetching, so lookups of cached keys aren't
+	// held up by a slow provider
+	call := j.fetching
+	if call == nil {
+		call = &jwksFetch{done: make(chan struct{})}
+		j.fetching = call
+		j.mu.Unlock()
+
+		keys, err := j.fetch()
+		j.mu.Lock()
+		if err == nil {
+			j.keys = keys
+			j.fetchedAt = time.Now()
+		}
+		call.err = err
+		j.fetching = nil
+		j.mu.Unlock()
+		close(call.done)
+	} else {
+		j.mu.Unlock()
+		<-call.done
+	}
+
+	if call.err != nil {
+		// Keep using what we had if the provider is briefly unreachable
+		if ok {
+			return key, nil
+		}
+		return nil, call.err
+	}
+	j.mu.Lock()
+	key, ok = j.keys[kid]
+	j.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// fetch downloads the provider's current signing keys.
+func (j *JWKS) fetch() (map[string]*rsa.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("couldn't fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("couldn't decode JWKS: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := rsaKeyFromJWK(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func rsaKeyFromJWK(k jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("exponent is too large")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(exponent.Int64()),
+	}, nil
+}
+
+// ValidateJWTWithJWKS checks an RS256 token signed by one of the keys in
+// jwks and returns the user ID in its subject.
+func ValidateJWTWithJWKS(tokenString string, jwks *JWKS, issuer string) (uuid.UUID, error) {
+	claimsStruct := jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(
+		tokenString,
+		&claimsStruct,
+		func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			return jwks.key(kid)
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+	)
+	if err != nil {
+		return uuid.Nil, classifyTokenError(err)
+	}
+	return userIDFromToken(token, issuer)
+}
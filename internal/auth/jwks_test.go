@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJWKSFetchesOutsideLock(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := map[string]string{
+		"kid": "current",
+		"kty": "RSA",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(priv.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(priv.E)).Bytes()),
+	}
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every fetch after the first hangs until released
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": []any{jwk}})
+	}))
+	defer srv.Close()
+
+	jwks := NewJWKS(srv.URL, time.Hour)
+	if _, err := jwks.key("current"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens naming a new key trigger a refetch, once the minimum interval
+	// has passed
+	jwks.mu.Lock()
+	jwks.fetchedAt = time.Now().Add(-2 * jwksMinRefetchInterval)
+	jwks.mu.Unlock()
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jwks.key("rotated")
+		}()
+	}
+
+	// Known keys are still served while the fetch hangs
+	waitForFetches(t, &fetches, 2)
+	done := make(chan error, 1)
+	go func() {
+		_, err := jwks.key("current")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("cached key lookup failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cached key lookup blocked on the fetch")
+	}
+
+	close(release)
+	wg.Wait()
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("%d fetches, want 2: concurrent lookups should share one", got)
+	}
+}
+
+func waitForFetches(t *testing.T, fetches *atomic.Int32, n int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for fetches.Load() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d fetches started, want %d", fetches.Load(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,27 @@
+package database
+
+import "github.com/google/uuid"
+
+// AddBytesServed adds to the user's tally of media bytes delivered today.
+func (c Client) AddBytesServed(userID uuid.UUID, bytes int64) error {
+	query := `
+	INSERT INTO bandwidth_usage (user_id, day, bytes)
+	VALUES (?, date('now'), ?)
+	ON CONFLICT(user_id, day) DO UPDATE SET bytes = bytes + excluded.bytes
+	`
+	_, err := c.db.Exec(query, userID, bytes)
+	return err
+}
+
+// GetBytesServed returns the media bytes delivered for the user's videos
+// between two days, inclusive, formatted as YYYY-MM-DD.
+func (c Client) GetBytesServed(userID uuid.UUID, fromDay, toDay string) (int64, error) {
+	query := `
+	SELECT COALESCE(SUM(bytes), 0)
+	FROM bandwidth_usage
+	WHERE user_id = ? AND day BETWEEN ? AND ?
+	`
+	var total int64
+	err := c.db.QueryRow(query, userID, fromDay, toDay).Scan(&total)
+	return total, err
+}
@@ -0,0 +1,45 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBytesServed(t *testing.T) {
+	c := newTestClient(t)
+	video := createTestVideo(t, c)
+	other, err := c.CreateUser(CreateUserParams{Email: "other@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int64{100, 250} {
+		if err := c.AddBytesServed(video.UserID, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.AddBytesServed(other.ID, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format(time.DateOnly)
+	tests := []struct {
+		name     string
+		from, to string
+		want     int64
+	}{
+		{"today", today, today, 350},
+		{"range including today", yesterday, today, 350},
+		{"before today", yesterday, yesterday, 0},
+	}
+	for _, tc := range tests {
+		got, err := c.GetBytesServed(video.UserID, tc.from, tc.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: %d bytes, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -39,6 +40,10 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	if err := c.addColumnIfNotExists("users", "plan", "TEXT NOT NULL DEFAULT 'free'"); err != nil {
+		return err
+	}
+
 	refreshTokenTable := `
 	CREATE TABLE IF NOT EXISTS refresh_tokens (
 		token TEXT PRIMARY KEY,
@@ -72,9 +77,156 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	transcriptTable := `
+	CREATE TABLE IF NOT EXISTS transcripts (
+		video_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		format TEXT NOT NULL,
+		body TEXT NOT NULL,
+		text TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(transcriptTable)
+	if err != nil {
+		return err
+	}
+
+	bandwidthTable := `
+	CREATE TABLE IF NOT EXISTS bandwidth_usage (
+		user_id TEXT NOT NULL,
+		day TEXT NOT NULL,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(user_id, day),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(bandwidthTable)
+	if err != nil {
+		return err
+	}
+
+	scanVerdictTable := `
+	CREATE TABLE IF NOT EXISTS scan_verdicts (
+		checksum TEXT PRIMARY KEY,
+		verdict TEXT NOT NULL,
+		scanned_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(scanVerdictTable)
+	if err != nil {
+		return err
+	}
+
+	processingJobTable := `
+	CREATE TABLE IF NOT EXISTS processing_jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		state TEXT NOT NULL DEFAULT 'queued',
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		file_path TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		media_type TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		profile_name TEXT NOT NULL,
+		staging BOOLEAN NOT NULL,
+		encode_deadline INTEGER NOT NULL,
+		bucket TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		upload_ip TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(processingJobTable)
+	if err != nil {
+		return err
+	}
+
+	videoMigrations := []struct {
+		column     string
+		definition string
+	}{
+		{"thumbnail_source", "TEXT NOT NULL DEFAULT ''"},
+		{"metadata", "TEXT NOT NULL DEFAULT '{}'"},
+		{"status", "TEXT NOT NULL DEFAULT 'published'"},
+		{"artifacts", "TEXT NOT NULL DEFAULT '[]'"},
+		{"content_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"file_size", "INTEGER NOT NULL DEFAULT 0"},
+		{"thumbnail_size", "INTEGER NOT NULL DEFAULT 0"},
+		{"transcript_format", "TEXT NOT NULL DEFAULT ''"},
+		{"deleted_at", "TIMESTAMP"},
+		{"thumbnail_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"dynamic_range", "TEXT NOT NULL DEFAULT 'SDR'"},
+		{"still_image", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"upload_user_agent", "TEXT NOT NULL DEFAULT ''"},
+		{"upload_ip", "TEXT NOT NULL DEFAULT ''"},
+		{"duration", "REAL NOT NULL DEFAULT 0"},
+		{"version", "INTEGER NOT NULL DEFAULT 0"},
+		{"sprites_url", "TEXT"},
+		{"sprites_vtt_url", "TEXT"},
+		{"processing_status", "TEXT NOT NULL DEFAULT ''"},
+		{"error_message", "TEXT NOT NULL DEFAULT ''"},
+		{"thumbnail_alt", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, m := range videoMigrations {
+		if err := c.addColumnIfNotExists("videos", m.column, m.definition); err != nil {
+			return err
+		}
+	}
+
+	// Media uploaded before processing statuses were tracked is ready
+	_, err = c.db.Exec(`UPDATE videos SET processing_status = 'ready' WHERE processing_status = '' AND video_url IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// addColumnIfNotExists lets older databases pick up columns added after the
+// table was first created.
+func (c *Client) addColumnIfNotExists(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
+// Ping checks that the database answers queries.
+func (c Client) Ping(ctx context.Context) error {
+	var one int
+	return c.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
@@ -82,6 +234,18 @@ func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM bandwidth_usage"); err != nil {
+		return fmt.Errorf("failed to reset table bandwidth_usage: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM scan_verdicts"); err != nil {
+		return fmt.Errorf("failed to reset table scan_verdicts: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processing_jobs"); err != nil {
+		return fmt.Errorf("failed to reset table processing_jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM transcripts"); err != nil {
+		return fmt.Errorf("failed to reset table transcripts: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
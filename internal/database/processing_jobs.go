@@ -0,0 +1,159 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ProcessingJobQueued  = "queued"
+	ProcessingJobRunning = "running"
+)
+
+// ProcessingJob is an upload saved to disk and waiting to be processed in
+// the background. It holds what the upload request knew that processing
+// needs, since the request is gone by the time the job runs.
+type ProcessingJob struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	State          string
+	VideoID        uuid.UUID
+	UserID         uuid.UUID
+	FilePath       string
+	Filename       string
+	MediaType      string
+	Checksum       string
+	ProfileName    string
+	Staging        bool
+	EncodeDeadline time.Duration
+	Bucket         string
+	UserAgent      string
+	UploadIP       string
+}
+
+const processingJobColumns = `
+		id,
+		created_at,
+		state,
+		video_id,
+		user_id,
+		file_path,
+		filename,
+		media_type,
+		checksum,
+		profile_name,
+		staging,
+		encode_deadline,
+		bucket,
+		user_agent,
+		upload_ip`
+
+func (c Client) CreateProcessingJob(job ProcessingJob) (ProcessingJob, error) {
+	job.ID = uuid.New()
+	query := `
+	INSERT INTO processing_jobs (
+		id,
+		created_at,
+		state,
+		video_id,
+		user_id,
+		file_path,
+		filename,
+		media_type,
+		checksum,
+		profile_name,
+		staging,
+		encode_deadline,
+		bucket,
+		user_agent,
+		upload_ip
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query,
+		job.ID,
+		ProcessingJobQueued,
+		job.VideoID,
+		job.UserID,
+		job.FilePath,
+		job.Filename,
+		job.MediaType,
+		job.Checksum,
+		job.ProfileName,
+		job.Staging,
+		int64(job.EncodeDeadline),
+		job.Bucket,
+		job.UserAgent,
+		job.UploadIP,
+	)
+	if err != nil {
+		return ProcessingJob{}, err
+	}
+	job.State = ProcessingJobQueued
+	return job, nil
+}
+
+// ClaimProcessingJob marks the oldest queued job as running and returns it.
+// The second return value is false when nothing is queued.
+func (c Client) ClaimProcessingJob() (ProcessingJob, bool, error) {
+	query := `
+	UPDATE processing_jobs
+	SET state = ?
+	WHERE id = (
+		SELECT id FROM processing_jobs
+		WHERE state = ?
+		ORDER BY created_at, rowid
+		LIMIT 1
+	)
+	RETURNING` + processingJobColumns
+
+	var job ProcessingJob
+	var encodeDeadline int64
+	err := c.db.QueryRow(query, ProcessingJobRunning, ProcessingJobQueued).Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.State,
+		&job.VideoID,
+		&job.UserID,
+		&job.FilePath,
+		&job.Filename,
+		&job.MediaType,
+		&job.Checksum,
+		&job.ProfileName,
+		&job.Staging,
+		&encodeDeadline,
+		&job.Bucket,
+		&job.UserAgent,
+		&job.UploadIP,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ProcessingJob{}, false, nil
+	}
+	if err != nil {
+		return ProcessingJob{}, false, err
+	}
+	job.EncodeDeadline = time.Duration(encodeDeadline)
+	return job, true, nil
+}
+
+// RequeueRunningProcessingJobs puts jobs that were running when the server
+// last stopped back in the queue.
+func (c Client) RequeueRunningProcessingJobs() (int64, error) {
+	query := `
+	UPDATE processing_jobs
+	SET state = ?
+	WHERE state = ?
+	`
+	result, err := c.db.Exec(query, ProcessingJobQueued, ProcessingJobRunning)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (c Client) DeleteProcessingJob(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM processing_jobs WHERE id = ?", id)
+	return err
+}
@@ -30,7 +30,8 @@ func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToke
 			expires_at
 		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
 	`
-	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	// Expiry is compared as text, so it's always stored in UTC
+	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt.UTC())
 	if err != nil {
 		return RefreshToken{}, err
 	}
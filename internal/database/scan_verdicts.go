@@ -0,0 +1,39 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// GetScanVerdict returns the verdict recorded for a file checksum, if one was
+// recorded within maxAge.
+func (c Client) GetScanVerdict(checksum string, maxAge time.Duration) (string, bool, error) {
+	query := `
+	SELECT verdict
+	FROM scan_verdicts
+	WHERE checksum = ? AND scanned_at > datetime('now', ?)
+	`
+	var verdict string
+	err := c.db.QueryRow(query, checksum, fmt.Sprintf("-%d seconds", int64(maxAge.Seconds()))).Scan(&verdict)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return verdict, true, nil
+}
+
+// PutScanVerdict records the verdict for a file checksum, replacing any
+// older one.
+func (c Client) PutScanVerdict(checksum, verdict string) error {
+	query := `
+	INSERT INTO scan_verdicts (checksum, verdict, scanned_at)
+	VALUES (?, ?, datetime('now'))
+	ON CONFLICT(checksum) DO UPDATE SET verdict = excluded.verdict, scanned_at = excluded.scanned_at
+	`
+	_, err := c.db.Exec(query, checksum, verdict)
+	return err
+}
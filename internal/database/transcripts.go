@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TranscriptFormatText = "text"
+	TranscriptFormatVTT  = "vtt"
+	TranscriptFormatSRT  = "srt"
+)
+
+// Transcript is the text spoken in a video. Body is the file as uploaded;
+// Text is the same content with any cue timings stripped, for searching.
+type Transcript struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Format    string    `json:"format"`
+	Body      string    `json:"body"`
+	Text      string    `json:"-"`
+}
+
+func (c Client) UpsertTranscript(t Transcript) error {
+	query := `
+	INSERT INTO transcripts (
+		video_id,
+		created_at,
+		updated_at,
+		format,
+		body,
+		text
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	ON CONFLICT(video_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		format = excluded.format,
+		body = excluded.body,
+		text = excluded.text
+	`
+	_, err := c.db.Exec(query, t.VideoID, t.Format, t.Body, t.Text)
+	return err
+}
+
+// GetTranscript returns the video's transcript, or an empty transcript if it
+// has none.
+func (c Client) GetTranscript(videoID uuid.UUID) (Transcript, error) {
+	query := `
+	SELECT video_id, created_at, updated_at, format, body, text
+	FROM transcripts
+	WHERE video_id = ?
+	`
+	var t Transcript
+	err := c.db.QueryRow(query, videoID).
+		Scan(&t.VideoID, &t.CreatedAt, &t.UpdatedAt, &t.Format, &t.Body, &t.Text)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Transcript{}, nil
+		}
+		return Transcript{}, err
+	}
+	return t, nil
+}
+
+// SearchVideosByTranscript returns the user's videos whose transcript
+// contains q, ignoring case.
+func (c Client) SearchVideosByTranscript(userID uuid.UUID, q string) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND deleted_at IS NULL AND id IN (
+		SELECT video_id FROM transcripts WHERE text LIKE ? ESCAPE '\'
+	)
+	ORDER BY created_at DESC
+	`
+
+	rows, err := c.db.Query(query, userID, "%"+escapeLike(q)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
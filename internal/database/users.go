@@ -8,6 +8,11 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	UserPlanFree = "free"
+	UserPlanPaid = "paid"
+)
+
 type User struct {
 	ID        uuid.UUID `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
@@ -73,17 +78,21 @@ func (c Client) GetUserByEmail(email string) (User, error) {
 	return user, nil
 }
 
+// GetUserByRefreshToken returns nil if the token doesn't exist, has been
+// revoked or has expired.
 func (c Client) GetUserByRefreshToken(token string) (*User, error) {
 	query := `
 		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
 		FROM users u
 		JOIN refresh_tokens rt ON u.id = rt.user_id
 		WHERE rt.token = ?
+		AND rt.revoked_at IS NULL
+		AND rt.expires_at > ?
 	`
 
 	var user User
 	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
+	err := c.db.QueryRow(query, token, time.Now().UTC()).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -145,3 +154,16 @@ func (c Client) DeleteUser(id uuid.UUID) error {
 	_, err := c.db.Exec(query, id.String())
 	return err
 }
+
+// GetUserPlan returns the user's billing plan.
+func (c Client) GetUserPlan(id uuid.UUID) (string, error) {
+	var plan string
+	err := c.db.QueryRow("SELECT plan FROM users WHERE id = ?", id.String()).Scan(&plan)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserPlanFree, nil
+		}
+		return "", err
+	}
+	return plan, nil
+}
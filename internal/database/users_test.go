@@ -0,0 +1,33 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestGetUserPlan(t *testing.T) {
+	c := newTestClient(t)
+	user, err := c.CreateUser(CreateUserParams{Email: "owner@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := c.GetUserPlan(user.ID)
+	if err != nil || plan != UserPlanFree {
+		t.Errorf("new user: got %q, %v; want %q", plan, err, UserPlanFree)
+	}
+
+	if _, err := c.db.Exec("UPDATE users SET plan = ? WHERE id = ?", UserPlanPaid, user.ID.String()); err != nil {
+		t.Fatal(err)
+	}
+	plan, err = c.GetUserPlan(user.ID)
+	if err != nil || plan != UserPlanPaid {
+		t.Errorf("upgraded user: got %q, %v; want %q", plan, err, UserPlanPaid)
+	}
+
+	plan, err = c.GetUserPlan(uuid.New())
+	if err != nil || plan != UserPlanFree {
+		t.Errorf("unknown user: got %q, %v; want %q", plan, err, UserPlanFree)
+	}
+}
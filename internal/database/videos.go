@@ -2,44 +2,198 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+const (
+	VideoStatusStaged    = "staged"
+	VideoStatusPublished = "published"
+)
+
+// The processing status tracks the latest upload of a video's media, for
+// clients to poll. It's empty until the first upload.
+const (
+	ProcessingStatusUploading  = "uploading"
+	ProcessingStatusProcessing = "processing"
+	ProcessingStatusReady      = "ready"
+	ProcessingStatusFailed     = "failed"
+)
+
+const (
+	DynamicRangeSDR   = "SDR"
+	DynamicRangeHDR10 = "HDR10"
+	DynamicRangeHLG   = "HLG"
+)
+
+const (
+	ThumbnailSourceUser        = "user"
+	ThumbnailSourceAuto        = "auto"
+	ThumbnailSourcePlaceholder = "placeholder"
+)
+
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID              uuid.UUID  `json:"id"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	ThumbnailURL    *string    `json:"thumbnail_url"`
+	ThumbnailSource string     `json:"thumbnail_source"`
+	VideoURL        *string    `json:"video_url"`
+	Metadata        Metadata   `json:"metadata"`
+	Status          string     `json:"status"`
+	Artifacts       []Artifact `json:"artifacts"`
+	ContentHash     string     `json:"content_hash"`
+	FileSize        int64      `json:"file_size"`
+	ThumbnailSize   int64      `json:"thumbnail_size"`
+	// TranscriptFormat is empty when the video has no transcript
+	TranscriptFormat string `json:"transcript_format"`
+	// ThumbnailHash is the perceptual hash of a user-uploaded thumbnail
+	ThumbnailHash string `json:"thumbnail_hash,omitempty"`
+	// ThumbnailAlt describes the thumbnail for screen readers
+	ThumbnailAlt string `json:"thumbnail_alt"`
+	DynamicRange string `json:"dynamic_range"`
+	// StillImage flags media that is one frozen frame for its whole length
+	StillImage bool `json:"still_image"`
+	// Where the media was uploaded from; only shown to the owner
+	UploadUserAgent string `json:"upload_user_agent,omitempty"`
+	UploadIP        string `json:"upload_ip,omitempty"`
+	// Duration is the media's length in seconds, or 0 if it couldn't be read
+	Duration float64 `json:"duration"`
+	// SpritesURL is the scrub-bar preview sheet and SpritesVTTURL the
+	// WebVTT track mapping playback times onto it
+	SpritesURL    *string `json:"sprites_url"`
+	SpritesVTTURL *string `json:"sprites_vtt_url"`
+	// ProcessingStatus isn't written by UpdateVideo, so a stale copy of the
+	// video can't overwrite it. ErrorMessage says why the latest upload
+	// failed.
+	ProcessingStatus string `json:"processing_status"`
+	ErrorMessage     string `json:"error_message,omitempty"`
+	// DeletedAt is set while a deleted video waits out its grace period
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Version counts the record's updates; UpdateVideo only succeeds if it
+	// hasn't changed since the video was read
+	Version int64 `json:"-"`
 	CreateVideoParams
 }
 
+// Artifact is a file derived from a video's media, such as a rendition or a
+// preview sprite.
+type Artifact struct {
+	Kind string `json:"kind"`
+	Key  string `json:"key"`
+}
+
+// Metadata holds arbitrary creator-defined tags for a video.
+type Metadata map[string]string
+
 type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		thumbnail_source,
 		video_url,
-		user_id
+		metadata,
+		status,
+		artifacts,
+		content_hash,
+		file_size,
+		thumbnail_size,
+		transcript_format,
+		deleted_at,
+		thumbnail_hash,
+		dynamic_range,
+		still_image,
+		upload_user_agent,
+		upload_ip,
+		duration,
+		version,
+		sprites_url,
+		sprites_vtt_url,
+		processing_status,
+		error_message,
+		thumbnail_alt,
+		user_id`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	var metadata, artifacts string
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailSource,
+		&video.VideoURL,
+		&metadata,
+		&video.Status,
+		&artifacts,
+		&video.ContentHash,
+		&video.FileSize,
+		&video.ThumbnailSize,
+		&video.TranscriptFormat,
+		&video.DeletedAt,
+		&video.ThumbnailHash,
+		&video.DynamicRange,
+		&video.StillImage,
+		&video.UploadUserAgent,
+		&video.UploadIP,
+		&video.Duration,
+		&video.Version,
+		&video.SpritesURL,
+		&video.SpritesVTTURL,
+		&video.ProcessingStatus,
+		&video.ErrorMessage,
+		&video.ThumbnailAlt,
+		&video.UserID,
+	)
+	if err != nil {
+		return Video{}, err
+	}
+	if err := json.Unmarshal([]byte(metadata), &video.Metadata); err != nil {
+		return Video{}, err
+	}
+	if video.Metadata == nil {
+		video.Metadata = Metadata{}
+	}
+	if err := json.Unmarshal([]byte(artifacts), &video.Artifacts); err != nil {
+		return Video{}, err
+	}
+	if video.Artifacts == nil {
+		video.Artifacts = []Artifact{}
+	}
+	return video, nil
+}
+
+// GetVideosByUser returns a page of the user's videos, newest first.
+func (c Client) GetVideosByUser(userID uuid.UUID, limit, offset int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
+	WHERE user_id = ? AND deleted_at IS NULL
+	ORDER BY created_at DESC, id
+	LIMIT ? OFFSET ?
 	`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.Query(query, userID, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -47,17 +201,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -66,6 +211,18 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 	return videos, nil
 }
 
+// CountVideosByUser returns how many videos GetVideosByUser can page through.
+func (c Client) CountVideosByUser(userID uuid.UUID) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM videos
+	WHERE user_id = ? AND deleted_at IS NULL
+	`
+	var count int
+	err := c.db.QueryRow(query, userID).Scan(&count)
+	return count, err
+}
+
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	id := uuid.New()
 	query := `
@@ -86,31 +243,41 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	return c.GetVideo(id)
 }
 
+// ErrVideoNotFound is returned when no video has the requested ID.
+var ErrVideoNotFound = errors.New("video not found")
+
+// GetVideo returns the video with the given ID, or ErrVideoNotFound if it
+// doesn't exist or has been soft-deleted.
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
-	WHERE id = ?
+	WHERE id = ? AND deleted_at IS NULL
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, ErrVideoNotFound
+		}
+		return Video{}, err
+	}
+
+	return video, nil
+}
+
+// GetVideoByContentHash returns one of the user's videos whose stored media
+// has the given SHA-256, or an empty video if there is none. Other users'
+// videos are never returned, so their media can't be linked to.
+func (c Client) GetVideoByContentHash(userID uuid.UUID, hash string) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE content_hash = ? AND user_id = ? AND video_url IS NOT NULL AND deleted_at IS NULL
+	LIMIT 1
+	`
+
+	video, err := scanVideo(c.db.QueryRow(query, hash, userID))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,31 +288,103 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
+// ErrVideoModified is returned by UpdateVideo when the video was updated by
+// someone else after it was read.
+var ErrVideoModified = errors.New("video was modified concurrently")
+
+// UpdateVideo saves the video, provided its version still matches the stored
+// one, and bumps the version. Otherwise it returns ErrVideoModified and
+// nothing is written.
 func (c Client) UpdateVideo(video Video) error {
+	metadata, err := json.Marshal(video.Metadata)
+	if err != nil {
+		return err
+	}
+	if video.Metadata == nil {
+		metadata = []byte("{}")
+	}
+	artifacts, err := json.Marshal(video.Artifacts)
+	if err != nil {
+		return err
+	}
+	if video.Artifacts == nil {
+		artifacts = []byte("[]")
+	}
+
 	query := `
 	UPDATE videos
 	SET
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnail_source = ?,
 		video_url = ?,
-		user_id = ?
-	WHERE id = ?
+		metadata = ?,
+		status = ?,
+		artifacts = ?,
+		content_hash = ?,
+		file_size = ?,
+		thumbnail_size = ?,
+		transcript_format = ?,
+		thumbnail_hash = ?,
+		dynamic_range = ?,
+		still_image = ?,
+		upload_user_agent = ?,
+		upload_ip = ?,
+		duration = ?,
+		sprites_url = ?,
+		sprites_vtt_url = ?,
+		thumbnail_alt = ?,
+		user_id = ?,
+		updated_at = CURRENT_TIMESTAMP,
+		version = version + 1
+	WHERE id = ? AND version = ?
 	`
 
-	_, err := c.db.Exec(
+	result, err := c.db.Exec(
 		query,
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		video.ThumbnailSource,
 		&video.VideoURL,
+		string(metadata),
+		video.Status,
+		string(artifacts),
+		video.ContentHash,
+		video.FileSize,
+		video.ThumbnailSize,
+		video.TranscriptFormat,
+		video.ThumbnailHash,
+		video.DynamicRange,
+		video.StillImage,
+		video.UploadUserAgent,
+		video.UploadIP,
+		video.Duration,
+		video.SpritesURL,
+		video.SpritesVTTURL,
+		video.ThumbnailAlt,
 		video.UserID,
 		video.ID,
+		video.Version,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrVideoModified
+	}
+	return nil
 }
 
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	if _, err := c.db.Exec("DELETE FROM transcripts WHERE video_id = ?", id); err != nil {
+		return err
+	}
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
@@ -153,3 +392,166 @@ func (c Client) DeleteVideo(id uuid.UUID) error {
 	_, err := c.db.Exec(query, id)
 	return err
 }
+
+// SetVideoProcessingStatus records where the video's latest upload is at. It
+// doesn't count as an update of the video, so edits made meanwhile still
+// succeed.
+func (c Client) SetVideoProcessingStatus(id uuid.UUID, status, errorMessage string) error {
+	query := `
+	UPDATE videos
+	SET processing_status = ?, error_message = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, errorMessage, id)
+	return err
+}
+
+// ClaimVideoUpload marks the video as uploading unless an upload of it is
+// already processing, reporting whether it did. The check and the update are
+// one statement, so of two uploads racing for a video only one gets through.
+func (c Client) ClaimVideoUpload(id uuid.UUID) (bool, error) {
+	query := `
+	UPDATE videos
+	SET processing_status = ?, error_message = ''
+	WHERE id = ? AND processing_status <> ?
+	`
+	result, err := c.db.Exec(query, ProcessingStatusUploading, id, ProcessingStatusProcessing)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// FailInterruptedUploads marks uploads that were in progress when the server
+// stopped as failed, unless a processing job will pick them up again.
+func (c Client) FailInterruptedUploads(errorMessage string) (int64, error) {
+	query := `
+	UPDATE videos
+	SET processing_status = ?, error_message = ?
+	WHERE processing_status IN (?, ?)
+		AND id NOT IN (SELECT video_id FROM processing_jobs)
+	`
+	result, err := c.db.Exec(query, ProcessingStatusFailed, errorMessage, ProcessingStatusUploading, ProcessingStatusProcessing)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SoftDeleteVideo hides the video from reads until it is restored or purged.
+func (c Client) SoftDeleteVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET deleted_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND deleted_at IS NULL
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+func (c Client) RestoreVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET deleted_at = NULL
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+// GetDeletedVideo returns a soft-deleted video, or ErrVideoNotFound if there
+// is no such video or it isn't deleted.
+func (c Client) GetDeletedVideo(id uuid.UUID) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE id = ? AND deleted_at IS NOT NULL
+	`
+
+	video, err := scanVideo(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, ErrVideoNotFound
+		}
+		return Video{}, err
+	}
+
+	return video, nil
+}
+
+// GetVideosDeletedBefore returns soft-deleted videos that have been deleted
+// for at least the given duration.
+func (c Client) GetVideosDeletedBefore(age time.Duration) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE deleted_at IS NOT NULL AND deleted_at <= datetime('now', ?)
+	`
+
+	rows, err := c.db.Query(query, fmt.Sprintf("-%d seconds", int64(age.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// GetThumbnailHashes returns the thumbnail hashes of the user's other
+// videos.
+func (c Client) GetThumbnailHashes(userID, excludeVideoID uuid.UUID) ([]string, error) {
+	query := `
+	SELECT thumbnail_hash
+	FROM videos
+	WHERE user_id = ? AND id != ? AND thumbnail_hash != '' AND deleted_at IS NULL
+	`
+	rows, err := c.db.Query(query, userID, excludeVideoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// CountVideosByURL counts videos, deleted or not, whose media is stored at
+// the given URL.
+func (c Client) CountVideosByURL(url string) (int, error) {
+	var n int
+	err := c.db.QueryRow("SELECT COUNT(*) FROM videos WHERE video_url = ?", url).Scan(&n)
+	return n, err
+}
+
+// GetUserStorageUsed returns the bytes of media and thumbnails stored for
+// the user's videos, including ones waiting out their deletion grace period.
+func (c Client) GetUserStorageUsed(userID uuid.UUID) (int64, error) {
+	query := `
+	SELECT COALESCE(SUM(file_size + thumbnail_size), 0)
+	FROM videos
+	WHERE user_id = ?
+	`
+	var total int64
+	err := c.db.QueryRow(query, userID).Scan(&total)
+	return total, err
+}
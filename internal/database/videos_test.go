@@ -0,0 +1,235 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func newTestClient(t *testing.T) Client {
+	t.Helper()
+	return newTestClientAt(t, filepath.Join(t.TempDir(), "tubely.db"))
+}
+
+func newTestClientAt(t *testing.T, path string) Client {
+	t.Helper()
+	c, err := NewClient(path)
+	if err != nil {
+		t.Fatalf("couldn't open database: %v", err)
+	}
+	t.Cleanup(func() { c.db.Close() })
+	return c
+}
+
+// createTestVideo adds a video owned by a new user.
+func createTestVideo(t *testing.T, c Client) Video {
+	t.Helper()
+	user, err := c.CreateUser(CreateUserParams{Email: "owner@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := c.CreateVideo(CreateVideoParams{Title: "original", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+func TestThumbnailSourceRoundTrip(t *testing.T) {
+	// Reopening runs the column migrations against an existing schema
+	path := filepath.Join(t.TempDir(), "tubely.db")
+	video := createTestVideo(t, newTestClientAt(t, path))
+	c := newTestClientAt(t, path)
+
+	if video.ThumbnailSource != "" {
+		t.Errorf("new video's thumbnail source = %q, want empty", video.ThumbnailSource)
+	}
+	url := "https://cdn.example.com/placeholder.png"
+	video.ThumbnailURL = &url
+	video.ThumbnailSource = ThumbnailSourcePlaceholder
+	if err := c.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ThumbnailSource != ThumbnailSourcePlaceholder {
+		t.Errorf("thumbnail source = %q, want %q", got.ThumbnailSource, ThumbnailSourcePlaceholder)
+	}
+}
+
+func TestGetVideoByContentHash(t *testing.T) {
+	c := newTestClient(t)
+	video := createTestVideo(t, c)
+	video.ContentHash = "abc123"
+	if err := c.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	// Videos without stored media can't be reused
+	got, err := c.GetVideoByContentHash(video.UserID, "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != uuid.Nil {
+		t.Errorf("found video %s without media", got.ID)
+	}
+
+	video, err = c.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "https://cdn.example.com/landscape/abc123.mp4"
+	video.VideoURL = &url
+	if err := c.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	got, err = c.GetVideoByContentHash(video.UserID, "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != video.ID || got.ContentHash != "abc123" {
+		t.Errorf("found video %s with hash %q, want %s", got.ID, got.ContentHash, video.ID)
+	}
+
+	// Another user's upload with the same content doesn't see this one
+	got, err = c.GetVideoByContentHash(uuid.New(), "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != uuid.Nil {
+		t.Errorf("another user found video %s", got.ID)
+	}
+
+	got, err = c.GetVideoByContentHash(video.UserID, "def456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != uuid.Nil {
+		t.Errorf("unknown hash found video %s", got.ID)
+	}
+}
+
+func TestFileSizesRoundTrip(t *testing.T) {
+	c := newTestClient(t)
+	video := createTestVideo(t, c)
+	video.FileSize = 5 << 20
+	video.ThumbnailSize = 12345
+	if err := c.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FileSize != video.FileSize || got.ThumbnailSize != video.ThumbnailSize {
+		t.Errorf("sizes = (%d, %d), want (%d, %d)", got.FileSize, got.ThumbnailSize, video.FileSize, video.ThumbnailSize)
+	}
+}
+
+func TestDynamicRangeRoundTrip(t *testing.T) {
+	c := newTestClient(t)
+	video := createTestVideo(t, c)
+	if video.DynamicRange != DynamicRangeSDR {
+		t.Errorf("new video dynamic range = %q, want %q", video.DynamicRange, DynamicRangeSDR)
+	}
+
+	video.DynamicRange = DynamicRangeHLG
+	if err := c.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DynamicRange != DynamicRangeHLG {
+		t.Errorf("dynamic range = %q, want %q", got.DynamicRange, DynamicRangeHLG)
+	}
+}
+
+func TestUpdateVideoConflict(t *testing.T) {
+	c := newTestClient(t)
+	created := createTestVideo(t, c)
+
+	first, err := c.GetVideo(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.GetVideo(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first.Title = "first"
+	if err := c.UpdateVideo(first); err != nil {
+		t.Fatalf("first update: %v", err)
+	}
+	second.Title = "second"
+	if err := c.UpdateVideo(second); !errors.Is(err, ErrVideoModified) {
+		t.Fatalf("second update: got %v, want ErrVideoModified", err)
+	}
+
+	stored, err := c.GetVideo(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "first" {
+		t.Errorf("stored title = %q, want %q", stored.Title, "first")
+	}
+}
+
+func TestClaimVideoUpload(t *testing.T) {
+	c := newTestClient(t)
+	user, err := c.CreateUser(CreateUserParams{Email: "owner@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := c.CreateVideo(CreateVideoParams{Title: "video", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claimed, err := c.ClaimVideoUpload(video.ID); err != nil || !claimed {
+		t.Fatalf("ClaimVideoUpload() = %v, %v; want true", claimed, err)
+	}
+	if err := c.SetVideoProcessingStatus(video.ID, ProcessingStatusProcessing, ""); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := c.ClaimVideoUpload(video.ID); err != nil || claimed {
+		t.Fatalf("ClaimVideoUpload() while processing = %v, %v; want false", claimed, err)
+	}
+
+	if err := c.SetVideoProcessingStatus(video.ID, ProcessingStatusFailed, "Couldn't process video"); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := c.ClaimVideoUpload(video.ID); err != nil || !claimed {
+		t.Fatalf("ClaimVideoUpload() after a failure = %v, %v; want true", claimed, err)
+	}
+	got, err := c.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ProcessingStatus != ProcessingStatusUploading || got.ErrorMessage != "" {
+		t.Errorf("status %q, error %q; want uploading without an error", got.ProcessingStatus, got.ErrorMessage)
+	}
+}
+
+func TestResetClearsProcessingJobs(t *testing.T) {
+	c := newTestClient(t)
+	video := createTestVideo(t, c)
+	if _, err := c.CreateProcessingJob(ProcessingJob{VideoID: video.ID, UserID: video.UserID, FilePath: "/tmp/upload.mp4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.ClaimProcessingJob(); err != nil || ok {
+		t.Errorf("claimed a job after reset: ok %v, err %v", ok, err)
+	}
+}
@@ -2,22 +2,37 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
-func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
-	if err != nil {
-		log.Println(err)
-	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+// respondWithError sends msg to the client and logs the underlying error
+// under the request's ID so the two can be matched up. The response's code
+// is derived from the status; use respondWithErrorCode where clients need
+// to tell causes with the same status apart.
+func respondWithError(w http.ResponseWriter, status int, msg string, err error) {
+	respondWithErrorCode(w, status, defaultErrorCode(status), msg, err)
+}
+
+// respondWithErrorCode is respondWithError with a machine-readable code.
+func respondWithErrorCode(w http.ResponseWriter, status int, code, msg string, err error) {
+	if err != nil || status > 499 {
+		attrs := []any{"request_id", w.Header().Get(requestIDHeader), "status", status, "code", code}
+		if err != nil {
+			attrs = append(attrs, "error", err)
+		}
+		slog.Error(msg, attrs...)
 	}
+	// error predates message and is kept for existing clients
 	type errorResponse struct {
-		Error string `json:"error"`
+		Error   string `json:"error"`
+		Message string `json:"message"`
+		Code    string `json:"code"`
 	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
+	respondWithJSON(w, status, errorResponse{
+		Error:   msg,
+		Message: msg,
+		Code:    code,
 	})
 }
 
@@ -25,7 +40,7 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		slog.Error("couldn't marshal JSON response", "error", err)
 		w.WriteHeader(500)
 		return
 	}
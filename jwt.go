@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+const (
+	jwtModeHS256 = "hs256"
+	jwtModeJWKS  = "jwks"
+)
+
+// Access tokens are short-lived; clients use their refresh token to get a
+// new one rather than logging in again.
+const (
+	accessTokenTTL  = time.Hour
+	refreshTokenTTL = 60 * 24 * time.Hour
+)
+
+// validateJWT checks an access token against whichever signing setup is
+// configured and returns the user ID it was issued for.
+func (cfg *apiConfig) validateJWT(token string) (uuid.UUID, error) {
+	if cfg.jwtMode == jwtModeJWKS {
+		return auth.ValidateJWTWithJWKS(token, cfg.jwks, cfg.jwksIssuer)
+	}
+	return auth.ValidateJWT(token, cfg.jwtSecret)
+}
+
+// authenticatedUserKey holds the user a middleware already validated the
+// request's token for.
+type authenticatedUserKey struct{}
+
+type authenticatedUser struct {
+	token  string
+	userID uuid.UUID
+}
+
+// withAuthenticatedUser records that token was validated for userID, so the
+// handler behind the middleware doesn't validate it again.
+func withAuthenticatedUser(r *http.Request, token string, userID uuid.UUID) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authenticatedUserKey{}, authenticatedUser{token: token, userID: userID}))
+}
+
+// validateRequestJWT is validateJWT for a token taken from r, reusing the
+// result if a middleware has validated the same token already.
+func (cfg *apiConfig) validateRequestJWT(r *http.Request, token string) (uuid.UUID, error) {
+	if u, ok := r.Context().Value(authenticatedUserKey{}).(authenticatedUser); ok && u.token == token {
+		return u.userID, nil
+	}
+	return cfg.validateJWT(token)
+}
+
+// respondWithJWTError rejects a request whose token failed validation. The
+// WWW-Authenticate header tells clients whether refreshing the token will
+// help or they need to log in again.
+func respondWithJWTError(w http.ResponseWriter, err error) {
+	description, code := "invalid", errCodeInvalidToken
+	switch {
+	case errors.Is(err, auth.ErrTokenExpired):
+		description, code = "expired", errCodeTokenExpired
+	case errors.Is(err, auth.ErrTokenNotYetValid):
+		description = "not yet valid"
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="`+description+`"`)
+	respondWithErrorCode(w, http.StatusUnauthorized, code, "Couldn't validate JWT", err)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+func TestRespondWithJWTError(t *testing.T) {
+	tests := []struct {
+		err             error
+		wantDescription string
+		wantCode        string
+	}{
+		{fmt.Errorf("%w: exp", auth.ErrTokenExpired), "expired", errCodeTokenExpired},
+		{fmt.Errorf("%w: nbf", auth.ErrTokenNotYetValid), "not yet valid", errCodeInvalidToken},
+		{fmt.Errorf("%w: signature", auth.ErrTokenInvalid), "invalid", errCodeInvalidToken},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		respondWithJWTError(w, tc.err)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%v: status %d, want 401", tc.err, w.Code)
+		}
+		challenge := w.Header().Get("WWW-Authenticate")
+		if !strings.Contains(challenge, `error_description="`+tc.wantDescription+`"`) {
+			t.Errorf("%v: WWW-Authenticate = %q, want description %q", tc.err, challenge, tc.wantDescription)
+		}
+		if code := errorCode(t, w); code != tc.wantCode {
+			t.Errorf("%v: code %q, want %q", tc.err, code, tc.wantCode)
+		}
+	}
+}
@@ -3,13 +3,23 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
@@ -21,10 +31,85 @@ type apiConfig struct {
 	filepathRoot     string
 	assetsRoot       string
 	s3Client         *s3.Client
+	s3Uploader       *manager.Uploader
+	s3Presigner      *s3.PresignClient
 	s3Bucket         string
 	s3Region         string
 	s3CfDistribution string
 	port             string
+
+	thumbnailPlaceholderURL    string
+	presignCache               *presignCache
+	maxPassthroughBitRate      int64
+	durationTolerance          float64
+	bucketOverrideNetworks     []*net.IPNet
+	maxKeyframeInterval        time.Duration
+	longGOPPolicy              string
+	maxDerivedArtifacts        int
+	aspectRatioFallback        string
+	thumbnailRegenAsyncBytes   int64
+	metrics                    *appMetrics
+	uploadTempDir              string
+	encodeDeadline             time.Duration
+	trackFileSizes             bool
+	maxTranscriptBytes         int64
+	softDeleteGrace            time.Duration
+	thumbnailMode              string
+	thumbnailStorage           string
+	thumbnailFlights           *thumbnailFlights
+	jwtMode                    string
+	jwks                       *auth.JWKS
+	jwksIssuer                 string
+	maintenance                *atomic.Bool
+	maintenanceRetryAfter      time.Duration
+	processingPipelines        map[string]string
+	uploadEvents               *uploadEventPublisher
+	streamTranscode            bool
+	thumbnailWatermark         *thumbnailWatermark
+	playbackDisposition        string
+	downloadDisposition        string
+	recentUploads              *recentUploads
+	processingProfiles         *processingProfiles
+	stillVideoMinDuration      time.Duration
+	stillVideoPolicy           string
+	trustedProxies             []*net.IPNet
+	adminUserIDs               map[uuid.UUID]bool
+	requireTLSUploads          bool
+	cleanupReplacedArtifacts   bool
+	scanCommand                []string
+	scanVerdictTTL             time.Duration
+	mediaExtensions            map[string]string
+	thumbnailMemoryLimit       int64
+	remuxContainers            bool
+	renditionUploadConcurrency int
+	presignTTL                 time.Duration
+	thumbnailFrameOffset       time.Duration
+	uploadProgress             *uploadProgressTracker
+	mediaToolTimeout           time.Duration
+	maxVideoUploadBytes        int64
+	maxThumbnailBytes          int64
+	versionAssetURLs           bool
+	userStorageQuota           int64
+	resumableUploads           *resumableUploadStore
+	maxThumbnailDimension      int
+	thumbnailMaxEdge           int
+	thumbnailJPEGQuality       int
+	deterministicVideoKeys     bool
+	sseKMSKeyID                string
+	spriteOptions              spriteOptions
+	uploadRateLimiter          *userRateLimiter
+	objectKeyPrefixes          []string
+	processingQueue            *processingQueue
+	backgroundTasks            *backgroundTasks
+	corsAllowedOrigins         []string
+	corsAllowedMethods         []string
+	corsAllowedHeaders         []string
+	idempotentUploads          *idempotentUploads
+	mediaLocks                 *mediaLocks
+	metricsToken               string
+
+	duplicateThumbnailPolicy    string
+	duplicateThumbnailThreshold int
 }
 
 type thumbnail struct {
@@ -35,6 +120,15 @@ type thumbnail struct {
 func main() {
 	godotenv.Load(".env")
 
+	// "json" emits one JSON object per log line for log collectors
+	switch logFormat := os.Getenv("LOG_FORMAT"); logFormat {
+	case "", "text":
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	default:
+		log.Fatalf("LOG_FORMAT must be text or json, got %q", logFormat)
+	}
+
 	pathToDB := os.Getenv("DB_PATH")
 	if pathToDB == "" {
 		log.Fatal("DB_URL must be set")
@@ -75,9 +169,11 @@ func main() {
 		log.Fatal("S3_REGION environment variable is not set")
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	// CloudFront domain media is served from; empty serves it straight from
+	// S3 through presigned URLs
+	s3CfDistribution := strings.TrimSuffix(os.Getenv("S3_CF_DISTRO"), "/")
+	if s3CfDistribution != "" && !strings.Contains(s3CfDistribution, "://") {
+		s3CfDistribution = "https://" + s3CfDistribution
 	}
 
 	port := os.Getenv("PORT")
@@ -85,21 +181,571 @@ func main() {
 		log.Fatal("PORT environment variable is not set")
 	}
 
-	awsConfig, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(s3Region))
+	// Optional: shown for videos that end up without a thumbnail
+	thumbnailPlaceholderURL := os.Getenv("THUMBNAIL_PLACEHOLDER_URL")
+
+	presignCacheSize := getEnvInt("PRESIGN_CACHE_SIZE", 1024)
+	if presignCacheSize < 0 {
+		log.Fatal("PRESIGN_CACHE_SIZE must not be negative")
+	}
+
+	// Uploads above this bit rate get re-encoded even if otherwise compatible
+	maxPassthroughBitRate := getEnvInt64("MAX_PASSTHROUGH_BITRATE", 8_000_000)
+
+	// Fraction by which the declared duration may differ from the real one; 0 disables the check
+	durationTolerance := getEnvFloat("DURATION_TOLERANCE", 0)
+	if durationTolerance < 0 {
+		log.Fatal("DURATION_TOLERANCE must not be negative")
+	}
+
+	// Networks allowed to pick an alternate bucket per request; empty disables overrides
+	bucketOverrideNetworks, err := parseCIDRs(os.Getenv("BUCKET_OVERRIDE_NETWORKS"))
+	if err != nil {
+		log.Fatalf("BUCKET_OVERRIDE_NETWORKS is invalid: %v", err)
+	}
+
+	// Per video codec override of how uploads are processed, e.g. "prores=transcode"
+	processingPipelines, err := parseProcessingPipelines(os.Getenv("PROCESSING_PIPELINES"))
+	if err != nil {
+		log.Fatalf("PROCESSING_PIPELINES is invalid: %v", err)
+	}
+
+	// Longest acceptable gap between keyframes; 0 skips the check
+	maxKeyframeInterval := getEnvDuration("MAX_KEYFRAME_INTERVAL", 0)
+	longGOPPolicy := os.Getenv("LONG_GOP_POLICY")
+	if longGOPPolicy == "" {
+		longGOPPolicy = longGOPPolicyWarn
+	}
+	if longGOPPolicy != longGOPPolicyWarn && longGOPPolicy != longGOPPolicyReencode {
+		log.Fatalf("LONG_GOP_POLICY must be %q or %q", longGOPPolicyWarn, longGOPPolicyReencode)
+	}
+
+	// Cap on renditions, previews and other files derived from one video; 0 means no cap
+	maxDerivedArtifacts := getEnvInt("MAX_DERIVED_ARTIFACTS", 0)
+	if maxDerivedArtifacts < 0 {
+		log.Fatal("MAX_DERIVED_ARTIFACTS must not be negative")
+	}
+
+	// Aspect class to assume when a video stream reports no dimensions; empty rejects such uploads
+	aspectRatioFallback := os.Getenv("ASPECT_RATIO_FALLBACK")
+	if aspectRatioFallback != "" && aspectRatioFallback != "other" && aspectRatioPrefix(aspectRatioFallback) == otherAspectRatioPrefix {
+		log.Fatal(`ASPECT_RATIO_FALLBACK must be a named ratio like "16:9" or "1:1", or "other"`)
+	}
+
+	// Thumbnail regeneration for media larger than this runs in the background
+	thumbnailRegenAsyncBytes := getEnvInt64("THUMBNAIL_REGEN_ASYNC_BYTES", 100<<20)
+
+	// Large objects go up as parts of this size, this many at a time
+	s3PartSize := getEnvInt64("S3_PART_SIZE", manager.DefaultUploadPartSize)
+	s3UploadConcurrency := getEnvInt("S3_UPLOAD_CONCURRENCY", manager.DefaultUploadConcurrency)
+	if err := validateUploaderSettings(s3PartSize, s3UploadConcurrency); err != nil {
+		log.Fatal(err)
+	}
+
+	// Where uploads are spooled while being processed; defaults to the OS temp dir
+	uploadTempDir := os.Getenv("UPLOAD_TEMP_DIR")
+	if uploadTempDir != "" {
+		if err := os.MkdirAll(uploadTempDir, 0700); err != nil {
+			log.Fatalf("Couldn't create upload temp directory: %v", err)
+		}
+		// mime/multipart spills large form parts into os.TempDir(), so point
+		// it at the same place
+		os.Setenv("TMPDIR", uploadTempDir)
+	}
+
+	// Default time budget for re-encoding an upload; 0 means no deadline
+	encodeDeadline := getEnvDuration("ENCODE_DEADLINE", 0)
+
+	// Pipe re-encoded output straight into S3 instead of a second temp file.
+	// Not used for encodes with a deadline, which may need to start over.
+	streamTranscode := getEnvBool("STREAM_TRANSCODE", false)
+
+	trackFileSizes := getEnvBool("TRACK_FILE_SIZES", true)
+
+	maxTranscriptBytes := getEnvInt64("MAX_TRANSCRIPT_BYTES", 1<<20)
+	if maxTranscriptBytes < 1 {
+		log.Fatal("MAX_TRANSCRIPT_BYTES must be positive")
+	}
+
+	// How long deleted videos can be restored before they're purged; 0 deletes immediately
+	softDeleteGrace := getEnvDuration("SOFT_DELETE_GRACE", 0)
+	if softDeleteGrace < 0 {
+		log.Fatal("SOFT_DELETE_GRACE must not be negative")
+	}
+
+	// Access tokens are either our own HS256 tokens or RS256 tokens from an
+	// external identity provider that publishes its keys as a JWKS
+	jwtMode := os.Getenv("JWT_MODE")
+	if jwtMode == "" {
+		jwtMode = jwtModeHS256
+	}
+	var jwks *auth.JWKS
+	jwksIssuer := os.Getenv("JWKS_ISSUER")
+	switch jwtMode {
+	case jwtModeHS256:
+	case jwtModeJWKS:
+		jwksURL := os.Getenv("JWKS_URL")
+		if jwksURL == "" {
+			log.Fatal("JWKS_URL must be set when JWT_MODE is jwks")
+		}
+		if jwksIssuer == "" {
+			log.Fatal("JWKS_ISSUER must be set when JWT_MODE is jwks")
+		}
+		jwks = auth.NewJWKS(jwksURL, getEnvDuration("JWKS_REFRESH_INTERVAL", time.Hour))
+	default:
+		log.Fatalf("JWT_MODE must be %q or %q", jwtModeHS256, jwtModeJWKS)
+	}
+
+	// When to pick a thumbnail for videos uploaded without one
+	thumbnailMode := os.Getenv("THUMBNAIL_MODE")
+	if thumbnailMode == "" {
+		thumbnailMode = thumbnailModeUpload
+	}
+	switch thumbnailMode {
+	case thumbnailModeOff, thumbnailModeUpload, thumbnailModeLazy:
+	default:
+		log.Fatalf("THUMBNAIL_MODE must be %q, %q or %q", thumbnailModeOff, thumbnailModeUpload, thumbnailModeLazy)
+	}
+	// Whether thumbnails are kept in the assets directory or in S3
+	thumbnailStorage := os.Getenv("THUMBNAIL_STORAGE")
+	if thumbnailStorage == "" {
+		thumbnailStorage = thumbnailStorageDisk
+	}
+	if thumbnailStorage != thumbnailStorageDisk && thumbnailStorage != thumbnailStorageS3 {
+		log.Fatalf("THUMBNAIL_STORAGE must be %q or %q", thumbnailStorageDisk, thumbnailStorageS3)
+	}
+	// Where in the video generated thumbnails are taken from
+	thumbnailFrameOffset := getEnvDuration("THUMBNAIL_FRAME_OFFSET", time.Second)
+	if thumbnailFrameOffset < 0 {
+		log.Fatal("THUMBNAIL_FRAME_OFFSET must not be negative")
+	}
+
+	// Maintenance mode pauses uploads; it can also be toggled with SIGUSR1/SIGUSR2
+	maintenance := &atomic.Bool{}
+	maintenance.Store(getEnvBool("MAINTENANCE_MODE", false))
+	maintenanceRetryAfter := getEnvDuration("MAINTENANCE_RETRY_AFTER", 5*time.Minute)
+	if maintenanceRetryAfter < time.Second {
+		log.Fatal("MAINTENANCE_RETRY_AFTER must be at least 1s")
+	}
+
+	// Optional SQS queue that hears about every completed upload
+	uploadEventsQueueURL := os.Getenv("UPLOAD_EVENTS_QUEUE_URL")
+	uploadEventsMaxAttempts := getEnvInt("UPLOAD_EVENTS_MAX_ATTEMPTS", 3)
+	if uploadEventsMaxAttempts < 1 {
+		log.Fatal("UPLOAD_EVENTS_MAX_ATTEMPTS must be at least 1")
+	}
+
+	// Whether to flag thumbnails that look like one of the user's other thumbnails
+	duplicateThumbnailPolicy := os.Getenv("DUPLICATE_THUMBNAIL_POLICY")
+	if duplicateThumbnailPolicy == "" {
+		duplicateThumbnailPolicy = duplicateThumbnailOff
+	}
+	switch duplicateThumbnailPolicy {
+	case duplicateThumbnailOff, duplicateThumbnailWarn, duplicateThumbnailReject:
+	default:
+		log.Fatalf("DUPLICATE_THUMBNAIL_POLICY must be %q, %q or %q", duplicateThumbnailOff, duplicateThumbnailWarn, duplicateThumbnailReject)
+	}
+	// Hashes at most this many bits apart (out of 64) count as duplicates
+	duplicateThumbnailThreshold := getEnvInt("DUPLICATE_THUMBNAIL_THRESHOLD", 6)
+	if duplicateThumbnailThreshold < 0 || duplicateThumbnailThreshold > 64 {
+		log.Fatal("DUPLICATE_THUMBNAIL_THRESHOLD must be between 0 and 64")
+	}
+
+	// Optional PNG logo stamped onto free-tier thumbnails
+	var watermark *thumbnailWatermark
+	if watermarkPath := os.Getenv("THUMBNAIL_WATERMARK_PATH"); watermarkPath != "" {
+		position := os.Getenv("THUMBNAIL_WATERMARK_POSITION")
+		if position == "" {
+			position = watermarkBottomRight
+		}
+		switch position {
+		case watermarkTopLeft, watermarkTopRight, watermarkBottomLeft, watermarkBottomRight:
+		default:
+			log.Fatalf("THUMBNAIL_WATERMARK_POSITION must be %q, %q, %q or %q", watermarkTopLeft, watermarkTopRight, watermarkBottomLeft, watermarkBottomRight)
+		}
+		scale := getEnvFloat("THUMBNAIL_WATERMARK_SCALE", 0.15)
+		if scale <= 0 || scale > 1 {
+			log.Fatal("THUMBNAIL_WATERMARK_SCALE must be greater than 0 and at most 1")
+		}
+		watermark, err = loadThumbnailWatermark(watermarkPath, position, scale)
+		if err != nil {
+			log.Fatalf("Couldn't load thumbnail watermark: %v", err)
+		}
+	}
+
+	// Content-Disposition for media served for playback and for the download endpoint
+	playbackDisposition := os.Getenv("PLAYBACK_DISPOSITION")
+	if playbackDisposition == "" {
+		playbackDisposition = dispositionInline
+	}
+	downloadDisposition := os.Getenv("DOWNLOAD_DISPOSITION")
+	if downloadDisposition == "" {
+		downloadDisposition = dispositionAttachment
+	}
+	for _, d := range []string{playbackDisposition, downloadDisposition} {
+		if d != dispositionInline && d != dispositionAttachment {
+			log.Fatal("PLAYBACK_DISPOSITION and DOWNLOAD_DISPOSITION must be inline or attachment")
+		}
+	}
+
+	// Identical files uploaded by the same user within this window are treated as one upload; 0 disables
+	uploadDedupWindow := getEnvDuration("UPLOAD_DEDUP_WINDOW", 0)
+
+	// JSON file of named processing profiles and which plans and API keys get them
+	processingProfiles, err := loadProcessingProfiles(os.Getenv("PROCESSING_PROFILES_FILE"))
+	if err != nil {
+		log.Fatalf("PROCESSING_PROFILES_FILE is invalid: %v", err)
+	}
+
+	// Uploads at least this long are checked for being a looped still image; 0 disables
+	stillVideoMinDuration := getEnvDuration("STILL_VIDEO_MIN_DURATION", 0)
+	stillVideoPolicy := os.Getenv("STILL_VIDEO_POLICY")
+	if stillVideoPolicy == "" {
+		stillVideoPolicy = stillVideoPolicyFlag
+	}
+	if stillVideoPolicy != stillVideoPolicyFlag && stillVideoPolicy != stillVideoPolicyReject {
+		log.Fatalf("STILL_VIDEO_POLICY must be %q or %q", stillVideoPolicyFlag, stillVideoPolicyReject)
+	}
+
+	// Proxies whose X-Forwarded-For entries are believed when recording client IPs
+	trustedProxies, err := parseCIDRs(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("TRUSTED_PROXIES is invalid: %v", err)
+	}
+
+	// Users who, besides a video's owner, can see the client it was uploaded from
+	adminUserIDs, err := parseUserIDs(os.Getenv("ADMIN_USER_IDS"))
+	if err != nil {
+		log.Fatalf("ADMIN_USER_IDS is invalid: %v", err)
+	}
+
+	// Reject plaintext uploads; behind a TLS-terminating proxy, list it in TRUSTED_PROXIES
+	requireTLSUploads := getEnvBool("REQUIRE_TLS", false)
+
+	// Delete renditions, HLS and previews of media once it has been replaced
+	cleanupReplacedArtifacts := getEnvBool("CLEANUP_REPLACED_ARTIFACTS", false)
+
+	// Command run on every upload to scan it for malware; empty disables scanning
+	scanCommand := strings.Fields(os.Getenv("SCAN_COMMAND"))
+	// How long a verdict is reused for identical files; 0 rescans every upload
+	scanVerdictTTL := getEnvDuration("SCAN_VERDICT_TTL", 24*time.Hour)
+	if scanVerdictTTL < 0 {
+		log.Fatal("SCAN_VERDICT_TTL must not be negative")
+	}
+
+	// File extension for each stored media type, e.g. "image/jpeg=.jpg"
+	mediaExtensions, err := parseMediaExtensions(os.Getenv("MEDIA_EXTENSIONS"))
+	if err != nil {
+		log.Fatalf("MEDIA_EXTENSIONS is invalid: %v", err)
+	}
+
+	// Thumbnails up to this size are processed in memory without temp files
+	thumbnailMemoryLimit := getEnvInt64("THUMBNAIL_MEMORY_LIMIT", 10<<20)
+	if thumbnailMemoryLimit <= 0 {
+		log.Fatal("THUMBNAIL_MEMORY_LIMIT must be positive")
+	}
+
+	// Also accept mkv uploads, remuxed to mp4 when their codecs allow it
+	remuxContainers := getEnvBool("REMUX_CONTAINERS", false)
+
+	// Renditions uploaded to S3 at once
+	renditionUploadConcurrency := getEnvInt("RENDITION_UPLOAD_CONCURRENCY", 4)
+	if renditionUploadConcurrency <= 0 {
+		log.Fatal("RENDITION_UPLOAD_CONCURRENCY must be positive")
+	}
+
+	// Lifetime of presigned media links handed to clients
+	presignTTL := getEnvDuration("PRESIGN_TTL", defaultPresignTTL)
+	if presignTTL <= presignRefreshMargin || presignTTL > 7*24*time.Hour {
+		log.Fatalf("PRESIGN_TTL must be longer than %s and at most 7 days", presignRefreshMargin)
+	}
+
+	// Limit on each ffprobe, quick ffmpeg and SCAN_COMMAND run; transcodes aren't affected. 0 disables
+	mediaToolTimeout := getEnvDuration("MEDIA_TOOL_TIMEOUT", defaultMediaToolTimeout)
+	if mediaToolTimeout < 0 {
+		log.Fatal("MEDIA_TOOL_TIMEOUT must not be negative")
+	}
+
+	// Largest request bodies accepted by the upload handlers
+	maxVideoUploadBytes := getEnvInt64("MAX_VIDEO_UPLOAD_BYTES", 1<<30)
+	maxThumbnailBytes := getEnvInt64("MAX_THUMBNAIL_BYTES", 10<<20)
+	if maxVideoUploadBytes <= 0 || maxThumbnailBytes <= 0 {
+		log.Fatal("MAX_VIDEO_UPLOAD_BYTES and MAX_THUMBNAIL_BYTES must be positive")
+	}
+	// Streamed transcodes are uploaded without knowing their size up front,
+	// so the part size can't be grown to stay under S3's part limit
+	if s3PartSize*int64(manager.MaxUploadParts) < maxVideoUploadBytes {
+		log.Fatalf("S3_PART_SIZE must be at least %d bytes to upload a %d byte video in %d parts",
+			(maxVideoUploadBytes+int64(manager.MaxUploadParts)-1)/int64(manager.MaxUploadParts), maxVideoUploadBytes, manager.MaxUploadParts)
+	}
+
+	// Retries of a failed upload request, or part of one, after transient S3
+	// errors, waiting twice as long before each one
+	s3PutRetries := getEnvInt("S3_PUT_RETRIES", 3)
+	s3PutRetryBaseDelay := getEnvDuration("S3_PUT_RETRY_BASE_DELAY", 100*time.Millisecond)
+	if s3PutRetries < 0 || s3PutRetryBaseDelay <= 0 {
+		log.Fatal("S3_PUT_RETRIES must not be negative and S3_PUT_RETRY_BASE_DELAY must be positive")
+	}
+
+	// Append a content-derived ?v= to asset and video URLs so caches notice
+	// replaced content
+	versionAssetURLs := getEnvBool("VERSION_ASSET_URLS", false)
+
+	// Bytes of media and thumbnails each user may store; 0 is unlimited
+	userStorageQuota := getEnvInt64("USER_STORAGE_QUOTA", 0)
+	if userStorageQuota < 0 {
+		log.Fatal("USER_STORAGE_QUOTA must not be negative")
+	}
+	if userStorageQuota > 0 && !trackFileSizes {
+		log.Fatal("USER_STORAGE_QUOTA requires TRACK_FILE_SIZES")
+	}
+
+	// Resumable upload sessions are kept here between chunks and survive
+	// restarts; abandoned ones are dropped after RESUMABLE_UPLOAD_TTL
+	resumableUploadDir := os.Getenv("RESUMABLE_UPLOAD_DIR")
+	if resumableUploadDir == "" {
+		resumableUploadDir = filepath.Join(os.TempDir(), "tubely-resumable")
+	}
+	resumableUploadTTL := getEnvDuration("RESUMABLE_UPLOAD_TTL", 24*time.Hour)
+	if resumableUploadTTL < 0 {
+		log.Fatal("RESUMABLE_UPLOAD_TTL must not be negative")
+	}
+	resumableUploads, err := newResumableUploadStore(resumableUploadDir, resumableUploadTTL)
+	if err != nil {
+		log.Fatalf("Couldn't create resumable upload directory: %v", err)
+	}
+
+	// Widest or tallest thumbnail accepted, checked before the image is decoded
+	maxThumbnailDimension := getEnvInt("MAX_THUMBNAIL_DIMENSION", 4096)
+	if maxThumbnailDimension <= 0 {
+		log.Fatal("MAX_THUMBNAIL_DIMENSION must be positive")
+	}
+
+	// Thumbnails with a longer edge are scaled down to it and re-encoded as
+	// JPEG at this quality
+	thumbnailMaxEdge := getEnvInt("THUMBNAIL_MAX_EDGE", 1280)
+	if thumbnailMaxEdge <= 0 {
+		log.Fatal("THUMBNAIL_MAX_EDGE must be positive")
+	}
+	thumbnailJPEGQuality := getEnvInt("THUMBNAIL_JPEG_QUALITY", 85)
+	if thumbnailJPEGQuality < 1 || thumbnailJPEGQuality > 100 {
+		log.Fatal("THUMBNAIL_JPEG_QUALITY must be between 1 and 100")
+	}
+
+	// Store each video's media at videos/<id>.<ext> instead of naming it after
+	// its content, so a re-upload overwrites the previous file
+	deterministicVideoKeys := getEnvBool("DETERMINISTIC_VIDEO_KEYS", false)
+
+	// Objects are encrypted at rest with this KMS key, or with S3-managed
+	// keys if it isn't set
+	sseKMSKeyID := os.Getenv("S3_SSE_KMS_KEY_ID")
+
+	// Scrub-bar previews sample a frame every SPRITE_INTERVAL into one sheet
+	// of SPRITE_COLUMNS x SPRITE_ROWS tiles. 0 disables them
+	spriteInterval := getEnvDuration("SPRITE_INTERVAL", 0)
+	spriteColumns := getEnvInt("SPRITE_COLUMNS", 10)
+	spriteRows := getEnvInt("SPRITE_ROWS", 10)
+	spriteTileWidth := getEnvInt("SPRITE_TILE_WIDTH", 160)
+	if spriteInterval < 0 {
+		log.Fatal("SPRITE_INTERVAL must not be negative")
+	}
+	// JPEG can't encode a sheet wider or taller than 65535 pixels
+	if spriteColumns <= 0 || spriteRows <= 0 || spriteTileWidth < 16 || spriteColumns*spriteTileWidth > 65535 {
+		log.Fatal("SPRITE_COLUMNS and SPRITE_ROWS must be positive and SPRITE_TILE_WIDTH at least 16, at most 65535 pixels per row")
+	}
+
+	// How long in-flight uploads get to finish on SIGINT or SIGTERM before
+	// they're cancelled
+	shutdownGracePeriod := getEnvDuration("SHUTDOWN_GRACE_PERIOD", 30*time.Second)
+	if shutdownGracePeriod <= 0 {
+		log.Fatal("SHUTDOWN_GRACE_PERIOD must be positive")
+	}
+
+	// Uploads and other media requests each user can make per minute on each
+	// route, and how many of those can come at once. 0 disables the limit
+	uploadRatePerMinute := getEnvInt("UPLOAD_RATE_PER_MINUTE", 0)
+	uploadRateBurst := getEnvInt("UPLOAD_RATE_BURST", max(uploadRatePerMinute, 1))
+	if uploadRatePerMinute < 0 || uploadRateBurst < 1 {
+		log.Fatal("UPLOAD_RATE_PER_MINUTE must not be negative and UPLOAD_RATE_BURST must be positive")
+	}
+
+	// Top-level prefixes objects may be written under
+	objectKeyPrefixes, err := parseObjectKeyPrefixes(os.Getenv("OBJECT_KEY_PREFIXES"))
+	if err != nil {
+		log.Fatalf("OBJECT_KEY_PREFIXES is invalid: %v", err)
+	}
+
+	// Background workers processing uploads after the request returns 202.
+	// 0 processes uploads in the request
+	processingWorkers := getEnvInt("PROCESSING_WORKERS", 0)
+	if processingWorkers < 0 {
+		log.Fatal("PROCESSING_WORKERS must not be negative")
+	}
+
+	// Origins browsers may call the API from, e.g. the SPA's. None by
+	// default, which leaves CORS off
+	corsAllowedOrigins := getEnvList("CORS_ALLOWED_ORIGINS", nil)
+	for _, origin := range corsAllowedOrigins {
+		if err := checkCORSOrigin(origin); err != nil {
+			log.Fatalf("CORS_ALLOWED_ORIGINS is invalid: %v", err)
+		}
+	}
+	corsAllowedMethods := getEnvList("CORS_ALLOWED_METHODS", defaultCORSMethods)
+	corsAllowedHeaders := getEnvList("CORS_ALLOWED_HEADERS", defaultCORSHeaders)
+
+	// How long the response to an upload sent with an Idempotency-Key is
+	// kept for retries. 0 ignores the header
+	idempotencyKeyTTL := getEnvDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+	if idempotencyKeyTTL < 0 {
+		log.Fatal("IDEMPOTENCY_KEY_TTL must not be negative")
+	}
+
+	// A region mismatch otherwise only shows up as confusing redirect errors
+	// on the first upload
+	s3RegionCheck := os.Getenv("S3_REGION_CHECK")
+	if s3RegionCheck == "" {
+		s3RegionCheck = regionCheckOff
+	}
+	if s3RegionCheck != regionCheckOff && s3RegionCheck != regionCheckFail && s3RegionCheck != regionCheckCorrect {
+		log.Fatalf("S3_REGION_CHECK must be %q, %q or %q", regionCheckOff, regionCheckFail, regionCheckCorrect)
+	}
+
+	// Bearer token scrapers send for /metrics. Without one the endpoint
+	// isn't served, since it exposes traffic and error rates
+	metricsToken := os.Getenv("METRICS_TOKEN")
+
+	// Caps on connections to each AWS endpoint; 0 means unlimited
+	awsMaxConnsPerHost := getEnvInt("AWS_MAX_CONNS_PER_HOST", 64)
+	awsMaxIdleConns := getEnvInt("AWS_MAX_IDLE_CONNS", 32)
+	if awsMaxConnsPerHost < 0 || awsMaxIdleConns < 0 {
+		log.Fatal("AWS_MAX_CONNS_PER_HOST and AWS_MAX_IDLE_CONNS must not be negative")
+	}
+
+	// Bounds on in-flight S3 requests, adapted to throttling; 0 disables the limit
+	s3MaxConcurrency := getEnvInt("S3_MAX_CONCURRENCY", 0)
+	s3MinConcurrency := getEnvInt("S3_MIN_CONCURRENCY", 1)
+	if s3MaxConcurrency < 0 || (s3MaxConcurrency > 0 && (s3MinConcurrency < 1 || s3MinConcurrency > s3MaxConcurrency)) {
+		log.Fatal("S3_MIN_CONCURRENCY must be between 1 and S3_MAX_CONCURRENCY")
+	}
+
+	metrics := newAppMetrics()
+	var s3Options []func(*s3.Options)
+	if s3MaxConcurrency > 0 {
+		s3Options = append(s3Options, newS3Limiter(s3MinConcurrency, s3MaxConcurrency, metrics).clientOption)
+	}
+	awsConfig, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(s3Region),
+		config.WithHTTPClient(newAWSHTTPClient(awsMaxConnsPerHost, awsMaxIdleConns, metrics)),
+	)
 	if err != nil {
 		log.Fatalf("Couldn't load AWS config: %v", err)
 	}
+	s3Client := s3.NewFromConfig(awsConfig, s3Options...)
+
+	if s3RegionCheck != regionCheckOff {
+		actualRegion, err := checkBucketRegion(s3Client, s3Bucket, s3Region, s3RegionCheck)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if actualRegion != s3Region {
+			slog.Warn("S3_REGION doesn't match the bucket's region, using the bucket's", "configured", s3Region, "bucket", s3Bucket, "region", actualRegion)
+			s3Region = actualRegion
+			awsConfig.Region = actualRegion
+			s3Client = s3.NewFromConfig(awsConfig, s3Options...)
+		}
+	}
+
 	cfg := apiConfig{
 		db:               db,
 		jwtSecret:        jwtSecret,
 		platform:         platform,
 		filepathRoot:     filepathRoot,
 		assetsRoot:       assetsRoot,
-		s3Client:         s3.NewFromConfig(awsConfig),
+		s3Client:         s3Client,
+		s3Uploader:       newS3Uploader(s3Client, s3PartSize, s3UploadConcurrency, s3PutRetries, s3PutRetryBaseDelay, metrics),
+		s3Presigner:      s3.NewPresignClient(s3Client),
 		s3Bucket:         s3Bucket,
 		s3Region:         s3Region,
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
+
+		thumbnailPlaceholderURL:    thumbnailPlaceholderURL,
+		presignCache:               newPresignCache(presignCacheSize),
+		maxPassthroughBitRate:      maxPassthroughBitRate,
+		durationTolerance:          durationTolerance,
+		bucketOverrideNetworks:     bucketOverrideNetworks,
+		maxKeyframeInterval:        maxKeyframeInterval,
+		longGOPPolicy:              longGOPPolicy,
+		maxDerivedArtifacts:        maxDerivedArtifacts,
+		aspectRatioFallback:        aspectRatioFallback,
+		thumbnailRegenAsyncBytes:   thumbnailRegenAsyncBytes,
+		metrics:                    metrics,
+		uploadTempDir:              uploadTempDir,
+		encodeDeadline:             encodeDeadline,
+		trackFileSizes:             trackFileSizes,
+		maxTranscriptBytes:         maxTranscriptBytes,
+		softDeleteGrace:            softDeleteGrace,
+		thumbnailMode:              thumbnailMode,
+		thumbnailStorage:           thumbnailStorage,
+		thumbnailFlights:           newThumbnailFlights(),
+		jwtMode:                    jwtMode,
+		jwks:                       jwks,
+		jwksIssuer:                 jwksIssuer,
+		maintenance:                maintenance,
+		maintenanceRetryAfter:      maintenanceRetryAfter,
+		processingPipelines:        processingPipelines,
+		uploadEvents:               newUploadEventPublisher(sqs.NewFromConfig(awsConfig), uploadEventsQueueURL, uploadEventsMaxAttempts),
+		streamTranscode:            streamTranscode,
+		thumbnailWatermark:         watermark,
+		playbackDisposition:        playbackDisposition,
+		downloadDisposition:        downloadDisposition,
+		recentUploads:              newRecentUploads(uploadDedupWindow),
+		processingProfiles:         processingProfiles,
+		stillVideoMinDuration:      stillVideoMinDuration,
+		stillVideoPolicy:           stillVideoPolicy,
+		trustedProxies:             trustedProxies,
+		adminUserIDs:               adminUserIDs,
+		requireTLSUploads:          requireTLSUploads,
+		cleanupReplacedArtifacts:   cleanupReplacedArtifacts,
+		scanCommand:                scanCommand,
+		scanVerdictTTL:             scanVerdictTTL,
+		mediaExtensions:            mediaExtensions,
+		thumbnailMemoryLimit:       thumbnailMemoryLimit,
+		remuxContainers:            remuxContainers,
+		renditionUploadConcurrency: renditionUploadConcurrency,
+		presignTTL:                 presignTTL,
+		thumbnailFrameOffset:       thumbnailFrameOffset,
+		uploadProgress:             newUploadProgressTracker(),
+		mediaToolTimeout:           mediaToolTimeout,
+		maxVideoUploadBytes:        maxVideoUploadBytes,
+		maxThumbnailBytes:          maxThumbnailBytes,
+		versionAssetURLs:           versionAssetURLs,
+		userStorageQuota:           userStorageQuota,
+		resumableUploads:           resumableUploads,
+		maxThumbnailDimension:      maxThumbnailDimension,
+		thumbnailMaxEdge:           thumbnailMaxEdge,
+		thumbnailJPEGQuality:       thumbnailJPEGQuality,
+		deterministicVideoKeys:     deterministicVideoKeys,
+		sseKMSKeyID:                sseKMSKeyID,
+		spriteOptions: spriteOptions{
+			interval:  spriteInterval,
+			columns:   spriteColumns,
+			rows:      spriteRows,
+			tileWidth: spriteTileWidth,
+		},
+		uploadRateLimiter:  newUserRateLimiter(uploadRatePerMinute, uploadRateBurst),
+		objectKeyPrefixes:  objectKeyPrefixes,
+		processingQueue:    newProcessingQueue(processingWorkers),
+		backgroundTasks:    newBackgroundTasks(),
+		corsAllowedOrigins: corsAllowedOrigins,
+		corsAllowedMethods: corsAllowedMethods,
+		corsAllowedHeaders: corsAllowedHeaders,
+		idempotentUploads:  newIdempotentUploads(idempotencyKeyTTL),
+		mediaLocks:         newMediaLocks(),
+		metricsToken:       metricsToken,
+
+		duplicateThumbnailPolicy:    duplicateThumbnailPolicy,
+		duplicateThumbnailThreshold: duplicateThumbnailThreshold,
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -107,6 +753,29 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	if softDeleteGrace > 0 {
+		go cfg.sweepDeletedVideos()
+	}
+	go resumableUploads.sweepResumableUploads()
+
+	// Uploads cut off by the last shutdown would otherwise look in progress
+	// forever. Queued ones are left for the workers to finish.
+	interrupted, err := db.FailInterruptedUploads("Upload was interrupted, please upload again")
+	if err != nil {
+		log.Fatalf("Couldn't check for interrupted uploads: %v", err)
+	}
+	if interrupted > 0 {
+		slog.Info("marked interrupted uploads as failed", "count", interrupted)
+	}
+
+	if cfg.processingQueue != nil {
+		if err := cfg.startProcessingWorkers(); err != nil {
+			log.Fatalf("Couldn't start processing workers: %v", err)
+		}
+	}
+
+	go cfg.watchMaintenanceSignals()
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
@@ -121,19 +790,50 @@ func main() {
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/videos/validate", cfg.requireTLS(cfg.rejectDuringMaintenance(cfg.rateLimitUploads(cfg.handlerVideoValidate))))
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.requireTLS(cfg.rejectDuringMaintenance(cfg.rateLimitUploads(cfg.instrumentUpload("thumbnail", cfg.handlerUploadThumbnail)))))
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.requireTLS(cfg.rejectDuringMaintenance(cfg.rateLimitUploads(cfg.instrumentUpload("video", cfg.handlerUploadVideo)))))
+	mux.HandleFunc("POST /api/uploads", cfg.requireTLS(cfg.rejectDuringMaintenance(cfg.rateLimitUploads(cfg.handlerResumableUploadCreate))))
+	mux.HandleFunc("HEAD /api/uploads/{uploadID}", cfg.requireTLS(cfg.handlerResumableUploadHead))
+	mux.HandleFunc("PATCH /api/uploads/{uploadID}", cfg.requireTLS(cfg.rejectDuringMaintenance(cfg.instrumentUpload("video_chunk", cfg.handlerResumableUploadPatch))))
+	mux.HandleFunc("DELETE /api/uploads/{uploadID}", cfg.requireTLS(cfg.handlerResumableUploadDelete))
+	mux.HandleFunc("GET /api/videos/{videoID}/thumbnail", cfg.handlerVideoThumbnail)
+	mux.HandleFunc("GET /api/videos/{videoID}/sprites.vtt", cfg.handlerVideoSpritesVTT)
+	mux.HandleFunc("GET /api/videos/{videoID}/upload-progress", cfg.handlerVideoUploadProgress)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail/regenerate", cfg.rateLimitUploads(cfg.handlerThumbnailRegenerate))
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail/from-frame", cfg.requireTLS(cfg.rejectDuringMaintenance(cfg.rateLimitUploads(cfg.handlerThumbnailFromFrame))))
+	mux.HandleFunc("PATCH /api/videos/{videoID}/thumbnail-meta", cfg.handlerVideoThumbnailMetaUpdate)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("GET /api/bandwidth", cfg.handlerBandwidth)
+	mux.HandleFunc("GET /api/videos/search", cfg.handlerVideosSearch)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("POST /api/videos/{videoID}/restore", cfg.handlerVideoRestore)
+	mux.HandleFunc("GET /api/videos/{videoID}/download", cfg.handlerVideoDownload)
+	mux.HandleFunc("GET /api/videos/{videoID}/stream", cfg.handlerStreamVideo)
+	mux.HandleFunc("POST /api/videos/{videoID}/promote", cfg.handlerVideoPromote)
+	mux.HandleFunc("POST /api/videos/{videoID}/trim", cfg.rateLimitUploads(cfg.handlerVideoTrim))
+	mux.HandleFunc("PUT /api/videos/{videoID}/metadata", cfg.handlerVideoMetadataSet)
+	mux.HandleFunc("PATCH /api/videos/{videoID}/metadata", cfg.handlerVideoMetadataMerge)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/metadata", cfg.handlerVideoMetadataClear)
+	mux.HandleFunc("PUT /api/videos/{videoID}/transcript", cfg.requireTLS(cfg.handlerVideoTranscriptSet))
+	mux.HandleFunc("GET /api/videos/{videoID}/transcript", cfg.handlerVideoTranscriptGet)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
 
+	mux.Handle("GET /metrics", cfg.requireMetricsToken(cfg.metrics.registry))
+	mux.HandleFunc("GET /healthz", cfg.handlerHealthz)
+	mux.HandleFunc("GET /livez", cfg.handlerLivez)
+
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: requestIDMiddleware(cfg.corsMiddleware(mux)),
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	slog.Info("serving on http://localhost:" + port + "/app/")
+	if err := serveUntilSignalled(srv, shutdownGracePeriod); err != nil {
+		log.Fatal(err)
+	}
+	cfg.backgroundTasks.drain(shutdownGracePeriod)
+	slog.Info("server stopped")
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+// watchMaintenanceSignals toggles maintenance mode at runtime: SIGUSR1 turns
+// it on and SIGUSR2 turns it off.
+func (cfg *apiConfig) watchMaintenanceSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range sigs {
+		enabled := sig == syscall.SIGUSR1
+		cfg.maintenance.Store(enabled)
+		slog.Info("maintenance mode toggled", "enabled", enabled)
+	}
+}
+
+// rejectDuringMaintenance turns new uploads away while maintenance mode is
+// on. Requests that got in before it was switched on are left to finish.
+func (cfg *apiConfig) rejectDuringMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.maintenance.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(cfg.maintenanceRetryAfter.Seconds())))
+			respondWithError(w, http.StatusServiceUnavailable, "Uploads are paused for maintenance", nil)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "sync"
+
+// mediaLocks serializes work on a stored media object that other videos may
+// share through deduplication. Deleting one checks that no video references
+// it, and that check means nothing unless uploads that start referencing
+// the object hold the same lock until their reference is committed.
+type mediaLocks struct {
+	mu    sync.Mutex
+	locks map[string]*mediaLock
+}
+
+type mediaLock struct {
+	sync.Mutex
+	// waiters counts holders and goroutines waiting, so the entry can be
+	// dropped once nobody needs it
+	waiters int
+}
+
+func newMediaLocks() *mediaLocks {
+	return &mediaLocks{locks: map[string]*mediaLock{}}
+}
+
+// lock blocks until the object is free and returns the function releasing it.
+func (m *mediaLocks) lock(bucket, key string) (unlock func()) {
+	id := bucket + "/" + key
+
+	m.mu.Lock()
+	l, ok := m.locks[id]
+	if !ok {
+		l = &mediaLock{}
+		m.locks[id] = l
+	}
+	l.waiters++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(m.locks, id)
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+)
+
+// Default limit on a single ffmpeg or ffprobe run outside of transcoding.
+const defaultMediaToolTimeout = 60 * time.Second
+
+type mediaToolTimeoutKey struct{}
+
+// mediaContext bounds every ffmpeg and ffprobe run made with the returned
+// context by MEDIA_TOOL_TIMEOUT, on top of the parent's own cancellation.
+// Transcodes legitimately run far longer and are given the parent instead.
+func (cfg *apiConfig) mediaContext(ctx context.Context) context.Context {
+	if cfg.mediaToolTimeout <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, mediaToolTimeoutKey{}, cfg.mediaToolTimeout)
+}
+
+// runMediaTool runs ffmpeg or ffprobe, writing its output to stdout if
+// non-nil. Output files the tool may have partly written are left for the
+// caller to remove.
+func runMediaTool(ctx context.Context, stdout io.Writer, name string, args ...string) error {
+	runCtx := ctx
+	timeout, _ := ctx.Value(mediaToolTimeoutKey{}).(time.Duration)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(runCtx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out after %s", name, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s error: %s, %w", name, stderr.String(), err)
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// requireMetricsToken serves the metrics only to scrapers presenting
+// METRICS_TOKEN as a bearer token. With no token configured they aren't
+// served at all.
+func (cfg *apiConfig) requireMetricsToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.metricsToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusUnauthorized, errCodeMissingToken, "Couldn't find metrics token", err)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.metricsToken)) != 1 {
+			respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidToken, "Invalid metrics token", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// metricsRegistry is a minimal Prometheus-compatible registry. It renders
+// every registered metric in the text exposition format on /metrics.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+func (reg *metricsRegistry) register(c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.collectors = append(reg.collectors, c)
+}
+
+func (reg *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	collectors := append([]collector(nil), reg.collectors...)
+	reg.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, c := range collectors {
+		c.writeTo(w)
+	}
+}
+
+// metricVec holds one value per combination of label values.
+type metricVec[T any] struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*T
+}
+
+func (v *metricVec[T]) with(labelValues []string, init func() *T) *T {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = init()
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *metricVec[T]) sortedKeys() []string {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *metricVec[T]) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+}
+
+func (v *metricVec[T]) labels(key string, extra ...string) string {
+	var pairs []string
+	if len(v.labelNames) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", v.labelNames[i], value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counterVec struct {
+	metricVec[float64]
+}
+
+func (reg *metricsRegistry) newCounter(name, help string, labelNames ...string) *counterVec {
+	c := &counterVec{metricVec[float64]{name: name, help: help, kind: "counter", labelNames: labelNames, series: map[string]*float64{}}}
+	reg.register(c)
+	return c
+}
+
+func (c *counterVec) add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.with(labelValues, func() *float64 { return new(float64) }) += delta
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w)
+	for _, k := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labels(k), formatFloat(*c.series[k]))
+	}
+}
+
+type gaugeVec struct {
+	metricVec[float64]
+}
+
+func (reg *metricsRegistry) newGauge(name, help string, labelNames ...string) *gaugeVec {
+	g := &gaugeVec{metricVec[float64]{name: name, help: help, kind: "gauge", labelNames: labelNames, series: map[string]*float64{}}}
+	reg.register(g)
+	return g
+}
+
+func (g *gaugeVec) set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.with(labelValues, func() *float64 { return new(float64) }) = value
+}
+
+func (g *gaugeVec) add(delta float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.with(labelValues, func() *float64 { return new(float64) }) += delta
+}
+
+func (g *gaugeVec) writeTo(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writeHeader(w)
+	for _, k := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labels(k), formatFloat(*g.series[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	metricVec[histogram]
+	buckets []float64
+}
+
+func (reg *metricsRegistry) newHistogram(name, help string, buckets []float64, labelNames ...string) *histogramVec {
+	h := &histogramVec{
+		metricVec: metricVec[histogram]{name: name, help: help, kind: "histogram", labelNames: labelNames, series: map[string]*histogram{}},
+		buckets:   buckets,
+	}
+	reg.register(h)
+	return h
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.with(labelValues, func() *histogram {
+		return &histogram{counts: make([]uint64, len(h.buckets))}
+	})
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	for _, k := range h.sortedKeys() {
+		s := h.series[k]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(k, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(k, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labels(k), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labels(k), s.count)
+	}
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// exponentialBuckets returns count bucket bounds starting at start and
+// growing by factor.
+func exponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// appMetrics holds every metric the server reports.
+type appMetrics struct {
+	registry *metricsRegistry
+
+	s3UploadThroughput *histogramVec
+	s3PartRetries      *counterVec
+	bytesServed        *counterVec
+	uploadEvents       *counterVec
+	awsConnections     *gaugeVec
+	s3Concurrency      *gaugeVec
+	s3Throttles        *counterVec
+	uploads            *counterVec
+	uploadedBytes      *counterVec
+	videoAspectRatios  *counterVec
+	mediaStepDuration  *histogramVec
+	s3PutDuration      *histogramVec
+}
+
+func newAppMetrics() *appMetrics {
+	reg := newMetricsRegistry()
+	return &appMetrics{
+		registry: reg,
+		s3UploadThroughput: reg.newHistogram(
+			"tubely_s3_upload_throughput_bytes_per_second",
+			"Throughput of completed S3 uploads.",
+			exponentialBuckets(256<<10, 2, 10),
+		),
+		s3PartRetries: reg.newCounter(
+			"tubely_s3_part_retries_total",
+			"S3 upload requests (including multipart parts) that were retried.",
+		),
+		bytesServed: reg.newCounter(
+			"tubely_media_bytes_served_total",
+			"Media bytes actually delivered to clients.",
+			"endpoint", "code",
+		),
+		uploadEvents: reg.newCounter(
+			"tubely_upload_events_total",
+			"Upload-completed events by delivery result.",
+			"result",
+		),
+		awsConnections: reg.newGauge(
+			"tubely_aws_open_connections",
+			"Open connections to AWS endpoints.",
+		),
+		s3Concurrency: reg.newGauge(
+			"tubely_s3_concurrency_limit",
+			"Current bound on in-flight S3 requests.",
+		),
+		s3Throttles: reg.newCounter(
+			"tubely_s3_throttles_total",
+			"S3 requests rejected with SlowDown or another throttling error.",
+		),
+		uploads: reg.newCounter(
+			"tubely_uploads_total",
+			"Upload requests by kind and result.",
+			"kind", "result",
+		),
+		uploadedBytes: reg.newCounter(
+			"tubely_uploaded_bytes_total",
+			"Bytes received in uploads, by kind and declared media type.",
+			"kind", "media_type",
+		),
+		videoAspectRatios: reg.newCounter(
+			"tubely_video_uploads_by_aspect_ratio_total",
+			"Processed video uploads by aspect ratio.",
+			"aspect_ratio",
+		),
+		mediaStepDuration: reg.newHistogram(
+			"tubely_media_step_duration_seconds",
+			"Time taken by ffprobe and ffmpeg steps of upload processing.",
+			exponentialBuckets(0.05, 2, 12),
+			"step",
+		),
+		s3PutDuration: reg.newHistogram(
+			"tubely_s3_put_duration_seconds",
+			"Latency of S3 object uploads, including every part of multipart ones.",
+			exponentialBuckets(0.05, 2, 12),
+		),
+	}
+}
+
+// timeMediaStep starts timing a media processing step. Call the returned
+// func when the step is done.
+func (m *appMetrics) timeMediaStep(step string) func() {
+	start := time.Now()
+	return func() {
+		m.mediaStepDuration.observe(time.Since(start).Seconds(), step)
+	}
+}
+
+// uploadResult buckets a response status for the uploads counter.
+func uploadResult(status int) string {
+	switch {
+	case status >= 500:
+		return "server_error"
+	case status >= 400:
+		return "client_error"
+	default:
+		return "success"
+	}
+}
+
+// instrumentUpload counts the handler's responses under the given upload
+// kind.
+func (cfg *apiConfig) instrumentUpload(kind string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingResponseWriter{ResponseWriter: w}
+		next(cw, r)
+		status := cw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		cfg.metrics.uploads.inc(kind, uploadResult(status))
+	}
+}
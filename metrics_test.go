@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsRequireToken(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	handler := cfg.requireMetricsToken(cfg.metrics.registry)
+
+	scrape := func(token string) int {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if got := scrape("anything"); got != http.StatusNotFound {
+		t.Errorf("with no token configured: status %d, want %d", got, http.StatusNotFound)
+	}
+
+	cfg.metricsToken = "scrape-secret"
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "guess", http.StatusUnauthorized},
+		{"right token", "scrape-secret", http.StatusOK},
+	} {
+		if got := scrape(tc.token); got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// defaultObjectKeyPrefixes are the top-level prefixes media, renditions,
+// sprites and thumbnails are written under.
+var defaultObjectKeyPrefixes = append(aspectRatioPrefixes(), deterministicVideoPrefix, stagingPrefix, "renditions/", "sprites/", thumbnailKeyPrefix)
+
+// Media is stored under this prefix when DETERMINISTIC_VIDEO_KEYS is set.
+const deterministicVideoPrefix = "videos/"
+
+// deterministicVideoKey is the one key a video's media is stored under when
+// keys are deterministic, e.g. videos/<id>.mp4.
+func (cfg apiConfig) deterministicVideoKey(videoID uuid.UUID, mediaType string, staging bool) (string, error) {
+	assetPath, err := cfg.getAssetPath(videoID.String(), mediaType)
+	if err != nil {
+		return "", err
+	}
+	key := deterministicVideoPrefix + assetPath
+	if staging {
+		key = stagingPrefix + key
+	}
+	return key, nil
+}
+
+var errUnsafeObjectKey = errors.New("unsafe object key")
+
+// checkObjectKey rejects keys that could put an object somewhere it wasn't
+// meant to go. Keys are composed from several inputs, so each one written is
+// checked to be relative, free of "." and ".." segments and under one of
+// the allowed prefixes.
+func (cfg apiConfig) checkObjectKey(key string) error {
+	if err := checkKeySegments(key); err != nil {
+		return err
+	}
+	for _, prefix := range cfg.objectKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q isn't under an allowed prefix", errUnsafeObjectKey, key)
+}
+
+func checkKeySegments(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return fmt.Errorf("%w: %q", errUnsafeObjectKey, key)
+	}
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		// Only a prefix may end in a slash
+		if segment == "" && i == len(segments)-1 {
+			continue
+		}
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("%w: %q", errUnsafeObjectKey, key)
+		}
+	}
+	return nil
+}
+
+// parseObjectKeyPrefixes reads a comma-separated list of prefixes, e.g.
+// "landscape/,portrait/". An empty list keeps the defaults.
+func parseObjectKeyPrefixes(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return defaultObjectKeyPrefixes, nil
+	}
+
+	var prefixes []string
+	for _, prefix := range strings.Split(list, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if !strings.HasSuffix(prefix, "/") {
+			return nil, fmt.Errorf("prefix %q must end in a slash", prefix)
+		}
+		if err := checkKeySegments(prefix); err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckKeySegments(t *testing.T) {
+	tests := []struct {
+		key  string
+		safe bool
+	}{
+		{"landscape/abc.mp4", true},
+		{"renditions/720/abc.mp4", true},
+		{"landscape/", true},
+		{"", false},
+		{"/landscape/abc.mp4", false},
+		{"landscape//abc.mp4", false},
+		{"landscape/../abc.mp4", false},
+		{"../abc.mp4", false},
+		{"landscape/..", false},
+		{"landscape/./abc.mp4", false},
+		{`landscape\..\abc.mp4`, false},
+		{`landscape\abc.mp4`, false},
+	}
+	for _, tc := range tests {
+		err := checkKeySegments(tc.key)
+		if tc.safe && err != nil {
+			t.Errorf("checkKeySegments(%q) = %v, want nil", tc.key, err)
+		}
+		if !tc.safe && !errors.Is(err, errUnsafeObjectKey) {
+			t.Errorf("checkKeySegments(%q) = %v, want errUnsafeObjectKey", tc.key, err)
+		}
+	}
+}
+
+func TestCheckObjectKey(t *testing.T) {
+	cfg := apiConfig{objectKeyPrefixes: []string{"landscape/", "thumbnails/"}}
+	tests := []struct {
+		key  string
+		safe bool
+	}{
+		{"landscape/abc.mp4", true},
+		{"thumbnails/abc.jpg", true},
+		{"portrait/abc.mp4", false},
+		{"landscapes/abc.mp4", false},
+		{"abc.mp4", false},
+		{"", false},
+		{"/landscape/abc.mp4", false},
+		{"landscape/../portrait/abc.mp4", false},
+		{`landscape\abc.mp4`, false},
+	}
+	for _, tc := range tests {
+		err := cfg.checkObjectKey(tc.key)
+		if tc.safe && err != nil {
+			t.Errorf("checkObjectKey(%q) = %v, want nil", tc.key, err)
+		}
+		if !tc.safe && !errors.Is(err, errUnsafeObjectKey) {
+			t.Errorf("checkObjectKey(%q) = %v, want errUnsafeObjectKey", tc.key, err)
+		}
+	}
+}
+
+func TestParseObjectKeyPrefixes(t *testing.T) {
+	if prefixes, err := parseObjectKeyPrefixes(" "); err != nil || len(prefixes) != len(defaultObjectKeyPrefixes) {
+		t.Errorf("empty list = %v, %v, want the defaults", prefixes, err)
+	}
+	for _, list := range []string{"landscape", "../", "a//", `a\b/`, "/a/"} {
+		if _, err := parseObjectKeyPrefixes(list); err == nil {
+			t.Errorf("parseObjectKeyPrefixes(%q) succeeded, want an error", list)
+		}
+	}
+}
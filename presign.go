@@ -0,0 +1,254 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Cached URLs are re-signed once they get this close to expiring so clients
+// never receive a link that dies mid-playback.
+const presignRefreshMargin = time.Minute
+
+const defaultPresignTTL = 15 * time.Minute
+
+type presignCacheKey struct {
+	bucket    string
+	key       string
+	ttl       time.Duration
+	overrides presignOverrides
+}
+
+// presignOverrides make S3 answer the signed GET with these headers instead
+// of the ones stored on the object.
+type presignOverrides struct {
+	contentType        string
+	contentDisposition string
+}
+
+type presignCacheEntry struct {
+	cacheKey  presignCacheKey
+	url       string
+	expiresAt time.Time
+}
+
+// presignCache is a fixed-size LRU of presigned GET URLs. A nil cache is
+// valid and never stores anything.
+type presignCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[presignCacheKey]*list.Element
+}
+
+func newPresignCache(capacity int) *presignCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &presignCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[presignCacheKey]*list.Element),
+	}
+}
+
+func (c *presignCache) get(k presignCacheKey, now time.Time) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[k]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*presignCacheEntry)
+	if !now.Add(presignRefreshMargin).Before(entry.expiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, k)
+		return "", false
+	}
+	c.ll.MoveToFront(el)
+	return entry.url, true
+}
+
+func (c *presignCache) put(k presignCacheKey, url string, expiresAt time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[k]; ok {
+		entry := el.Value.(*presignCacheEntry)
+		entry.url = url
+		entry.expiresAt = expiresAt
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[k] = c.ll.PushFront(&presignCacheEntry{cacheKey: k, url: url, expiresAt: expiresAt})
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*presignCacheEntry).cacheKey)
+	}
+}
+
+// invalidate drops every cached URL for the object, whatever its TTL.
+func (c *presignCache) invalidate(bucket, key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, el := range c.items {
+		if k.bucket == bucket && k.key == key {
+			c.ll.Remove(el)
+			delete(c.items, k)
+		}
+	}
+}
+
+func (cfg *apiConfig) presignGetObject(ctx context.Context, bucket, key string, ttl time.Duration, overrides presignOverrides) (string, error) {
+	cacheKey := presignCacheKey{bucket: bucket, key: key, ttl: ttl, overrides: overrides}
+	if url, ok := cfg.presignCache.get(cacheKey, time.Now()); ok {
+		return url, nil
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	input := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	if overrides.contentType != "" {
+		input.ResponseContentType = &overrides.contentType
+	}
+	if overrides.contentDisposition != "" {
+		input.ResponseContentDisposition = &overrides.contentDisposition
+	}
+
+	req, err := cfg.s3Presigner.PresignGetObject(ctx, input, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", fmt.Errorf("couldn't presign object %s: %w", key, err)
+	}
+
+	cfg.presignCache.put(cacheKey, req.URL, expiresAt)
+	return req.URL, nil
+}
+
+// Bounds how many URLs batchSignVideos signs at once.
+const presignWorkers = 8
+
+type signedVideo struct {
+	database.Video
+	// URLError is set when the video's media URL couldn't be signed, in which
+	// case VideoURL is omitted rather than failing the whole response.
+	URLError bool `json:"url_error,omitempty"`
+}
+
+// signVideo swaps the video's stored URLs for presigned ones when they point
+// at S3 objects that aren't served through the CloudFront distribution. A
+// thumbnail or sprite sheet that can't be signed is dropped; only the media
+// URL failing to sign is an error.
+func (cfg *apiConfig) signVideo(ctx context.Context, video database.Video) (database.Video, error) {
+	video.ThumbnailURL = cfg.signOptionalURL(ctx, video.ID, "thumbnail", video.ThumbnailURL)
+	video.SpritesURL = cfg.signOptionalURL(ctx, video.ID, "sprites", video.SpritesURL)
+	// The index refers to the sheet, which has to be signed inside it too
+	if video.SpritesVTTURL != nil && !cfg.isCloudFrontURL(*video.SpritesVTTURL) {
+		if _, _, err := cfg.parseS3Key(*video.SpritesVTTURL); err == nil {
+			vttURL := cfg.spritesVTTEndpoint(video.ID)
+			video.SpritesVTTURL = &vttURL
+		}
+	}
+
+	if video.VideoURL == nil {
+		return video, nil
+	}
+	url, err := cfg.signObjectURL(ctx, *video.VideoURL, mediaOverrides(cfg.playbackDisposition, video.Title))
+	if err != nil {
+		return video, err
+	}
+	video.VideoURL = &url
+	return video, nil
+}
+
+// signOptionalURL signs a URL the video can do without, logging and
+// dropping it if it can't be signed.
+func (cfg *apiConfig) signOptionalURL(ctx context.Context, videoID uuid.UUID, name string, url *string) *string {
+	if url == nil {
+		return nil
+	}
+	signed, err := cfg.signObjectURL(ctx, *url, presignOverrides{})
+	if err != nil {
+		slog.Error("couldn't sign URL", "field", name, "video_id", videoID, "error", err)
+		return nil
+	}
+	return &signed
+}
+
+// signObjectURL presigns a stored URL if it points at an S3 object that
+// isn't served through CloudFront. Any other URL, like a CloudFront link or
+// a thumbnail in the assets directory, is returned as it is.
+func (cfg *apiConfig) signObjectURL(ctx context.Context, url string, overrides presignOverrides) (string, error) {
+	if cfg.isCloudFrontURL(url) {
+		return url, nil
+	}
+	bucket, key, err := cfg.parseS3Key(url)
+	if err != nil {
+		return url, nil
+	}
+	return cfg.presignGetObject(ctx, bucket, key, cfg.presignTTL, overrides)
+}
+
+// signVideoForResponse signs the video for a response to an operation that
+// has already succeeded. If signing fails the URL is dropped rather than
+// failing the request or handing out a link that won't work.
+func (cfg *apiConfig) signVideoForResponse(ctx context.Context, video database.Video) database.Video {
+	signed, err := cfg.signVideo(ctx, video)
+	if err != nil {
+		slog.Error("couldn't sign URL", "video_id", video.ID, "error", err)
+		signed.VideoURL = nil
+	}
+	return signed
+}
+
+// batchSignVideos signs every video's URL using a bounded pool of workers,
+// preserving order.
+func (cfg *apiConfig) batchSignVideos(ctx context.Context, videos []database.Video) []signedVideo {
+	signed := make([]signedVideo, len(videos))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for range min(presignWorkers, len(videos)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				video, err := cfg.signVideo(ctx, videos[i])
+				if err != nil {
+					slog.Error("couldn't sign URL", "video_id", video.ID, "error", err)
+					video.VideoURL = nil
+				}
+				signed[i] = signedVideo{Video: video, URLError: err != nil}
+			}
+		}()
+	}
+
+	for i := range videos {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return signed
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// listVideos returns n videos, alternating between media behind the
+// CloudFront distribution and media in a bucket that needs signing.
+func listVideos(cfg *apiConfig, n int) []database.Video {
+	videos := make([]database.Video, n)
+	for i := range videos {
+		var url string
+		if i%2 == 0 {
+			url = cfg.getCloudFrontURL(fmt.Sprintf("landscape/%d.mp4", i))
+		} else {
+			url = cfg.getObjectURL("other-bucket", fmt.Sprintf("landscape/%d.mp4", i))
+		}
+		videos[i] = database.Video{ID: uuid.New(), VideoURL: &url}
+	}
+	return videos
+}
+
+func TestBatchSignVideos(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	cfg.presignCache = newPresignCache(100)
+
+	videos := append(listVideos(cfg, 25), database.Video{ID: uuid.New()})
+	signed := cfg.batchSignVideos(context.Background(), videos)
+	if len(signed) != len(videos) {
+		t.Fatalf("got %d videos, want %d", len(signed), len(videos))
+	}
+	for i, v := range signed {
+		if v.ID != videos[i].ID {
+			t.Fatalf("video %d is %s, want %s: order not preserved", i, v.ID, videos[i].ID)
+		}
+		if v.URLError {
+			t.Errorf("video %d: unexpected URL error", i)
+		}
+		switch {
+		case videos[i].VideoURL == nil:
+			if v.VideoURL != nil {
+				t.Errorf("video %d: got URL %s for a video without media", i, *v.VideoURL)
+			}
+		case i%2 == 0:
+			if *v.VideoURL != *videos[i].VideoURL {
+				t.Errorf("video %d: CloudFront URL changed to %s", i, *v.VideoURL)
+			}
+		default:
+			want := fmt.Sprintf("/other-bucket/landscape/%d.mp4?", i)
+			if !strings.Contains(*v.VideoURL, want) || !strings.Contains(*v.VideoURL, "X-Amz-Signature=") {
+				t.Errorf("video %d: URL %s isn't a signed URL for %s", i, *v.VideoURL, want)
+			}
+		}
+	}
+
+	// A second listing is served from the cache
+	again := cfg.batchSignVideos(context.Background(), videos)
+	for i := range again {
+		if again[i].VideoURL != nil && *again[i].VideoURL != *signed[i].VideoURL {
+			t.Errorf("video %d was re-signed instead of served from the cache", i)
+		}
+	}
+}
+
+func TestBatchSignVideosDegradesOnError(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	cfg.s3Client = s3.New(s3.Options{
+		Region: testRegion,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{}, errors.New("no credentials")
+		}),
+	})
+	cfg.s3Presigner = s3.NewPresignClient(cfg.s3Client)
+
+	videos := listVideos(cfg, 4)
+	signed := cfg.batchSignVideos(context.Background(), videos)
+	for i, v := range signed {
+		if i%2 == 0 {
+			if v.URLError || v.VideoURL == nil {
+				t.Errorf("video %d: CloudFront video lost its URL", i)
+			}
+			continue
+		}
+		if !v.URLError || v.VideoURL != nil {
+			t.Errorf("video %d: url_error = %v, URL = %v; want the URL dropped and flagged", i, v.URLError, v.VideoURL)
+		}
+	}
+}
+
+func BenchmarkBatchSignVideos(b *testing.B) {
+	cfg, _ := newTestConfig(b)
+	cfg.s3CfDistribution = "https://cdn.example.com"
+	videos := listVideos(cfg, 100)
+
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached %v", cached), func(b *testing.B) {
+			cfg.presignCache = nil
+			if cached {
+				cfg.presignCache = newPresignCache(len(videos))
+			}
+			for range b.N {
+				cfg.batchSignVideos(context.Background(), videos)
+			}
+		})
+	}
+}
+
+func TestPresignCache(t *testing.T) {
+	now := time.Now()
+	c := newPresignCache(2)
+	a := presignCacheKey{bucket: testBucket, key: "a", ttl: time.Hour}
+	b := presignCacheKey{bucket: testBucket, key: "b", ttl: time.Hour}
+	d := presignCacheKey{bucket: testBucket, key: "d", ttl: time.Hour}
+
+	c.put(a, "url-a", now.Add(time.Hour))
+	c.put(b, "url-b", now.Add(time.Hour))
+	// Reading a makes b the least recently used
+	if url, ok := c.get(a, now); !ok || url != "url-a" {
+		t.Fatalf("get(a) = %q, %v", url, ok)
+	}
+	c.put(d, "url-d", now.Add(time.Hour))
+	if _, ok := c.get(b, now); ok {
+		t.Error("b wasn't evicted")
+	}
+	if _, ok := c.get(a, now); !ok {
+		t.Error("a was evicted")
+	}
+
+	// URLs close to expiring are signed again rather than handed out
+	if _, ok := c.get(a, now.Add(time.Hour-presignRefreshMargin/2)); ok {
+		t.Error("URL about to expire was served from the cache")
+	}
+
+	c.invalidate(testBucket, "d")
+	if _, ok := c.get(d, now); ok {
+		t.Error("invalidated URL was served from the cache")
+	}
+
+	disabled := newPresignCache(0)
+	disabled.put(a, "url-a", now.Add(time.Hour))
+	if _, ok := disabled.get(a, now); ok {
+		t.Error("disabled cache stored a URL")
+	}
+}
+
+func TestPresignGetObjectUsesCache(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.presignCache = newPresignCache(16)
+	ctx := context.Background()
+
+	first, err := cfg.presignGetObject(ctx, testBucket, "landscape/abc.mp4", time.Hour, presignOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A later signature would differ in its timestamp
+	time.Sleep(1100 * time.Millisecond)
+	second, err := cfg.presignGetObject(ctx, testBucket, "landscape/abc.mp4", time.Hour, presignOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("the second signature wasn't served from the cache")
+	}
+
+	withOverrides, err := cfg.presignGetObject(ctx, testBucket, "landscape/abc.mp4", time.Hour, presignOverrides{contentDisposition: "attachment"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withOverrides == first {
+		t.Error("URLs with different overrides share a cache entry")
+	}
+
+	cfg.presignCache.invalidate(testBucket, "landscape/abc.mp4")
+	third, err := cfg.presignGetObject(ctx, testBucket, "landscape/abc.mp4", time.Hour, presignOverrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first {
+		t.Error("invalidated URL was served from the cache")
+	}
+}
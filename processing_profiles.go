@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"os"
+	"slices"
+)
+
+const defaultProfileName = "default"
+
+// apiKeyHeader identifies enterprise integrations, which get the processing
+// profile tied to their key.
+const apiKeyHeader = "X-API-Key"
+
+// errUnknownAPIKey is returned by profileFor for a key with no profile.
+var errUnknownAPIKey = errors.New("unknown API key")
+
+// processingProfile controls how much work goes into an upload.
+type processingProfile struct {
+	// Preset is the x264 preset used when re-encoding
+	Preset string `json:"preset"`
+	// MaxBitRate caps re-encoded output; 0 falls back to MAX_PASSTHROUGH_BITRATE
+	MaxBitRate int64 `json:"max_bit_rate"`
+	// Renditions lists the heights of extra renditions to produce
+	Renditions []int `json:"renditions"`
+	// Derivations lists the artifact kinds to derive from the media; empty
+	// allows every kind that's enabled
+	Derivations []string `json:"derivations"`
+}
+
+// derives reports whether the profile allows artifacts of the kind.
+func (p processingProfile) derives(kind string) bool {
+	return len(p.Derivations) == 0 || slices.Contains(p.Derivations, kind)
+}
+
+// processingProfiles maps principals to named profiles. API keys take
+// precedence over the user's plan.
+type processingProfiles struct {
+	Profiles map[string]processingProfile `json:"profiles"`
+	Plans    map[string]string            `json:"plans"`
+	APIKeys  map[string]string            `json:"api_keys"`
+}
+
+var validPresets = map[string]bool{
+	"ultrafast": true, "superfast": true, "veryfast": true, "faster": true, "fast": true,
+	"medium": true, "slow": true, "slower": true, "veryslow": true,
+}
+
+// loadProcessingProfiles reads the profiles file, or returns a single
+// default profile when there's no file.
+func loadProcessingProfiles(path string) (*processingProfiles, error) {
+	profiles := &processingProfiles{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, profiles); err != nil {
+			return nil, fmt.Errorf("couldn't parse profiles: %w", err)
+		}
+	}
+	if profiles.Profiles == nil {
+		profiles.Profiles = map[string]processingProfile{}
+	}
+	if _, ok := profiles.Profiles[defaultProfileName]; !ok {
+		profiles.Profiles[defaultProfileName] = processingProfile{Preset: qualityPreset}
+	}
+	return profiles, profiles.validate()
+}
+
+func (p *processingProfiles) validate() error {
+	for name, profile := range p.Profiles {
+		if !validPresets[profile.Preset] {
+			return fmt.Errorf("profile %s: unknown preset %q", name, profile.Preset)
+		}
+		if profile.MaxBitRate < 0 {
+			return fmt.Errorf("profile %s: max_bit_rate must not be negative", name)
+		}
+		for _, height := range profile.Renditions {
+			if height <= 0 || height%2 != 0 {
+				return fmt.Errorf("profile %s: rendition height %d must be a positive even number", name, height)
+			}
+		}
+		for _, kind := range profile.Derivations {
+			if _, ok := artifactPriority[kind]; !ok {
+				return fmt.Errorf("profile %s: unknown derivation %q", name, kind)
+			}
+		}
+	}
+	for plan, name := range p.Plans {
+		if _, ok := p.Profiles[name]; !ok {
+			return fmt.Errorf("plan %s refers to unknown profile %s", plan, name)
+		}
+	}
+	for _, name := range p.APIKeys {
+		if _, ok := p.Profiles[name]; !ok {
+			return fmt.Errorf("an API key refers to unknown profile %s", name)
+		}
+	}
+	return nil
+}
+
+// profileFor picks the processing profile for an upload from the caller's
+// API key, falling back to the uploading user's plan.
+func (cfg *apiConfig) profileFor(r *http.Request, userID uuid.UUID) (string, processingProfile, error) {
+	profiles := cfg.processingProfiles
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		name, ok := profiles.APIKeys[key]
+		if !ok {
+			return "", processingProfile{}, errUnknownAPIKey
+		}
+		return name, profiles.Profiles[name], nil
+	}
+
+	plan, err := cfg.db.GetUserPlan(userID)
+	if err != nil {
+		return "", processingProfile{}, err
+	}
+	name, ok := profiles.Plans[plan]
+	if !ok {
+		name = defaultProfileName
+	}
+	return name, profiles.Profiles[name], nil
+}
+
+// respondWithProfileError reports why profileFor failed: the client's key
+// or our lookup of the user's plan.
+func respondWithProfileError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnknownAPIKey) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidProfile, "Unknown API key", err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Couldn't determine processing profile", err)
+}
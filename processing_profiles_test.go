@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProfileFor(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.processingProfiles = &processingProfiles{
+		Profiles: map[string]processingProfile{
+			defaultProfileName: {Preset: "fast"},
+			"light":            {Preset: "veryfast"},
+			"enterprise":       {Preset: "slow", Renditions: []int{1080, 720, 480}},
+		},
+		Plans:   map[string]string{"free": "light"},
+		APIKeys: map[string]string{"ent-key": "enterprise"},
+	}
+	if err := cfg.processingProfiles.validate(); err != nil {
+		t.Fatal(err)
+	}
+	user, _ := createTestUser(t, cfg, "user@example.com")
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set(apiKeyHeader, "ent-key")
+	name, profile, err := cfg.profileFor(req, user.ID)
+	if err != nil || name != "enterprise" || len(profile.Renditions) != 3 {
+		t.Errorf("enterprise key got profile %q with %d renditions, %v", name, len(profile.Renditions), err)
+	}
+
+	name, profile, err = cfg.profileFor(httptest.NewRequest(http.MethodPost, "/", nil), user.ID)
+	if err != nil || name != "light" || len(profile.Renditions) != 0 {
+		t.Errorf("free user got profile %q with %d renditions, %v", name, len(profile.Renditions), err)
+	}
+
+	// A bad key is the client's mistake, not an authentication failure
+	req.Header.Set(apiKeyHeader, "nope")
+	if _, _, err := cfg.profileFor(req, user.ID); !errors.Is(err, errUnknownAPIKey) {
+		t.Fatalf("unknown key: got %v, want errUnknownAPIKey", err)
+	}
+	w := httptest.NewRecorder()
+	respondWithProfileError(w, errUnknownAPIKey)
+	if w.Code != http.StatusBadRequest || errorCode(t, w) != errCodeInvalidProfile {
+		t.Errorf("unknown key response: %d %q", w.Code, errorCode(t, w))
+	}
+	w = httptest.NewRecorder()
+	respondWithProfileError(w, errors.New("database is locked"))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("lookup failure status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
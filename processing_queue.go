@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// How often idle workers check for jobs they weren't woken for, such as ones
+// requeued after a restart while all workers were busy.
+const processingPollInterval = 30 * time.Second
+
+// processingQueue hands saved uploads to background workers so the upload
+// request can return before ffmpeg and S3 are done. Jobs are kept in the
+// database, so ones cut short by a restart run again on startup. A nil
+// queue means uploads are processed in the request.
+type processingQueue struct {
+	workers int
+	wake    chan struct{}
+}
+
+func newProcessingQueue(workers int) *processingQueue {
+	if workers <= 0 {
+		return nil
+	}
+	return &processingQueue{
+		workers: workers,
+		wake:    make(chan struct{}, workers),
+	}
+}
+
+// notify wakes an idle worker, if there is one. Busy workers check for more
+// work before going idle, so a dropped wakeup doesn't strand a job.
+func (q *processingQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// startProcessingWorkers requeues jobs interrupted by the last shutdown and
+// starts the workers. They run until the process exits.
+func (cfg *apiConfig) startProcessingWorkers() error {
+	requeued, err := cfg.db.RequeueRunningProcessingJobs()
+	if err != nil {
+		return err
+	}
+	if requeued > 0 {
+		slog.Info("requeued interrupted processing jobs", "count", requeued)
+	}
+	for range cfg.processingQueue.workers {
+		go cfg.runProcessingWorker()
+	}
+	return nil
+}
+
+func (cfg *apiConfig) runProcessingWorker() {
+	for {
+		job, ok, err := cfg.db.ClaimProcessingJob()
+		if err != nil {
+			slog.Error("couldn't claim processing job", "error", err)
+		}
+		if !ok {
+			select {
+			case <-cfg.processingQueue.wake:
+			case <-time.After(processingPollInterval):
+			}
+			continue
+		}
+		cfg.runProcessingJob(job)
+	}
+}
+
+// queueVideoUpload records the saved upload as a job and responds 202 with
+// the video marked as processing. It reports whether the upload was queued,
+// after which its file belongs to the job.
+func (cfg *apiConfig) queueVideoUpload(w http.ResponseWriter, r *http.Request, logger *slog.Logger, upload videoUpload) bool {
+	vid := upload.video
+
+	// The status goes first so a worker never finishes the job before the
+	// video is marked
+	vid.ProcessingStatus, vid.ErrorMessage = database.ProcessingStatusProcessing, ""
+	cfg.setProcessingStatus(vid.ID, vid.ProcessingStatus, "")
+
+	job, err := cfg.db.CreateProcessingJob(database.ProcessingJob{
+		VideoID:        vid.ID,
+		UserID:         upload.userID,
+		FilePath:       upload.file.Name(),
+		Filename:       upload.filename,
+		MediaType:      upload.mediaType,
+		Checksum:       upload.checksum,
+		ProfileName:    upload.profileName,
+		Staging:        upload.staging,
+		EncodeDeadline: upload.encodeDeadline,
+		Bucket:         upload.bucket,
+		UserAgent:      upload.userAgent,
+		UploadIP:       upload.uploadIP,
+	})
+	if err != nil {
+		cfg.setProcessingStatus(vid.ID, database.ProcessingStatusFailed, "Couldn't queue video")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video", err)
+		return false
+	}
+	upload.file.Close()
+	cfg.processingQueue.notify()
+
+	logger.Info("queued video for processing", "job_id", job.ID)
+	respondWithJSON(w, http.StatusAccepted, videoUploadResponse{
+		Video:             cfg.signVideoForResponse(r.Context(), vid),
+		ProcessingProfile: upload.profileName,
+	})
+	return true
+}
+
+// runProcessingJob processes a claimed job. The job and its file are removed
+// whatever the outcome, which is recorded as the video's processing status.
+func (cfg *apiConfig) runProcessingJob(job database.ProcessingJob) {
+	logger := slog.Default().With("operation", "process_video", "job_id", job.ID, "video_id", job.VideoID, "user_id", job.UserID)
+	defer func() {
+		removeUploadFiles(job.FilePath)
+		if err := cfg.db.DeleteProcessingJob(job.ID); err != nil {
+			logger.Error("couldn't delete processing job", "error", err)
+		}
+	}()
+
+	err := cfg.processJob(logger, job)
+	if errors.Is(err, database.ErrVideoNotFound) {
+		logger.Info("video was deleted before processing finished")
+		return
+	}
+	if err != nil {
+		logger.Error("processing failed", "error", err)
+		return
+	}
+	logger.Info("processed video")
+}
+
+func (cfg *apiConfig) processJob(logger *slog.Logger, job database.ProcessingJob) error {
+	vid, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+
+	// A restart may have cleared the temp dir, or left a partial output
+	// behind that ffmpeg would refuse to overwrite
+	os.Remove(job.FilePath + processingSuffix)
+	f, err := os.Open(job.FilePath)
+	if err != nil {
+		cfg.setProcessingStatus(vid.ID, database.ProcessingStatusFailed, "Upload is no longer available, please upload again")
+		return err
+	}
+	defer f.Close()
+
+	// Profiles can change between the upload and a requeued run
+	profileName := job.ProfileName
+	profile, ok := cfg.processingProfiles.Profiles[profileName]
+	if !ok {
+		profileName = defaultProfileName
+		profile = cfg.processingProfiles.Profiles[profileName]
+	}
+
+	_, err = cfg.runVideoUpload(context.Background(), logger, videoUpload{
+		video:          vid,
+		userID:         job.UserID,
+		profileName:    profileName,
+		profile:        profile,
+		mediaType:      job.MediaType,
+		staging:        job.Staging,
+		encodeDeadline: job.EncodeDeadline,
+		file:           f,
+		checksum:       job.Checksum,
+		filename:       job.Filename,
+		bucket:         job.Bucket,
+		userAgent:      job.UserAgent,
+		uploadIP:       job.UploadIP,
+	})
+	return err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Shown for failures that don't carry a message of their own. Errors from
+// ffmpeg and S3 can include paths and stderr, so they're only logged.
+const genericProcessingError = "Couldn't process video"
+
+// runVideoUpload processes the upload, keeping the video's processing status
+// up to date for clients polling it.
+func (cfg *apiConfig) runVideoUpload(ctx context.Context, logger *slog.Logger, upload videoUpload) (videoUploadResponse, error) {
+	videoID := upload.video.ID
+	cfg.setProcessingStatus(videoID, database.ProcessingStatusProcessing, "")
+
+	resp, err := cfg.processVideoUpload(ctx, logger, upload)
+	if err != nil {
+		cfg.setProcessingStatus(videoID, database.ProcessingStatusFailed, processingErrorMessage(err))
+		return resp, err
+	}
+	// An identical upload to another video can be returned in place of
+	// this one, which leaves this video without new media
+	if resp.ID != videoID {
+		cfg.setProcessingStatus(videoID, database.ProcessingStatusFailed, "Duplicate of a recent upload")
+		return resp, nil
+	}
+	cfg.setProcessingStatus(videoID, database.ProcessingStatusReady, "")
+	resp.ProcessingStatus, resp.ErrorMessage = database.ProcessingStatusReady, ""
+	return resp, nil
+}
+
+// setProcessingStatus records the status, logging rather than failing the
+// upload if it can't.
+func (cfg *apiConfig) setProcessingStatus(videoID uuid.UUID, status, errorMessage string) {
+	if err := cfg.db.SetVideoProcessingStatus(videoID, status, errorMessage); err != nil {
+		slog.Error("couldn't set processing status", "video_id", videoID, "status", status, "error", err)
+	}
+}
+
+// processingErrorMessage is the client-facing reason an upload failed: the
+// message it would have been rejected with in the request.
+func processingErrorMessage(err error) string {
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		return uploadErr.message
+	}
+	return genericProcessingError
+}
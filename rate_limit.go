@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+)
+
+// userRateLimiter gives each user a token bucket per route. A nil limiter
+// allows everything.
+type userRateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	users     map[userRoute]*userBucket
+	lastSweep time.Time
+}
+
+// userRoute identifies a bucket, so a burst of thumbnail uploads doesn't use
+// up the user's video uploads.
+type userRoute struct {
+	userID uuid.UUID
+	route  string
+}
+
+type userBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newUserRateLimiter(perMinute, burst int) *userRateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &userRateLimiter{
+		limit: rate.Limit(float64(perMinute) / 60),
+		burst: burst,
+		users: make(map[userRoute]*userBucket),
+	}
+}
+
+// refillTime is how long an untouched bucket takes to fill back up, after
+// which it's no different from a new one and can be dropped.
+func (l *userRateLimiter) refillTime() time.Duration {
+	return time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+}
+
+// allow takes a token from the user's bucket for the route. When it's empty
+// it returns how long until the next token.
+func (l *userRateLimiter) allow(userID uuid.UUID, route string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Sweeping at most once per refill period keeps the cost per request
+	// constant while bounding the map to recently active users
+	if idle := l.refillTime(); now.Sub(l.lastSweep) >= idle {
+		for key, b := range l.users {
+			if now.Sub(b.lastSeen) >= idle {
+				delete(l.users, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	key := userRoute{userID: userID, route: route}
+	b, ok := l.users[key]
+	if !ok {
+		b = &userBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.users[key] = b
+	}
+	b.lastSeen = now
+
+	r := b.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// rateLimitUploads turns away users who start uploads, or other media work,
+// faster than the configured rate. Each route the user calls has its own
+// bucket. Requests without a valid JWT are passed through for the handler to
+// reject; for the rest, the handler reuses the user the token was validated
+// for.
+func (cfg *apiConfig) rateLimitUploads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		userID, err := cfg.validateJWT(token)
+		if err != nil {
+			next(w, r)
+			return
+		}
+
+		if ok, retryAfter := cfg.uploadRateLimiter.allow(userID, r.Pattern, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			respondWithError(w, http.StatusTooManyRequests, "Too many uploads, try again later", nil)
+			return
+		}
+		next(w, withAuthenticatedUser(r, token, userID))
+	}
+}
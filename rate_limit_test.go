@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestUserRateLimiterBucketsPerRoute(t *testing.T) {
+	l := newUserRateLimiter(60, 1)
+	now := time.Now()
+	alice, bob := uuid.New(), uuid.New()
+	const upload = "POST /api/video_upload/{videoID}"
+	const trim = "POST /api/videos/{videoID}/trim"
+
+	if ok, _ := l.allow(alice, upload, now); !ok {
+		t.Fatal("first upload was refused")
+	}
+	ok, retryAfter := l.allow(alice, upload, now)
+	if ok {
+		t.Fatal("second upload within the burst was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("retry after %s, want up to 1s", retryAfter)
+	}
+
+	// Other routes and other users have their own buckets
+	if ok, _ := l.allow(alice, trim, now); !ok {
+		t.Error("trim shared the upload bucket")
+	}
+	if ok, _ := l.allow(bob, upload, now); !ok {
+		t.Error("another user shared the bucket")
+	}
+
+	if ok, _ := l.allow(alice, upload, now.Add(time.Second)); !ok {
+		t.Error("upload was refused after the bucket refilled")
+	}
+
+	var disabled *userRateLimiter
+	if ok, _ := disabled.allow(alice, upload, now); !ok {
+		t.Error("disabled limiter refused a request")
+	}
+}
+
+func TestRateLimitUploadsPassesOnValidatedUser(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.uploadRateLimiter = newUserRateLimiter(60, 5)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	var got uuid.UUID
+	handler := cfg.rateLimitUploads(func(w http.ResponseWriter, r *http.Request) {
+		// Validating again would fail now, so the user has to come from the
+		// middleware
+		cfg.jwtSecret = "rotated"
+		userID, err := cfg.validateRequestJWT(r, token)
+		if err != nil {
+			t.Errorf("handler couldn't reuse the validated user: %v", err)
+		}
+		got = userID
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/api/videos/validate", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	handler(httptest.NewRecorder(), r)
+	if got != user.ID {
+		t.Errorf("handler saw user %s, want %s", got, user.ID)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// recentUploads remembers which video each user's recent uploads ended up
+// in, keyed by checksum and filename, so a double-clicked upload collapses
+// into the first one instead of being processed twice.
+type recentUploads struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*recentUpload
+}
+
+type recentUpload struct {
+	videoID uuid.UUID
+	// done is closed once the upload has finished, successfully or not
+	done      chan struct{}
+	succeeded bool
+	at        time.Time
+}
+
+func newRecentUploads(window time.Duration) *recentUploads {
+	if window <= 0 {
+		return nil
+	}
+	return &recentUploads{
+		window:  window,
+		entries: map[string]*recentUpload{},
+	}
+}
+
+func recentUploadKey(userID uuid.UUID, checksum, filename string) string {
+	return userID.String() + "\x00" + checksum + "\x00" + filename
+}
+
+// claim registers an upload under key. If an identical upload is already in
+// flight or finished within the window, that one is returned instead and
+// claimed is false.
+func (ru *recentUploads) claim(key string, videoID uuid.UUID) (entry *recentUpload, claimed bool) {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range ru.entries {
+		if e.succeeded && now.Sub(e.at) > ru.window {
+			delete(ru.entries, k)
+		}
+	}
+
+	if e, ok := ru.entries[key]; ok {
+		return e, false
+	}
+	e := &recentUpload{videoID: videoID, done: make(chan struct{})}
+	ru.entries[key] = e
+	return e, true
+}
+
+// finish records the outcome of a claimed upload. Failed uploads are
+// forgotten so a retry goes through.
+func (ru *recentUploads) finish(key string, entry *recentUpload, succeeded bool) {
+	ru.mu.Lock()
+	entry.succeeded = succeeded
+	entry.at = time.Now()
+	if !succeeded {
+		delete(ru.entries, key)
+	}
+	ru.mu.Unlock()
+	close(entry.done)
+}
+
+// wait blocks until the entry's upload finishes and reports whether it
+// succeeded.
+func (entry *recentUpload) wait(ctx context.Context) (bool, error) {
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	return entry.succeeded, nil
+}
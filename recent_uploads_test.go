@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestRecentUploadsClaim(t *testing.T) {
+	if newRecentUploads(0) != nil {
+		t.Error("a zero window should disable deduplication")
+	}
+
+	ru := newRecentUploads(time.Minute)
+	first, second := uuid.New(), uuid.New()
+	key := recentUploadKey(uuid.New(), "abc", "clip.mp4")
+
+	entry, claimed := ru.claim(key, first)
+	if !claimed {
+		t.Fatal("first upload wasn't claimed")
+	}
+	dup, claimed := ru.claim(key, second)
+	if claimed || dup != entry {
+		t.Fatal("in-flight duplicate wasn't collapsed into the first upload")
+	}
+	if _, claimed := ru.claim(recentUploadKey(uuid.New(), "abc", "clip.mp4"), second); !claimed {
+		t.Error("another user's identical upload was collapsed")
+	}
+	if _, claimed := ru.claim(recentUploadKey(uuid.New(), "abc", "other.mp4"), second); !claimed {
+		t.Error("an upload with another filename was collapsed")
+	}
+
+	ru.finish(key, entry, true)
+	succeeded, err := dup.wait(context.Background())
+	if err != nil || !succeeded {
+		t.Errorf("wait = %v, %v; want success", succeeded, err)
+	}
+	if e, claimed := ru.claim(key, second); claimed || e.videoID != first {
+		t.Error("duplicate within the window wasn't collapsed")
+	}
+
+	// Past the window the same file counts as a new upload
+	entry.at = time.Now().Add(-2 * time.Minute)
+	if _, claimed := ru.claim(key, second); !claimed {
+		t.Error("upload after the window was collapsed")
+	}
+}
+
+func TestRecentUploadsForgetFailures(t *testing.T) {
+	ru := newRecentUploads(time.Minute)
+	key := recentUploadKey(uuid.New(), "abc", "clip.mp4")
+
+	entry, _ := ru.claim(key, uuid.New())
+	dup, _ := ru.claim(key, uuid.New())
+	ru.finish(key, entry, false)
+
+	if succeeded, err := dup.wait(context.Background()); err != nil || succeeded {
+		t.Errorf("wait = %v, %v; want failure", succeeded, err)
+	}
+	if _, claimed := ru.claim(key, uuid.New()); !claimed {
+		t.Error("retry of a failed upload was collapsed")
+	}
+}
+
+func TestRecentUploadWaitCanceled(t *testing.T) {
+	ru := newRecentUploads(time.Minute)
+	entry, _ := ru.claim("key", uuid.New())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := entry.wait(ctx); err == nil {
+		t.Error("expected an error once the context is canceled")
+	}
+}
+
+func TestUploadVideoCollapsesRecentDuplicate(t *testing.T) {
+	cfg, _ := newVideoTestConfig(t)
+	cfg.recentUploads = newRecentUploads(time.Minute)
+	user, token := createTestUser(t, cfg, "owner@example.com")
+
+	// A finished upload of the same file, as if it was just posted
+	data := []byte("already uploaded video")
+	sum := sha256.Sum256(data)
+	first := createTestVideo(t, cfg, user.ID)
+	videoURL := cfg.getCloudFrontURL("landscape/first.mp4")
+	first.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(first); err != nil {
+		t.Fatal(err)
+	}
+	key := recentUploadKey(user.ID, hex.EncodeToString(sum[:]), "upload.mp4")
+	entry, _ := cfg.recentUploads.claim(key, first.ID)
+	cfg.recentUploads.finish(key, entry, true)
+
+	second := createTestVideo(t, cfg, user.ID)
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, videoUploadRequest(t, second.ID.String(), token, "video/mp4", data))
+	if w.Code != http.StatusOK {
+		t.Fatalf("duplicate: status %d: %s", w.Code, w.Body)
+	}
+	var resp database.Video
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != first.ID {
+		t.Errorf("duplicate returned video %s, want the first upload %s", resp.ID, first.ID)
+	}
+
+	// A different file isn't collapsed and goes on to be probed, which this
+	// fake media fails
+	w = httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, videoUploadRequest(t, second.ID.String(), token, "video/mp4", []byte("some other video")))
+	if w.Code == http.StatusOK {
+		t.Fatalf("distinct upload was collapsed: %s", w.Body)
+	}
+	// and its failure isn't remembered
+	if len(cfg.recentUploads.entries) != 1 {
+		t.Errorf("recent uploads = %d entries, want only the first upload", len(cfg.recentUploads.entries))
+	}
+}
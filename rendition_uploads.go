@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// renditionFile is an encoded rendition on disk and the key it's stored under.
+type renditionFile struct {
+	height int
+	path   string
+	key    string
+}
+
+// createRenditions encodes the heights from the local media and uploads them
+// under prefix + renditions/<height>/, returning the keys once all of them
+// are stored.
+func (cfg *apiConfig) createRenditions(ctx context.Context, bucket, mediaPath, prefix, name string, heights []int) ([]string, error) {
+	paths, err := processVideoRenditions(ctx, mediaPath, heights)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]renditionFile, len(heights))
+	keys := make([]string, len(heights))
+	for i, height := range heights {
+		defer os.Remove(paths[i])
+		keys[i] = prefix + path.Join("renditions", strconv.Itoa(height), name)
+		files[i] = renditionFile{height: height, path: paths[i], key: keys[i]}
+	}
+
+	if err := cfg.uploadRenditions(ctx, bucket, "video/mp4", files); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// uploadRenditions uploads the files to S3 in parallel, at most
+// RENDITION_UPLOAD_CONCURRENCY at a time. It's all or nothing: if any upload
+// fails no more are started and the ones that already landed are deleted,
+// so the caller only records renditions on the video once this returns nil.
+func (cfg *apiConfig) uploadRenditions(ctx context.Context, bucket, mediaType string, files []renditionFile) error {
+	// Uploads in flight are left to finish rather than cancelled: a PUT
+	// cancelled after its body was sent can still land, after the cleanup
+	stopped, stop := context.WithCancel(ctx)
+	defer stop()
+
+	sem := make(chan struct{}, cfg.renditionUploadConcurrency)
+	// Uploads that errored may still have landed if ctx itself was
+	// cancelled, so everything started is cleaned up, not just what finished
+	started := make([]bool, len(files))
+	errs := make(chan error, len(files))
+
+	var wg sync.WaitGroup
+	for i, file := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-stopped.Done():
+				return
+			}
+			defer func() { <-sem }()
+			if stopped.Err() != nil {
+				return
+			}
+
+			started[i] = true
+			if err := cfg.uploadRendition(ctx, bucket, mediaType, file); err != nil {
+				errs <- fmt.Errorf("rendition %dp: %w", file.height, err)
+				stop()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	err, failed := <-errs
+	if !failed {
+		return nil
+	}
+
+	var keys []string
+	for i, file := range files {
+		if started[i] {
+			keys = append(keys, file.key)
+		}
+	}
+	cfg.deleteObjects(context.Background(), bucket, keys)
+	return err
+}
+
+func (cfg *apiConfig) uploadRendition(ctx context.Context, bucket, mediaType string, file renditionFile) error {
+	f, err := os.Open(file.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return cfg.uploadObject(ctx, &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &file.key,
+		Body:        f,
+		ContentType: &mediaType,
+	}, info.Size())
+}
+
+// deleteObjects removes objects that were uploaded but never recorded,
+// logging rather than failing since the caller is already handling an error.
+func (cfg *apiConfig) deleteObjects(ctx context.Context, bucket string, keys []string) {
+	for _, key := range keys {
+		_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			slog.Error("couldn't delete orphaned object", "bucket", bucket, "key", key, "error", err)
+		}
+	}
+}
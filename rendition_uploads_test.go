@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testRenditionFiles(t *testing.T, heights ...int) []renditionFile {
+	t.Helper()
+	dir := t.TempDir()
+	var files []renditionFile
+	for _, height := range heights {
+		p := filepath.Join(dir, fmt.Sprintf("%d.mp4", height))
+		if err := os.WriteFile(p, []byte(fmt.Sprintf("%dp rendition", height)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, renditionFile{
+			height: height,
+			path:   p,
+			key:    fmt.Sprintf("renditions/%d/video-id/abc.mp4", height),
+		})
+	}
+	return files
+}
+
+func TestUploadRenditions(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.renditionUploadConcurrency = 2
+	files := testRenditionFiles(t, 1080, 720, 480, 360)
+
+	if err := cfg.uploadRenditions(context.Background(), testBucket, "video/mp4", files); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		body, ok := fake.object(testBucket, file.key)
+		if !ok || string(body) != fmt.Sprintf("%dp rendition", file.height) {
+			t.Errorf("%s = %q, %v", file.key, body, ok)
+		}
+	}
+}
+
+func TestUploadRenditionsOneFails(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	// Whichever renditions landed before the failure have to be removed
+	cfg.renditionUploadConcurrency = 2
+	files := testRenditionFiles(t, 1080, 720, 480)
+	fake.failPuts(testBucket, files[2].key)
+
+	if err := cfg.uploadRenditions(context.Background(), testBucket, "video/mp4", files); err == nil {
+		t.Fatal("upload succeeded with a failing rendition")
+	}
+	for _, file := range files {
+		if _, ok := fake.object(testBucket, file.key); ok {
+			t.Errorf("%s was left behind", file.key)
+		}
+	}
+}
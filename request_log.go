@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type requestLoggerKey struct{}
+
+// requestIDMiddleware tags each request with a fresh ID, echoed back in the
+// X-Request-ID header, and gives handlers a logger that includes it.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := uuid.NewString()
+		w.Header().Set(requestIDHeader, requestID)
+
+		logger := slog.Default().With("request_id", requestID, "method", r.Method, "path", r.URL.Path)
+		ctx := context.WithValue(r.Context(), requestLoggerKey{}, logger)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestLogger returns the request's logger, or the default one for
+// requests that didn't pass through requestIDMiddleware.
+func requestLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(requestLoggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errUploadSessionNotFound = errors.New("upload session not found")
+
+// How often expired sessions are looked for. Clients abandon uploads all the
+// time, and each one holds up to MAX_VIDEO_UPLOAD_BYTES of disk.
+const resumableUploadSweepInterval = 10 * time.Minute
+
+// resumableUpload is a video upload sent in chunks. Its state lives next to
+// the received bytes on disk, so a restart doesn't lose progress.
+type resumableUpload struct {
+	ID             uuid.UUID     `json:"id"`
+	VideoID        uuid.UUID     `json:"video_id"`
+	UserID         uuid.UUID     `json:"user_id"`
+	Length         int64         `json:"length"`
+	Offset         int64         `json:"offset"`
+	MediaType      string        `json:"media_type"`
+	Filename       string        `json:"filename"`
+	Staging        bool          `json:"staging"`
+	EncodeDeadline time.Duration `json:"encode_deadline"`
+	CreatedAt      time.Time     `json:"created_at"`
+}
+
+// resumableUploadStore keeps each session as a .part file holding the bytes
+// received so far and a .json file holding its state.
+type resumableUploadStore struct {
+	dir string
+	// Sessions older than this are discarded
+	ttl time.Duration
+
+	mu sync.Mutex
+	// busy holds the sessions a request is currently writing to
+	busy map[uuid.UUID]bool
+}
+
+func newResumableUploadStore(dir string, ttl time.Duration) (*resumableUploadStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &resumableUploadStore{dir: dir, ttl: ttl, busy: map[uuid.UUID]bool{}}, nil
+}
+
+func (s *resumableUploadStore) dataPath(id uuid.UUID) string {
+	return filepath.Join(s.dir, id.String()+".part")
+}
+
+func (s *resumableUploadStore) statePath(id uuid.UUID) string {
+	return filepath.Join(s.dir, id.String()+".json")
+}
+
+func (s *resumableUploadStore) create(u resumableUpload) error {
+	f, err := os.OpenFile(s.dataPath(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := s.save(u); err != nil {
+		os.Remove(s.dataPath(u.ID))
+		return err
+	}
+	return nil
+}
+
+// save replaces the session's state file atomically, so a crash leaves
+// either the old offset or the new one.
+func (s *resumableUploadStore) save(u resumableUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := s.statePath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.statePath(u.ID))
+}
+
+func (s *resumableUploadStore) load(id uuid.UUID) (resumableUpload, error) {
+	data, err := os.ReadFile(s.statePath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return resumableUpload{}, errUploadSessionNotFound
+	}
+	if err != nil {
+		return resumableUpload{}, err
+	}
+	var u resumableUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return resumableUpload{}, fmt.Errorf("couldn't parse upload session %s: %w", id, err)
+	}
+	if s.ttl > 0 && time.Since(u.CreatedAt) > s.ttl {
+		s.remove(id)
+		return resumableUpload{}, errUploadSessionNotFound
+	}
+	return u, nil
+}
+
+// lock claims the session for one request at a time. It reports false if
+// another request holds it.
+func (s *resumableUploadStore) lock(id uuid.UUID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy[id] {
+		return false
+	}
+	s.busy[id] = true
+	return true
+}
+
+func (s *resumableUploadStore) unlock(id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, id)
+}
+
+// append writes body to the session at its current offset and records how
+// much arrived, even if the body was cut off part way.
+func (s *resumableUploadStore) append(u *resumableUpload, body io.Reader) error {
+	f, err := os.OpenFile(s.dataPath(u.ID), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Bytes past the recorded offset are from a write whose offset was never
+	// saved, and the client will send them again
+	if err := f.Truncate(u.Offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, copyErr := io.Copy(f, io.LimitReader(body, u.Length-u.Offset))
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	u.Offset += n
+	if err := s.save(*u); err != nil {
+		return err
+	}
+	return copyErr
+}
+
+// sweep removes the sessions that have outlived the TTL, along with data
+// files whose state was never written. Sessions a request is writing to are
+// left for the next sweep.
+func (s *resumableUploadStore) sweep() {
+	if s.ttl <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		slog.Error("couldn't list resumable uploads", "error", err)
+		return
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".part")
+		if !ok {
+			continue
+		}
+		id, err := uuid.Parse(name)
+		if err != nil || !s.lock(id) {
+			continue
+		}
+		// load discards the session once it has expired
+		_, err = s.load(id)
+		if errors.Is(err, errUploadSessionNotFound) {
+			if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > s.ttl {
+				s.remove(id)
+			}
+		} else if err != nil {
+			slog.Error("couldn't check resumable upload", "upload_id", id, "error", err)
+		}
+		s.unlock(id)
+	}
+}
+
+// sweepResumableUploads runs sweep periodically until the process exits.
+func (s *resumableUploadStore) sweepResumableUploads() {
+	ticker := time.NewTicker(resumableUploadSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.sweep()
+	}
+}
+
+func (s *resumableUploadStore) remove(id uuid.UUID) {
+	removeUploadFiles(s.dataPath(id))
+	os.Remove(s.statePath(id))
+}
+
+// release forgets a session whose received bytes were handed over to be
+// processed, leaving the data file to its new owner.
+func (s *resumableUploadStore) release(id uuid.UUID) {
+	os.Remove(s.statePath(id))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestResumableUploadSweep(t *testing.T) {
+	store, err := newResumableUploadStore(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := resumableUpload{ID: uuid.New(), Length: 10, CreatedAt: time.Now().Add(-2 * time.Hour)}
+	fresh := resumableUpload{ID: uuid.New(), Length: 10, CreatedAt: time.Now()}
+	busy := resumableUpload{ID: uuid.New(), Length: 10, CreatedAt: time.Now().Add(-2 * time.Hour)}
+	for _, u := range []resumableUpload{expired, fresh, busy} {
+		if err := store.create(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !store.lock(busy.ID) {
+		t.Fatal("couldn't lock session")
+	}
+
+	// A data file whose state was never written, left by a crash
+	orphan := uuid.New()
+	if err := os.WriteFile(store.dataPath(orphan), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(store.dataPath(orphan), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	store.sweep()
+
+	for _, tc := range []struct {
+		name string
+		id   uuid.UUID
+		kept bool
+	}{
+		{"expired", expired.ID, false},
+		{"fresh", fresh.ID, true},
+		{"busy", busy.ID, true},
+		{"orphan", orphan, false},
+	} {
+		if got := fileExists(store.dataPath(tc.id)); got != tc.kept {
+			t.Errorf("%s session data kept = %v, want %v", tc.name, got, tc.kept)
+		}
+	}
+	if fileExists(store.statePath(expired.ID)) {
+		t.Error("expired session state wasn't removed")
+	}
+}
+
+func TestResumableUploadErrorCodes(t *testing.T) {
+	cfg, _ := newVideoTestConfig(t)
+	store, err := newResumableUploadStore(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.resumableUploads = store
+	owner, ownerToken := createTestUser(t, cfg, "owner@example.com")
+	_, otherToken := createTestUser(t, cfg, "other@example.com")
+	video := createTestVideo(t, cfg, owner.ID)
+
+	metadata := func(videoID string) string {
+		enc := base64.StdEncoding.EncodeToString
+		return "video_id " + enc([]byte(videoID)) + ",filetype " + enc([]byte("video/mp4"))
+	}
+	create := func(token, meta string, length int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/uploads", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Upload-Length", strconv.Itoa(length))
+		req.Header.Set("Upload-Metadata", meta)
+		w := httptest.NewRecorder()
+		cfg.handlerResumableUploadCreate(w, req)
+		return w
+	}
+
+	for _, tc := range []struct {
+		name   string
+		w      *httptest.ResponseRecorder
+		status int
+		code   string
+	}{
+		{"bad video ID", create(ownerToken, metadata("nope"), 10), http.StatusBadRequest, errCodeInvalidID},
+		{"not the owner", create(otherToken, metadata(video.ID.String()), 10), http.StatusUnauthorized, errCodeNotOwner},
+	} {
+		if tc.w.Code != tc.status || errorCode(t, tc.w) != tc.code {
+			t.Errorf("%s: got %d %q, want %d %q", tc.name, tc.w.Code, errorCode(t, tc.w), tc.status, tc.code)
+		}
+	}
+
+	cfg.userStorageQuota = 5
+	if w := create(ownerToken, metadata(video.ID.String()), 10); w.Code != http.StatusForbidden || errorCode(t, w) != errCodeQuotaExceeded {
+		t.Errorf("over quota: got %d %q", w.Code, errorCode(t, w))
+	}
+	cfg.userStorageQuota = 0
+
+	w := create(ownerToken, metadata(video.ID.String()), 10)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+
+	// A chunk sent for the wrong offset
+	req := httptest.NewRequest(http.MethodPatch, location, strings.NewReader("abc"))
+	req.SetPathValue("uploadID", strings.TrimPrefix(location, "/api/uploads/"))
+	req.Header.Set("Authorization", "Bearer "+ownerToken)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "3")
+	w = httptest.NewRecorder()
+	cfg.handlerResumableUploadPatch(w, req)
+	if w.Code != http.StatusConflict || errorCode(t, w) != errCodeOffsetMismatch {
+		t.Errorf("wrong offset: got %d %q", w.Code, errorCode(t, w))
+	}
+
+	req = httptest.NewRequest(http.MethodHead, "/api/uploads/"+uuid.NewString(), nil)
+	req.SetPathValue("uploadID", uuid.NewString())
+	req.Header.Set("Authorization", "Bearer "+ownerToken)
+	w = httptest.NewRecorder()
+	cfg.handlerResumableUploadHead(w, req)
+	if w.Code != http.StatusNotFound || errorCode(t, w) != errCodeUploadNotFound {
+		t.Errorf("unknown upload: got %d %q", w.Code, errorCode(t, w))
+	}
+}
+
+func TestResumableUploadFinishClaimsVideo(t *testing.T) {
+	cfg, _ := newVideoTestConfig(t)
+	store, err := newResumableUploadStore(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.resumableUploads = store
+	owner, token := createTestUser(t, cfg, "owner@example.com")
+	video := createTestVideo(t, cfg, owner.ID)
+
+	upload := resumableUpload{ID: uuid.New(), VideoID: video.ID, UserID: owner.ID, Length: 10, MediaType: "video/mp4", CreatedAt: time.Now()}
+	if err := store.create(upload); err != nil {
+		t.Fatal(err)
+	}
+	// Another upload of the video is already processing
+	if err := cfg.db.SetVideoProcessingStatus(video.ID, database.ProcessingStatusProcessing, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/uploads/"+upload.ID.String(), strings.NewReader("0123456789"))
+	req.SetPathValue("uploadID", upload.ID.String())
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	w := httptest.NewRecorder()
+	cfg.handlerResumableUploadPatch(w, req)
+	if w.Code != http.StatusConflict || errorCode(t, w) != errCodeAlreadyProcessing {
+		t.Errorf("got %d %q, want %d %q", w.Code, errorCode(t, w), http.StatusConflict, errCodeAlreadyProcessing)
+	}
+
+	// The finish can be retried once the other upload is done
+	kept, err := store.load(upload.ID)
+	if err != nil {
+		t.Fatalf("session wasn't kept for a retry: %v", err)
+	}
+	if kept.Offset != upload.Length {
+		t.Errorf("kept offset = %d, want %d", kept.Offset, upload.Length)
+	}
+
+	// A video that's gone can't ever be finished
+	if err := cfg.db.DeleteVideo(video.ID); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodPatch, "/api/uploads/"+upload.ID.String(), nil)
+	req.SetPathValue("uploadID", upload.ID.String())
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(upload.Length, 10))
+	w = httptest.NewRecorder()
+	cfg.handlerResumableUploadPatch(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("retry for a deleted video: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if _, err := store.load(upload.ID); err != errUploadSessionNotFound {
+		t.Errorf("session outlived a permanent failure: %v", err)
+	}
+}
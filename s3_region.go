@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	regionCheckOff     = "off"
+	regionCheckFail    = "fail"
+	regionCheckCorrect = "correct"
+)
+
+// bucketRegion asks S3 which region the bucket lives in, using the
+// x-amz-bucket-region header of a HeadBucket response.
+func bucketRegion(client *s3.Client, bucket string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	region, err := manager.GetBucketRegion(ctx, client, bucket)
+	if err != nil {
+		return "", fmt.Errorf("couldn't determine region of bucket %s: %w", bucket, err)
+	}
+	return region, nil
+}
+
+// checkBucketRegion compares the bucket's actual region with the configured
+// one. A mismatch is an error under regionCheckFail; otherwise the actual
+// region is returned so the caller can correct itself.
+func checkBucketRegion(client *s3.Client, bucket, configured, mode string) (string, error) {
+	actual, err := bucketRegion(client, bucket)
+	if err != nil {
+		return "", err
+	}
+	if actual != configured && mode == regionCheckFail {
+		return "", fmt.Errorf("S3_REGION is %s but bucket %s is in %s", configured, bucket, actual)
+	}
+	return actual, nil
+}
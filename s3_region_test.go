@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// regionS3 answers HeadBucket the way S3 does for a bucket in region.
+func regionS3(t *testing.T, region string) *s3.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/"+testBucket {
+			writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+			return
+		}
+		w.Header().Set("X-Amz-Bucket-Region", region)
+		if region != testRegion {
+			w.WriteHeader(http.StatusMovedPermanently)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return s3.New(s3.Options{
+		Region:       testRegion,
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+}
+
+func TestCheckBucketRegion(t *testing.T) {
+	tests := []struct {
+		name         string
+		bucketRegion string
+		mode         string
+		want         string
+		wantErr      bool
+	}{
+		{"matching region", testRegion, regionCheckFail, testRegion, false},
+		{"mismatch fails", "eu-west-1", regionCheckFail, "", true},
+		{"mismatch is corrected", "eu-west-1", regionCheckCorrect, "eu-west-1", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := checkBucketRegion(regionS3(t, tc.bucketRegion), testBucket, testRegion, tc.mode)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("region = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// After a throttle the limit is only cut again once this has passed, since
+// requests already in flight were sent under the old limit and will often be
+// throttled too.
+const s3ThrottleCooldown = time.Second
+
+// s3Limiter bounds how many S3 requests are in flight, halving the bound
+// when S3 answers SlowDown and growing it by about one per round of
+// successful requests until it's back at the maximum.
+type s3Limiter struct {
+	mu       sync.Mutex
+	limit    float64
+	min      float64
+	max      float64
+	inFlight int
+	lastCut  time.Time
+	// wake is closed and replaced whenever a slot frees up
+	wake    chan struct{}
+	metrics *appMetrics
+}
+
+func newS3Limiter(minConcurrency, maxConcurrency int, metrics *appMetrics) *s3Limiter {
+	metrics.s3Concurrency.set(float64(maxConcurrency))
+	return &s3Limiter{
+		limit:   float64(maxConcurrency),
+		min:     float64(minConcurrency),
+		max:     float64(maxConcurrency),
+		wake:    make(chan struct{}),
+		metrics: metrics,
+	}
+}
+
+func (l *s3Limiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inFlight < int(l.limit) {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *s3Limiter) release(throttled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	if throttled {
+		l.metrics.s3Throttles.inc()
+		if now := time.Now(); now.Sub(l.lastCut) >= s3ThrottleCooldown {
+			l.limit = math.Max(l.min, math.Floor(l.limit/2))
+			l.lastCut = now
+		}
+	} else if l.limit < l.max {
+		l.limit = math.Min(l.max, l.limit+1/l.limit)
+	}
+	l.metrics.s3Concurrency.set(math.Floor(l.limit))
+
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// clientOption installs the limiter on every attempt of every S3 request,
+// including retries and multipart parts. A slot is held until the response
+// headers arrive, not while a GetObject body is being read.
+func (l *s3Limiter) clientOption(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("S3Limiter",
+			func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+				if err := l.acquire(ctx); err != nil {
+					return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+				}
+				out, metadata, err := next.HandleFinalize(ctx, in)
+				l.release(isS3Throttle(err))
+				return out, metadata, err
+			},
+		), middleware.After)
+	})
+}
+
+func isS3Throttle(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException":
+		return true
+	}
+	return false
+}
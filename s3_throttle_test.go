@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+func (l *s3Limiter) currentLimit() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func TestS3LimiterAdapts(t *testing.T) {
+	l := newS3Limiter(2, 16, newAppMetrics())
+	ctx := context.Background()
+
+	// One throttle halves the limit; more within the cooldown don't, since
+	// they were sent under the old limit
+	for range 3 {
+		if err := l.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+		l.release(true)
+	}
+	if got := l.currentLimit(); got != 8 {
+		t.Fatalf("limit after a burst of throttles = %v, want 8", got)
+	}
+
+	// Repeated throttling stops at the minimum
+	for range 5 {
+		l.lastCut = time.Time{}
+		l.acquire(ctx)
+		l.release(true)
+	}
+	if got := l.currentLimit(); got != 2 {
+		t.Fatalf("limit after sustained throttling = %v, want the minimum 2", got)
+	}
+
+	// Successes grow it back by about one per round, up to the maximum
+	for range 10 {
+		l.acquire(ctx)
+		l.release(false)
+	}
+	if got := l.currentLimit(); got <= 2 || got >= 16 {
+		t.Errorf("limit after a few successes = %v, want between 2 and 16", got)
+	}
+	for range 1000 {
+		l.acquire(ctx)
+		l.release(false)
+	}
+	if got := l.currentLimit(); got != 16 {
+		t.Errorf("limit after throttling subsided = %v, want the maximum 16", got)
+	}
+}
+
+func TestS3LimiterBlocksAtLimit(t *testing.T) {
+	l := newS3Limiter(1, 1, newAppMetrics())
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire over the limit = %v, want it to wait", err)
+	}
+
+	acquired := make(chan error)
+	go func() { acquired <- l.acquire(context.Background()) }()
+	l.release(false)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("release didn't wake a waiting request")
+	}
+}
+
+func TestS3LimiterOnClient(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	limiter := newS3Limiter(1, 8, cfg.metrics)
+	client := s3.New(cfg.s3Client.Options(), limiter.clientOption)
+
+	put := func() error {
+		_, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String(testBucket),
+			Key:    aws.String("landscape/abc.mp4"),
+			Body:   bytes.NewReader([]byte("video")),
+		})
+		return err
+	}
+
+	fake.throttlePuts(testBucket, "landscape/abc.mp4", true)
+	err := put()
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "SlowDown" {
+		t.Fatalf("throttled put = %v, want SlowDown", err)
+	}
+	if got := limiter.currentLimit(); got != 4 {
+		t.Errorf("limit after SlowDown = %v, want 4", got)
+	}
+
+	fake.throttlePuts(testBucket, "landscape/abc.mp4", false)
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+	if got := limiter.currentLimit(); got <= 4 {
+		t.Errorf("limit after a success = %v, want it to grow", got)
+	}
+}
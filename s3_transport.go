@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// newAWSHTTPClient builds the one HTTP client every AWS client shares, with
+// bounded connection pools so bursts of S3 work can't exhaust file
+// descriptors. Open connections are reported to the metrics.
+func newAWSHTTPClient(maxConnsPerHost, maxIdleConns int, metrics *appMetrics) *awshttp.BuildableClient {
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.MaxConnsPerHost = maxConnsPerHost
+		tr.MaxIdleConns = maxIdleConns
+		tr.MaxIdleConnsPerHost = maxIdleConns
+
+		dial := tr.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			metrics.awsConnections.add(1)
+			return &trackedConn{Conn: conn, onClose: func() { metrics.awsConnections.add(-1) }}, nil
+		}
+	})
+}
+
+type trackedConn struct {
+	net.Conn
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(c.onClose)
+	return c.Conn.Close()
+}
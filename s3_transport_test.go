@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func awsConnectionsMetric(t *testing.T, metrics *appMetrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, "tubely_aws_open_connections "); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestAWSHTTPClientLimits(t *testing.T) {
+	client := newAWSHTTPClient(16, 8, newAppMetrics())
+	tr := client.GetTransport()
+	if tr.MaxConnsPerHost != 16 {
+		t.Errorf("MaxConnsPerHost = %d, want 16", tr.MaxConnsPerHost)
+	}
+	if tr.MaxIdleConns != 8 || tr.MaxIdleConnsPerHost != 8 {
+		t.Errorf("MaxIdleConns = %d, MaxIdleConnsPerHost = %d, want 8", tr.MaxIdleConns, tr.MaxIdleConnsPerHost)
+	}
+	if tr.DisableKeepAlives {
+		t.Error("keep-alives are disabled, so connections aren't reused")
+	}
+}
+
+func TestAWSHTTPClientCountsConnections(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	metrics := newAppMetrics()
+	tr := newAWSHTTPClient(4, 4, metrics).GetTransport()
+	client := &http.Client{Transport: tr}
+	for range 3 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	// Sequential requests reuse the one pooled connection
+	if got := awsConnectionsMetric(t, metrics); got != "1" {
+		t.Errorf("open connections = %q, want 1", got)
+	}
+
+	tr.CloseIdleConnections()
+	if got := awsConnectionsMetric(t, metrics); got != "0" {
+		t.Errorf("open connections after closing idle ones = %q, want 0", got)
+	}
+}
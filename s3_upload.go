@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// countingRetryer reports every retried S3 request to the retry counter.
+type countingRetryer struct {
+	aws.RetryerV2
+	retries *counterVec
+}
+
+func (r countingRetryer) RetryDelay(attempt int, err error) (time.Duration, error) {
+	r.retries.inc()
+	return r.RetryerV2.RetryDelay(attempt, err)
+}
+
+// validateUploaderSettings checks S3_PART_SIZE and S3_UPLOAD_CONCURRENCY
+// against the limits S3 and the uploader impose.
+func validateUploaderSettings(partSize int64, concurrency int) error {
+	if partSize < manager.MinUploadPartSize {
+		return fmt.Errorf("S3_PART_SIZE must be at least %d bytes", manager.MinUploadPartSize)
+	}
+	if concurrency < 1 {
+		return fmt.Errorf("S3_UPLOAD_CONCURRENCY must be at least 1")
+	}
+	return nil
+}
+
+// exponentialBackoff waits base before the first retry and twice as long
+// before each one after that, up to the SDK's usual maximum.
+type exponentialBackoff struct {
+	base time.Duration
+}
+
+func (b exponentialBackoff) BackoffDelay(attempt int, err error) (time.Duration, error) {
+	delay := b.base
+	for i := 1; i < attempt && delay < retry.DefaultMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, retry.DefaultMaxBackoff), nil
+}
+
+// newS3Uploader returns an uploader whose requests, including each part of
+// a multipart upload, are retried up to retries times after transient
+// errors. The body is rewound by the SDK before each retry.
+func newS3Uploader(client *s3.Client, partSize int64, concurrency, retries int, retryBaseDelay time.Duration, metrics *appMetrics) *manager.Uploader {
+	retryer := retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = retries + 1
+		o.Backoff = exponentialBackoff{base: retryBaseDelay}
+		// Corruption on the way to S3 is as transient as a dropped connection
+		o.Retryables = append(o.Retryables, retry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+			if isS3ChecksumMismatch(err) {
+				return aws.TrueTernary
+			}
+			return aws.UnknownTernary
+		}))
+	})
+	return manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = partSize
+		u.Concurrency = concurrency
+		u.ClientOptions = append(u.ClientOptions, func(o *s3.Options) {
+			o.Retryer = countingRetryer{
+				RetryerV2: retryer,
+				retries:   metrics.s3PartRetries,
+			}
+		})
+	})
+}
+
+// uploadObject streams input.Body to S3, splitting large bodies into
+// concurrently uploaded parts. size is only used for throughput metrics;
+// pass 0 to leave the upload out of them.
+func (cfg *apiConfig) uploadObject(ctx context.Context, input *s3.PutObjectInput, size int64) error {
+	if err := cfg.checkObjectKey(*input.Key); err != nil {
+		return err
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = cfg.serverSideEncryption()
+	// S3 checks the object, or each part of a multipart upload, against a
+	// SHA-256 sent with it and rejects bytes that were corrupted on the way
+	if input.ChecksumAlgorithm == "" {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
+
+	start := time.Now()
+	_, err := cfg.s3Uploader.Upload(ctx, input)
+	cfg.metrics.s3PutDuration.observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 && size > 0 {
+		cfg.metrics.s3UploadThroughput.observe(float64(size) / elapsed)
+	}
+	return nil
+}
+
+// objectChecksumSHA256 turns a hex SHA-256 of an object's content into the
+// base64 form S3 expects for a full-object checksum. Only single-part
+// uploads can use it; a multipart upload's checksum is one of its parts'.
+func objectChecksumSHA256(hexHash string) (*string, error) {
+	sum, err := hex.DecodeString(hexHash)
+	if err != nil {
+		return nil, err
+	}
+	return aws.String(base64.StdEncoding.EncodeToString(sum)), nil
+}
+
+// isS3ChecksumMismatch reports whether S3 rejected an upload because the
+// bytes it received didn't match the checksum sent with them.
+func isS3ChecksumMismatch(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "BadDigest", "InvalidDigest", "XAmzContentSHA256Mismatch":
+		return true
+	}
+	return false
+}
+
+// copyObject copies an object within the bucket. A copy doesn't inherit the
+// source's encryption, so it's set again.
+func (cfg *apiConfig) copyObject(ctx context.Context, bucket, srcKey, dstKey string) error {
+	if err := cfg.checkObjectKey(dstKey); err != nil {
+		return err
+	}
+	copySource := bucket + "/" + srcKey
+	input := &s3.CopyObjectInput{
+		Bucket:     &bucket,
+		Key:        &dstKey,
+		CopySource: &copySource,
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = cfg.serverSideEncryption()
+	_, err := cfg.s3Client.CopyObject(ctx, input)
+	return err
+}
+
+// discardReplacedMedia deletes the object behind a video's previous media
+// once the video points at a different one, unless another video still
+// uses it.
+func (cfg *apiConfig) discardReplacedMedia(ctx context.Context, oldURL *string, newURL string) {
+	if oldURL == nil {
+		return
+	}
+	oldBucket, oldKey, err := cfg.parseS3Key(*oldURL)
+	if err != nil {
+		return
+	}
+	if newBucket, newKey, err := cfg.parseS3Key(newURL); err == nil && newBucket == oldBucket && newKey == oldKey {
+		return
+	}
+	cfg.discardUnreferencedObjects(ctx, oldBucket, *oldURL, []string{oldKey})
+}
+
+// serverSideEncryption returns the encryption every object we write is
+// stored with: SSE-KMS under the configured key, or SSE-S3 without one.
+func (cfg *apiConfig) serverSideEncryption() (types.ServerSideEncryption, *string) {
+	if cfg.sseKMSKeyID == "" {
+		return types.ServerSideEncryptionAes256, nil
+	}
+	return types.ServerSideEncryptionAwsKms, aws.String(cfg.sseKMSKeyID)
+}
+
+// discardUnreferencedObjects deletes the objects stored for an update that
+// was then rejected, unless a video points at url: identical media maps onto
+// the same keys, so the update that won may have stored the very same ones.
+func (cfg *apiConfig) discardUnreferencedObjects(ctx context.Context, bucket, url string, keys []string) {
+	if _, key, err := cfg.parseS3Key(url); err == nil {
+		unlock := cfg.mediaLocks.lock(bucket, key)
+		defer unlock()
+	}
+	refs, err := cfg.db.CountVideosByURL(url)
+	if err != nil {
+		slog.Error("couldn't check references to media, keeping its objects", "url", url, "error", err)
+		return
+	}
+	if refs == 0 {
+		cfg.deleteObjects(ctx, bucket, keys)
+	}
+}
+
+// objectExists reports whether the bucket already holds an object at key.
+func (cfg *apiConfig) objectExists(ctx context.Context, bucket, key string) (bool, error) {
+	_, err := cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
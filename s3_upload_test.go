@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+func TestValidateUploaderSettings(t *testing.T) {
+	tests := []struct {
+		name        string
+		partSize    int64
+		concurrency int
+		wantErr     bool
+	}{
+		{"defaults", manager.DefaultUploadPartSize, manager.DefaultUploadConcurrency, false},
+		{"larger parts", 64 << 20, 8, false},
+		{"part size below the S3 minimum", manager.MinUploadPartSize - 1, 5, true},
+		{"zero part size", 0, 5, true},
+		{"zero concurrency", manager.DefaultUploadPartSize, 0, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateUploaderSettings(tc.partSize, tc.concurrency)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("err = %v, want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewS3UploaderSettings(t *testing.T) {
+	_, client := newFakeS3(t)
+	uploader := newS3Uploader(client, 16<<20, 7, 0, time.Millisecond, newAppMetrics())
+	if uploader.PartSize != 16<<20 {
+		t.Errorf("PartSize = %d, want %d", uploader.PartSize, 16<<20)
+	}
+	if uploader.Concurrency != 7 {
+		t.Errorf("Concurrency = %d, want 7", uploader.Concurrency)
+	}
+}
+
+func TestUploadObjectMetrics(t *testing.T) {
+	fake, _ := newFakeS3(t)
+	// Fail the first PUT so the uploader has to retry it
+	var puts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && puts.Add(1) == 1 {
+			writeS3Error(w, http.StatusServiceUnavailable, "ServiceUnavailable")
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	client := s3.New(s3.Options{
+		Region:       testRegion,
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+
+	metrics := newAppMetrics()
+	cfg := &apiConfig{
+		s3Uploader:        newS3Uploader(client, 5<<20, 1, 1, time.Millisecond, metrics),
+		metrics:           metrics,
+		objectKeyPrefixes: defaultObjectKeyPrefixes,
+	}
+	body := []byte("processed video bytes")
+	err := cfg.uploadObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(testBucket),
+		Key:    aws.String("landscape/abc.mp4"),
+		Body:   bytes.NewReader(body),
+	}, int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := fake.object(testBucket, "landscape/abc.mp4"); !ok || !bytes.Equal(got, body) {
+		t.Errorf("stored object = %q, want %q", got, body)
+	}
+
+	rr := httptest.NewRecorder()
+	metrics.registry.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	exposition := rr.Body.String()
+	for _, want := range []string{
+		"tubely_s3_part_retries_total 1\n",
+		"tubely_s3_upload_throughput_bytes_per_second_count 1\n",
+	} {
+		if !strings.Contains(exposition, want) {
+			t.Errorf("metrics missing %q:\n%s", strings.TrimSpace(want), exposition)
+		}
+	}
+}
+
+func TestUploadObjectChecksum(t *testing.T) {
+	body := []byte("processed video bytes")
+	sum := sha256.Sum256(body)
+	wrongSum := sha256.Sum256([]byte("something else"))
+
+	tests := []struct {
+		name     string
+		hash     []byte
+		mismatch bool
+	}{
+		{"matching", sum[:], false},
+		{"corrupted", wrongSum[:], true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, fake := newTestConfig(t)
+			checksum, err := objectChecksumSHA256(hex.EncodeToString(tc.hash))
+			if err != nil {
+				t.Fatal(err)
+			}
+			input := &s3.PutObjectInput{
+				Bucket:         aws.String(testBucket),
+				Key:            aws.String("landscape/abc.mp4"),
+				Body:           bytes.NewReader(body),
+				ChecksumSHA256: checksum,
+			}
+			err = cfg.uploadObject(context.Background(), input, int64(len(body)))
+
+			if input.ChecksumAlgorithm != "SHA256" {
+				t.Errorf("ChecksumAlgorithm = %q, want SHA256", input.ChecksumAlgorithm)
+			}
+			if tc.mismatch {
+				if !isS3ChecksumMismatch(err) {
+					t.Fatalf("upload error = %v, want a checksum mismatch", err)
+				}
+				if _, ok := fake.object(testBucket, "landscape/abc.mp4"); ok {
+					t.Error("corrupted upload was stored")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fake.putHeaders(testBucket, "landscape/abc.mp4").Get("X-Amz-Checksum-Sha256"); got != *checksum {
+				t.Errorf("sent checksum = %q, want %q", got, *checksum)
+			}
+		})
+	}
+}
+
+func TestObjectChecksumSHA256(t *testing.T) {
+	got, err := objectChecksumSHA256("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	if err != nil || *got != "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=" {
+		t.Errorf("objectChecksumSHA256(empty) = %v, %v", got, err)
+	}
+	if _, err := objectChecksumSHA256("not hex"); err == nil {
+		t.Error("objectChecksumSHA256 accepted a non-hex hash")
+	}
+}
+
+func TestIsS3ChecksumMismatch(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&smithy.GenericAPIError{Code: "BadDigest"}, true},
+		{&smithy.GenericAPIError{Code: "InvalidDigest"}, true},
+		{&smithy.GenericAPIError{Code: "XAmzContentSHA256Mismatch"}, true},
+		{fmt.Errorf("upload: %w", &smithy.GenericAPIError{Code: "BadDigest"}), true},
+		{&smithy.GenericAPIError{Code: "SlowDown"}, false},
+		{errors.New("BadDigest"), false},
+		{nil, false},
+	}
+	for _, tc := range tests {
+		if got := isS3ChecksumMismatch(tc.err); got != tc.want {
+			t.Errorf("isS3ChecksumMismatch(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestUploadObjectServerSideEncryption(t *testing.T) {
+	tests := []struct {
+		name       string
+		kmsKeyID   string
+		wantSSE    types.ServerSideEncryption
+		wantKeyID  string
+		wantHeader string
+	}{
+		{"SSE-S3 by default", "", types.ServerSideEncryptionAes256, "", "AES256"},
+		{"SSE-KMS with a key", "arn:aws:kms:us-east-1:111122223333:key/test", types.ServerSideEncryptionAwsKms, "arn:aws:kms:us-east-1:111122223333:key/test", "aws:kms"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, fake := newTestConfig(t)
+			cfg.sseKMSKeyID = tc.kmsKeyID
+			ctx := context.Background()
+
+			input := &s3.PutObjectInput{
+				Bucket: aws.String(testBucket),
+				Key:    aws.String("landscape/abc.mp4"),
+				Body:   bytes.NewReader([]byte("video")),
+			}
+			if err := cfg.uploadObject(ctx, input, 5); err != nil {
+				t.Fatal(err)
+			}
+			if input.ServerSideEncryption != tc.wantSSE {
+				t.Errorf("ServerSideEncryption = %q, want %q", input.ServerSideEncryption, tc.wantSSE)
+			}
+			if got := aws.ToString(input.SSEKMSKeyId); got != tc.wantKeyID {
+				t.Errorf("SSEKMSKeyId = %q, want %q", got, tc.wantKeyID)
+			}
+
+			// Copies don't inherit the source's encryption
+			if err := cfg.copyObject(ctx, testBucket, "landscape/abc.mp4", "videos/abc.mp4"); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"landscape/abc.mp4", "videos/abc.mp4"} {
+				h := fake.putHeaders(testBucket, key)
+				if got := h.Get("X-Amz-Server-Side-Encryption"); got != tc.wantHeader {
+					t.Errorf("%s: encryption header = %q, want %q", key, got, tc.wantHeader)
+				}
+				if got := h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); got != tc.wantKeyID {
+					t.Errorf("%s: KMS key header = %q, want %q", key, got, tc.wantKeyID)
+				}
+			}
+		})
+	}
+}
+
+func TestUploaderRetriesTransientErrors(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.s3Uploader = newS3Uploader(cfg.s3Client, 5<<20, 1, 2, time.Millisecond, cfg.metrics)
+	ctx := context.Background()
+	upload := func(key string) error {
+		return cfg.uploadObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(testBucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte("video")),
+		}, 0)
+	}
+
+	fake.failPutsTimes(testBucket, "landscape/throttled.mp4", "SlowDown", 2)
+	if err := upload("landscape/throttled.mp4"); err != nil {
+		t.Fatalf("upload throttled twice with 2 retries failed: %v", err)
+	}
+	if body, _ := fake.object(testBucket, "landscape/throttled.mp4"); string(body) != "video" {
+		t.Errorf("stored %q after retries, want %q", body, "video")
+	}
+
+	fake.failPutsTimes(testBucket, "landscape/corrupted.mp4", "BadDigest", 1)
+	if err := upload("landscape/corrupted.mp4"); err != nil {
+		t.Errorf("upload corrupted once wasn't retried: %v", err)
+	}
+
+	fake.failPutsTimes(testBucket, "landscape/busy.mp4", "SlowDown", 3)
+	if err := upload("landscape/busy.mp4"); !isS3Throttle(err) {
+		t.Errorf("upload throttled past its retries: got %v, want SlowDown", err)
+	}
+
+	fake.failPutsTimes(testBucket, "landscape/denied.mp4", "AccessDenied", 1)
+	if err := upload("landscape/denied.mp4"); err == nil {
+		t.Error("AccessDenied was retried")
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := exponentialBackoff{base: 100 * time.Millisecond}
+	for attempt, want := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		50: retry.DefaultMaxBackoff,
+	} {
+		if got, _ := b.BackoffDelay(attempt, nil); got != want {
+			t.Errorf("BackoffDelay(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long requests cancelled at the end of the grace period get to clean up
+// their temp files and return.
+const cancelledRequestTimeout = 5 * time.Second
+
+// serveUntilSignalled runs the server until SIGINT or SIGTERM, then stops
+// accepting connections and gives in-flight requests gracePeriod to finish.
+// Requests still running after that have their contexts cancelled, which
+// kills their ffmpeg runs and aborts their S3 calls so their deferred cleanup
+// removes any temp files.
+func serveUntilSignalled(srv *http.Server, gracePeriod time.Duration) error {
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	baseCtx := context.WithValue(requestCtx, shutdownContextKey{}, requestCtx)
+	srv.BaseContext = func(net.Listener) context.Context { return baseCtx }
+
+	// Shutdown stops waiting once its deadline passes, so handlers are
+	// tracked separately to know when the cancelled ones have returned
+	var inFlight sync.WaitGroup
+	next := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Done()
+		next.ServeHTTP(w, r)
+	})
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-sigs:
+		slog.Info("draining requests", "signal", sig, "grace_period", gracePeriod)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	slog.Warn("requests still running after the grace period, cancelling them", "grace_period", gracePeriod)
+	cancelRequests()
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(cancelledRequestTimeout):
+		slog.Error("cancelled requests didn't return in time", "timeout", cancelledRequestTimeout)
+	}
+	return nil
+}
+
+// shutdownContextKey holds the context serveUntilSignalled cancels once the
+// grace period is over.
+type shutdownContextKey struct{}
+
+// workContext returns the context for work a request has to finish once
+// started, such as storing an upload. Unlike the request's own context it
+// isn't cancelled when the client disconnects, only when the server gives up
+// on in-flight requests at shutdown. The caller must call cancel when the
+// work is done.
+func workContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	shutdown, ok := r.Context().Value(shutdownContextKey{}).(context.Context)
+	if !ok {
+		return ctx, cancel
+	}
+	stop := context.AfterFunc(shutdown, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// backgroundTasks tracks work that carries on after the request that
+// started it has been answered, so shutdown can wait for it.
+type backgroundTasks struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newBackgroundTasks() *backgroundTasks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundTasks{ctx: ctx, cancel: cancel}
+}
+
+// start runs task in the background. Once draining has begun, new tasks are
+// refused and start returns false.
+func (b *backgroundTasks) start(task func(ctx context.Context)) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return false
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		task(b.ctx)
+	}()
+	return true
+}
+
+// drain waits up to gracePeriod for running tasks, then cancels them and
+// gives them a little longer to clean up.
+func (b *backgroundTasks) drain(gracePeriod time.Duration) {
+	b.mu.Lock()
+	b.stopped = true
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(gracePeriod):
+	}
+
+	slog.Warn("background tasks still running after the grace period, cancelling them", "grace_period", gracePeriod)
+	b.cancel()
+	select {
+	case <-done:
+	case <-time.After(cancelledRequestTimeout):
+		slog.Error("cancelled background tasks didn't return in time", "timeout", cancelledRequestTimeout)
+	}
+}
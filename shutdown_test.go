@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWorkContext(t *testing.T) {
+	shutdown, cancelShutdown := context.WithCancel(context.Background())
+	defer cancelShutdown()
+	base := context.WithValue(shutdown, shutdownContextKey{}, shutdown)
+	clientCtx, disconnect := context.WithCancel(base)
+	r := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(clientCtx)
+
+	ctx, cancel := workContext(r)
+	defer cancel()
+
+	// The client going away leaves the work running
+	disconnect()
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("work context ended with the request: %v", err)
+	}
+
+	cancelShutdown()
+	<-ctx.Done()
+}
+
+func TestWorkContextWithoutServer(t *testing.T) {
+	clientCtx, disconnect := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(clientCtx)
+
+	ctx, cancel := workContext(r)
+	disconnect()
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("work context ended with the request: %v", err)
+	}
+	cancel()
+	if ctx.Err() == nil {
+		t.Error("cancel didn't end the work context")
+	}
+}
+
+func TestBackgroundTasksDrain(t *testing.T) {
+	tasks := newBackgroundTasks()
+
+	finished := make(chan struct{})
+	release := make(chan struct{})
+	if !tasks.start(func(ctx context.Context) {
+		<-release
+		close(finished)
+	}) {
+		t.Fatal("task wasn't started")
+	}
+	cancelled := make(chan struct{})
+	tasks.start(func(ctx context.Context) {
+		<-ctx.Done()
+		close(cancelled)
+	})
+
+	close(release)
+	tasks.drain(50 * time.Millisecond)
+	select {
+	case <-finished:
+	default:
+		t.Error("drain returned before the running task finished")
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Error("task still running after the grace period wasn't cancelled")
+	}
+
+	if tasks.start(func(context.Context) {}) {
+		t.Error("task was started after draining")
+	}
+}
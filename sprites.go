@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// spriteOptions control the scrub-bar preview: a frame every interval,
+// scaled to tileWidth and tiled into a sheet of at most columns x rows.
+type spriteOptions struct {
+	interval  time.Duration
+	columns   int
+	rows      int
+	tileWidth int
+}
+
+// spriteLayout is where each sampled frame sits on the sheet.
+type spriteLayout struct {
+	interval   float64
+	frames     int
+	columns    int
+	rows       int
+	tileWidth  int
+	tileHeight int
+}
+
+// planSprites fits the video into one sheet. The grid is fixed, so long
+// videos are sampled less often than the configured interval.
+func planSprites(probe videoProbe, opts spriteOptions) (spriteLayout, error) {
+	stream, ok := probe.videoStream()
+	if !ok {
+		return spriteLayout{}, errors.New("no video stream found")
+	}
+	width, height := stream.displaySize()
+	duration := probe.duration()
+	if width == 0 || height == 0 {
+		return spriteLayout{}, errNoDimensions
+	}
+	if duration <= 0 {
+		return spriteLayout{}, errors.New("video has no duration")
+	}
+
+	interval := opts.interval.Seconds()
+	if capacity := opts.columns * opts.rows; duration/interval > float64(capacity) {
+		interval = duration / float64(capacity)
+	}
+	frames := int(math.Ceil(duration / interval))
+	columns := min(opts.columns, frames)
+
+	// Odd dimensions upset ffmpeg's scaler with subsampled chroma
+	tileWidth := max(2, opts.tileWidth&^1)
+	tileHeight := max(2, int(math.Round(float64(tileWidth)*float64(height)/float64(width)))&^1)
+
+	return spriteLayout{
+		interval:   interval,
+		frames:     frames,
+		columns:    columns,
+		rows:       (frames + columns - 1) / columns,
+		tileWidth:  tileWidth,
+		tileHeight: tileHeight,
+	}, nil
+}
+
+// extractSprite samples the media at the layout's interval and tiles the
+// frames into a single JPEG.
+func extractSprite(ctx context.Context, inputPath string, layout spriteLayout) (string, error) {
+	outputPath := inputPath + ".sprite.jpg"
+
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d,tile=%dx%d",
+		strconv.FormatFloat(layout.interval, 'f', 3, 64),
+		layout.tileWidth, layout.tileHeight, layout.columns, layout.rows)
+	err := runMediaTool(ctx, nil, "ffmpeg",
+		"-y",
+		"-i", inputPath,
+		"-vf", filter,
+		"-frames:v", "1",
+		"-q:v", "5",
+		outputPath,
+	)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("error extracting sprite: %w", err)
+	}
+
+	fileInfo, err := os.Stat(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("could not stat sprite: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(outputPath)
+		return "", errors.New("extracted sprite is empty")
+	}
+	return outputPath, nil
+}
+
+// spriteVTT maps each interval of the video to its tile on the sheet, using
+// the media fragment syntax players expect for thumbnail tracks. The sheet
+// is referenced relative to the VTT, which is stored beside it.
+func spriteVTT(spriteName string, layout spriteLayout, duration float64) []byte {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < layout.frames; i++ {
+		start := float64(i) * layout.interval
+		end := min(start+layout.interval, duration)
+		x := (i % layout.columns) * layout.tileWidth
+		y := (i / layout.columns) * layout.tileHeight
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(end), spriteName, x, y, layout.tileWidth, layout.tileHeight)
+	}
+	return []byte(b.String())
+}
+
+func vttTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3_600_000, ms/60_000%60, ms/1000%60, ms%1000)
+}
+
+// createSprites builds the preview sheet and its WebVTT index from the local
+// media and uploads both under prefix + sprites/, named after name,
+// returning their keys. Any previously signed links to those keys are
+// invalidated. Nothing is left in the bucket if either upload fails.
+func (cfg *apiConfig) createSprites(ctx context.Context, bucket, mediaPath, prefix, name string, probe videoProbe) (spriteKey, vttKey string, err error) {
+	layout, err := planSprites(probe, cfg.spriteOptions)
+	if err != nil {
+		return "", "", err
+	}
+
+	spritePath, err := extractSprite(cfg.mediaContext(ctx), mediaPath, layout)
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(spritePath)
+
+	base := strings.TrimSuffix(name, path.Ext(name))
+	spriteKey = prefix + path.Join("sprites", base+".jpg")
+	vttKey = prefix + path.Join("sprites", base+".vtt")
+
+	spriteFile, err := os.Open(spritePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer spriteFile.Close()
+	spriteInfo, err := spriteFile.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	spriteType := "image/jpeg"
+	err = cfg.uploadObject(ctx, &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &spriteKey,
+		Body:        spriteFile,
+		ContentType: &spriteType,
+	}, spriteInfo.Size())
+	if err != nil {
+		return "", "", err
+	}
+
+	cfg.presignCache.invalidate(bucket, spriteKey)
+	vtt := spriteVTT(path.Base(spriteKey), layout, probe.duration())
+	vttType := "text/vtt"
+	err = cfg.uploadObject(ctx, &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &vttKey,
+		Body:        bytes.NewReader(vtt),
+		ContentType: &vttType,
+	}, int64(len(vtt)))
+	if err != nil {
+		cfg.deleteObjects(context.Background(), bucket, []string{spriteKey})
+		return "", "", err
+	}
+	return spriteKey, vttKey, nil
+}
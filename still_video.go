@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+const (
+	stillVideoPolicyFlag   = "flag"
+	stillVideoPolicyReject = "reject"
+)
+
+// Share of a video that must be frozen for it to count as a still image.
+const stillVideoFrozenShare = 0.95
+
+var freezeDurationPattern = regexp.MustCompile(`lavfi\.freezedetect\.freeze_duration: ([0-9.]+)`)
+var freezeStartPattern = regexp.MustCompile(`lavfi\.freezedetect\.freeze_start: ([0-9.]+)`)
+
+// frozenDuration returns how many seconds of the first video stream show no
+// meaningful change between frames. Frames are sampled once a second to
+// keep this cheap on long uploads.
+// Like a transcode it decodes the whole stream, so it's bounded by ctx alone
+// rather than the media tool timeout.
+func frozenDuration(ctx context.Context, filePath string, duration float64) (float64, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-v", "info",
+		"-i", filePath,
+		"-map", "0:v:0",
+		"-vf", "fps=1,freezedetect=n=-60dB:d=2",
+		"-f", "null", "-",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("error detecting frozen frames: %s, %v", stderr.String(), err)
+	}
+	return parseFrozenDuration(stderr.Bytes(), duration), nil
+}
+
+// parseFrozenDuration totals the freezes freezedetect logged.
+func parseFrozenDuration(log []byte, duration float64) float64 {
+	starts := freezeStartPattern.FindAllSubmatch(log, -1)
+	durations := freezeDurationPattern.FindAllSubmatch(log, -1)
+
+	total := 0.0
+	for _, m := range durations {
+		d, err := strconv.ParseFloat(string(m[1]), 64)
+		if err == nil {
+			total += d
+		}
+	}
+	// A freeze that runs to the end of the file never reports its duration
+	if len(starts) > len(durations) {
+		start, err := strconv.ParseFloat(string(starts[len(starts)-1][1]), 64)
+		if err == nil && duration > start {
+			total += duration - start
+		}
+	}
+	return total
+}
+
+// isStillVideo reports whether almost all of the video is a single frozen
+// image.
+func isStillVideo(ctx context.Context, filePath string, duration float64) (bool, error) {
+	if duration <= 0 {
+		return false, nil
+	}
+	frozen, err := frozenDuration(ctx, filePath, duration)
+	if err != nil {
+		return false, err
+	}
+	return frozen/duration >= stillVideoFrozenShare, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseFrozenDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		log      string
+		duration float64
+		want     float64
+	}{
+		{
+			name:     "moving",
+			log:      "frame=  600 fps=0.0 q=-0.0 Lsize=N/A time=00:00:10.00\n",
+			duration: 10,
+			want:     0,
+		},
+		{
+			name: "frozen to the end",
+			log: "[freezedetect @ 0x1] lavfi.freezedetect.freeze_start: 0\n" +
+				"frame=  600 fps=0.0 q=-0.0 Lsize=N/A time=00:10:00.00\n",
+			duration: 600,
+			want:     600,
+		},
+		{
+			name: "frozen in places",
+			log: "[freezedetect @ 0x1] lavfi.freezedetect.freeze_start: 2\n" +
+				"[freezedetect @ 0x1] lavfi.freezedetect.freeze_duration: 3.5\n" +
+				"[freezedetect @ 0x1] lavfi.freezedetect.freeze_end: 5.5\n" +
+				"[freezedetect @ 0x1] lavfi.freezedetect.freeze_start: 8\n",
+			duration: 10,
+			want:     5.5,
+		},
+	}
+	for _, tc := range tests {
+		if got := parseFrozenDuration([]byte(tc.log), tc.duration); got != tc.want {
+			t.Errorf("%s: parseFrozenDuration = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIsStillVideo(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   bool
+	}{
+		{"still image", "color=c=blue:s=320x240:r=10:d=12", true},
+		{"moving picture", "testsrc=s=320x240:r=10:d=12", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fixture := makeFixture(t, "fixture.mp4", "-f", "lavfi", "-i", tc.source, "-pix_fmt", "yuv420p")
+			got, err := isStillVideo(context.Background(), fixture, 12)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("isStillVideo = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "github.com/google/uuid"
+
+// withinStorageQuota reports whether the user can store newBytes in place of
+// replacedBytes without going over the per-user quota.
+func (cfg *apiConfig) withinStorageQuota(userID uuid.UUID, replacedBytes, newBytes int64) (bool, error) {
+	if cfg.userStorageQuota == 0 {
+		return true, nil
+	}
+	used, err := cfg.db.GetUserStorageUsed(userID)
+	if err != nil {
+		return false, err
+	}
+	return used-replacedBytes+newBytes <= cfg.userStorageQuota, nil
+}
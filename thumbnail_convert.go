@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"io"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnails in these formats are re-encoded as JPEG before they're stored,
+// since not every client displays them and an animated GIF makes a poor
+// still.
+var convertedThumbnailTypes = map[string]bool{
+	"image/webp": true,
+	"image/gif":  true,
+}
+
+// checkThumbnailDimensions reads just the image header and rejects images
+// wider or taller than maxDimension, so a small file that decodes to an
+// enormous bitmap is refused before anything allocates it. The reader is
+// rewound afterwards.
+func checkThumbnailDimensions(r io.ReadSeeker, maxDimension int) error {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return fmt.Errorf("couldn't decode image: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if config.Width > maxDimension || config.Height > maxDimension {
+		return fmt.Errorf("image is %dx%d, larger than %dx%d", config.Width, config.Height, maxDimension, maxDimension)
+	}
+	return nil
+}
+
+// normalizeThumbnail re-encodes the thumbnail as a JPEG if it's in a format
+// that has to be converted or its longest edge is over maxEdge, in which case
+// it's scaled down to fit. It returns nil when the upload can be stored as
+// is. The reader is rewound afterwards.
+func normalizeThumbnail(r io.ReadSeeker, mediaType string, maxEdge, quality int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode image: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if !convertedThumbnailTypes[mediaType] && max(config.Width, config.Height) <= maxEdge {
+		return nil, nil
+	}
+
+	// Re-encoding drops the EXIF block, so the rotation it describes has to
+	// be applied to the pixels
+	orientation := 1
+	if mediaType == "image/jpeg" {
+		orientation = jpegOrientation(r)
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	img, _, err := image.Decode(r)
+	if _, seekErr := r.Seek(0, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode image: %w", err)
+	}
+	img = orientImage(img, orientation)
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if longest := max(width, height); longest > maxEdge {
+		width = max(1, width*maxEdge/longest)
+		height = max(1, height*maxEdge/longest)
+	}
+
+	// Transparent areas come out white rather than JPEG's default black
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	xdraw.CatmullRom.Scale(canvas, canvas.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, canvas, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("couldn't encode JPEG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	thumbnailModeOff    = "off"
+	thumbnailModeUpload = "upload"
+	thumbnailModeLazy   = "lazy"
+)
+
+// thumbnailFlights makes sure only one request at a time generates a given
+// video's thumbnail. Everyone else waits for that result.
+type thumbnailFlights struct {
+	mu    sync.Mutex
+	calls map[uuid.UUID]*thumbnailFlight
+}
+
+type thumbnailFlight struct {
+	done  chan struct{}
+	video database.Video
+	err   error
+}
+
+func newThumbnailFlights() *thumbnailFlights {
+	return &thumbnailFlights{calls: map[uuid.UUID]*thumbnailFlight{}}
+}
+
+func (f *thumbnailFlights) do(id uuid.UUID, fn func() (database.Video, error)) (database.Video, error) {
+	f.mu.Lock()
+	if call, ok := f.calls[id]; ok {
+		f.mu.Unlock()
+		<-call.done
+		return call.video, call.err
+	}
+	call := &thumbnailFlight{done: make(chan struct{})}
+	f.calls[id] = call
+	f.mu.Unlock()
+
+	call.video, call.err = fn()
+
+	f.mu.Lock()
+	delete(f.calls, id)
+	f.mu.Unlock()
+	close(call.done)
+	return call.video, call.err
+}
+
+// needsThumbnail reports whether the video has no thumbnail of its own.
+func needsThumbnail(video database.Video) bool {
+	return video.ThumbnailURL == nil || video.ThumbnailSource == database.ThumbnailSourcePlaceholder
+}
+
+// lazyThumbnail generates the video's thumbnail the first time it's asked
+// for and stores it, so later requests are served from the record.
+func (cfg *apiConfig) lazyThumbnail(ctx context.Context, video database.Video) (database.Video, error) {
+	// Waiters share the result, so one caller going away mustn't cancel it
+	ctx = context.WithoutCancel(ctx)
+	return cfg.thumbnailFlights.do(video.ID, func() (database.Video, error) {
+		// Someone may have finished generating it while we were queued
+		current, err := cfg.db.GetVideo(video.ID)
+		if err != nil {
+			return video, err
+		}
+		if !needsThumbnail(current) {
+			return current, nil
+		}
+		return cfg.regenerateThumbnail(ctx, current)
+	})
+}
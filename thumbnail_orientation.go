@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+const exifOrientationTag = 0x0112
+
+// jpegOrientation returns the EXIF orientation (1-8) recorded in a JPEG, or
+// 1, meaning the pixels are already upright, if there isn't one.
+func jpegOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+		// EXIF lives in a header segment, so there's no point reading past
+		// the start of the image data
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return 1
+		}
+		if marker[1] != 0xE1 {
+			if _, err := br.Discard(length); err != nil {
+				return 1
+			}
+			continue
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 1
+		}
+		if tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok {
+			return exifOrientation(tiff)
+		}
+	}
+}
+
+// exifOrientation reads the orientation tag from IFD0 of an EXIF TIFF block.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+			return v
+		}
+		break
+	}
+	return 1
+}
+
+// orientImage returns img turned upright according to an EXIF orientation.
+// Orientations 5-8 are rotated a quarter turn, swapping width and height.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				dx, dy = x, h-1-y
+			case 5: // mirrored, rotated a quarter turn anticlockwise
+				dx, dy = y, x
+			case 6: // rotated a quarter turn anticlockwise
+				dx, dy = h-1-y, x
+			case 7: // mirrored, rotated a quarter turn clockwise
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated a quarter turn clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
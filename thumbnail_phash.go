@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"os"
+	"strconv"
+)
+
+const (
+	duplicateThumbnailOff    = "off"
+	duplicateThumbnailWarn   = "warn"
+	duplicateThumbnailReject = "reject"
+)
+
+// thumbnailHash computes a 64-bit difference hash of the image: it's shrunk
+// to 9x8 grayscale and each bit records whether a pixel is brighter than its
+// right-hand neighbour. Re-encoded, resized or lightly edited copies of an
+// image end up only a few bits apart.
+func thumbnailHash(filePath string) (uint64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return thumbnailHashFrom(f)
+}
+
+func thumbnailHashFrom(r io.Reader) (uint64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't decode image: %w", err)
+	}
+
+	const w, h = 9, 8
+	var gray [h][w]float64
+	bounds := img.Bounds()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gray[y][x] = averageLuma(img,
+				bounds.Min.X+x*bounds.Dx()/w, bounds.Min.Y+y*bounds.Dy()/h,
+				bounds.Min.X+(x+1)*bounds.Dx()/w, bounds.Min.Y+(y+1)*bounds.Dy()/h,
+			)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// averageLuma averages the brightness of the pixels in [x0,x1)x[y0,y1),
+// sampling at most 16 pixels in each direction.
+func averageLuma(img image.Image, x0, y0, x1, y1 int) float64 {
+	x1, y1 = max(x1, x0+1), max(y1, y0+1)
+	stepX, stepY := max(1, (x1-x0)/16), max(1, (y1-y0)/16)
+
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
+
+func formatThumbnailHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// closestThumbnailHash returns the smallest Hamming distance between hash
+// and any of the stored hashes, or -1 if there are none.
+func closestThumbnailHash(hash uint64, stored []string) int {
+	closest := -1
+	for _, s := range stored {
+		other, err := strconv.ParseUint(s, 16, 64)
+		if err != nil {
+			continue
+		}
+		d := bits.OnesCount64(hash ^ other)
+		if closest == -1 || d < closest {
+			closest = d
+		}
+	}
+	return closest
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// gradientImage fades from black to white left to right, or from white to
+// black when reversed.
+func gradientImage(size int, reversed bool) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for x := range size {
+		for y := range size {
+			v := x
+			if reversed {
+				v = size - 1 - x
+			}
+			shade := uint8(v * 255 / size)
+			img.Set(x, y, color.RGBA{shade, shade, shade, 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t testing.TB, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeImageFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestThumbnailHash(t *testing.T) {
+	original := gradientImage(128, false)
+	var recompressed bytes.Buffer
+	if err := jpeg.Encode(&recompressed, original, &jpeg.Options{Quality: 40}); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(name string, data []byte) uint64 {
+		h, err := thumbnailHash(writeImageFile(t, name, data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	originalHash := hash("original.png", encodePNG(t, original))
+	resizedHash := hash("resized.png", encodePNG(t, gradientImage(300, false)))
+	jpegHash := hash("recompressed.jpg", recompressed.Bytes())
+	distinctHash := hash("distinct.png", encodePNG(t, gradientImage(128, true)))
+
+	stored := []string{formatThumbnailHash(originalHash)}
+	if d := closestThumbnailHash(resizedHash, stored); d > 6 {
+		t.Errorf("resized copy is %d bits away", d)
+	}
+	if d := closestThumbnailHash(jpegHash, stored); d > 6 {
+		t.Errorf("recompressed copy is %d bits away", d)
+	}
+	if d := closestThumbnailHash(distinctHash, stored); d <= 6 {
+		t.Errorf("distinct image is only %d bits away", d)
+	}
+
+	if _, err := thumbnailHash(writeImageFile(t, "junk.png", []byte("not an image"))); err == nil {
+		t.Error("expected an error for an undecodable image")
+	}
+}
+
+func TestClosestThumbnailHash(t *testing.T) {
+	if d := closestThumbnailHash(0, nil); d != -1 {
+		t.Errorf("no hashes: got %d, want -1", d)
+	}
+	stored := []string{"not hex", formatThumbnailHash(0xff), formatThumbnailHash(0x3)}
+	if d := closestThumbnailHash(0x1, stored); d != 1 {
+		t.Errorf("got %d, want 1", d)
+	}
+}
+
+func TestUploadThumbnailDuplicatePolicy(t *testing.T) {
+	original := encodePNG(t, gradientImage(128, false))
+	nearDuplicate := encodePNG(t, gradientImage(200, false))
+	distinct := encodePNG(t, gradientImage(128, true))
+
+	tests := []struct {
+		policy     string
+		image      []byte
+		wantStatus int
+	}{
+		{duplicateThumbnailReject, nearDuplicate, http.StatusUnprocessableEntity},
+		{duplicateThumbnailReject, distinct, http.StatusOK},
+		{duplicateThumbnailWarn, nearDuplicate, http.StatusOK},
+		{duplicateThumbnailOff, nearDuplicate, http.StatusOK},
+	}
+	for _, tc := range tests {
+		cfg := newThumbnailTestConfig(t)
+		cfg.duplicateThumbnailPolicy = tc.policy
+		cfg.duplicateThumbnailThreshold = 6
+		user, token := createTestUser(t, cfg, "creator@example.com")
+		first := createTestVideo(t, cfg, user.ID)
+		second := createTestVideo(t, cfg, user.ID)
+
+		w := httptest.NewRecorder()
+		cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, first.ID.String(), token, original))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: first upload: status %d: %s", tc.policy, w.Code, w.Body)
+		}
+
+		w = httptest.NewRecorder()
+		cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, second.ID.String(), token, tc.image))
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: second upload: status %d, want %d: %s", tc.policy, w.Code, tc.wantStatus, w.Body)
+			continue
+		}
+
+		stored, err := cfg.db.GetVideo(second.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.wantStatus != http.StatusOK {
+			if stored.ThumbnailURL != nil && stored.ThumbnailSource == database.ThumbnailSourceUser {
+				t.Errorf("%s: rejected thumbnail was stored", tc.policy)
+			}
+			continue
+		}
+		wantHashed := tc.policy != duplicateThumbnailOff
+		if (stored.ThumbnailHash != "") != wantHashed {
+			t.Errorf("%s: stored hash %q, want hashed %v", tc.policy, stored.ThumbnailHash, wantHashed)
+		}
+	}
+}
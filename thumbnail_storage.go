@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	thumbnailStorageDisk = "disk"
+	thumbnailStorageS3   = "s3"
+)
+
+// Thumbnails stored in S3 are kept under this prefix, named as they would be
+// in the assets directory.
+const thumbnailKeyPrefix = "thumbnails/"
+
+// thumbnailWorkPath returns where a new thumbnail is written while it's
+// processed. On disk that's its final place in the assets directory;
+// thumbnails bound for S3 go to a temp file the caller removes once
+// storeThumbnail has uploaded it.
+func (cfg *apiConfig) thumbnailWorkPath(assetPath string) (string, error) {
+	if cfg.thumbnailStorage != thumbnailStorageS3 {
+		return cfg.getAssetDiskPath(assetPath)
+	}
+	f, err := os.CreateTemp(cfg.uploadTempDir, "tubely-thumbnail")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// storeThumbnail makes the thumbnail processed at workPath servable and
+// returns its unversioned URL.
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, workPath, assetPath, mediaType string) (string, error) {
+	if cfg.thumbnailStorage != thumbnailStorageS3 {
+		return cfg.getAssetURL(assetPath), nil
+	}
+
+	f, err := os.Open(workPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	key := thumbnailKeyPrefix + assetPath
+	err = cfg.uploadObject(ctx, &s3.PutObjectInput{
+		Bucket:      &cfg.s3Bucket,
+		Key:         &key,
+		Body:        f,
+		ContentType: &mediaType,
+	}, info.Size())
+	if err != nil {
+		return "", err
+	}
+	return cfg.getObjectURL(cfg.s3Bucket, key), nil
+}
+
+// storeThumbnailData is storeThumbnail for a thumbnail held in memory,
+// which is written straight to the assets directory or S3.
+func (cfg *apiConfig) storeThumbnailData(ctx context.Context, data []byte, assetPath, mediaType string) (string, error) {
+	if cfg.thumbnailStorage != thumbnailStorageS3 {
+		diskPath, err := cfg.getAssetDiskPath(assetPath)
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(diskPath, data, 0644); err != nil {
+			os.Remove(diskPath)
+			return "", err
+		}
+		return cfg.getAssetURL(assetPath), nil
+	}
+
+	key := thumbnailKeyPrefix + assetPath
+	err := cfg.uploadObject(ctx, &s3.PutObjectInput{
+		Bucket:      &cfg.s3Bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(data),
+		ContentType: &mediaType,
+	}, int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	return cfg.getObjectURL(cfg.s3Bucket, key), nil
+}
+
+// removeThumbnailAsset deletes the stored file behind a thumbnail URL,
+// whether it's in the assets directory or in S3. URLs that point anywhere
+// else, like placeholders, are left alone.
+func (cfg *apiConfig) removeThumbnailAsset(ctx context.Context, url string) {
+	if assetPath, ok := cfg.assetPathFromURL(url); ok {
+		diskPath, err := cfg.getAssetDiskPath(assetPath)
+		if err != nil {
+			slog.Error("couldn't remove asset", "path", assetPath, "error", err)
+			return
+		}
+		if err := os.Remove(diskPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("couldn't remove asset", "path", assetPath, "error", err)
+		}
+		return
+	}
+
+	bucket, key, err := cfg.parseS3Key(url)
+	if err != nil || bucket != cfg.s3Bucket || !strings.HasPrefix(key, thumbnailKeyPrefix) {
+		return
+	}
+	cfg.deleteObjects(ctx, bucket, []string{key})
+}
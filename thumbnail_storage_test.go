@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestStoreThumbnailOnDisk(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+
+	workPath, err := cfg.thumbnailWorkPath("thumb.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskPath, _ := cfg.getAssetDiskPath("thumb.jpg")
+	if workPath != diskPath {
+		t.Fatalf("work path = %q, want the asset's place on disk %q", workPath, diskPath)
+	}
+	if err := os.WriteFile(workPath, []byte("jpeg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cfg.storeThumbnail(context.Background(), workPath, "thumb.jpg", "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := cfg.getAssetURL("thumb.jpg"); got != want {
+		t.Errorf("url = %q, want %q", got, want)
+	}
+	if _, ok := fake.object(testBucket, thumbnailKeyPrefix+"thumb.jpg"); ok {
+		t.Error("disk thumbnail was uploaded to S3")
+	}
+
+	// Disk thumbnails are served by the app itself and left unsigned
+	video, err := cfg.signVideo(context.Background(), database.Video{ThumbnailURL: &got})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *video.ThumbnailURL != got {
+		t.Errorf("signed thumbnail URL = %q, want it unchanged", *video.ThumbnailURL)
+	}
+
+	cfg.removeThumbnailAsset(context.Background(), got)
+	if _, err := os.Stat(diskPath); !os.IsNotExist(err) {
+		t.Errorf("thumbnail wasn't removed from disk: %v", err)
+	}
+}
+
+func TestStoreThumbnailInS3(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.thumbnailStorage = thumbnailStorageS3
+
+	workPath, err := cfg.thumbnailWorkPath("thumb.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(workPath)
+	if !strings.HasPrefix(workPath, cfg.uploadTempDir) {
+		t.Fatalf("work path = %q, want a temp file in %q", workPath, cfg.uploadTempDir)
+	}
+	if err := os.WriteFile(workPath, []byte("jpeg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cfg.storeThumbnail(context.Background(), workPath, "thumb.jpg", "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := thumbnailKeyPrefix + "thumb.jpg"
+	if want := cfg.getObjectURL(testBucket, key); got != want {
+		t.Errorf("url = %q, want %q", got, want)
+	}
+	if body, ok := fake.object(testBucket, key); !ok || string(body) != "jpeg" {
+		t.Errorf("stored object = %q, %v; want the thumbnail", body, ok)
+	}
+	if diskPath, _ := cfg.getAssetDiskPath("thumb.jpg"); fileExists(diskPath) {
+		t.Error("S3 thumbnail was also written to the assets directory")
+	}
+
+	// The bucket is private without CloudFront, so clients get a signed link
+	video, err := cfg.signVideo(context.Background(), database.Video{ThumbnailURL: &got})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := url.Parse(*video.ThumbnailURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(signed.Path, "/"+key) || signed.Query().Get("X-Amz-Expires") == "" {
+		t.Errorf("thumbnail URL %q isn't a presigned link to %s", *video.ThumbnailURL, key)
+	}
+
+	cfg.removeThumbnailAsset(context.Background(), got)
+	if _, ok := fake.object(testBucket, key); ok {
+		t.Error("thumbnail wasn't removed from S3")
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestPurgeVideoKeepsPlaceholderThumbnail(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "owner@example.com")
+
+	diskPath, err := cfg.getAssetDiskPath("placeholder.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(diskPath, []byte("jpeg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.thumbnailPlaceholderURL = cfg.getAssetURL("placeholder.jpg")
+
+	video := createTestVideo(t, cfg, user.ID)
+	cfg.applyThumbnailPlaceholder(&video)
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.purgeVideo(context.Background(), video); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(diskPath); err != nil {
+		t.Errorf("placeholder was removed along with the video: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isHTTPS reports whether the request reached us over TLS. Behind a proxy
+// that terminates TLS, X-Forwarded-Proto is believed only when the peer is
+// one of the trusted proxies; anyone else could set it.
+func (cfg *apiConfig) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !isFromNetworks(r, cfg.trustedProxies) {
+		return false
+	}
+	// The proxy closest to us appends last
+	protos := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(protos[len(protos)-1]), "https")
+}
+
+// requireTLS rejects plaintext requests when REQUIRE_TLS is set, so uploads
+// and the bearer tokens that come with them never cross the network in the
+// clear.
+func (cfg *apiConfig) requireTLS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.requireTLSUploads && !cfg.isHTTPS(r) {
+			w.Header().Set("Upgrade", "TLS/1.2, HTTP/1.1")
+			w.Header().Set("Connection", "Upgrade")
+			respondWithError(w, http.StatusUpgradeRequired, "Uploads must use HTTPS", nil)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireTLS(t *testing.T) {
+	proxies, err := parseCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		tls        bool
+		remoteAddr string
+		proto      string
+		wantStatus int
+	}{
+		{"disabled", false, false, "203.0.113.7:5000", "", http.StatusOK},
+		{"direct TLS", true, true, "203.0.113.7:5000", "", http.StatusOK},
+		{"plaintext", true, false, "203.0.113.7:5000", "", http.StatusUpgradeRequired},
+		{"trusted proxy forwarding https", true, false, "10.1.2.3:443", "https", http.StatusOK},
+		{"trusted proxy forwarding http", true, false, "10.1.2.3:443", "http", http.StatusUpgradeRequired},
+		{"proxy nearest us saw http", true, false, "10.1.2.3:443", "https, http", http.StatusUpgradeRequired},
+		{"untrusted peer claiming https", true, false, "203.0.113.7:5000", "https", http.StatusUpgradeRequired},
+	}
+	for _, tc := range tests {
+		cfg := &apiConfig{requireTLSUploads: tc.enabled, trustedProxies: proxies}
+		handler := cfg.requireTLS(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+
+		r := httptest.NewRequest(http.MethodPost, "/api/video_upload/x", nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if tc.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.wantStatus)
+		}
+		if tc.wantStatus == http.StatusUpgradeRequired && w.Header().Get("Upgrade") == "" {
+			t.Errorf("%s: 426 without an Upgrade header", tc.name)
+		}
+	}
+}
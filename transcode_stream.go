@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// errTranscodeFailed marks failures on the ffmpeg side of a streamed
+// transcode, as opposed to the S3 side.
+var errTranscodeFailed = errors.New("transcode failed")
+
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// transcodeToS3 re-encodes inputPath and pipes ffmpeg's output straight into
+// a multipart upload, so the encoded file never touches disk. A moov atom
+// can't be written up front without seeking, so the output is fragmented
+// mp4, which browsers can start playing just as early. If ffmpeg fails
+// partway the upload is aborted and no object is left behind. It returns the
+// size and SHA-256 of what was uploaded.
+func (cfg *apiConfig) transcodeToS3(ctx context.Context, inputPath string, opts transcodeOptions, input *s3.PutObjectInput) (int64, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	args := append(transcodeArgs(inputPath, opts),
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-f", "mp4", "pipe:1",
+	)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	if err := cmd.Start(); err != nil {
+		return 0, "", fmt.Errorf("%w: %v", errTranscodeFailed, err)
+	}
+
+	ffmpegErr := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			err = fmt.Errorf("%w: %s, %v", errTranscodeFailed, stderr.String(), err)
+		}
+		ffmpegErr <- err
+		// Readers see the ffmpeg error instead of a clean EOF, which makes
+		// the uploader abort rather than complete a truncated object
+		pw.CloseWithError(err)
+	}()
+
+	h := sha256.New()
+	var size byteCounter
+	input.Body = io.TeeReader(pr, io.MultiWriter(h, &size))
+
+	// Throughput here is bounded by the encoder, so it isn't recorded as S3
+	// upload throughput
+	if err := cfg.uploadObject(ctx, input, 0); err != nil {
+		select {
+		case ffErr := <-ffmpegErr:
+			// ffmpeg already exited; if it failed, that's why the upload did
+			if ffErr != nil {
+				return 0, "", ffErr
+			}
+		default:
+			// The upload gave up first, so stop ffmpeg. Failing the pipe
+			// unblocks its pending writes so it can exit.
+			cancel()
+			pr.CloseWithError(err)
+			<-ffmpegErr
+		}
+		return 0, "", err
+	}
+	if err := <-ffmpegErr; err != nil {
+		return 0, "", err
+	}
+	if size == 0 {
+		return 0, "", fmt.Errorf("%w: transcoded output is empty", errTranscodeFailed)
+	}
+	return int64(size), hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// streamInput writes a stand-in upload into its own directory, so anything
+// else that appears there was written by the transcode.
+func streamInput(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "tubely-upload.mp4")
+	if err := os.WriteFile(inputPath, []byte("original upload"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir, inputPath
+}
+
+func assertOnlyInput(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if !slices.Equal(names, []string{"tubely-upload.mp4"}) {
+		t.Errorf("transcode left files behind: %v", names)
+	}
+}
+
+func TestTranscodeToS3(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	fakeFFmpeg(t, `[ "$out" = pipe:1 ] || exit 1
+printf 'fragmented mp4'
+`)
+	dir, inputPath := streamInput(t)
+
+	size, hash, err := cfg.transcodeToS3(context.Background(), inputPath, transcodeOptions{}, &s3.PutObjectInput{
+		Bucket:      aws.String(testBucket),
+		Key:         aws.String("landscape/streamed.mp4"),
+		ContentType: aws.String("video/mp4"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, ok := fake.object(testBucket, "landscape/streamed.mp4")
+	if !ok || string(body) != "fragmented mp4" {
+		t.Fatalf("uploaded %q, %v", body, ok)
+	}
+	sum := sha256.Sum256(body)
+	if size != int64(len(body)) || hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("got size %d hash %s, want %d %x", size, hash, len(body), sum)
+	}
+	assertOnlyInput(t, dir)
+}
+
+func TestTranscodeToS3AbortsOnFFmpegFailure(t *testing.T) {
+	for name, script := range map[string]string{
+		"fails midway": "printf 'partial output'\nexit 1\n",
+		"empty output": "exit 0\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, fake := newTestConfig(t)
+			fakeFFmpeg(t, script)
+			dir, inputPath := streamInput(t)
+
+			_, _, err := cfg.transcodeToS3(context.Background(), inputPath, transcodeOptions{}, &s3.PutObjectInput{
+				Bucket: aws.String(testBucket),
+				Key:    aws.String("landscape/broken.mp4"),
+			})
+			if !errors.Is(err, errTranscodeFailed) {
+				t.Fatalf("got %v, want errTranscodeFailed", err)
+			}
+			if name == "fails midway" {
+				if _, ok := fake.object(testBucket, "landscape/broken.mp4"); ok {
+					t.Error("a truncated object was uploaded")
+				}
+			}
+			assertOnlyInput(t, dir)
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+
+	"github.com/google/uuid"
+)
+
+// videoCheck is what checkVideoFile found out about an upload.
+type videoCheck struct {
+	probe      videoProbe
+	stillImage bool
+}
+
+// checkVideoFile runs a saved upload through the checks every video has to
+// pass before it's processed: the storage quota, the malware scan, probing,
+// the declared container and duration, and still-image detection. Failures
+// are uploadErrors. A still image is only reported when the policy lets it
+// through.
+func (cfg *apiConfig) checkVideoFile(ctx context.Context, userID uuid.UUID, replacedBytes int64, file *os.File, mediaType string) (videoCheck, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return videoCheck{}, uploadFailure(http.StatusInternalServerError, "Couldn't inspect video", err)
+	}
+	// Other uploads may have landed since the request was accepted
+	ok, err := cfg.withinStorageQuota(userID, replacedBytes, info.Size())
+	if err != nil {
+		return videoCheck{}, uploadFailure(http.StatusInternalServerError, "Couldn't check storage quota", err)
+	}
+	if !ok {
+		return videoCheck{}, uploadFailureCode(http.StatusForbidden, errCodeQuotaExceeded, "Storage quota exceeded", nil)
+	}
+
+	if len(cfg.scanCommand) > 0 {
+		verdict, err := cfg.scanUpload(ctx, file.Name())
+		if err != nil {
+			return videoCheck{}, uploadFailureCode(http.StatusBadGateway, errCodeScanFailed, "Couldn't scan video", err)
+		}
+		if verdict == scanVerdictInfected {
+			return videoCheck{}, uploadFailureCode(http.StatusUnprocessableEntity, errCodeMalwareDetected, "Video failed the malware scan", nil)
+		}
+	}
+
+	// Every ffprobe and quick ffmpeg run below is bounded by the media tool
+	// timeout, so a malformed file can't pin the handler
+	mediaCtx := cfg.mediaContext(ctx)
+
+	// One ffprobe run gives the streams, duration and aspect ratio used later
+	done := cfg.metrics.timeMediaStep("probe")
+	probe, err := probeVideo(mediaCtx, file.Name())
+	done()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// ffprobe ran but couldn't make sense of the file
+		return videoCheck{}, uploadFailureCode(http.StatusBadRequest, errCodeInvalidVideo, "file is not a valid video", err)
+	}
+	if err != nil {
+		return videoCheck{}, uploadFailure(http.StatusInternalServerError, "Couldn't probe video", err)
+	}
+	if err := probe.checkPlayable(); err != nil {
+		return videoCheck{}, uploadFailureCode(http.StatusBadRequest, errCodeInvalidVideo, "file is not a valid video", err)
+	}
+	if !containerMatches(mediaType, probe) {
+		err := fmt.Errorf("declared %s, found %s", mediaType, probe.Format.FormatName)
+		return videoCheck{}, uploadFailureCode(http.StatusBadRequest, errCodeContentTypeMismatch, "File contents don't match its Content-Type", err)
+	}
+	// Reject files whose header lies about how much media they contain
+	if cfg.durationTolerance > 0 {
+		computed, err := countVideoDuration(mediaCtx, file.Name())
+		if err != nil {
+			return videoCheck{}, uploadFailureCode(http.StatusUnprocessableEntity, errCodeInvalidVideo, "Couldn't determine video duration", err)
+		}
+		if durationMismatch(probe.duration(), computed, cfg.durationTolerance) {
+			err := fmt.Errorf("declared %.2fs, computed %.2fs", probe.duration(), computed)
+			return videoCheck{}, uploadFailureCode(http.StatusUnprocessableEntity, errCodeDurationMismatch, "Declared video duration doesn't match its contents", err)
+		}
+	}
+
+	// A looped still image isn't a video; long ones are an engagement scam
+	check := videoCheck{probe: probe}
+	if cfg.stillVideoMinDuration > 0 && probe.duration() >= cfg.stillVideoMinDuration.Seconds() {
+		still, err := isStillVideo(ctx, file.Name(), probe.duration())
+		if err != nil {
+			return videoCheck{}, uploadFailure(http.StatusInternalServerError, "Couldn't analyze video", err)
+		}
+		if still && cfg.stillVideoPolicy == stillVideoPolicyReject {
+			return videoCheck{}, uploadFailureCode(http.StatusUnprocessableEntity, errCodeStillImage, "Video is a single still image", nil)
+		}
+		check.stillImage = still
+	}
+	return check, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+)
+
+const uploadCompletedEventType = "upload.completed"
+
+// uploadCompletedEvent is what downstream consumers receive on the queue
+// once an upload has been processed and stored.
+type uploadCompletedEvent struct {
+	Type           string    `json:"type"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	VideoID        uuid.UUID `json:"video_id"`
+	UserID         uuid.UUID `json:"user_id"`
+	Bucket         string    `json:"bucket"`
+	Keys           []string  `json:"keys"`
+	Duration       float64   `json:"duration"`
+	AspectRatio    string    `json:"aspect_ratio"`
+	OccurredAt     time.Time `json:"occurred_at"`
+}
+
+// sqsSender is the part of the SQS client we use.
+type sqsSender interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+type uploadEventPublisher struct {
+	client      sqsSender
+	queueURL    string
+	maxAttempts int
+}
+
+func newUploadEventPublisher(client sqsSender, queueURL string, maxAttempts int) *uploadEventPublisher {
+	if queueURL == "" {
+		return nil
+	}
+	return &uploadEventPublisher{
+		client:      client,
+		queueURL:    queueURL,
+		maxAttempts: maxAttempts,
+	}
+}
+
+// publish sends the event, retrying with backoff. FIFO queues deduplicate on
+// the idempotency key and keep each video's events in order; standard queues
+// carry the key as an attribute for consumers to deduplicate themselves.
+func (p *uploadEventPublisher) publish(ctx context.Context, event uploadCompletedEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	input := &sqs.SendMessageInput{
+		QueueUrl:    &p.queueURL,
+		MessageBody: aws.String(string(body)),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"idempotency_key": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(event.IdempotencyKey),
+			},
+		},
+	}
+	if strings.HasSuffix(p.queueURL, ".fifo") {
+		input.MessageGroupId = aws.String(event.VideoID.String())
+		input.MessageDeduplicationId = aws.String(event.IdempotencyKey)
+	}
+
+	backoff := 200 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		_, err = p.client.SendMessage(ctx, input)
+		if err == nil || attempt >= p.maxAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// publishUploadCompleted announces a finished upload in the background.
+// Delivery problems are logged and counted but never fail the upload.
+func (cfg *apiConfig) publishUploadCompleted(event uploadCompletedEvent) {
+	if cfg.uploadEvents == nil {
+		return
+	}
+	event.Type = uploadCompletedEventType
+	event.OccurredAt = time.Now().UTC()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := cfg.uploadEvents.publish(ctx, event); err != nil {
+			slog.Error("couldn't publish upload event", "video_id", event.VideoID, "error", err)
+			cfg.metrics.uploadEvents.inc("failed")
+			return
+		}
+		cfg.metrics.uploadEvents.inc("published")
+	}()
+}
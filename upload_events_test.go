@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/google/uuid"
+)
+
+// fakeSQS records sent messages and fails the first failures calls.
+type fakeSQS struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	sent     []*sqs.SendMessageInput
+}
+
+func (f *fakeSQS) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, errors.New("sqs unavailable")
+	}
+	f.sent = append(f.sent, params)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func testUploadEvent() uploadCompletedEvent {
+	videoID := uuid.New()
+	return uploadCompletedEvent{
+		Type:           uploadCompletedEventType,
+		IdempotencyKey: videoID.String() + ":abc123",
+		VideoID:        videoID,
+		UserID:         uuid.New(),
+		Bucket:         "tubely",
+		Keys:           []string{"landscape/video.mp4"},
+		Duration:       12.5,
+		AspectRatio:    "16:9",
+		OccurredAt:     time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestPublishUploadEventMessageShape(t *testing.T) {
+	client := &fakeSQS{}
+	publisher := newUploadEventPublisher(client, "https://sqs.us-east-1.amazonaws.com/123/uploads", 3)
+	event := testUploadEvent()
+	if err := publisher.publish(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(client.sent))
+	}
+	msg := client.sent[0]
+	if *msg.QueueUrl != publisher.queueURL {
+		t.Errorf("queue URL = %s", *msg.QueueUrl)
+	}
+	if msg.MessageGroupId != nil || msg.MessageDeduplicationId != nil {
+		t.Error("standard queue message has FIFO fields set")
+	}
+	if attr := msg.MessageAttributes["idempotency_key"]; attr.StringValue == nil || *attr.StringValue != event.IdempotencyKey {
+		t.Errorf("idempotency_key attribute = %+v", attr)
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal([]byte(*msg.MessageBody), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"type":            "upload.completed",
+		"idempotency_key": event.IdempotencyKey,
+		"video_id":        event.VideoID.String(),
+		"user_id":         event.UserID.String(),
+		"bucket":          "tubely",
+		"keys":            []any{"landscape/video.mp4"},
+		"duration":        12.5,
+		"aspect_ratio":    "16:9",
+		"occurred_at":     "2026-01-02T03:04:05Z",
+	}
+	if len(body) != len(want) {
+		t.Errorf("body has %d fields, want %d: %s", len(body), len(want), *msg.MessageBody)
+	}
+	for field, value := range want {
+		got, _ := json.Marshal(body[field])
+		expected, _ := json.Marshal(value)
+		if string(got) != string(expected) {
+			t.Errorf("%s = %s, want %s", field, got, expected)
+		}
+	}
+}
+
+func TestPublishUploadEventFIFO(t *testing.T) {
+	client := &fakeSQS{}
+	publisher := newUploadEventPublisher(client, "https://sqs.us-east-1.amazonaws.com/123/uploads.fifo", 1)
+	event := testUploadEvent()
+	if err := publisher.publish(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	msg := client.sent[0]
+	if msg.MessageGroupId == nil || *msg.MessageGroupId != event.VideoID.String() {
+		t.Errorf("message group = %v, want %s", msg.MessageGroupId, event.VideoID)
+	}
+	if msg.MessageDeduplicationId == nil || *msg.MessageDeduplicationId != event.IdempotencyKey {
+		t.Errorf("deduplication id = %v, want %s", msg.MessageDeduplicationId, event.IdempotencyKey)
+	}
+}
+
+func TestPublishUploadEventRetries(t *testing.T) {
+	client := &fakeSQS{failures: 1}
+	publisher := newUploadEventPublisher(client, "https://sqs.us-east-1.amazonaws.com/123/uploads", 3)
+	if err := publisher.publish(context.Background(), testUploadEvent()); err != nil {
+		t.Fatalf("expected the retry to succeed: %v", err)
+	}
+	if client.calls != 2 || len(client.sent) != 1 {
+		t.Errorf("calls = %d, sent = %d; want 2 and 1", client.calls, len(client.sent))
+	}
+
+	client = &fakeSQS{failures: 10}
+	publisher = newUploadEventPublisher(client, "https://sqs.us-east-1.amazonaws.com/123/uploads", 2)
+	if err := publisher.publish(context.Background(), testUploadEvent()); err == nil {
+		t.Error("expected an error once attempts run out")
+	}
+	if client.calls != 2 {
+		t.Errorf("calls = %d, want 2", client.calls)
+	}
+}
+
+func TestNewUploadEventPublisherDisabled(t *testing.T) {
+	if p := newUploadEventPublisher(&fakeSQS{}, "", 3); p != nil {
+		t.Error("expected no publisher without a queue URL")
+	}
+	cfg, _ := newTestConfig(t)
+	cfg.publishUploadCompleted(testUploadEvent())
+}
+
+func TestPublishUploadCompletedMetersFailures(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.uploadEvents = newUploadEventPublisher(&fakeSQS{failures: 1}, "https://sqs.us-east-1.amazonaws.com/123/uploads", 1)
+	cfg.publishUploadCompleted(testUploadEvent())
+	cfg.publishUploadCompleted(testUploadEvent())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		cfg.metrics.registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		body := rec.Body.String()
+		if strings.Contains(body, `tubely_upload_events_total{result="failed"} 1`) &&
+			strings.Contains(body, `tubely_upload_events_total{result="published"} 1`) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upload events were not metered:\n%s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
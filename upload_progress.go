@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// uploadProgress counts the bytes of a video upload's request body read so
+// far.
+type uploadProgress struct {
+	received atomic.Int64
+	// total is the request's Content-Length, or -1 when the client didn't
+	// send one
+	total int64
+}
+
+// uploadProgressTracker holds the progress of the video uploads currently
+// being received, keyed by video.
+type uploadProgressTracker struct {
+	mu      sync.Mutex
+	uploads map[uuid.UUID]*uploadProgress
+}
+
+func newUploadProgressTracker() *uploadProgressTracker {
+	return &uploadProgressTracker{uploads: map[uuid.UUID]*uploadProgress{}}
+}
+
+// start begins tracking an upload, replacing any earlier one for the video.
+func (t *uploadProgressTracker) start(videoID uuid.UUID, total int64) *uploadProgress {
+	p := &uploadProgress{total: total}
+	t.mu.Lock()
+	t.uploads[videoID] = p
+	t.mu.Unlock()
+	return p
+}
+
+// finish stops tracking the upload, unless a newer one for the same video
+// has taken its place.
+func (t *uploadProgressTracker) finish(videoID uuid.UUID, p *uploadProgress) {
+	t.mu.Lock()
+	if t.uploads[videoID] == p {
+		delete(t.uploads, videoID)
+	}
+	t.mu.Unlock()
+}
+
+func (t *uploadProgressTracker) get(videoID uuid.UUID) (*uploadProgress, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.uploads[videoID]
+	return p, ok
+}
+
+// progressReader counts bytes as they're read from the request body.
+type progressReader struct {
+	io.ReadCloser
+	progress *uploadProgress
+}
+
+func (r progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.progress.received.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+)
+
+const (
+	scanVerdictClean    = "clean"
+	scanVerdictInfected = "infected"
+)
+
+// scanUpload runs SCAN_COMMAND against the file and returns its verdict. The
+// command follows clamscan's convention: exit 0 is clean, 1 is infected and
+// anything else is a failure. Verdicts are cached by checksum so identical
+// files uploaded by different users are only scanned once per
+// SCAN_VERDICT_TTL.
+func (cfg *apiConfig) scanUpload(ctx context.Context, filePath string) (string, error) {
+	checksum, err := hashFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	if cfg.scanVerdictTTL > 0 {
+		verdict, ok, err := cfg.db.GetScanVerdict(checksum, cfg.scanVerdictTTL)
+		if err != nil {
+			slog.Error("couldn't look up scan verdict", "checksum", checksum, "error", err)
+		} else if ok {
+			return verdict, nil
+		}
+	}
+
+	// A scanner that hangs mustn't hold the upload forever, so it's bounded
+	// like the media tools
+	args := append(append([]string{}, cfg.scanCommand[1:]...), filePath)
+	var output bytes.Buffer
+	verdict := scanVerdictClean
+	if err := runMediaTool(cfg.mediaContext(ctx), &output, cfg.scanCommand[0], args...); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			return "", fmt.Errorf("error scanning upload: %s, %w", output.String(), err)
+		}
+		verdict = scanVerdictInfected
+	}
+
+	if cfg.scanVerdictTTL > 0 {
+		if err := cfg.db.PutScanVerdict(checksum, verdict); err != nil {
+			slog.Error("couldn't cache scan verdict", "checksum", checksum, "error", err)
+		}
+	}
+	return verdict, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeScanner writes a scanner script that flags files containing INFECTED
+// and logs each run, returning the command and the log's path.
+func fakeScanner(t *testing.T, body string) ([]string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	script := filepath.Join(dir, "scan.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho run >> "+runs+"\n"+body), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return []string{"sh", script}, runs
+}
+
+func countRuns(t *testing.T, runs string) int {
+	t.Helper()
+	b, err := os.ReadFile(runs)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(b), "run")
+}
+
+func writeUpload(t *testing.T, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "upload.mp4")
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestScanUploadVerdictCache(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	var runs string
+	cfg.scanCommand, runs = fakeScanner(t, `grep -q INFECTED "$1" && exit 1
+exit 0
+`)
+	cfg.scanVerdictTTL = time.Hour
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		content  string
+		want     string
+		wantRuns int
+	}{
+		{"clean file is scanned", "clean bytes", scanVerdictClean, 1},
+		{"identical file reuses the verdict", "clean bytes", scanVerdictClean, 1},
+		{"infected file is scanned", "INFECTED bytes", scanVerdictInfected, 2},
+		{"identical infected file reuses the verdict", "INFECTED bytes", scanVerdictInfected, 2},
+	}
+	for _, tc := range tests {
+		verdict, err := cfg.scanUpload(ctx, writeUpload(t, tc.content))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if verdict != tc.want {
+			t.Errorf("%s: verdict %q, want %q", tc.name, verdict, tc.want)
+		}
+		if got := countRuns(t, runs); got != tc.wantRuns {
+			t.Errorf("%s: scanner ran %d times, want %d", tc.name, got, tc.wantRuns)
+		}
+	}
+}
+
+func TestScanUploadWithoutCache(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	var runs string
+	cfg.scanCommand, runs = fakeScanner(t, "exit 0\n")
+	upload := writeUpload(t, "clean bytes")
+	for range 2 {
+		if _, err := cfg.scanUpload(context.Background(), upload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := countRuns(t, runs); got != 2 {
+		t.Errorf("scanner ran %d times, want 2", got)
+	}
+}
+
+func TestScanUploadFailures(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.mediaToolTimeout = 200 * time.Millisecond
+	upload := writeUpload(t, "clean bytes")
+
+	cfg.scanCommand, _ = fakeScanner(t, "exit 2\n")
+	if _, err := cfg.scanUpload(context.Background(), upload); err == nil {
+		t.Error("scanner error was taken as a verdict")
+	}
+
+	cfg.scanCommand, _ = fakeScanner(t, "exec sleep 10\n")
+	start := time.Now()
+	if _, err := cfg.scanUpload(context.Background(), upload); err == nil {
+		t.Error("hung scanner succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("hung scanner held the upload for %s", elapsed)
+	}
+}
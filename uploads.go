@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+)
+
+// removeMultipartFiles deletes the temp files ParseMultipartForm spills large
+// parts into. Go only removes them when the form is garbage collected, which
+// under load is far too late.
+func removeMultipartFiles(r *http.Request) {
+	if r.MultipartForm == nil {
+		return
+	}
+	if err := r.MultipartForm.RemoveAll(); err != nil {
+		requestLogger(r).Error("couldn't remove multipart temp files", "error", err)
+	}
+}
+
+// sniffMediaType detects the file's media type from its first 512 bytes, as
+// http.DetectContentType does, and rewinds it so it can be read in full.
+func sniffMediaType(f io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	return mediaType, err
+}
+
+// processingSuffix is appended to an upload's temp file name to get the path
+// ffmpeg writes the processed copy to.
+const processingSuffix = ".processing"
+
+// createUploadTemp creates the temp file an upload is saved to. The returned
+// cleanup closes and removes it along with its processed copy; defer it
+// straight away so no error path leaves either behind.
+func createUploadTemp(dir string) (*os.File, func(), error) {
+	f, err := os.CreateTemp(dir, "tubely-upload.mp4")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		removeUploadFiles(f.Name())
+	}
+	return f, cleanup, nil
+}
+
+// removeUploadFiles deletes a saved upload and its processed copy.
+func removeUploadFiles(path string) {
+	for _, name := range []string{path, path + processingSuffix} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("couldn't remove upload temp file", "error", err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestSniffMediaType(t *testing.T) {
+	mp4 := append([]byte{0, 0, 0, 0x18}, []byte("ftypmp42\x00\x00\x00\x00mp42isom")...)
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"png", testPNG(t, 8), "image/png"},
+		{"jpeg", testJPEG(t, 8), "image/jpeg"},
+		{"mp4", mp4, "video/mp4"},
+		{"text", []byte("just some notes, renamed to .mp4\n"), "text/plain"},
+		{"empty", nil, "text/plain"},
+		{"executable", []byte("MZ\x90\x00\x03\x00\x00\x00"), "application/octet-stream"},
+	}
+	for _, tc := range tests {
+		r := bytes.NewReader(tc.data)
+		got, err := sniffMediaType(r)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: sniffMediaType = %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+		// The whole file still has to be read afterwards
+		if rest, _ := io.ReadAll(r); !bytes.Equal(rest, tc.data) {
+			t.Errorf("%s: reader wasn't rewound", tc.name)
+		}
+	}
+}
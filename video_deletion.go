@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const deletedVideoSweepInterval = time.Minute
+
+// sweepDeletedVideos purges soft-deleted videos once their grace period has
+// passed. It runs until the process exits.
+func (cfg *apiConfig) sweepDeletedVideos() {
+	ticker := time.NewTicker(deletedVideoSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cfg.purgeExpiredVideos(context.Background())
+	}
+}
+
+// purgeExpiredVideos purges every soft-deleted video whose grace period has
+// passed.
+func (cfg *apiConfig) purgeExpiredVideos(ctx context.Context) {
+	videos, err := cfg.db.GetVideosDeletedBefore(cfg.softDeleteGrace)
+	if err != nil {
+		slog.Error("couldn't list deleted videos", "error", err)
+		return
+	}
+	for _, video := range videos {
+		if err := cfg.purgeVideo(ctx, video); err != nil {
+			slog.Error("couldn't purge video", "video_id", video.ID, "error", err)
+		}
+	}
+}
+
+// purgeVideo removes the video record along with its stored media and
+// thumbnail. Media shared with another video through deduplication is kept.
+func (cfg *apiConfig) purgeVideo(ctx context.Context, video database.Video) error {
+	if video.VideoURL != nil {
+		if err := cfg.purgeMedia(ctx, *video.VideoURL); err != nil {
+			return err
+		}
+	}
+
+	bucket := cfg.s3Bucket
+	if video.VideoURL != nil {
+		if b, _, err := cfg.parseS3Key(*video.VideoURL); err == nil {
+			bucket = b
+		}
+	}
+	for _, a := range video.Artifacts {
+		if a.Kind == artifactThumbnail || !ownsArtifact(video.ID, a) {
+			continue
+		}
+		if err := cfg.deleteArtifact(ctx, bucket, a); err != nil {
+			return fmt.Errorf("couldn't delete %s artifact %s: %w", a.Kind, a.Key, err)
+		}
+	}
+
+	if err := cfg.db.DeleteVideo(video.ID); err != nil {
+		return err
+	}
+	// The placeholder is shared by every video showing it
+	if video.ThumbnailURL != nil && video.ThumbnailSource != database.ThumbnailSourcePlaceholder {
+		cfg.removeThumbnailAsset(ctx, *video.ThumbnailURL)
+	}
+	return nil
+}
+
+// purgeMedia deletes the media object at url unless a video other than the
+// one being purged references it.
+func (cfg *apiConfig) purgeMedia(ctx context.Context, url string) error {
+	bucket, key, err := cfg.parseS3Key(url)
+	if err != nil {
+		return nil
+	}
+	unlock := cfg.mediaLocks.lock(bucket, key)
+	defer unlock()
+
+	refs, err := cfg.db.CountVideosByURL(url)
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		return nil
+	}
+	_, err = cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	// Already gone is as good as deleted
+	var noSuchKey *types.NoSuchKey
+	if err != nil && !errors.As(err, &noSuchKey) {
+		return err
+	}
+	cfg.presignCache.invalidate(bucket, key)
+	return nil
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	processingPassthrough = "passthrough"
+	processingFastStart   = "faststart"
+	processingRemux       = "remux"
+	processingTranscode   = "transcode"
+)
+
+type videoProbe struct {
+	Streams []probeStream `json:"streams"`
+	Format  struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		BitRate    string            `json:"bit_rate"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+type probeStream struct {
+	CodecType    string `json:"codec_type"`
+	CodecName    string `json:"codec_name"`
+	PixFmt       string `json:"pix_fmt"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	AvgFrameRate string `json:"avg_frame_rate"`
+
+	ColorTransfer  string `json:"color_transfer"`
+	ColorPrimaries string `json:"color_primaries"`
+
+	Tags map[string]string `json:"tags"`
+	// Newer ffmpeg reports rotation here instead of the rotate tag
+	SideDataList []struct {
+		Rotation float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// videoUploadTypes are the accepted upload types. Anything that isn't
+// already a compatible mp4 is remuxed or transcoded, so what we store is
+// always mp4.
+var videoUploadTypes = map[string]bool{
+	"video/mp4":       true,
+	"video/quicktime": true,
+	"video/webm":      true,
+}
+
+// mkv is only accepted when REMUX_CONTAINERS is set.
+const matroskaMediaType = "video/x-matroska"
+
+// acceptsVideoType reports whether uploads declaring the media type are
+// accepted.
+func (cfg *apiConfig) acceptsVideoType(mediaType string) bool {
+	return videoUploadTypes[mediaType] || (cfg.remuxContainers && mediaType == matroskaMediaType)
+}
+
+// containerMatches reports whether ffprobe agrees with the upload's declared
+// media type. mp4 and QuickTime share a demuxer, as do mkv and WebM, so WebM
+// additionally has to use codecs the format allows.
+func containerMatches(mediaType string, probe videoProbe) bool {
+	demuxers := strings.Split(probe.Format.FormatName, ",")
+	switch mediaType {
+	case "video/mp4", "video/quicktime":
+		return slices.Contains(demuxers, "mov")
+	case matroskaMediaType:
+		return slices.Contains(demuxers, "matroska")
+	case "video/webm":
+		if !slices.Contains(demuxers, "webm") {
+			return false
+		}
+		for _, stream := range probe.Streams {
+			switch stream.CodecName {
+			case "vp8", "vp9", "av1", "vorbis", "opus", "webvtt":
+			default:
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// processedMarker is written into the metadata of every file we produce so
+// re-uploads of our own output can be recognized.
+const processedMarker = "tubely-processed"
+
+const (
+	longGOPPolicyWarn     = "warn"
+	longGOPPolicyReencode = "reencode"
+)
+
+// Keyframe spacing used when re-encoding sources with overly long GOPs.
+const targetKeyframeInterval = 2 * time.Second
+
+type transcodeOptions struct {
+	preset     string
+	maxBitRate int64
+	// gopSize forces a keyframe every gopSize frames when non-zero
+	gopSize int
+}
+
+const (
+	qualityPreset = "medium"
+	fastPreset    = "ultrafast"
+	// Share of an encode deadline the quality preset gets before we give up
+	// on it and restart with the fast one
+	qualityDeadlineShare = 0.6
+)
+
+func probeVideo(ctx context.Context, filePath string) (videoProbe, error) {
+	var stdout bytes.Buffer
+	err := runMediaTool(ctx, &stdout, "ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_streams",
+		"-show_format", filePath,
+	)
+	if err != nil {
+		return videoProbe{}, err
+	}
+
+	var probe videoProbe
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return videoProbe{}, fmt.Errorf("could not parse ffprobe output: %v", err)
+	}
+	return probe, nil
+}
+
+// videoStream returns the first video stream, if any.
+func (p videoProbe) videoStream() (probeStream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "video" {
+			return stream, true
+		}
+	}
+	return probeStream{}, false
+}
+
+// checkPlayable rejects probes of files with no video stream or nothing to
+// play, like an empty file or a document renamed to .mp4.
+func (p videoProbe) checkPlayable() error {
+	if _, ok := p.videoStream(); !ok {
+		return errors.New("no video stream")
+	}
+	if p.duration() <= 0 {
+		return fmt.Errorf("duration is %.2fs", p.duration())
+	}
+	return nil
+}
+
+// displaySize returns the stream's frame size as players show it, with any
+// rotation applied.
+func (s probeStream) displaySize() (int, int) {
+	rotation, _ := strconv.ParseFloat(s.Tags["rotate"], 64)
+	for _, sd := range s.SideDataList {
+		if sd.Rotation != 0 {
+			rotation = sd.Rotation
+		}
+	}
+	if math.Mod(math.Abs(rotation), 180) == 90 {
+		return s.Height, s.Width
+	}
+	return s.Width, s.Height
+}
+
+// errNoDimensions means ffprobe found a video stream but couldn't tell its
+// width and height.
+var errNoDimensions = errors.New("video stream has no dimensions")
+
+// namedAspectRatios are the shapes aspectRatio recognises, each with how far
+// off a video can be and still count, and the prefix its media is stored
+// under. Ultrawide covers both 64:27 and 2.39:1 masters.
+var namedAspectRatios = []struct {
+	name      string
+	ratio     float64
+	tolerance float64
+	prefix    string
+}{
+	{"16:9", 16.0 / 9.0, 0.01, "landscape/"},
+	{"9:16", 9.0 / 16.0, 0.01, "portrait/"},
+	{"4:3", 4.0 / 3.0, 0.01, "standard/"},
+	{"3:4", 3.0 / 4.0, 0.01, "standard-portrait/"},
+	{"1:1", 1, 0.01, "square/"},
+	{"4:5", 4.0 / 5.0, 0.01, "vertical/"},
+	{"21:9", 21.0 / 9.0, 0.06, "ultrawide/"},
+}
+
+// Where media whose ratio isn't one of the named ones is stored.
+const otherAspectRatioPrefix = "other/"
+
+// aspectRatio names the shape of the first video stream, e.g. "16:9" or
+// "1:1", or gives its reduced width:height like "12:5" when it isn't one
+// of the named ratios. Audio or data streams can come before it.
+func (p videoProbe) aspectRatio() (string, error) {
+	stream, ok := p.videoStream()
+	if !ok {
+		return "", errors.New("no video stream found")
+	}
+	// Phones record portrait video as landscape frames plus a rotation, so
+	// classify by the orientation players will display
+	width, height := stream.displaySize()
+	if width == 0 || height == 0 {
+		return "", errNoDimensions
+	}
+	ratio := float64(width) / float64(height)
+
+	for _, named := range namedAspectRatios {
+		if math.Abs(ratio-named.ratio) <= named.tolerance {
+			return named.name, nil
+		}
+	}
+	d := gcd(width, height)
+	return fmt.Sprintf("%d:%d", width/d, height/d), nil
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// aspectRatioPrefix returns the prefix media of the given ratio is stored
+// under.
+func aspectRatioPrefix(ratio string) string {
+	for _, named := range namedAspectRatios {
+		if named.name == ratio {
+			return named.prefix
+		}
+	}
+	return otherAspectRatioPrefix
+}
+
+// aspectRatioPrefixes lists every prefix media can be stored under by ratio.
+func aspectRatioPrefixes() []string {
+	prefixes := []string{otherAspectRatioPrefix}
+	for _, named := range namedAspectRatios {
+		prefixes = append(prefixes, named.prefix)
+	}
+	return prefixes
+}
+
+// aspectRatioClass is the ratio if it's a named one, or "other". Unnamed
+// ratios are too many to use as metric labels.
+func aspectRatioClass(ratio string) string {
+	if aspectRatioPrefix(ratio) == otherAspectRatioPrefix {
+		return "other"
+	}
+	return ratio
+}
+
+// gopSizeFor returns the number of frames between keyframes that gives
+// targetKeyframeInterval at the video's frame rate.
+func (p videoProbe) gopSizeFor(interval time.Duration) int {
+	fps := 30.0
+	if stream, ok := p.videoStream(); ok {
+		if f, err := parseFrameRate(stream.AvgFrameRate); err == nil {
+			fps = f
+		}
+	}
+	return max(1, int(math.Round(fps*interval.Seconds())))
+}
+
+// maxKeyframeInterval returns the longest gap in seconds between consecutive
+// keyframes of the first video stream. Only keyframes are decoded.
+func maxKeyframeInterval(ctx context.Context, filePath string) (float64, error) {
+	times, err := keyframeTimes(ctx, filePath)
+	if err != nil {
+		return 0, err
+	}
+
+	longest := 0.0
+	for i := 1; i < len(times); i++ {
+		longest = math.Max(longest, times[i]-times[i-1])
+	}
+	return longest, nil
+}
+
+// keyframeTimes returns the timestamps in seconds of the first video
+// stream's keyframes, in order.
+func keyframeTimes(ctx context.Context, filePath string) ([]float64, error) {
+	var stdout bytes.Buffer
+	err := runMediaTool(ctx, &stdout, "ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-skip_frame", "nokey",
+		"-show_entries", "frame=pts_time,best_effort_timestamp_time",
+		"-print_format", "json", filePath,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var output struct {
+		Frames []struct {
+			PtsTime        string `json:"pts_time"`
+			BestEffortTime string `json:"best_effort_timestamp_time"`
+		} `json:"frames"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return nil, fmt.Errorf("could not parse ffprobe output: %v", err)
+	}
+
+	times := make([]float64, 0, len(output.Frames))
+	for _, frame := range output.Frames {
+		ts := frame.PtsTime
+		if ts == "" || ts == "N/A" {
+			ts = frame.BestEffortTime
+		}
+		t, err := strconv.ParseFloat(ts, 64)
+		if err != nil {
+			continue
+		}
+		times = append(times, t)
+	}
+	return times, nil
+}
+
+// dynamicRange classifies the video as SDR, HDR10 or HLG from its transfer
+// characteristics. Wide-gamut BT.2020 primaries alone don't make a video
+// HDR, and anything missing or unrecognized is treated as SDR.
+func (p videoProbe) dynamicRange() string {
+	stream, ok := p.videoStream()
+	if !ok {
+		return database.DynamicRangeSDR
+	}
+	switch stream.ColorTransfer {
+	case "smpte2084":
+		return database.DynamicRangeHDR10
+	case "arib-std-b67":
+		return database.DynamicRangeHLG
+	}
+	return database.DynamicRangeSDR
+}
+
+// bitRate returns the container's overall bit rate, or 0 if unknown.
+// isMP4 reports whether the container is mp4. ffprobe names mov and mp4 the
+// same demuxer, so QuickTime files are told apart by their major brand.
+func (p videoProbe) isMP4() bool {
+	if !strings.Contains(p.Format.FormatName, "mp4") {
+		return false
+	}
+	return strings.TrimSpace(p.Format.Tags["major_brand"]) != "qt"
+}
+
+func (p videoProbe) bitRate() int64 {
+	n, err := strconv.ParseInt(p.Format.BitRate, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// duration returns the container-declared duration in seconds, or 0 if
+// unknown.
+func (p videoProbe) duration() float64 {
+	d, err := strconv.ParseFloat(p.Format.Duration, 64)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// countVideoDuration computes the duration from the packets actually present
+// in the first video stream rather than trusting the container header.
+func countVideoDuration(ctx context.Context, filePath string) (float64, error) {
+	var stdout bytes.Buffer
+	err := runMediaTool(ctx, &stdout, "ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-count_packets",
+		"-show_entries", "stream=nb_read_packets,avg_frame_rate",
+		"-print_format", "json", filePath,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var output struct {
+		Streams []struct {
+			NbReadPackets string `json:"nb_read_packets"`
+			AvgFrameRate  string `json:"avg_frame_rate"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return 0, fmt.Errorf("could not parse ffprobe output: %v", err)
+	}
+	if len(output.Streams) == 0 {
+		return 0, errors.New("no video stream found")
+	}
+
+	packets, err := strconv.ParseFloat(output.Streams[0].NbReadPackets, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid packet count: %v", err)
+	}
+	fps, err := parseFrameRate(output.Streams[0].AvgFrameRate)
+	if err != nil {
+		return 0, err
+	}
+	return packets / fps, nil
+}
+
+// parseFrameRate parses ffprobe's rational frame rates such as "30000/1001".
+func parseFrameRate(rate string) (float64, error) {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid frame rate %q", rate)
+	}
+	d := 1.0
+	if found {
+		d, err = strconv.ParseFloat(den, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid frame rate %q", rate)
+		}
+	}
+	if n <= 0 || d <= 0 {
+		return 0, fmt.Errorf("invalid frame rate %q", rate)
+	}
+	return n / d, nil
+}
+
+// durationMismatch reports whether the declared and computed durations differ
+// by more than tolerance, expressed as a fraction of the larger one.
+func durationMismatch(declared, computed, tolerance float64) bool {
+	longest := math.Max(declared, computed)
+	if longest == 0 {
+		return false
+	}
+	return math.Abs(declared-computed)/longest > tolerance
+}
+
+// decideProcessing picks the cheapest processing that still yields a
+// browser-friendly mp4, along with the reason for the choice.
+func decideProcessing(probe videoProbe, fastStart bool, maxBitRate int64) (string, string) {
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			if stream.CodecName != "h264" {
+				return processingTranscode, "video codec " + stream.CodecName + " is not h264"
+			}
+			if stream.PixFmt != "yuv420p" {
+				return processingTranscode, "pixel format " + stream.PixFmt + " is not yuv420p"
+			}
+		case "audio":
+			if stream.CodecName != "aac" && stream.CodecName != "mp3" {
+				return processingTranscode, "audio codec " + stream.CodecName + " is not aac or mp3"
+			}
+		}
+	}
+
+	if maxBitRate > 0 && probe.bitRate() > maxBitRate {
+		return processingTranscode, fmt.Sprintf("bit rate %d exceeds %d", probe.bitRate(), maxBitRate)
+	}
+	// The codecs can be copied as they are, just not the container
+	if !probe.isMP4() {
+		return processingRemux, "container " + probe.Format.FormatName + " is not mp4"
+	}
+	if !fastStart {
+		return processingFastStart, "moov atom is not at the start"
+	}
+	return processingPassthrough, "already compatible"
+}
+
+// parseProcessingPipelines reads a comma separated list of codec=pipeline
+// pairs, e.g. "prores=transcode,h264=faststart".
+func parseProcessingPipelines(s string) (map[string]string, error) {
+	pipelines := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		codec, pipeline, ok := strings.Cut(pair, "=")
+		codec, pipeline = strings.TrimSpace(codec), strings.TrimSpace(pipeline)
+		if !ok || codec == "" {
+			return nil, fmt.Errorf("%q is not codec=pipeline", pair)
+		}
+		switch pipeline {
+		case processingPassthrough, processingFastStart, processingRemux, processingTranscode:
+		default:
+			return nil, fmt.Errorf("unknown pipeline %q for %s", pipeline, codec)
+		}
+		pipelines[codec] = pipeline
+	}
+	return pipelines, nil
+}
+
+// selectPipeline picks how to process an upload. A pipeline configured for
+// the video codec wins; anything else falls back to decideProcessing.
+func selectPipeline(probe videoProbe, fastStart bool, maxBitRate int64, pipelines map[string]string) (string, string) {
+	stream, ok := probe.videoStream()
+	if !ok {
+		return decideProcessing(probe, fastStart, maxBitRate)
+	}
+	pipeline, ok := pipelines[stream.CodecName]
+	if !ok {
+		return decideProcessing(probe, fastStart, maxBitRate)
+	}
+	// Whatever the pipeline, what we store has to be an mp4
+	if (pipeline == processingPassthrough || pipeline == processingFastStart) && !probe.isMP4() {
+		return processingRemux, "configured for " + stream.CodecName + ", container is not mp4"
+	}
+	if pipeline == processingFastStart && fastStart {
+		return processingPassthrough, "configured for " + stream.CodecName + ", already fast start"
+	}
+	return pipeline, "configured for " + stream.CodecName
+}
+
+func hashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isFastStart reports whether the mp4's moov atom comes before its media
+// data, which lets browsers start playback before the whole file arrives.
+func isFastStart(filePath string) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(f, header[:8]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerLen := int64(8)
+		switch size {
+		case 0:
+			// Atom runs to the end of the file
+			return string(header[4:8]) == "moov", nil
+		case 1:
+			if _, err := io.ReadFull(f, header[8:16]); err != nil {
+				return false, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerLen = 16
+		}
+
+		switch string(header[4:8]) {
+		case "moov":
+			return true, nil
+		case "mdat":
+			return false, nil
+		}
+
+		if size < headerLen {
+			return false, fmt.Errorf("invalid atom size %d", size)
+		}
+		if _, err := f.Seek(size-headerLen, io.SeekCurrent); err != nil {
+			return false, err
+		}
+	}
+}
+
+// transcodeWithDeadline encodes with the quality preset, falling back to the
+// fast preset when the quality encode would blow the deadline, and finally to
+// passing the original through untouched. It returns the output path (the
+// input path on passthrough) and the preset that produced it.
+func transcodeWithDeadline(ctx context.Context, inputPath string, opts transcodeOptions, deadline time.Duration) (string, string, error) {
+	if opts.preset == "" {
+		opts.preset = qualityPreset
+	}
+	if deadline <= 0 {
+		outputPath, err := transcodeVideo(ctx, inputPath, opts)
+		return outputPath, opts.preset, err
+	}
+
+	start := time.Now()
+	encodeCtx, cancel := context.WithTimeout(ctx, time.Duration(float64(deadline)*qualityDeadlineShare))
+	outputPath, err := transcodeVideo(encodeCtx, inputPath, opts)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return outputPath, opts.preset, err
+	}
+
+	slog.Warn("encode exceeded its share of the deadline, retrying faster", "preset", opts.preset, "input", inputPath, "deadline", deadline, "retry_preset", fastPreset)
+	opts.preset = fastPreset
+	encodeCtx, cancel = context.WithTimeout(ctx, deadline-time.Since(start))
+	outputPath, err = transcodeVideo(encodeCtx, inputPath, opts)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return outputPath, opts.preset, err
+	}
+
+	slog.Warn("encode missed the deadline, passing the original through", "preset", fastPreset, "input", inputPath, "deadline", deadline)
+	return inputPath, processingPassthrough, nil
+}
+
+func transcodeVideo(ctx context.Context, inputPath string, opts transcodeOptions) (string, error) {
+	outputPath := inputPath + processingSuffix
+
+	args := append(transcodeArgs(inputPath, opts), "-movflags", "faststart", "-f", "mp4", outputPath)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("error transcoding video: %s, %v", stderr.String(), err)
+	}
+
+	fileInfo, err := os.Stat(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("could not stat transcoded file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("transcoded file is empty")
+	}
+
+	return outputPath, nil
+}
+
+// transcodeArgs returns the ffmpeg arguments for re-encoding inputPath, minus
+// the output options.
+func transcodeArgs(inputPath string, opts transcodeOptions) []string {
+	preset := opts.preset
+	if preset == "" {
+		preset = qualityPreset
+	}
+	args := []string{
+		"-y",
+		"-i", inputPath,
+		"-c:v", "libx264",
+		"-preset", preset,
+		"-crf", "23",
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+	}
+	if opts.maxBitRate > 0 {
+		args = append(args,
+			"-maxrate", strconv.FormatInt(opts.maxBitRate, 10),
+			"-bufsize", strconv.FormatInt(opts.maxBitRate*2, 10),
+		)
+	}
+	if opts.gopSize > 0 {
+		args = append(args, "-g", strconv.Itoa(opts.gopSize))
+	}
+	return append(args, "-metadata", "comment="+processedMarker)
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func probeOfSize(width, height int) videoProbe {
+	return videoProbe{Streams: []probeStream{
+		{CodecType: "audio"},
+		{CodecType: "video", Width: width, Height: height},
+	}}
+}
+
+func TestAspectRatio(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          string
+		prefix        string
+	}{
+		{1920, 1080, "16:9", "landscape/"},
+		{1080, 1920, "9:16", "portrait/"},
+		{1080, 1080, "1:1", "square/"},
+		{1440, 1080, "4:3", "standard/"},
+		{1080, 1350, "4:5", "vertical/"},
+		{2560, 1080, "21:9", "ultrawide/"},
+		{3840, 1606, "21:9", "ultrawide/"},
+		{1200, 500, "12:5", otherAspectRatioPrefix},
+		{1000, 300, "10:3", otherAspectRatioPrefix},
+		{997, 700, "997:700", otherAspectRatioPrefix},
+	}
+	for _, tc := range tests {
+		got, err := probeOfSize(tc.width, tc.height).aspectRatio()
+		if err != nil || got != tc.want {
+			t.Errorf("aspectRatio(%dx%d) = %q, %v, want %q", tc.width, tc.height, got, err, tc.want)
+			continue
+		}
+		if prefix := aspectRatioPrefix(got); prefix != tc.prefix {
+			t.Errorf("aspectRatioPrefix(%q) = %q, want %q", got, prefix, tc.prefix)
+		}
+	}
+}
+
+func TestAspectRatioErrors(t *testing.T) {
+	if _, err := (videoProbe{Streams: []probeStream{{CodecType: "audio"}}}).aspectRatio(); err == nil {
+		t.Error("audio-only probe succeeded, want an error")
+	}
+	if _, err := probeOfSize(0, 1080).aspectRatio(); !errors.Is(err, errNoDimensions) {
+		t.Errorf("zero width = %v, want errNoDimensions", err)
+	}
+}
+
+func TestGCD(t *testing.T) {
+	tests := []struct{ a, b, want int }{
+		{1920, 1080, 120},
+		{1080, 1080, 1080},
+		{3840, 1606, 2},
+		{997, 991, 1},
+		{7, 0, 7},
+	}
+	for _, tc := range tests {
+		if got := gcd(tc.a, tc.b); got != tc.want {
+			t.Errorf("gcd(%d, %d) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+// probeOf builds a probe of an mp4 with the given streams and bit rate.
+func probeOf(bitRate string, streams ...probeStream) videoProbe {
+	var p videoProbe
+	p.Format.FormatName = "mov,mp4,m4a,3gp,3g2,mj2"
+	p.Format.BitRate = bitRate
+	p.Streams = streams
+	return p
+}
+
+func TestDecideProcessing(t *testing.T) {
+	h264 := probeStream{CodecType: "video", CodecName: "h264", PixFmt: "yuv420p"}
+	aac := probeStream{CodecType: "audio", CodecName: "aac"}
+
+	tests := []struct {
+		name       string
+		probe      videoProbe
+		fastStart  bool
+		maxBitRate int64
+		want       string
+	}{
+		{"compatible and fast start", probeOf("1000000", h264, aac), true, 0, processingPassthrough},
+		{"compatible with mp3 audio", probeOf("1000000", h264, probeStream{CodecType: "audio", CodecName: "mp3"}), true, 0, processingPassthrough},
+		{"under the bit rate cap", probeOf("1000000", h264, aac), true, 2000000, processingPassthrough},
+		{"moov at the end", probeOf("1000000", h264, aac), false, 0, processingFastStart},
+		{"hevc video", probeOf("1000000", probeStream{CodecType: "video", CodecName: "hevc", PixFmt: "yuv420p"}, aac), true, 0, processingTranscode},
+		{"10-bit pixel format", probeOf("1000000", probeStream{CodecType: "video", CodecName: "h264", PixFmt: "yuv420p10le"}, aac), true, 0, processingTranscode},
+		{"opus audio", probeOf("1000000", h264, probeStream{CodecType: "audio", CodecName: "opus"}), true, 0, processingTranscode},
+		{"over the bit rate cap", probeOf("5000000", h264, aac), true, 2000000, processingTranscode},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, reason := decideProcessing(tc.probe, tc.fastStart, tc.maxBitRate)
+			if got != tc.want {
+				t.Errorf("got %s (%s), want %s", got, reason, tc.want)
+			}
+			if reason == "" {
+				t.Error("no reason given")
+			}
+		})
+	}
+}
+
+// containerProbe builds a probe of one video stream and an optional audio
+// stream in the given container.
+func containerProbe(format, brand, video, pixFmt, audio string) videoProbe {
+	p := videoProbe{Streams: []probeStream{{CodecType: "video", CodecName: video, PixFmt: pixFmt}}}
+	if audio != "" {
+		p.Streams = append(p.Streams, probeStream{CodecType: "audio", CodecName: audio})
+	}
+	p.Format.FormatName = format
+	p.Format.Tags = map[string]string{"major_brand": brand}
+	return p
+}
+
+func TestDecideProcessingContainers(t *testing.T) {
+	const mp4 = "mov,mp4,m4a,3gp,3g2,mj2"
+	tests := []struct {
+		name  string
+		probe videoProbe
+		want  string
+	}{
+		{"isom mp4", containerProbe(mp4, "isom", "h264", "yuv420p", "aac"), processingPassthrough},
+		{"h264/aac in mkv", containerProbe("matroska,webm", "", "h264", "yuv420p", "aac"), processingRemux},
+		{"h264/aac in mov", containerProbe(mp4, "qt", "h264", "yuv420p", "aac"), processingRemux},
+		{"mp3 audio in mkv", containerProbe("matroska,webm", "", "h264", "yuv420p", "mp3"), processingRemux},
+		{"silent mkv", containerProbe("matroska,webm", "", "h264", "yuv420p", ""), processingRemux},
+		{"opus audio can't be copied", containerProbe("matroska,webm", "", "h264", "yuv420p", "opus"), processingTranscode},
+		{"vp9 in webm", containerProbe("matroska,webm", "", "vp9", "yuv420p", "opus"), processingTranscode},
+		{"10-bit h264 in mkv", containerProbe("matroska,webm", "", "h264", "yuv420p10le", "aac"), processingTranscode},
+	}
+	for _, tc := range tests {
+		got, reason := decideProcessing(tc.probe, true, 0)
+		if got != tc.want {
+			t.Errorf("%s: decideProcessing = %q (%s), want %q", tc.name, got, reason, tc.want)
+		}
+	}
+
+	overLimit := containerProbe("matroska,webm", "", "h264", "yuv420p", "aac")
+	overLimit.Format.BitRate = "20000000"
+	if got, _ := decideProcessing(overLimit, true, 8000000); got != processingTranscode {
+		t.Errorf("over the bit rate limit: decideProcessing = %q, want %q", got, processingTranscode)
+	}
+
+	// A configured pipeline can't skip the remux a non-mp4 container needs
+	pipelines := map[string]string{"h264": processingFastStart}
+	mkv := containerProbe("matroska,webm", "", "h264", "yuv420p", "aac")
+	if got, reason := selectPipeline(mkv, true, 0, pipelines); got != processingRemux {
+		t.Errorf("configured codec in mkv: selectPipeline = %q (%s), want %q", got, reason, processingRemux)
+	}
+}
+
+func TestParseProcessingPipelines(t *testing.T) {
+	got, err := parseProcessingPipelines(" prores = transcode, h264=faststart,,vp9=passthrough ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"prores": processingTranscode, "h264": processingFastStart, "vp9": processingPassthrough}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for codec, pipeline := range want {
+		if got[codec] != pipeline {
+			t.Errorf("%s: got %q, want %q", codec, got[codec], pipeline)
+		}
+	}
+
+	if got, err := parseProcessingPipelines(""); err != nil || len(got) != 0 {
+		t.Errorf("empty: got %v, %v", got, err)
+	}
+	for _, bad := range []string{"prores", "=transcode", "prores=copy"} {
+		if _, err := parseProcessingPipelines(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestSelectPipeline(t *testing.T) {
+	h264 := probeStream{CodecType: "video", CodecName: "h264", PixFmt: "yuv420p"}
+	prores := probeStream{CodecType: "video", CodecName: "prores", PixFmt: "yuv422p10le"}
+	vp9 := probeStream{CodecType: "video", CodecName: "vp9", PixFmt: "yuv420p"}
+	aac := probeStream{CodecType: "audio", CodecName: "aac"}
+	pipelines := map[string]string{
+		"h264": processingFastStart,
+		"vp9":  processingPassthrough,
+	}
+
+	tests := []struct {
+		name      string
+		probe     videoProbe
+		fastStart bool
+		want      string
+	}{
+		{"unconfigured codec falls back", probeOf("1000000", prores, aac), true, processingTranscode},
+		{"configured faststart", probeOf("1000000", h264, aac), false, processingFastStart},
+		{"configured faststart already fast start", probeOf("1000000", h264, aac), true, processingPassthrough},
+		{"configured passthrough overrides codec check", probeOf("1000000", vp9, aac), false, processingPassthrough},
+		{"audio only falls back", probeOf("128000", aac), true, processingPassthrough},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, reason := selectPipeline(tc.probe, tc.fastStart, 0, pipelines)
+			if got != tc.want {
+				t.Errorf("got %s (%s), want %s", got, reason, tc.want)
+			}
+		})
+	}
+
+	if got, _ := selectPipeline(probeOf("1000000", h264, aac), true, 0, map[string]string{"h264": processingTranscode}); got != processingTranscode {
+		t.Errorf("forced transcode: got %s", got)
+	}
+}
+
+func TestAspectRatioRotated(t *testing.T) {
+	rotated := func(tag string, sideData float64) videoProbe {
+		stream := probeStream{CodecType: "video", Width: 1920, Height: 1080}
+		if tag != "" {
+			stream.Tags = map[string]string{"rotate": tag}
+		}
+		if sideData != 0 {
+			stream.SideDataList = append(stream.SideDataList, struct {
+				Rotation float64 `json:"rotation"`
+			}{sideData})
+		}
+		return videoProbe{Streams: []probeStream{stream}}
+	}
+
+	tests := []struct {
+		name  string
+		probe videoProbe
+		want  string
+	}{
+		{"no rotation", rotated("", 0), "16:9"},
+		{"rotate tag 90", rotated("90", 0), "9:16"},
+		{"rotate tag 270", rotated("270", 0), "9:16"},
+		{"rotate tag 180", rotated("180", 0), "16:9"},
+		{"side data -90", rotated("", -90), "9:16"},
+		{"side data 90", rotated("", 90), "9:16"},
+		{"side data overrides the tag", rotated("90", 180), "16:9"},
+	}
+	for _, tc := range tests {
+		got, err := tc.probe.aspectRatio()
+		if err != nil || got != tc.want {
+			t.Errorf("%s: aspectRatio = %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestProbeRotatedFixture(t *testing.T) {
+	landscape := makeFixture(t, "landscape.mp4", "-f", "lavfi", "-i", "testsrc=s=1280x720:r=10:d=1", "-pix_fmt", "yuv420p")
+
+	// A phone's portrait clip: landscape frames plus a display rotation.
+	// Older ffmpeg only writes the legacy rotate tag.
+	rotated := filepath.Join(t.TempDir(), "rotated.mp4")
+	attempts := [][]string{
+		{"-display_rotation", "90", "-i", landscape, "-c", "copy", rotated},
+		{"-i", landscape, "-c", "copy", "-metadata:s:v:0", "rotate=90", rotated},
+	}
+	made := false
+	for _, args := range attempts {
+		if exec.Command("ffmpeg", append([]string{"-v", "error", "-y"}, args...)...).Run() == nil {
+			made = true
+			break
+		}
+	}
+	if !made {
+		t.Skip("this ffmpeg can't write a rotated fixture")
+	}
+
+	probe, err := probeVideo(context.Background(), rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := probe.aspectRatio(); err != nil || got != "9:16" {
+		t.Errorf("aspectRatio of rotated 16:9 frames = %q, %v, want 9:16", got, err)
+	}
+	if prefix := aspectRatioPrefix("9:16"); prefix != "portrait/" {
+		t.Errorf("rotated clip stored under %q, want portrait/", prefix)
+	}
+}
+
+func TestDynamicRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe string
+		want  string
+	}{
+		{"bt709", `{"streams":[{"codec_type":"video","color_transfer":"bt709","color_primaries":"bt709"}]}`, database.DynamicRangeSDR},
+		{"pq", `{"streams":[{"codec_type":"video","color_transfer":"smpte2084","color_primaries":"bt2020"}]}`, database.DynamicRangeHDR10},
+		{"hlg", `{"streams":[{"codec_type":"video","color_transfer":"arib-std-b67","color_primaries":"bt2020"}]}`, database.DynamicRangeHLG},
+		{"wide gamut only", `{"streams":[{"codec_type":"video","color_transfer":"bt2020-10","color_primaries":"bt2020"}]}`, database.DynamicRangeSDR},
+		{"no color metadata", `{"streams":[{"codec_type":"video"}]}`, database.DynamicRangeSDR},
+		{"unknown transfer", `{"streams":[{"codec_type":"video","color_transfer":"unknown"}]}`, database.DynamicRangeSDR},
+		{"audio only", `{"streams":[{"codec_type":"audio","color_transfer":"smpte2084"}]}`, database.DynamicRangeSDR},
+		{"hdr second video stream", `{"streams":[{"codec_type":"audio"},{"codec_type":"video","color_transfer":"smpte2084"}]}`, database.DynamicRangeHDR10},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var probe videoProbe
+			if err := json.Unmarshal([]byte(tc.probe), &probe); err != nil {
+				t.Fatal(err)
+			}
+			if got := probe.dynamicRange(); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// writeAtoms writes an mp4 made of empty top-level atoms of the given types.
+func writeAtoms(t *testing.T, types ...string) string {
+	t.Helper()
+	var data []byte
+	for _, typ := range types {
+		atom := make([]byte, 16)
+		binary.BigEndian.PutUint32(atom, uint32(len(atom)))
+		copy(atom[4:], typ)
+		data = append(data, atom...)
+	}
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIsFastStart(t *testing.T) {
+	tests := []struct {
+		name  string
+		atoms []string
+		want  bool
+	}{
+		{"moov before mdat", []string{"ftyp", "moov", "mdat"}, true},
+		{"mdat before moov", []string{"ftyp", "mdat", "moov"}, false},
+		{"no moov", []string{"ftyp", "free"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := isFastStart(writeAtoms(t, tc.atoms...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseFrameRate(t *testing.T) {
+	tests := []struct {
+		rate    string
+		want    float64
+		wantErr bool
+	}{
+		{"30/1", 30, false},
+		{"30000/1001", 30000.0 / 1001, false},
+		{"25", 25, false},
+		{"0/0", 0, true},
+		{"30/0", 0, true},
+		{"fast", 0, true},
+	}
+	for _, tc := range tests {
+		got, err := parseFrameRate(tc.rate)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseFrameRate(%q) = %v, %v; want %v, error %v", tc.rate, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestDurationMismatch(t *testing.T) {
+	tests := []struct {
+		name               string
+		declared, computed float64
+		tolerance          float64
+		want               bool
+	}{
+		{"identical", 10, 10, 0.05, false},
+		{"within tolerance", 10, 10.4, 0.05, false},
+		{"header understates", 2, 10, 0.05, true},
+		{"header overstates", 10, 2, 0.05, true},
+		{"unknown durations", 0, 0, 0.05, false},
+	}
+	for _, tc := range tests {
+		if got := durationMismatch(tc.declared, tc.computed, tc.tolerance); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// falsifyDuration rewrites the movie, track and media header durations of a
+// version 0 mp4 to a tenth of their value, as a tampered upload would.
+func falsifyDuration(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Offset of the 32-bit duration from the start of each atom's payload
+	offsets := map[string]int{"mvhd": 16, "tkhd": 20, "mdhd": 16}
+	patched := 0
+	for typ, offset := range offsets {
+		for i := 0; i+12+offset <= len(data); i++ {
+			if string(data[i+4:i+8]) != typ || data[i+8] != 0 {
+				continue
+			}
+			at := i + 8 + offset
+			d := binary.BigEndian.Uint32(data[at:])
+			binary.BigEndian.PutUint32(data[at:], d/10)
+			patched++
+		}
+	}
+	if patched < len(offsets) {
+		t.Fatalf("only patched %d duration fields", patched)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFalsifiedDurationIsDetected(t *testing.T) {
+	const tolerance = 0.1
+	for _, falsified := range []bool{false, true} {
+		path := makeFixture(t, "clip.mp4", "-f", "lavfi", "-i", "testsrc=duration=5:size=160x90:rate=10", "-c:v", "libx264", "-pix_fmt", "yuv420p")
+		if falsified {
+			falsifyDuration(t, path)
+		}
+
+		probe, err := probeVideo(context.Background(), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		computed, err := countVideoDuration(context.Background(), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := durationMismatch(probe.duration(), computed, tolerance); got != falsified {
+			t.Errorf("falsified %v: declared %.2fs, computed %.2fs, mismatch %v", falsified, probe.duration(), computed, got)
+		}
+	}
+}
+
+func TestGOPSizeFor(t *testing.T) {
+	withRate := func(rate string) videoProbe {
+		return videoProbe{Streams: []probeStream{{CodecType: "audio"}, {CodecType: "video", AvgFrameRate: rate}}}
+	}
+	tests := []struct {
+		name  string
+		probe videoProbe
+		want  int
+	}{
+		{"30 fps", withRate("30/1"), 60},
+		{"ntsc", withRate("30000/1001"), 60},
+		{"25 fps", withRate("25/1"), 50},
+		{"unknown rate falls back to 30 fps", withRate("0/0"), 60},
+		{"no video stream", videoProbe{}, 60},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.probe.gopSizeFor(2 * time.Second); got != tc.want {
+				t.Errorf("gopSizeFor = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTranscodeArgsGOP(t *testing.T) {
+	args := transcodeArgs("in.mp4", transcodeOptions{})
+	if slices.Contains(args, "-g") {
+		t.Errorf("args without a GOP size contain -g: %v", args)
+	}
+
+	args = transcodeArgs("in.mp4", transcodeOptions{gopSize: 48})
+	i := slices.Index(args, "-g")
+	if i < 0 || i+1 >= len(args) || args[i+1] != strconv.Itoa(48) {
+		t.Errorf("args = %v, want -g 48", args)
+	}
+}
+
+func TestLongGOPIsReencoded(t *testing.T) {
+	// 10s at 10 fps with a single keyframe
+	input := makeFixture(t, "long-gop.mp4",
+		"-f", "lavfi", "-i", "testsrc=duration=10:size=160x120:rate=10",
+		"-c:v", "libx264", "-g", "1000", "-keyint_min", "1000", "-sc_threshold", "0", "-pix_fmt", "yuv420p")
+
+	interval, err := maxKeyframeInterval(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval < 5 {
+		t.Fatalf("fixture keyframe interval = %.1fs, want a long GOP", interval)
+	}
+
+	probe, err := probeVideo(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := transcodeVideo(context.Background(), input, transcodeOptions{gopSize: probe.gopSizeFor(targetKeyframeInterval)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(output)
+
+	interval, err = maxKeyframeInterval(context.Background(), output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval > targetKeyframeInterval.Seconds()+0.1 {
+		t.Errorf("re-encoded keyframe interval = %.1fs, want at most %s", interval, targetKeyframeInterval)
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.mp4")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"; got != want {
+		t.Errorf("hashFile = %s, want %s", got, want)
+	}
+}
+
+func TestTranscodeArgsMarkOutput(t *testing.T) {
+	args := transcodeArgs("in.mp4", transcodeOptions{})
+	if i := slices.Index(args, "-metadata"); i < 0 || args[i+1] != "comment="+processedMarker {
+		t.Errorf("args = %v, want the processed marker", args)
+	}
+}
+
+// fakeFFmpeg puts a shell script named ffmpeg first on PATH. It runs with
+// ffmpeg's arguments in "$@" and $out set to the output path.
+func fakeFFmpeg(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	body := "#!/bin/sh\nfor out; do :; done\n" + script
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestTranscodeWithDeadline(t *testing.T) {
+	// Each script stalls the presets that are too slow for the deadline
+	tests := []struct {
+		name       string
+		script     string
+		deadline   time.Duration
+		wantPreset string
+	}{
+		{"quality finishes", `echo encoded > "$out"`, time.Second, qualityPreset},
+		{"no deadline", `case "$*" in *"-preset medium"*) sleep 0.2 ;; esac
+echo encoded > "$out"`, 0, qualityPreset},
+		{"slow quality falls back to fast", `case "$*" in *"-preset medium"*) exec sleep 5 ;; esac
+echo encoded > "$out"`, 500 * time.Millisecond, fastPreset},
+		{"slow fast preset passes through", `exec sleep 5`, 300 * time.Millisecond, processingPassthrough},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeFFmpeg(t, tc.script)
+			input := filepath.Join(t.TempDir(), "upload.mp4")
+			if err := os.WriteFile(input, []byte("original"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			output, preset, err := transcodeWithDeadline(context.Background(), input, transcodeOptions{}, tc.deadline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preset != tc.wantPreset {
+				t.Errorf("preset = %q, want %q", preset, tc.wantPreset)
+			}
+			if tc.deadline > 0 && time.Since(start) > tc.deadline+time.Second {
+				t.Errorf("took %s with a %s deadline", time.Since(start), tc.deadline)
+			}
+
+			wantOutput := input + ".processing"
+			if tc.wantPreset == processingPassthrough {
+				wantOutput = input
+			}
+			if output != wantOutput {
+				t.Errorf("output = %s, want %s", output, wantOutput)
+			}
+			if _, err := os.Stat(input + ".processing"); tc.wantPreset == processingPassthrough && err == nil {
+				t.Error("abandoned encode left its output behind")
+			}
+		})
+	}
+}
+
+func TestCheckPlayable(t *testing.T) {
+	withDuration := func(p videoProbe, d string) videoProbe {
+		p.Format.Duration = d
+		return p
+	}
+	tests := []struct {
+		name     string
+		probe    videoProbe
+		playable bool
+	}{
+		{"video", withDuration(probeOfSize(1920, 1080), "12.5"), true},
+		{"no streams", withDuration(videoProbe{}, "12.5"), false},
+		{"audio only", withDuration(videoProbe{Streams: []probeStream{{CodecType: "audio"}}}, "12.5"), false},
+		{"zero duration", withDuration(probeOfSize(1920, 1080), "0"), false},
+		{"unknown duration", withDuration(probeOfSize(1920, 1080), "N/A"), false},
+	}
+	for _, tc := range tests {
+		if err := tc.probe.checkPlayable(); (err == nil) != tc.playable {
+			t.Errorf("%s: checkPlayable = %v, want playable %v", tc.name, err, tc.playable)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// processVideoRenditions encodes one mp4 per target height concurrently and
+// returns their paths in the same order as heights. If any encode fails the
+// rest are cancelled and every output is removed.
+func processVideoRenditions(ctx context.Context, inputPath string, heights []int) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	outputPaths := make([]string, len(heights))
+	errs := make(chan error, len(heights))
+
+	var wg sync.WaitGroup
+	for i, height := range heights {
+		outputPaths[i] = fmt.Sprintf("%s.%dp.mp4", inputPath, height)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := encodeRendition(ctx, inputPath, outputPaths[i], height); err != nil {
+				errs <- fmt.Errorf("rendition %dp: %w", height, err)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	if err, failed := <-errs; failed {
+		for _, outputPath := range outputPaths {
+			os.Remove(outputPath)
+		}
+		return nil, err
+	}
+	return outputPaths, nil
+}
+
+func encodeRendition(ctx context.Context, inputPath, outputPath string, height int) error {
+	args := append(transcodeArgs(inputPath, transcodeOptions{}),
+		"-vf", "scale=-2:"+strconv.Itoa(height),
+		"-movflags", "faststart",
+		"-f", "mp4", outputPath,
+	)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("error encoding rendition: %s, %v", stderr.String(), err)
+	}
+	return nil
+}
+
+// renditionHeights returns the requested heights that are below the source's,
+// since upscaling only wastes storage.
+func renditionHeights(requested []int, probe videoProbe) []int {
+	stream, ok := probe.videoStream()
+	if !ok {
+		return nil
+	}
+	var heights []int
+	for _, height := range requested {
+		if height < stream.Height {
+			heights = append(heights, height)
+		}
+	}
+	return heights
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// errFrameOutOfRange is returned for a frame past the end of the video.
+var errFrameOutOfRange = errors.New("timestamp is past the end of the video")
+
+// extractBestFrame writes a JPEG of the most representative frame starting
+// at offset, as chosen by ffmpeg's thumbnail filter, and returns its path.
+func extractBestFrame(ctx context.Context, inputPath string, offset time.Duration) (string, error) {
+	return extractFrame(ctx, inputPath, offset, "-vf", "thumbnail=100")
+}
+
+// extractFrameAt writes a JPEG of the frame shown at the given time and
+// returns its path.
+func extractFrameAt(ctx context.Context, inputPath string, at time.Duration) (string, error) {
+	return extractFrame(ctx, inputPath, at)
+}
+
+func extractFrame(ctx context.Context, inputPath string, offset time.Duration, filterArgs ...string) (string, error) {
+	outputPath := inputPath + ".thumbnail.jpg"
+
+	args := []string{
+		"-y",
+		"-ss", strconv.FormatFloat(offset.Seconds(), 'f', 3, 64),
+		"-i", inputPath,
+	}
+	args = append(args, filterArgs...)
+	args = append(args, "-frames:v", "1", outputPath)
+	err := runMediaTool(ctx, nil, "ffmpeg", args...)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("error extracting frame: %w", err)
+	}
+
+	fileInfo, err := os.Stat(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("could not stat extracted frame: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(outputPath)
+		return "", errors.New("extracted frame is empty")
+	}
+
+	return outputPath, nil
+}
+
+// downloadObject copies an S3 object into a temp file and returns its path.
+func (cfg *apiConfig) downloadObject(ctx context.Context, bucket, key string) (string, error) {
+	out, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't get object %s: %w", key, err)
+	}
+	defer out.Body.Close()
+
+	tempFile, err := os.CreateTemp(cfg.uploadTempDir, "tubely-download")
+	if err != nil {
+		return "", err
+	}
+	defer tempFile.Close()
+
+	if _, err := io.Copy(tempFile, out.Body); err != nil {
+		os.Remove(tempFile.Name())
+		return "", fmt.Errorf("couldn't download object %s: %w", key, err)
+	}
+	return tempFile.Name(), nil
+}
+
+// saveThumbnailAsset stores a copy of the image at srcPath as a thumbnail
+// asset and returns its public URL and size.
+func (cfg *apiConfig) saveThumbnailAsset(ctx context.Context, srcPath, mediaType string) (string, int64, error) {
+	randBytes := make([]byte, 32)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", 0, err
+	}
+	assetPath, err := cfg.getAssetPath(base64.RawURLEncoding.EncodeToString(randBytes), mediaType)
+	if err != nil {
+		return "", 0, err
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	dstPath, err := cfg.thumbnailWorkPath(assetPath)
+	if err != nil {
+		return "", 0, err
+	}
+	if cfg.thumbnailStorage == thumbnailStorageS3 {
+		defer os.Remove(dstPath)
+	}
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer dst.Close()
+
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(dst, h), src)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := dst.Close(); err != nil {
+		return "", 0, err
+	}
+
+	url, err := cfg.storeThumbnail(ctx, dstPath, assetPath, mediaType)
+	if err != nil {
+		return "", 0, err
+	}
+	return cfg.versionURL(url, hex.EncodeToString(h.Sum(nil))), written, nil
+}
+
+// thumbnailFromMedia picks a frame from a local video file and saves it as a
+// thumbnail asset.
+func (cfg *apiConfig) thumbnailFromMedia(ctx context.Context, mediaPath string, ownerID uuid.UUID) (string, int64, error) {
+	ctx = cfg.mediaContext(ctx)
+
+	// Skip fades in from black, unless the video is over by then
+	offset := cfg.thumbnailFrameOffset
+	if offset > 0 {
+		probe, err := probeVideo(ctx, mediaPath)
+		if err != nil {
+			return "", 0, err
+		}
+		if probe.duration() <= offset.Seconds() {
+			offset = 0
+		}
+	}
+
+	framePath, err := extractBestFrame(ctx, mediaPath, offset)
+	if err != nil {
+		return "", 0, err
+	}
+	return cfg.saveFrameThumbnail(ctx, framePath, ownerID)
+}
+
+// thumbnailFromFrameAt saves the frame shown at the given time in a local
+// video file as a thumbnail asset.
+func (cfg *apiConfig) thumbnailFromFrameAt(ctx context.Context, mediaPath string, at time.Duration, ownerID uuid.UUID) (string, int64, error) {
+	ctx = cfg.mediaContext(ctx)
+
+	probe, err := probeVideo(ctx, mediaPath)
+	if err != nil {
+		return "", 0, err
+	}
+	if d := probe.duration(); d > 0 && at.Seconds() >= d {
+		return "", 0, errFrameOutOfRange
+	}
+
+	framePath, err := extractFrameAt(ctx, mediaPath, at)
+	if err != nil {
+		return "", 0, err
+	}
+	return cfg.saveFrameThumbnail(ctx, framePath, ownerID)
+}
+
+// saveFrameThumbnail watermarks an extracted frame and saves it as a
+// thumbnail asset. The frame is removed either way.
+func (cfg *apiConfig) saveFrameThumbnail(ctx context.Context, framePath string, ownerID uuid.UUID) (string, int64, error) {
+	defer os.Remove(framePath)
+
+	if err := cfg.watermarkThumbnail(framePath, "image/jpeg", ownerID); err != nil {
+		return "", 0, fmt.Errorf("couldn't watermark thumbnail: %w", err)
+	}
+
+	url, size, err := cfg.saveThumbnailAsset(ctx, framePath, "image/jpeg")
+	if err != nil {
+		return "", 0, fmt.Errorf("couldn't save thumbnail: %w", err)
+	}
+	return url, size, nil
+}
+
+// regenerateThumbnail re-runs frame selection on the video's stored media and
+// swaps in the result as the video's thumbnail.
+func (cfg *apiConfig) regenerateThumbnail(ctx context.Context, video database.Video) (database.Video, error) {
+	return cfg.replaceThumbnailFromMedia(ctx, video, database.ThumbnailSourceAuto, func(mediaPath string) (string, int64, error) {
+		return cfg.thumbnailFromMedia(ctx, mediaPath, video.UserID)
+	})
+}
+
+// thumbnailFromFrame swaps in the frame shown at the given time in the
+// video's stored media as its thumbnail.
+func (cfg *apiConfig) thumbnailFromFrame(ctx context.Context, video database.Video, at time.Duration) (database.Video, error) {
+	return cfg.replaceThumbnailFromMedia(ctx, video, database.ThumbnailSourceUser, func(mediaPath string) (string, int64, error) {
+		return cfg.thumbnailFromFrameAt(ctx, mediaPath, at, video.UserID)
+	})
+}
+
+// replaceThumbnailFromMedia downloads the video's stored media, makes a
+// thumbnail from it with thumbnailFrom and makes that the video's thumbnail.
+func (cfg *apiConfig) replaceThumbnailFromMedia(ctx context.Context, video database.Video, source string, thumbnailFrom func(mediaPath string) (string, int64, error)) (database.Video, error) {
+	if video.VideoURL == nil {
+		return video, errors.New("video has no media")
+	}
+	bucket, key, err := cfg.parseS3Key(*video.VideoURL)
+	if err != nil {
+		return video, err
+	}
+
+	mediaPath, err := cfg.downloadObject(ctx, bucket, key)
+	if err != nil {
+		return video, err
+	}
+	defer os.Remove(mediaPath)
+
+	url, size, err := thumbnailFrom(mediaPath)
+	if err != nil {
+		return video, err
+	}
+
+	oldURL, oldSource := video.ThumbnailURL, video.ThumbnailSource
+	video.ThumbnailURL = &url
+	video.ThumbnailSource = source
+	video.ThumbnailHash = ""
+	if cfg.trackFileSizes {
+		video.ThumbnailSize = size
+	}
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		cfg.removeThumbnailAsset(context.Background(), url)
+		return video, err
+	}
+
+	// The placeholder is shared by every video showing it
+	if oldURL != nil && oldSource != database.ThumbnailSourcePlaceholder {
+		cfg.removeThumbnailAsset(ctx, *oldURL)
+	}
+	return video, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// keyframeCut returns where a stream-copy cut requested at start actually
+// lands: the last keyframe at or before it.
+func keyframeCut(keyframes []float64, start float64) float64 {
+	cut := 0.0
+	for _, t := range keyframes {
+		if t > start {
+			break
+		}
+		cut = t
+	}
+	return cut
+}
+
+// trimVideo copies the [start, end) stretch of inputPath into a new file
+// without re-encoding. Because nothing is re-encoded the start snaps back to
+// the preceding keyframe.
+func trimVideo(ctx context.Context, inputPath string, start, end float64) (string, error) {
+	outputPath := inputPath + ".trimmed.mp4"
+
+	err := runMediaTool(ctx, nil, "ffmpeg",
+		"-y",
+		"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+		"-to", strconv.FormatFloat(end, 'f', 3, 64),
+		"-i", inputPath,
+		"-c", "copy",
+		"-avoid_negative_ts", "make_zero",
+		"-metadata", "comment="+processedMarker,
+		"-movflags", "faststart",
+		"-f", "mp4", outputPath,
+	)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("error trimming video: %w", err)
+	}
+
+	fileInfo, err := os.Stat(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("could not stat trimmed file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("trimmed file is empty")
+	}
+	return outputPath, nil
+}
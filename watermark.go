@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	watermarkTopLeft     = "top-left"
+	watermarkTopRight    = "top-right"
+	watermarkBottomLeft  = "bottom-left"
+	watermarkBottomRight = "bottom-right"
+)
+
+// thumbnailWatermark is a logo stamped onto free-tier thumbnails.
+type thumbnailWatermark struct {
+	logo     image.Image
+	position string
+	// scale is the logo's width as a fraction of the thumbnail's width
+	scale float64
+}
+
+func loadThumbnailWatermark(path, position string, scale float64) (*thumbnailWatermark, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	logo, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode watermark PNG: %w", err)
+	}
+	return &thumbnailWatermark{logo: logo, position: position, scale: scale}, nil
+}
+
+// watermarkThumbnail stamps the watermark onto the thumbnail file in place,
+// unless there's no watermark configured or the owner is on a paid plan.
+func (cfg *apiConfig) watermarkThumbnail(filePath, mediaType string, ownerID uuid.UUID) error {
+	ok, err := cfg.watermarkApplies(ownerID)
+	if err != nil || !ok {
+		return err
+	}
+	return cfg.thumbnailWatermark.apply(filePath, mediaType)
+}
+
+// watermarkThumbnailData is watermarkThumbnail for a thumbnail held in
+// memory. The image is returned unchanged when no watermark applies.
+func (cfg *apiConfig) watermarkThumbnailData(data []byte, mediaType string, ownerID uuid.UUID) ([]byte, error) {
+	ok, err := cfg.watermarkApplies(ownerID)
+	if err != nil || !ok {
+		return data, err
+	}
+	var buf bytes.Buffer
+	if err := cfg.thumbnailWatermark.stamp(bytes.NewReader(data), &buf, mediaType); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (cfg *apiConfig) watermarkApplies(ownerID uuid.UUID) (bool, error) {
+	if cfg.thumbnailWatermark == nil {
+		return false, nil
+	}
+	plan, err := cfg.db.GetUserPlan(ownerID)
+	if err != nil {
+		return false, err
+	}
+	return plan != database.UserPlanPaid, nil
+}
+
+func (wm *thumbnailWatermark) apply(filePath, mediaType string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return wm.stamp(bytes.NewReader(data), out, mediaType)
+}
+
+func (wm *thumbnailWatermark) stamp(r io.Reader, w io.Writer, mediaType string) error {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return fmt.Errorf("couldn't decode thumbnail: %w", err)
+	}
+
+	bounds := src.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), src, bounds.Min, draw.Src)
+
+	logoBounds := wm.logo.Bounds()
+	width := max(1, int(float64(bounds.Dx())*wm.scale))
+	height := max(1, width*logoBounds.Dy()/max(1, logoBounds.Dx()))
+	logo := scaleNearest(wm.logo, width, height)
+
+	margin := bounds.Dx() / 50
+	x, y := margin, margin
+	switch wm.position {
+	case watermarkTopRight:
+		x = bounds.Dx() - width - margin
+	case watermarkBottomLeft:
+		y = bounds.Dy() - height - margin
+	case watermarkBottomRight:
+		x = bounds.Dx() - width - margin
+		y = bounds.Dy() - height - margin
+	}
+	draw.Draw(canvas, image.Rect(x, y, x+width, y+height), logo, image.Point{}, draw.Over)
+
+	if mediaType == "image/png" {
+		return png.Encode(w, canvas)
+	}
+	return jpeg.Encode(w, canvas, &jpeg.Options{Quality: 90})
+}
+
+// scaleNearest resizes img with nearest-neighbour sampling, which is plenty
+// for a small logo.
+func scaleNearest(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, img.At(
+				bounds.Min.X+x*bounds.Dx()/width,
+				bounds.Min.Y+y*bounds.Dy()/height,
+			))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var (
+	watermarkRed  = color.RGBA{255, 0, 0, 255}
+	watermarkBlue = color.RGBA{0, 0, 255, 255}
+)
+
+func solidImage(width, height int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func writePNG(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readPNG(t *testing.T, path string) image.Image {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func assertColorAt(t *testing.T, img image.Image, x, y int, want color.RGBA) {
+	t.Helper()
+	r, g, b, a := img.At(x, y).RGBA()
+	got := color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+	if got != want {
+		t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+	}
+}
+
+func testWatermark(t *testing.T, position string) *thumbnailWatermark {
+	t.Helper()
+	logoPath := filepath.Join(t.TempDir(), "logo.png")
+	writePNG(t, logoPath, solidImage(10, 5, watermarkRed))
+	wm, err := loadThumbnailWatermark(logoPath, position, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wm
+}
+
+func TestWatermarkPosition(t *testing.T) {
+	// A 200x100 thumbnail gets a 40x20 logo with a 4px margin
+	tests := []struct {
+		position string
+		inside   image.Point
+		outside  image.Point
+	}{
+		{watermarkTopLeft, image.Pt(4, 4), image.Pt(195, 95)},
+		{watermarkTopRight, image.Pt(195, 4), image.Pt(4, 95)},
+		{watermarkBottomLeft, image.Pt(4, 95), image.Pt(195, 4)},
+		{watermarkBottomRight, image.Pt(195, 95), image.Pt(4, 4)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.position, func(t *testing.T) {
+			thumbPath := filepath.Join(t.TempDir(), "thumb.png")
+			writePNG(t, thumbPath, solidImage(200, 100, watermarkBlue))
+
+			if err := testWatermark(t, tc.position).apply(thumbPath, "image/png"); err != nil {
+				t.Fatal(err)
+			}
+
+			img := readPNG(t, thumbPath)
+			if img.Bounds().Dx() != 200 || img.Bounds().Dy() != 100 {
+				t.Fatalf("output is %v, want 200x100", img.Bounds())
+			}
+			assertColorAt(t, img, tc.inside.X, tc.inside.Y, watermarkRed)
+			assertColorAt(t, img, tc.outside.X, tc.outside.Y, watermarkBlue)
+			assertColorAt(t, img, 100, 50, watermarkBlue)
+		})
+	}
+}
+
+func TestWatermarkBottomRightBounds(t *testing.T) {
+	thumbPath := filepath.Join(t.TempDir(), "thumb.png")
+	writePNG(t, thumbPath, solidImage(200, 100, watermarkBlue))
+	if err := testWatermark(t, watermarkBottomRight).apply(thumbPath, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	img := readPNG(t, thumbPath)
+
+	// The logo spans x 156-195 and y 76-95
+	assertColorAt(t, img, 156, 76, watermarkRed)
+	assertColorAt(t, img, 195, 95, watermarkRed)
+	assertColorAt(t, img, 155, 76, watermarkBlue)
+	assertColorAt(t, img, 156, 75, watermarkBlue)
+	assertColorAt(t, img, 196, 95, watermarkBlue)
+	assertColorAt(t, img, 195, 96, watermarkBlue)
+}
+
+func TestWatermarkThumbnailSkipsWithoutConfig(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	thumbPath := filepath.Join(t.TempDir(), "thumb.png")
+	writePNG(t, thumbPath, solidImage(200, 100, watermarkBlue))
+	if err := cfg.watermarkThumbnail(thumbPath, "image/png", uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	assertColorAt(t, readPNG(t, thumbPath), 195, 95, watermarkBlue)
+}
+
+func TestUploadThumbnailIsWatermarked(t *testing.T) {
+	cfg := newThumbnailTestConfig(t)
+	cfg.thumbnailWatermark = testWatermark(t, watermarkBottomRight)
+	user, token := createTestUser(t, cfg, "free@example.com")
+	video := createTestVideo(t, cfg, user.ID)
+
+	var upload bytes.Buffer
+	if err := png.Encode(&upload, solidImage(200, 100, watermarkBlue)); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	cfg.handlerUploadThumbnail(w, thumbnailUploadRequest(t, video.ID.String(), token, upload.Bytes()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	stored, err := filepath.Glob(filepath.Join(cfg.assetsRoot, "*.png"))
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("stored thumbnails: %v, %v", stored, err)
+	}
+	img := readPNG(t, stored[0])
+	assertColorAt(t, img, 195, 95, watermarkRed)
+	assertColorAt(t, img, 4, 4, watermarkBlue)
+}